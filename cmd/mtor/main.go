@@ -1,65 +1,149 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
-	"laptudirm.com/x/mtor/internal/build"
 	"laptudirm.com/x/mtor/pkg/file"
+	"laptudirm.com/x/mtor/pkg/log"
+	"laptudirm.com/x/mtor/pkg/mse"
+	"laptudirm.com/x/mtor/pkg/peer"
 	"laptudirm.com/x/mtor/pkg/torrent"
 )
 
 func main() {
 	// basic config
 	config := &torrent.DownloadConfig{
-		Backlog:     25,
+		MaxBacklog:  250,
+		QueueTime:   3 * time.Second,
 		PeerAmt:     500,
 		DownTimeout: 20 * time.Second,
 		ConnTimeout: 5 * time.Second,
+		Encryption:  mse.Enabled,
+		Logger:      log.New(os.Stderr, log.LevelWarn),
+		Events: &torrent.Events{
+			OnPeerConnected: func(p peer.Peer) {
+				fmt.Printf("mtor: connected to peer %s\n", p)
+			},
+			OnPieceVerified: func(index, done, total int) {
+				fmt.Printf("mtor: downloaded piece %v, %v/%v pieces\n", index, done, total)
+			},
+			OnComplete: func(taken time.Duration) {
+				fmt.Println("mtor: download complete")
+				fmt.Printf("mtor: %s taken\n", taken)
+			},
+		},
+	}
+
+	if len(os.Args) == 3 {
+		switch os.Args[1] {
+		case "verify":
+			verify(os.Args[2])
+			return
+		case "info":
+			info(os.Args[2])
+			return
+		}
 	}
 
 	if len(os.Args) != 2 {
-		fmt.Fprintln(os.Stderr, "usage: mtor [torrent]")
+		fmt.Fprintln(os.Stderr, "usage: mtor [torrent|url]")
+		fmt.Fprintln(os.Stderr, "       mtor verify [torrent]")
+		fmt.Fprintln(os.Stderr, "       mtor info [torrent]")
 		os.Exit(1)
 	}
 
-	r, err := os.Open(os.Args[1])
+	f, err := open(os.Args[1])
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	f, err := file.Open(r)
+	t, err := f.Torrent()
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	t, err := f.Torrent()
+	fmt.Printf("torrent %x - %d pieces\n", t.InfoHash, len(t.PieceHashes))
+
+	// write pieces directly to the torrent's files in cwd
+	storage := f.Storage(".")
+	err = storage.Init()
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	defer storage.Close()
 
-	fmt.Printf("torrent %x - %d pieces\n", t.InfoHash, len(t.PieceHashes))
+	err = t.DownloadPieces(storage, config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+}
 
-	ps := build.PieceManager
-	err = ps.Init()
+// open opens the torrent at the provided path, which may be a http(s) url.
+func open(path string) (*file.Metainfo, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return file.OpenURL(context.Background(), path)
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return file.Open(r)
+}
+
+// verify hash-checks the torrent's files in cwd, and prints a report.
+func verify(path string) {
+	f, err := open(path)
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	defer ps.Close()
 
-	err = t.DownloadPieces(ps, config)
+	report, err := f.Verify(".")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	err = f.Save(ps, ".") // save in cwd
+	for _, file := range report.Files {
+		status := "ok"
+		switch {
+		case !file.Exists:
+			status = "missing"
+		case !file.Complete():
+			status = fmt.Sprintf("%d/%d pieces valid", file.Valid, file.Pieces)
+		}
+
+		fmt.Printf("%s: %s\n", strings.Join(file.File.Path, "/"), status)
+	}
+
+	fmt.Printf("%d/%d pieces valid\n", report.Bitfield.Count(), f.PieceCount())
+}
+
+// info prints a JSON description of the torrent.
+func info(path string) {
+	f, err := open(path)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println(string(b))
 }
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strconv"
 )
 
 // piece represents the piece manager.
@@ -66,6 +67,40 @@ func (p *piece) Get(i int) ([]byte, error) {
 	return os.ReadFile(file)
 }
 
+// Has checks if a piece is stored in the manager.
+func (p *piece) Has(i int) bool {
+	if p.isClosed() {
+		return false
+	}
+
+	_, err := os.Stat(path.Join(p.src, fmt.Sprintf("%x", i)))
+	return err == nil
+}
+
+// Indices lists the indices of the pieces stored in the manager.
+func (p *piece) Indices() ([]int, error) {
+	if p.isClosed() {
+		return nil, ErrManagerClosed
+	}
+
+	entries, err := os.ReadDir(p.src)
+	if err != nil {
+		return nil, err
+	}
+
+	var indices []int
+	for _, entry := range entries {
+		i, err := strconv.ParseInt(entry.Name(), 16, 0)
+		if err != nil {
+			continue // not a piece
+		}
+
+		indices = append(indices, int(i))
+	}
+
+	return indices, nil
+}
+
 // Close closes the manager.
 func (p *piece) Close() error {
 	if p.isClosed() {
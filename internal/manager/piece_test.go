@@ -0,0 +1,40 @@
+package manager
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestPieceIndices(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	p := New()
+	if p.Has(0) {
+		t.Error("uninitialized manager has a piece")
+	}
+
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, i := range []int{3, 17} {
+		if err := p.Put(i, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !p.Has(17) || p.Has(4) {
+		t.Errorf("manager has pieces 17: %v, 4: %v", p.Has(17), p.Has(4))
+	}
+
+	indices, err := p.Indices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Ints(indices)
+	if len(indices) != 2 || indices[0] != 3 || indices[1] != 17 {
+		t.Errorf("stored indices %v", indices)
+	}
+}
@@ -230,10 +230,14 @@ func (e *encoder) marshalUint(v reflect.Value) {
 func (e *encoder) marshaler(v reflect.Value) error {
 	// type cast to Marshaler and call MarshalBencode
 	b, err := v.Interface().(Marshaler).MarshalBencode()
+	if err != nil {
+		return err
+	}
+
 	if !Valid(b) {
 		panic(fmt.Sprintf("(%s).MarshalBencode() returned invalid bencode string %#v", v.Type(), string(b)))
 	}
 
 	e.data += string(b)
-	return err
+	return nil
 }
@@ -15,6 +15,8 @@
 // hold multiple flags values as a byte slice.
 package bitfield
 
+import "fmt"
+
 // Bitfield represents a single mutable bitfield.
 type Bitfield struct {
 	bits []byte
@@ -25,6 +27,72 @@ func New(bits []byte) Bitfield {
 	return Bitfield{bits: bits}
 }
 
+// Parse creates a new Bitfield which holds n bits from the provided bits,
+// like a bitfield received from a peer. It fails if the length of the bits
+// doesn't match n, or if any of the spare bits after the nth bit are set.
+func Parse(bits []byte, n int) (Bitfield, error) {
+	if len(bits) != (n+7)/8 {
+		return Bitfield{}, fmt.Errorf("bitfield: expected %d bytes for %d bits, received %d", (n+7)/8, n, len(bits))
+	}
+
+	if spare := n % 8; spare != 0 && bits[len(bits)-1]<<spare != 0 {
+		return Bitfield{}, fmt.Errorf("bitfield: spare bits set in last byte %08b", bits[len(bits)-1])
+	}
+
+	return New(bits), nil
+}
+
+// Empty creates a new Bitfield which can hold n bits, all of which are
+// cleared.
+func Empty(n int) Bitfield {
+	return Bitfield{bits: make([]byte, (n+7)/8)}
+}
+
+// Full creates a new Bitfield which can hold n bits, all of which are set.
+func Full(n int) Bitfield {
+	b := Empty(n)
+	for i := 0; i < n; i++ {
+		b.Set(i)
+	}
+
+	return b
+}
+
+// Bytes returns a copy of the underlying bytes of the bitfield b.
+func (b Bitfield) Bytes() []byte {
+	bits := make([]byte, len(b.bits))
+	copy(bits, b.bits)
+	return bits
+}
+
+// Clone returns a deep copy of the bitfield b.
+func (b Bitfield) Clone() Bitfield {
+	return Bitfield{bits: b.Bytes()}
+}
+
+// Any checks if any bit of the bitfield b is set.
+func (b Bitfield) Any() bool {
+	for _, byt := range b.bits {
+		if byt != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Count returns the number of set bits in the bitfield b.
+func (b Bitfield) Count() int {
+	count := 0
+	for _, byt := range b.bits {
+		for ; byt != 0; byt &= byt - 1 {
+			count++
+		}
+	}
+
+	return count
+}
+
 // Has checks if the ith bit of the bitfield b is set.
 func (b Bitfield) Has(i int) bool {
 	atByte, byteOffset, inRange := b.indexOf(i)
@@ -49,7 +117,7 @@ func (b Bitfield) Set(i int) {
 	b.bits[atByte] |= 1 << (7 - byteOffset)
 }
 
-// Clear sets the ith bit of the bitfield b.
+// Clear clears the ith bit of the bitfield b.
 func (b Bitfield) Clear(i int) {
 	atByte, byteOffset, inRange := b.indexOf(i)
 	if !inRange {
@@ -60,11 +128,19 @@ func (b Bitfield) Clear(i int) {
 	b.bits[atByte] &^= 1 << (7 - byteOffset)
 }
 
+// Merge sets the bits of the bitfield b which are set in the bitfield o.
+// Bytes of o beyond the length of b are ignored.
+func (b Bitfield) Merge(o Bitfield) {
+	for i := 0; i < len(b.bits) && i < len(o.bits); i++ {
+		b.bits[i] |= o.bits[i]
+	}
+}
+
 // indexOf returns the byte index, byte offset, and whether i is inside the
 // bitfield or not.
 func (b Bitfield) indexOf(i int) (atByte int, byteOffset int, inRange bool) {
 	atByte = i / 8     // 8 pieces per byte
 	byteOffset = i % 8 // offset in byte
-	inRange = atByte > 0 && atByte < len(b.bits)
+	inRange = i >= 0 && atByte < len(b.bits)
 	return
 }
@@ -0,0 +1,86 @@
+package bitfield_test
+
+import (
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+)
+
+func TestFirstByte(t *testing.T) {
+	b := bitfield.Empty(10)
+
+	// bits of the first byte used to be out of range
+	for _, i := range []int{0, 7} {
+		if b.Has(i) {
+			t.Errorf("bit %d set in empty bitfield", i)
+		}
+
+		b.Set(i)
+		if !b.Has(i) {
+			t.Errorf("bit %d not set", i)
+		}
+	}
+
+	if bits := b.Bytes(); bits[0] != 0x81 || bits[1] != 0 {
+		t.Errorf("bitfield is %08b", bits)
+	}
+
+	b.Clear(0)
+	if b.Has(0) || !b.Has(7) {
+		t.Errorf("cleared bit 0, bitfield is %08b", b.Bytes())
+	}
+
+	// out of range bits are ignored
+	b.Set(-1)
+	b.Set(16)
+	if b.Has(-1) || b.Has(16) || b.Count() != 1 {
+		t.Errorf("out of range bits changed bitfield to %08b", b.Bytes())
+	}
+}
+
+func TestMerge(t *testing.T) {
+	b := bitfield.Empty(10)
+	b.Set(1)
+
+	o := bitfield.Empty(10)
+	o.Set(8)
+	o.Set(9)
+
+	b.Merge(o)
+	if bits := b.Bytes(); bits[0] != 0x40 || bits[1] != 0xc0 {
+		t.Errorf("merged bitfield is %08b", bits)
+	}
+
+	// shorter bitfields only merge their own bytes
+	b = bitfield.Empty(16)
+	b.Merge(bitfield.Full(8))
+	if b.Count() != 8 {
+		t.Errorf("merged bitfield is %08b", b.Bytes())
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		bits []byte
+		n    int
+		ok   bool
+	}{
+		{[]byte{0xff, 0xc0}, 10, true},
+		{[]byte{0xff, 0xff}, 16, true},
+		{[]byte{}, 0, true},
+		{[]byte{0xff}, 10, false},       // too short
+		{[]byte{0xff, 0, 0}, 10, false}, // too long
+		{[]byte{0xff, 0xe0}, 10, false}, // spare bit set
+	}
+
+	for _, test := range tests {
+		b, err := bitfield.Parse(test.bits, test.n)
+		if (err == nil) != test.ok {
+			t.Errorf("parsing %08b as %d bits returned %v", test.bits, test.n, err)
+		}
+
+		if err == nil && b.Count() != bitfield.New(test.bits).Count() {
+			t.Errorf("parsed %08b as %08b", test.bits, b.Bytes())
+		}
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/torrent"
+)
+
+// limits of the piece lengths chosen for created torrents
+const (
+	MinCreatePieceLength = torrent.MinPieceLength // 16 kb
+	MaxCreatePieceLength = 16 << 20               // 16 mb
+)
+
+// DefaultTargetPieces is the number of pieces targeted when choosing the
+// piece length of a created torrent.
+const DefaultTargetPieces = 1500
+
+// CreateOptions contains the options used to create a torrent.
+type CreateOptions struct {
+	// Name is the name of the torrent. It is required when a torrent is
+	// created from multiple paths, and defaults to the base name of the
+	// path otherwise.
+	Name string
+
+	// PieceLength is the length of each piece, which must be a power of
+	// two. Defaults to the length chosen by PieceLengthFor, targeting
+	// TargetPieces pieces, or DefaultTargetPieces if it is zero.
+	PieceLength  int
+	TargetPieces int
+
+	// Announce contains the announce urls of the torrent's trackers, in
+	// order of preference. Each url is put in its own tier.
+	Announce []string
+
+	// Trackers contains tiers of announce urls, which are used instead of
+	// the tiers created from Announce. The first url is used as the
+	// announce url if Announce is empty.
+	Trackers [][]string
+
+	// WebSeeds contains the urls of the torrent's web seeds.
+	WebSeeds []string
+
+	Comment   string    // free-form comment
+	CreatedBy string    // author of the torrent
+	Private   bool      // whether peers should only be found using trackers
+	Date      time.Time // creation date, defaults to the current time
+
+	// Source is stored in the info dictionary as the source tag, which
+	// changes the infohash, so that the same content can be cross-seeded
+	// on trackers which require a tag.
+	Source string
+
+	// Deterministic omits the creation date unless Date is set, so that
+	// creating a torrent from the same content with the same options
+	// always produces identical metainfo, and the same infohash. Files
+	// are always added and keys always marshalled in a stable order.
+	Deterministic bool
+
+	// Hashers is the number of goroutines hashing pieces. Defaults to the
+	// number of CPUs.
+	Hashers int
+}
+
+// sourceFile represents a file which is added to a created torrent.
+type sourceFile struct {
+	path   string   // path of the file on disk
+	elems  []string // path of the file in the torrent
+	length int64    // length of the file
+}
+
+// Create creates a torrent from the files at the provided paths. A single
+// regular file creates a single-file torrent, while a directory or multiple
+// paths create a multi-file torrent. Directories are added recursively, in
+// lexical order.
+func Create(paths []string, opts CreateOptions) (*Metainfo, error) {
+	name, files, single, err := collect(paths, opts.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	pieceLen := opts.PieceLength
+	switch {
+	case pieceLen == 0:
+		var size int64
+		for _, file := range files {
+			size += file.length
+		}
+
+		target := opts.TargetPieces
+		if target <= 0 {
+			target = DefaultTargetPieces
+		}
+
+		pieceLen = PieceLengthFor(size, target)
+	case pieceLen < 0 || pieceLen&(pieceLen-1) != 0:
+		return nil, fmt.Errorf("file: piece length %v is not a power of two", pieceLen)
+	}
+
+	hashers := opts.Hashers
+	if hashers <= 0 {
+		hashers = runtime.NumCPU()
+	}
+
+	pieces, err := hashPieces(files, pieceLen, hashers)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metainfo{
+		Info: &info{
+			PieceLen: pieceLen,
+			Pieces:   string(pieces),
+			Name:     name,
+			Source:   opts.Source,
+		},
+		Comment: opts.Comment,
+		Author:  opts.CreatedBy,
+	}
+
+	switch date := opts.Date; {
+	case !date.IsZero():
+		m.Date = date.Unix()
+	case !opts.Deterministic:
+		m.Date = time.Now().Unix()
+	}
+
+	if opts.Private {
+		m.Info.Private = 1
+	}
+
+	if len(opts.Announce) > 0 {
+		m.Announce = opts.Announce[0]
+	}
+
+	switch {
+	case len(opts.Trackers) > 0:
+		for _, tier := range opts.Trackers {
+			if len(tier) > 0 {
+				m.AnnounceList = append(m.AnnounceList, tier)
+			}
+		}
+
+		if m.Announce == "" && len(m.AnnounceList) > 0 {
+			m.Announce = m.AnnounceList[0][0]
+		}
+	case len(opts.Announce) > 1:
+		for _, url := range opts.Announce {
+			m.AnnounceList = append(m.AnnounceList, []string{url})
+		}
+	}
+
+	if len(opts.WebSeeds) > 0 {
+		urls := make([]any, len(opts.WebSeeds))
+		for i, url := range opts.WebSeeds {
+			urls[i] = url
+		}
+		m.URLList = urls
+	}
+
+	if single {
+		m.Info.Length = int(files[0].length)
+		return m, nil
+	}
+
+	for _, file := range files {
+		m.Info.Files = append(m.Info.Files, singleFile{
+			Length: int(file.length),
+			Path:   file.elems,
+		})
+	}
+
+	return m, nil
+}
+
+// PieceLengthFor returns the power of two piece length which divides size
+// bytes into the number of pieces closest to target, limited between
+// MinCreatePieceLength and MaxCreatePieceLength.
+func PieceLengthFor(size int64, target int) int {
+	pieceLen := MinCreatePieceLength
+	for pieceLen < MaxCreatePieceLength {
+		// compare the piece counts of this length and the next one
+		n := (size + int64(pieceLen) - 1) / int64(pieceLen)
+		if n <= int64(target) || n-int64(target) <= int64(target)-n/2 {
+			break
+		}
+
+		pieceLen <<= 1
+	}
+
+	return pieceLen
+}
+
+// collect finds the files at the provided paths, and returns the name of
+// the torrent, its files, and whether it is a single-file torrent.
+func collect(paths []string, name string) (string, []sourceFile, bool, error) {
+	switch {
+	case len(paths) == 0:
+		return "", nil, false, errors.New("file: no paths to create torrent from")
+	case len(paths) > 1 && name == "":
+		return "", nil, false, errors.New("file: torrent with multiple paths has no name")
+	}
+
+	// a single regular file
+	if len(paths) == 1 {
+		info, err := os.Stat(paths[0])
+		if err != nil {
+			return "", nil, false, err
+		}
+
+		if name == "" {
+			abs, err := filepath.Abs(paths[0])
+			if err != nil {
+				return "", nil, false, err
+			}
+
+			name = filepath.Base(abs)
+		}
+
+		if info.Mode().IsRegular() {
+			return name, []sourceFile{{path: paths[0], length: info.Size()}}, true, nil
+		}
+
+		files, err := walk(paths[0], nil)
+		if err != nil {
+			return "", nil, false, err
+		}
+
+		return name, files, false, checkFiles(files)
+	}
+
+	// multiple paths, each stored under its base name
+	var files []sourceFile
+	for _, path := range paths {
+		found, err := walk(path, []string{filepath.Base(path)})
+		if err != nil {
+			return "", nil, false, err
+		}
+
+		files = append(files, found...)
+	}
+
+	return name, files, false, checkFiles(files)
+}
+
+// walk returns the regular files at the provided path, with their paths
+// in the torrent relative to path, after the prefix.
+func walk(root string, prefix []string) ([]sourceFile, error) {
+	var files []sourceFile
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		elems := append([]string{}, prefix...)
+		if rel, _ := filepath.Rel(root, path); rel != "." {
+			elems = append(elems, strings.Split(filepath.ToSlash(rel), "/")...)
+		}
+
+		files = append(files, sourceFile{path: path, elems: elems, length: info.Size()})
+		return nil
+	})
+
+	return files, err
+}
+
+// checkFiles checks if the files of a multi-file torrent are valid.
+func checkFiles(files []sourceFile) error {
+	if len(files) == 0 {
+		return errors.New("file: no files to create torrent from")
+	}
+
+	seen := make(map[string]bool)
+	for _, file := range files {
+		path := strings.Join(file.elems, "/")
+		if seen[path] {
+			return fmt.Errorf("file: duplicate path %q in torrent", path)
+		}
+
+		seen[path] = true
+	}
+
+	return nil
+}
+
+// hashPieces reads the provided files as a contiguous stream, and returns
+// the concatenated hashes of its pieces. Pieces are hashed in parallel by
+// the provided number of goroutines.
+func hashPieces(files []sourceFile, pieceLen, hashers int) ([]byte, error) {
+	var total int64
+	for _, file := range files {
+		total += file.length
+	}
+
+	pieceNum := int((total + int64(pieceLen) - 1) / int64(pieceLen))
+	hashes := make([]byte, pieceNum*sha1.Size)
+
+	type job struct {
+		index int    // index of the piece
+		buf   []byte // contents of the piece
+	}
+
+	jobs := make(chan job, hashers)
+
+	var wg sync.WaitGroup
+	wg.Add(hashers)
+	for i := 0; i < hashers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sum := sha1.Sum(j.buf)
+				copy(hashes[j.index*sha1.Size:], sum[:])
+			}
+		}()
+	}
+
+	err := readPieces(files, pieceLen, pieceNum, func(index int, buf []byte) {
+		jobs <- job{index: index, buf: buf}
+	})
+
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// readPieces reads the provided files as a contiguous stream, and calls fn
+// with each piece. It fails if the files don't contain exactly pieceNum
+// pieces, which happens if they change while being read.
+func readPieces(files []sourceFile, pieceLen, pieceNum int, fn func(int, []byte)) error {
+	errChanged := errors.New("file: files changed while being hashed")
+
+	index, n := 0, 0
+	buf := make([]byte, pieceLen)
+
+	for _, file := range files {
+		f, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+
+		for {
+			m, err := io.ReadFull(f, buf[n:])
+			n += m
+
+			if n == pieceLen {
+				if index == pieceNum {
+					f.Close()
+					return errChanged
+				}
+
+				fn(index, buf)
+				index++
+				buf, n = make([]byte, pieceLen), 0
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+
+		f.Close()
+	}
+
+	// last piece is irregular in length
+	if n > 0 {
+		if index == pieceNum {
+			return errChanged
+		}
+
+		fn(index, buf[:n])
+		index++
+	}
+
+	if index != pieceNum {
+		return errChanged
+	}
+
+	return nil
+}
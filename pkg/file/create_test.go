@@ -0,0 +1,235 @@
+package file_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestCreate(t *testing.T) {
+	src := t.TempDir()
+	contents := map[string]string{
+		"b":       "0123456789",
+		"a/x":     "abc",
+		"a/y/z":   "defgh",
+		"a/empty": "",
+	}
+
+	for name, data := range contents {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := file.Create([]string{src}, file.CreateOptions{
+		Name:        "test",
+		PieceLength: 4,
+		Announce:    []string{"http://a/announce", "http://b/announce"},
+		Private:     true,
+		Hashers:     3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the created metainfo can be parsed again
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = file.Open(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor, err := m.Torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tor.Announce != "http://a/announce" {
+		t.Errorf("announce is %q", tor.Announce)
+	}
+
+	// files are in lexical order
+	stream := []byte("abc" + "" + "defgh" + "0123456789")
+	if tor.Length != len(stream) {
+		t.Fatalf("torrent length is %d, expected %d", tor.Length, len(stream))
+	}
+
+	for i, hash := range tor.PieceHashes {
+		end := (i + 1) * 4
+		if end > len(stream) {
+			end = len(stream)
+		}
+
+		if hash != sha1.Sum(stream[i*4:end]) {
+			t.Errorf("hash of piece %d is wrong", i)
+		}
+	}
+
+	// saving the torrent recreates the directory
+	dst := t.TempDir()
+	if err := m.Save(streamPieces(stream, 4), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range contents {
+		got, err := os.ReadFile(filepath.Join(dst, "test", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != data {
+			t.Errorf("saved file %s is %q, expected %q", name, got, data)
+		}
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "single")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := file.Create([]string{path}, file.CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor, err := m.Torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tor.Length != 5 || len(tor.PieceHashes) != 1 || tor.PieceHashes[0] != sha1.Sum([]byte("hello")) {
+		t.Errorf("unexpected torrent %+v", tor)
+	}
+
+	if _, err := file.Create([]string{path}, file.CreateOptions{PieceLength: 1000}); err == nil {
+		t.Error("created torrent with invalid piece length")
+	}
+}
+
+// streamPieces splits data into pieces of the provided length.
+func streamPieces(data []byte, length int) pieceList {
+	var pieces pieceList
+	for len(data) > length {
+		pieces = append(pieces, data[:length])
+		data = data[length:]
+	}
+
+	return append(pieces, data)
+}
+
+func TestPieceLengthFor(t *testing.T) {
+	tests := []struct {
+		size   int64
+		target int
+		length int
+	}{
+		{0, 1500, file.MinCreatePieceLength},
+		{5 << 20, 1500, 16 << 10},
+		{1 << 30, 1500, 1 << 20},
+		{1 << 30, 100, 8 << 20},
+		{1 << 40, 1500, file.MaxCreatePieceLength},
+	}
+
+	for _, test := range tests {
+		if length := file.PieceLengthFor(test.size, test.target); length != test.length {
+			t.Errorf("piece length for %d bytes is %d, expected %d", test.size, length, test.length)
+		}
+	}
+}
+
+func TestCreateTiers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "single")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := file.Create([]string{path}, file.CreateOptions{
+		Trackers: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+		WebSeeds: []string{"http://seed/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.PieceLength() != file.MinCreatePieceLength {
+		t.Errorf("piece length is %d", m.PieceLength())
+	}
+
+	tor, err := m.Torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tor.Announce != "http://a/announce" || len(tor.Trackers) != 2 || len(tor.Trackers[0]) != 2 {
+		t.Errorf("trackers are %q, %q", tor.Announce, tor.Trackers)
+	}
+
+	if len(tor.WebSeeds) != 1 || tor.WebSeeds[0] != "http://seed/" {
+		t.Errorf("web seeds are %q", tor.WebSeeds)
+	}
+}
+
+func TestCreateDeterministic(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "test")
+	for _, name := range []string{"b", "a", "c"} {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(src, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name+"data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	create := func(source string) ([]byte, [20]byte) {
+		m, err := file.Create([]string{src}, file.CreateOptions{
+			Announce:      []string{"http://tracker/announce"},
+			Source:        source,
+			Deterministic: true,
+			Hashers:       2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if _, err := m.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := m.InfoHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return b.Bytes(), hash
+	}
+
+	first, hash := create("A")
+	second, _ := create("A")
+	if !bytes.Equal(first, second) {
+		t.Errorf("metainfo differs between runs:\n%q\n%q", first, second)
+	}
+
+	if bytes.Contains(first, []byte("creation date")) {
+		t.Error("deterministic metainfo contains a creation date")
+	}
+
+	if _, other := create("B"); other == hash {
+		t.Error("source tag doesn't change the infohash")
+	}
+}
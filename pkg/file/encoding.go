@@ -0,0 +1,99 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// cp1252 contains the characters of the windows-1252 encoding which differ
+// from iso-8859-1, in the range 0x80 to 0x9f. Undefined bytes are mapped
+// to the corresponding control characters, like iso-8859-1.
+var cp1252 = [32]rune{
+	'€', '\x81', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\x8d', 'Ž', '\x8f',
+	'\x90', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\x9d', 'ž', 'Ÿ',
+}
+
+// name returns the readable name of the torrent, preferring name.utf-8.
+func (f *Metainfo) name() string {
+	return f.text(f.Info.Name, f.Info.NameUTF8)
+}
+
+// path returns the readable path of a file of the torrent, preferring
+// path.utf-8.
+func (f *Metainfo) path(file singleFile) []string {
+	if valid(file.PathUTF8) {
+		return file.PathUTF8
+	}
+
+	elems := make([]string, len(file.Path))
+	for i, elem := range file.Path {
+		elems[i] = f.text(elem, "")
+	}
+
+	return elems
+}
+
+// text returns a readable UTF-8 version of a string of the metainfo. The
+// UTF-8 variant of the string is used if it is valid. Otherwise, the string
+// is transcoded from the metainfo's encoding, if it is a known one, and any
+// remaining invalid UTF-8 is replaced with underscores.
+func (f *Metainfo) text(s, utf string) string {
+	if utf != "" && utf8.ValidString(utf) {
+		return utf
+	}
+
+	switch strings.ToLower(strings.ReplaceAll(f.Encoding, "_", "-")) {
+	case "iso-8859-1", "latin1", "latin-1":
+		return decode(s, false)
+	case "windows-1252", "cp1252":
+		return decode(s, true)
+	}
+
+	return strings.ToValidUTF8(s, "_")
+}
+
+// decode converts an iso-8859-1 string, or a windows-1252 string if win is
+// true, into UTF-8.
+func decode(s string, win bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if win && c >= 0x80 && c <= 0x9f {
+			b.WriteRune(cp1252[c-0x80])
+			continue
+		}
+
+		b.WriteRune(rune(c))
+	}
+
+	return b.String()
+}
+
+// valid reports whether a path is non-empty, and all its elements are valid
+// UTF-8.
+func valid(path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+
+	for _, elem := range path {
+		if !utf8.ValidString(elem) {
+			return false
+		}
+	}
+
+	return true
+}
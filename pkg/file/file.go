@@ -17,26 +17,37 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
-	"math/rand"
-	"os"
-	"path"
-	"time"
 
 	"laptudirm.com/x/mtor/pkg/bencode"
+	"laptudirm.com/x/mtor/pkg/peer"
 	"laptudirm.com/x/mtor/pkg/torrent"
 )
 
-// Port is the port the client is listening on.
+// Port is the default port the client is listening on.
 const Port = 6881
 
-// file represents a .torrent metainfo file.
-type file struct {
+// Metainfo represents a .torrent metainfo file.
+type Metainfo struct {
 	Info     *info  `bencode:"info"`     // info section of metainfo
 	Announce string `bencode:"announce"` // tracker announce url
 
-	Date    int64  `bencode:"creation date"` // creation timestamp
-	Comment string `bencode:"comment"`       // free-form comment
-	Author  string `bencode:"created by"`    // author of the metainfo
+	// piece hashes of a v2 torrent's files, keyed by their pieces roots
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+
+	// tiers of tracker announce urls
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+
+	// web seed url, or list of web seed urls
+	URLList any `bencode:"url-list,omitempty"`
+
+	Date    int64  `bencode:"creation date,omitempty"` // creation timestamp
+	Comment string `bencode:"comment,omitempty"`       // free-form comment
+	Author  string `bencode:"created by,omitempty"`    // author of the metainfo
+
+	// character encoding of the metainfo's strings, if not UTF-8
+	Encoding string `bencode:"encoding,omitempty"`
+
+	extra map[string]rawValue `bencode:"-"` // unknown keys
 }
 
 // info represents the info section of a metainfo file.
@@ -46,144 +57,59 @@ type info struct {
 	Pieces   string `bencode:"pieces"`       // hash of each piece
 
 	// file name in single-file torrent, directory name in multi-file torrent
-	Name string `bencode:"name"`
+	Name     string `bencode:"name"`
+	NameUTF8 string `bencode:"name.utf-8,omitempty"` // UTF-8 variant of the name
 
 	// single-file only
-	Length int `bencode:"length,omitempty"` // length of file in single-file torrent
+	Length int    `bencode:"length,omitempty"` // length of file in single-file torrent
+	MD5    string `bencode:"md5sum,omitempty"` // md5 sum of file in single-file torrent
 
 	// multi-file only
 	Files []singleFile `bencode:"files,omitempty"` // files in multi-file torrent
-}
 
-// file represtents a single file in multi-file torrent.
-type singleFile struct {
-	Length int      `bencode:"length"` // length of the file
-	Path   []string `bencode:"path"`   // path of the file
-}
+	// v2 only
+	MetaVersion int            `bencode:"meta version,omitempty"` // 2 for v2 torrents
+	FileTree    map[string]any `bencode:"file tree,omitempty"`    // tree of files in v2 torrent
 
-// Save saves the torrent as a file or directory, fetching pieces from the
-// provided piece manager.
-func (f *file) Save(pieces torrent.PieceManager, dst string) error {
-	if f.isSingleFile() {
-		return f.saveSingleFile(pieces, dst)
-	}
+	Private int    `bencode:"private,omitempty"` // 1 if peers are only from trackers
+	Source  string `bencode:"source,omitempty"`  // source tag, used by private trackers
 
-	return f.saveMultiFile(pieces, dst)
+	raw    []byte              `bencode:"-"` // raw bencode of the parsed info dictionary
+	parsed []byte              `bencode:"-"` // info dictionary as marshalled when parsed
+	extra  map[string]rawValue `bencode:"-"` // unknown keys
 }
 
-// saveSingleFile saves a single-file torrent as a file, fetching the pieces
-// from the provided piece manager.
-func (f *file) saveSingleFile(pieces torrent.PieceManager, dst string) error {
-	length := len(f.Info.Pieces) / 20 // each hash is 20 bytes
-
-	file, err := os.Create(path.Join(dst, f.Info.Name))
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// get each piece
-	for i := 0; i < length; i++ {
-		piece, err := pieces.Get(i)
-		if err != nil {
-			return err
-		}
+// file represtents a single file in multi-file torrent.
+type singleFile struct {
+	Length   int      `bencode:"length"`               // length of the file
+	Path     []string `bencode:"path"`                 // path of the file
+	PathUTF8 []string `bencode:"path.utf-8,omitempty"` // UTF-8 variant of the path
+	MD5      string   `bencode:"md5sum,omitempty"`     // md5 sum of the file
 
-		// write each piece to the file
-		_, err = file.Write(piece)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	extra map[string]rawValue `bencode:"-"` // unknown keys
 }
 
-func (f *file) saveMultiFile(pieces torrent.PieceManager, dst string) error {
-	fileIndex, left := 0, 0
+// TorrentConfig contains the identity of the client downloading a torrent
+// created from a metainfo file, so that embedders can control it, and
+// multiple instances don't collide.
+type TorrentConfig struct {
+	// Port is the port the client is listening on. Defaults to Port.
+	Port uint16
 
-	var file *os.File
-	defer file.Close()
-
-	var err error
-
-	// nextFile closes the current file and opens the next file
-	nextFile := func() error {
-		if file != nil {
-			// close the current file
-			file.Close()
-		}
-
-		fileinfo := f.Info.Files[fileIndex]
-		filepath := []string{dst}
-		filepath = append(filepath, fileinfo.Path...)
-
-		// create new file
-		file, err = os.Create(path.Join(filepath...))
-		if err != nil {
-			return err
-		}
-
-		fileIndex++
-		left = fileinfo.Length
-		return nil
-	}
-
-	// open the first file
-	err = nextFile()
-	if err != nil {
-		return err
-	}
-
-	pieceNum := len(f.Info.Pieces) / 20
-
-pieceLoop:
-	// loop through all the pieces
-	for i := 0; i < pieceNum; i++ {
-
-		// get next piece
-		piece, err := pieces.Get(i)
-		if err != nil {
-			return err
-		}
-		consumed := 0
-
-		// repeat until whole piece is consumed
-		for {
-			piece = piece[consumed:]
-			length := len(piece)
-
-			switch {
-			// current file will consume whole piece
-			case left >= length:
-				_, err := file.Write(piece)
-				if err != nil {
-					return err
-				}
-
-				left -= length
-				continue pieceLoop
-
-			// current file finished
-			case left == 0:
-				err := nextFile()
-				if err != nil {
-					return err
-				}
-
-			// current file will consume a part of the piece
-			case left < length:
-				file.Write(piece[:left])
-				consumed += left
-				left = 0
-			}
-		}
-	}
+	// PeerID generates the peer id of the client. Defaults to
+	// peer.SessionID, which is shared by the whole process.
+	PeerID func() ([20]byte, error)
+}
 
-	return nil
+// Torrent converts a file into a torrent.Torrent, using the default
+// TorrentConfig.
+func (f *Metainfo) Torrent() (*torrent.Torrent, error) {
+	return f.TorrentWith(TorrentConfig{})
 }
 
-// Torrent converts a file into a torrent.Torrent.
-func (f *file) Torrent() (*torrent.Torrent, error) {
+// TorrentWith converts a file into a torrent.Torrent, with the identity
+// provided by the config.
+func (f *Metainfo) TorrentWith(config TorrentConfig) (*torrent.Torrent, error) {
 	hash, err := f.Info.hash()
 	if err != nil {
 		return nil, err
@@ -194,25 +120,59 @@ func (f *file) Torrent() (*torrent.Torrent, error) {
 		return nil, err
 	}
 
-	// generate random user id
-	var id [20]byte
-	rand.Seed(time.Now().Unix())
-	rand.Read(id[:])
+	port := config.Port
+	if port == 0 {
+		port = Port
+	}
+
+	id := peer.SessionID()
+	if config.PeerID != nil {
+		if id, err = config.PeerID(); err != nil {
+			return nil, err
+		}
+	}
 
 	return &torrent.Torrent{
 		Announce:    f.Announce,
 		InfoHash:    hash,
 		PieceHashes: hashes,
 		PieceLength: f.Info.PieceLen,
-		Length:      f.length(),
-		Port:        Port,
+		Length:      int(f.TotalLength()),
+		Trackers:    f.AnnounceList,
+		WebSeeds:    f.WebSeeds(),
+		Private:     f.Info.Private == 1,
+		Source:      f.Info.Source,
+		Comment:     f.Comment,
+		Port:        port,
 		Name:        id,
 	}, nil
 }
 
-// hash calculates the infohash of info.
+// WebSeeds returns the urls of the torrent's web seeds.
+func (f *Metainfo) WebSeeds() []string {
+	switch v := f.URLList.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []any:
+		var urls []string
+		for _, url := range v {
+			if url, ok := url.(string); ok && url != "" {
+				urls = append(urls, url)
+			}
+		}
+		return urls
+	}
+
+	return nil
+}
+
+// hash calculates the infohash of info. The infohash of a parsed info
+// dictionary which hasn't been modified is calculated from its raw bencode,
+// since marshalling it again may change it.
 func (i *info) hash() ([20]byte, error) {
-	b, err := bencode.Marshal(i)
+	b, err := i.MarshalBencode()
 	if err != nil {
 		return [20]byte{}, err
 	}
@@ -220,17 +180,6 @@ func (i *info) hash() ([20]byte, error) {
 	return sha1.Sum(b), nil
 }
 
-// remove excess removes the files key from the bencode for single file
-// torrents.
-func removeExcess(buf []byte) []byte {
-	res := make([]byte, len(buf)-9)
-
-	// literally remove the files field
-	copy(res, buf[:1])
-	copy(res[1:], buf[10:])
-	return res
-}
-
 // hashes returns an array containing the hash of each piece in the
 // info.
 func (i *info) hashes() ([][20]byte, error) {
@@ -249,36 +198,97 @@ func (i *info) hashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
-func (f *file) length() int {
+// File describes a file of a torrent.
+type File struct {
+	Path   []string // path of the file, starting with the torrent's name
+	Length int64    // length of the file
+	Offset int64    // offset of the file in the torrent
+	MD5    string   // hex md5 sum of the file, if provided
+}
+
+// Name returns the name of the torrent, which is the file name of a
+// single-file torrent, or the directory name of a multi-file torrent. The
+// name is always valid UTF-8.
+func (f *Metainfo) Name() string {
+	return f.name()
+}
+
+// Files returns the files of the torrent, in order. A single-file torrent
+// has a single file, whose path is the torrent's name. The paths are always
+// valid UTF-8.
+func (f *Metainfo) Files() []File {
 	if f.isSingleFile() {
-		return f.Info.Length
+		return []File{{
+			Path:   []string{f.name()},
+			Length: int64(f.Info.Length),
+			MD5:    f.Info.MD5,
+		}}
 	}
 
-	length := 0
+	files := make([]File, len(f.Info.Files))
+
+	var offset int64
+	for i, file := range f.Info.Files {
+		files[i] = File{
+			Path:   append([]string{f.name()}, f.path(file)...),
+			Length: int64(file.Length),
+			Offset: offset,
+			MD5:    file.MD5,
+		}
+
+		offset += int64(file.Length)
+	}
+
+	return files
+}
+
+// TotalLength returns the total length of the torrent's files.
+func (f *Metainfo) TotalLength() int64 {
+	if f.isSingleFile() {
+		return int64(f.Info.Length)
+	}
+
+	var length int64
 	for _, file := range f.Info.Files {
-		length += file.Length
+		length += int64(file.Length)
 	}
 
 	return length
 }
 
-func (f *file) isSingleFile() bool {
-	return len(f.Info.Files) == 0
+// PieceLength returns the length of each piece of the torrent.
+func (f *Metainfo) PieceLength() int {
+	return f.Info.PieceLen
+}
+
+// PieceCount returns the number of pieces of the torrent.
+func (f *Metainfo) PieceCount() int {
+	return len(f.Info.Pieces) / 20 // each hash is 20 bytes
 }
 
-// Open opens a io.Reader as a .torrent metainfo file.
-func Open(r io.Reader) (*file, error) {
-	var f file
+// InfoHash returns the infohash of the torrent.
+func (f *Metainfo) InfoHash() ([20]byte, error) {
+	return f.Info.hash()
+}
 
-	b, err := io.ReadAll(r)
-	if err != nil {
-		return nil, err
-	}
+// isSingleFile checks if the metainfo describes a single-file torrent.
+func (f *Metainfo) isSingleFile() bool {
+	return len(f.Info.Files) == 0
+}
 
-	err = bencode.Unmarshal(b, &f)
+// WriteTo writes the metainfo to w as a .torrent file.
+func (f *Metainfo) WriteTo(w io.Writer) (int64, error) {
+	b, err := bencode.Marshal(f)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return &f, nil
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// Open opens a io.Reader as a .torrent metainfo file, enforcing
+// DefaultLimits.
+func Open(r io.Reader) (*Metainfo, error) {
+	return OpenWith(r, DefaultLimits)
 }
@@ -0,0 +1,279 @@
+package file_test
+
+import (
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// pieceList is a PieceManager which serves pieces from memory.
+type pieceList [][]byte
+
+func (p pieceList) Init() error               { return nil }
+func (p pieceList) Close() error              { return nil }
+func (p pieceList) Put(int, []byte) error     { return errors.New("unimplemented") }
+func (p pieceList) Get(i int) ([]byte, error) { return p[i], nil }
+
+func TestSaveMultiFile(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second piece spans the files a and dir/b, and the empty file
+	// in between
+	dst := t.TempDir()
+	pieces := pieceList{[]byte("abcd"), []byte("efgh"), []byte("i")}
+	if err := f.Save(pieces, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"a":     "abc",
+		"empty": "",
+		"dir/b": "defghi",
+	}
+
+	for name, expected := range files {
+		b, err := os.ReadFile(filepath.Join(dst, "test", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != expected {
+			t.Errorf("file %s is %q, expected %q", name, b, expected)
+		}
+	}
+}
+
+func TestSaveSingleFile(t *testing.T) {
+	single := "d8:announce9:localhost4:infod6:lengthi5e4:name4:test" +
+		"12:piece lengthi4e6:pieces40:" + strings.Repeat("x", 40) + "ee"
+
+	f, err := file.Open(strings.NewReader(single))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := f.Save(pieceList{[]byte("abcd"), []byte("e")}, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "abcde" {
+		t.Errorf("file is %q, expected %q", b, "abcde")
+	}
+}
+
+func TestInfoHash(t *testing.T) {
+	// info dictionaries with keys which are not parsed
+	infos := []string{
+		"d6:lengthi5e4:name4:test12:piece lengthi4e6:pieces40:" + strings.Repeat("x", 40) + "7:privatei1e6:source3:abce",
+		multiFile[strings.Index(multiFile, "4:info")+6 : len(multiFile)-1],
+	}
+
+	for _, info := range infos {
+		f, err := file.Open(strings.NewReader("d8:announce9:localhost4:info" + info + "e"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tor, err := f.Torrent()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tor.InfoHash != sha1.Sum([]byte(info)) {
+			t.Errorf("infohash of %q isn't calculated from the raw info dictionary", info)
+		}
+	}
+}
+
+func TestMetainfoFields(t *testing.T) {
+	info := "d6:lengthi5e4:name4:test12:piece lengthi4e6:pieces40:" + strings.Repeat("x", 40) +
+		"7:privatei1e6:source3:abce"
+
+	metainfos := map[string][]string{
+		"8:url-list14:http://seed/a/":                    {"http://seed/a/"},
+		"8:url-listl14:http://seed/a/14:http://seed/b/e": {"http://seed/a/", "http://seed/b/"},
+	}
+
+	for urlList, seeds := range metainfos {
+		f, err := file.Open(strings.NewReader("d8:announce9:localhost13:announce-listll1:a1:bel1:ce" +
+			"e7:comment2:hi4:info" + info + urlList + "e"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tor, err := f.Torrent()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tor.Trackers) != 2 || len(tor.Trackers[0]) != 2 || tor.Trackers[1][0] != "c" {
+			t.Errorf("trackers are %v", tor.Trackers)
+		}
+
+		if strings.Join(tor.WebSeeds, " ") != strings.Join(seeds, " ") {
+			t.Errorf("web seeds are %v, expected %v", tor.WebSeeds, seeds)
+		}
+
+		if !tor.Private || tor.Source != "abc" || tor.Comment != "hi" {
+			t.Errorf("private %v, source %q, comment %q", tor.Private, tor.Source, tor.Comment)
+		}
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Name() != "test" || f.TotalLength() != 9 || f.PieceLength() != 4 || f.PieceCount() != 3 {
+		t.Errorf("name %q, length %d, piece length %d, pieces %d",
+			f.Name(), f.TotalLength(), f.PieceLength(), f.PieceCount())
+	}
+
+	files := f.Files()
+	if len(files) != 3 {
+		t.Fatalf("%d files, expected 3", len(files))
+	}
+
+	last := files[2]
+	if strings.Join(last.Path, "/") != "test/dir/b" || last.Length != 6 || last.Offset != 3 {
+		t.Errorf("last file is %+v", last)
+	}
+
+	hash, err := f.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor, _ := f.Torrent()
+	if hash != tor.InfoHash {
+		t.Error("infohash doesn't match the torrent's")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	single := "d8:encoding10:iso-8859-14:infod6:lengthi1e4:name4:caf\xe9" +
+		"12:piece lengthi1e6:pieces20:" + strings.Repeat("x", 20) + "ee"
+
+	f, err := file.Open(strings.NewReader(single))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Name() != "café" {
+		t.Errorf("name is %q, expected %q", f.Name(), "café")
+	}
+
+	multi := "d4:infod5:filesld6:lengthi1e4:pathl3:a\xffbe10:path.utf-8l3:abcee" +
+		"d6:lengthi1e4:pathl3:x\xffyeee4:name4:dir\xff12:piece lengthi1e" +
+		"6:pieces40:" + strings.Repeat("x", 40) + "ee"
+
+	f, err = file.Open(strings.NewReader(multi))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, file := range f.Files() {
+		paths = append(paths, strings.Join(file.Path, "/"))
+	}
+
+	if strings.Join(paths, " ") != "dir_/abc dir_/x_y" {
+		t.Errorf("paths are %q", paths)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	data := "d4:infod5:filesld4:attr1:x6:lengthi1e4:pathl1:aeee4:name4:test" +
+		"12:piece lengthi1e6:pieces20:" + strings.Repeat("x", 20) + "8:x-custom3:fooe" +
+		"5:nodesl1:nee"
+
+	f, err := file.Open(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := f.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// editing fields outside the info dictionary keeps the infohash
+	f.Comment = "edited"
+	f.AnnounceList = [][]string{{"http://tracker/announce"}}
+
+	var b strings.Builder
+	if _, err := f.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"5:nodes", "8:x-custom", "4:attr"} {
+		if !strings.Contains(b.String(), key) {
+			t.Errorf("key %s not preserved in %q", key, b.String())
+		}
+	}
+
+	f, err = file.Open(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := f.InfoHash()
+	if err != nil || after != before {
+		t.Errorf("infohash changed from %x to %x, %v", before, after, err)
+	}
+}
+
+func TestTorrentWith(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor, err := f.Torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tor.Port != file.Port || tor.Name != peer.SessionID() {
+		t.Errorf("default identity is %v, %q", tor.Port, tor.Name)
+	}
+
+	id, err := peer.NewID("-XX0000-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor, err = f.TorrentWith(file.TorrentConfig{
+		Port:   7000,
+		PeerID: func() ([20]byte, error) { return id, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tor.Port != 7000 || tor.Name != id {
+		t.Errorf("configured identity is %v, %q", tor.Port, tor.Name)
+	}
+
+	failing := func() ([20]byte, error) { return [20]byte{}, errors.New("no id") }
+	if _, err := f.TorrentWith(file.TorrentConfig{PeerID: failing}); err == nil {
+		t.Error("peer id error ignored")
+	}
+}
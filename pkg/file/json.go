@@ -0,0 +1,88 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// jsonMetainfo is the JSON representation of a metainfo file.
+type jsonMetainfo struct {
+	Name     string `json:"name"`
+	InfoHash string `json:"info_hash"`
+
+	Announce     string     `json:"announce,omitempty"`
+	AnnounceList [][]string `json:"announce_list,omitempty"`
+	WebSeeds     []string   `json:"web_seeds,omitempty"`
+
+	Comment   string `json:"comment,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+	Date      int64  `json:"creation_date,omitempty"`
+	Private   bool   `json:"private"`
+	Source    string `json:"source,omitempty"`
+
+	Length      int64      `json:"length"`
+	PieceLength int        `json:"piece_length"`
+	PieceCount  int        `json:"piece_count"`
+	Files       []jsonFile `json:"files"`
+}
+
+// jsonFile is the JSON representation of a file of a torrent.
+type jsonFile struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	Offset int64  `json:"offset"`
+	MD5    string `json:"md5sum,omitempty"`
+}
+
+// MarshalJSON converts the metainfo into a JSON description of the
+// torrent, for scripting and indexing. The infohash is hex encoded, and the
+// piece hashes are summarized by their count. File paths are joined with
+// slashes, and start with the torrent's name.
+func (f *Metainfo) MarshalJSON() ([]byte, error) {
+	hash, err := f.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+
+	m := jsonMetainfo{
+		Name:         f.Name(),
+		InfoHash:     hex.EncodeToString(hash[:]),
+		Announce:     f.Announce,
+		AnnounceList: f.AnnounceList,
+		WebSeeds:     f.WebSeeds(),
+		Comment:      f.Comment,
+		CreatedBy:    f.Author,
+		Date:         f.Date,
+		Private:      f.Info.Private == 1,
+		Source:       f.Info.Source,
+		Length:       f.TotalLength(),
+		PieceLength:  f.PieceLength(),
+		PieceCount:   f.PieceCount(),
+		Files:        []jsonFile{},
+	}
+
+	for _, file := range f.Files() {
+		m.Files = append(m.Files, jsonFile{
+			Path:   strings.Join(file.Path, "/"),
+			Length: file.Length,
+			Offset: file.Offset,
+			MD5:    file.MD5,
+		})
+	}
+
+	return json.Marshal(m)
+}
@@ -0,0 +1,48 @@
+package file_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m struct {
+		Name       string `json:"name"`
+		InfoHash   string `json:"info_hash"`
+		Length     int64  `json:"length"`
+		PieceCount int    `json:"piece_count"`
+		Files      []struct {
+			Path   string `json:"path"`
+			Offset int64  `json:"offset"`
+		} `json:"files"`
+	}
+
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Name != "test" || len(m.InfoHash) != 40 || m.Length != 9 || m.PieceCount != 3 {
+		t.Errorf("metainfo marshalled as %s", b)
+	}
+
+	if len(m.Files) != 3 || m.Files[2].Path != "test/dir/b" || m.Files[2].Offset != 3 {
+		t.Errorf("files marshalled as %+v", m.Files)
+	}
+
+	if strings.Contains(string(b), strings.Repeat("x", 20)) {
+		t.Error("piece hashes included in json")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"fmt"
+	"io"
+
+	"laptudirm.com/x/mtor/pkg/bencode"
+)
+
+// Limits contains the limits enforced while opening a metainfo file, so
+// that a crafted file can't exhaust memory. A zero limit is not enforced.
+type Limits struct {
+	MaxSize   int64 // maximum size of the metainfo file, in bytes
+	MaxFiles  int   // maximum number of files
+	MaxPieces int   // maximum number of pieces
+	MaxDepth  int   // maximum number of elements in a file's path
+}
+
+// DefaultLimits are the limits used by Open.
+var DefaultLimits = Limits{
+	MaxSize:   10 << 20, // 10 mb
+	MaxFiles:  1 << 20,
+	MaxPieces: 1 << 21,
+	MaxDepth:  64,
+}
+
+// LimitError is returned when a metainfo file exceeds a limit.
+type LimitError struct {
+	Limit string // name of the exceeded limit
+	Value int64  // value of the metainfo, or the limit plus one if unknown
+	Max   int64  // maximum allowed value
+}
+
+// Error implements the error interface.
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("file: metainfo exceeds %s limit: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// OpenWith opens a io.Reader as a .torrent metainfo file, enforcing the
+// provided limits. Exceeded limits are reported with a *LimitError.
+func OpenWith(r io.Reader, limits Limits) (*Metainfo, error) {
+	if limits.MaxSize > 0 {
+		r = io.LimitReader(r, limits.MaxSize+1)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if limits.MaxSize > 0 && int64(len(b)) > limits.MaxSize {
+		return nil, &LimitError{Limit: "size", Value: limits.MaxSize + 1, Max: limits.MaxSize}
+	}
+
+	var f Metainfo
+	if err := bencode.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	if err := f.check(limits); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// check checks the parsed metainfo against the provided limits.
+func (f *Metainfo) check(limits Limits) error {
+	if f.Info == nil {
+		return nil
+	}
+
+	if n := len(f.Info.Files); limits.MaxFiles > 0 && n > limits.MaxFiles {
+		return &LimitError{Limit: "file count", Value: int64(n), Max: int64(limits.MaxFiles)}
+	}
+
+	if n := f.PieceCount(); limits.MaxPieces > 0 && n > limits.MaxPieces {
+		return &LimitError{Limit: "piece count", Value: int64(n), Max: int64(limits.MaxPieces)}
+	}
+
+	if limits.MaxDepth > 0 {
+		for _, file := range f.Info.Files {
+			n := len(file.Path)
+			if len(file.PathUTF8) > n {
+				n = len(file.PathUTF8)
+			}
+
+			if n > limits.MaxDepth {
+				return &LimitError{Limit: "path depth", Value: int64(n), Max: int64(limits.MaxDepth)}
+			}
+		}
+	}
+
+	// files of a v2 file tree
+	if f.Info.FileTree != nil {
+		n := 0
+		err := walkTree(f.Info.FileTree, nil, limits.MaxDepth, func([]string, int64, string) error {
+			n++
+			if limits.MaxFiles > 0 && n > limits.MaxFiles {
+				return &LimitError{Limit: "file count", Value: int64(n), Max: int64(limits.MaxFiles)}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
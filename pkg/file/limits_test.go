@@ -0,0 +1,34 @@
+package file_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		limits file.Limits
+		limit  string
+	}{
+		{file.Limits{MaxSize: 64}, "size"},
+		{file.Limits{MaxFiles: 2}, "file count"},
+		{file.Limits{MaxPieces: 2}, "piece count"},
+		{file.Limits{MaxDepth: 1}, "path depth"},
+	}
+
+	for _, test := range tests {
+		_, err := file.OpenWith(strings.NewReader(multiFile), test.limits)
+
+		var limitErr *file.LimitError
+		if !errors.As(err, &limitErr) || limitErr.Limit != test.limit {
+			t.Errorf("%s limit: error is %v", test.limit, err)
+		}
+	}
+
+	if _, err := file.OpenWith(strings.NewReader(multiFile), file.DefaultLimits); err != nil {
+		t.Errorf("metainfo within limits: %v", err)
+	}
+}
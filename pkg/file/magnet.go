@@ -0,0 +1,189 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// magnet uri prefixes of exact topics
+const (
+	btihPrefix = "urn:btih:"     // v1 infohash
+	btmhPrefix = "urn:btmh:1220" // v2 infohash, as a sha2-256 multihash
+)
+
+// ErrNoInfoHash is returned when a magnet link doesn't contain an infohash.
+var ErrNoInfoHash = errors.New("file: magnet link has no infohash")
+
+// Magnet represents a magnet link of a torrent.
+type Magnet struct {
+	InfoHash   [20]byte // v1 infohash
+	InfoHashV2 [32]byte // v2 infohash
+	HasV1      bool     // whether the v1 infohash is present
+	HasV2      bool     // whether the v2 infohash is present
+
+	Name     string   // display name
+	Trackers []string // tracker announce urls
+	WebSeeds []string // web seed urls
+}
+
+// ParseMagnet parses a magnet link. The v1 infohash may be hex or base32
+// encoded, and at least one of the v1 and v2 infohashes must be present.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("file: invalid magnet link scheme %q", u.Scheme)
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{
+		Name:     query.Get("dn"),
+		Trackers: query["tr"],
+		WebSeeds: query["ws"],
+	}
+
+	for _, xt := range query["xt"] {
+		switch {
+		case strings.HasPrefix(xt, btihPrefix):
+			hash, err := decodeInfoHash(xt[len(btihPrefix):])
+			if err != nil {
+				return nil, err
+			}
+
+			m.InfoHash, m.HasV1 = hash, true
+		case strings.HasPrefix(xt, btmhPrefix):
+			hash, err := hex.DecodeString(xt[len(btmhPrefix):])
+			if err != nil || len(hash) != len(m.InfoHashV2) {
+				return nil, fmt.Errorf("file: invalid v2 infohash %q", xt)
+			}
+
+			copy(m.InfoHashV2[:], hash)
+			m.HasV2 = true
+		}
+	}
+
+	if !m.HasV1 && !m.HasV2 {
+		return nil, ErrNoInfoHash
+	}
+
+	return m, nil
+}
+
+// decodeInfoHash decodes a hex or base32 encoded v1 infohash.
+func decodeInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = errors.New("invalid length")
+	}
+
+	if err != nil {
+		return hash, fmt.Errorf("file: invalid infohash %q: %v", s, err)
+	}
+
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// String returns the magnet link, with a hex encoded v1 infohash.
+func (m *Magnet) String() string {
+	var params []string
+
+	if m.HasV1 {
+		params = append(params, "xt="+btihPrefix+hex.EncodeToString(m.InfoHash[:]))
+	}
+
+	if m.HasV2 {
+		params = append(params, "xt="+btmhPrefix+hex.EncodeToString(m.InfoHashV2[:]))
+	}
+
+	if m.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(m.Name))
+	}
+
+	for _, tr := range m.Trackers {
+		params = append(params, "tr="+url.QueryEscape(tr))
+	}
+
+	for _, ws := range m.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(ws))
+	}
+
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// Magnet returns the magnet link of the metainfo, containing its infohash,
+// name, and trackers.
+func (f *Metainfo) Magnet() (*Magnet, error) {
+	hash, err := f.Info.hash()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{InfoHash: hash, HasV1: true, Name: f.name()}
+	if f.IsV2() {
+		if m.InfoHashV2, err = f.InfoHashV2(); err != nil {
+			return nil, err
+		}
+
+		m.HasV2 = true
+		m.HasV1 = f.IsHybrid()
+	}
+
+	// trackers from the announce key and all tiers, without duplicates
+	seen := make(map[string]bool)
+	trackers := []string{f.Announce}
+	for _, tier := range f.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+
+	for _, tr := range trackers {
+		if tr != "" && !seen[tr] {
+			seen[tr] = true
+			m.Trackers = append(m.Trackers, tr)
+		}
+	}
+
+	return m, nil
+}
+
+// MagnetLink returns the magnet link of the metainfo as a string.
+func (f *Metainfo) MagnetLink() (string, error) {
+	m, err := f.Magnet()
+	if err != nil {
+		return "", err
+	}
+
+	return m.String(), nil
+}
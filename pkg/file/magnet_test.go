@@ -0,0 +1,79 @@
+package file_test
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	b, _ := hex.DecodeString(hash)
+	b32 := base32.StdEncoding.EncodeToString(b)
+	v2 := strings.Repeat("ab", 32)
+
+	links := []string{
+		"magnet:?xt=urn:btih:" + hash + "&dn=some+name&tr=http%3A%2F%2Ftracker%2Fannounce&tr=udp%3A%2F%2Fother%3A80&ws=http%3A%2F%2Fseed%2F",
+		"magnet:?xt=urn:btih:" + strings.ToLower(b32) + "&xt=urn:btmh:1220" + v2 + "&dn=some%20name&tr=http://tracker/announce&tr=udp://other:80&ws=http://seed/",
+	}
+
+	for _, link := range links {
+		m, err := file.ParseMagnet(link)
+		if err != nil {
+			t.Fatalf("parsing %s: %v", link, err)
+		}
+
+		if !m.HasV1 || hex.EncodeToString(m.InfoHash[:]) != hash {
+			t.Errorf("%s: infohash is %x", link, m.InfoHash)
+		}
+
+		if m.Name != "some name" || len(m.Trackers) != 2 || m.Trackers[1] != "udp://other:80" || len(m.WebSeeds) != 1 {
+			t.Errorf("%s: parsed as %+v", link, m)
+		}
+
+		// links round trip
+		again, err := file.ParseMagnet(m.String())
+		if err != nil || again.String() != m.String() {
+			t.Errorf("%s: generated link %s doesn't round trip", link, m.String())
+		}
+	}
+
+	m, err := file.ParseMagnet("magnet:?xt=urn:btmh:1220" + v2)
+	if err != nil || m.HasV1 || !m.HasV2 || hex.EncodeToString(m.InfoHashV2[:]) != v2 {
+		t.Errorf("v2 magnet parsed as %+v, %v", m, err)
+	}
+
+	if _, err := file.ParseMagnet("magnet:?dn=nothing"); !errors.Is(err, file.ErrNoInfoHash) {
+		t.Errorf("magnet without infohash returned %v", err)
+	}
+}
+
+func TestMagnetLink(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := f.MagnetLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor, err := f.Torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := file.ParseMagnet(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.InfoHash != tor.InfoHash || m.Name != "test" || len(m.Trackers) != 1 || m.Trackers[0] != "localhost" {
+		t.Errorf("magnet link %s doesn't describe the torrent", link)
+	}
+}
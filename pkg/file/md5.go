@@ -0,0 +1,92 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// MD5Error is returned when files on disk don't match the md5 sums in the
+// metainfo.
+type MD5Error struct {
+	Files []File // files whose md5 sums don't match
+}
+
+// Error implements the error interface.
+func (e *MD5Error) Error() string {
+	paths := make([]string, len(e.Files))
+	for i, file := range e.Files {
+		paths[i] = strings.Join(file.Path, "/")
+	}
+
+	return "file: md5 sum mismatch: " + strings.Join(paths, ", ")
+}
+
+// CheckMD5 checks the torrent's files inside the directory dir, laid out
+// like by Save, against the optional md5 sums in the metainfo. Files
+// without a md5 sum are not checked. Mismatching files are reported with a
+// *MD5Error.
+func (f *Metainfo) CheckMD5(dir string) error {
+	return f.checkMD5(f.Storage(dir))
+}
+
+// checkMD5 checks the md5 sums of the files of the storage which are not
+// skipped.
+func (f *Metainfo) checkMD5(s *Storage) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	var mismatched []File
+	for i, file := range f.Files() {
+		if file.MD5 == "" || s.files[i].skip {
+			continue
+		}
+
+		sum, err := md5File(s.files[i].path)
+		if err != nil {
+			return err
+		}
+
+		if !strings.EqualFold(sum, file.MD5) {
+			mismatched = append(mismatched, file)
+		}
+	}
+
+	if mismatched != nil {
+		return &MD5Error{Files: mismatched}
+	}
+
+	return nil
+}
+
+// md5File calculates the hex md5 sum of the file at the provided path.
+func md5File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,40 @@
+package file_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestCheckMD5(t *testing.T) {
+	open := func(sum string) *file.Metainfo {
+		f, err := file.Open(strings.NewReader("d4:infod6:lengthi3e6:md5sum32:" + sum +
+			"4:name1:a12:piece lengthi4e6:pieces20:" + strings.Repeat("x", 20) + "ee"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f
+	}
+
+	// md5 sum of "abc"
+	f := open("900150983CD24FB0D6963F7D28E17F72")
+	if f.Files()[0].MD5 == "" {
+		t.Fatal("md5 sum not parsed")
+	}
+
+	dst := t.TempDir()
+	opts := file.SaveOptions{CheckMD5: true, Atomic: true}
+	if err := f.SaveWith(pieceList{[]byte("abc")}, dst, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	f = open(strings.Repeat("0", 32))
+
+	var mismatch *file.MD5Error
+	if err := f.CheckMD5(dst); !errors.As(err, &mismatch) || len(mismatch.Files) != 1 {
+		t.Errorf("mismatching file reported as %v", err)
+	}
+}
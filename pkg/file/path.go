@@ -0,0 +1,94 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"fmt"
+	"strings"
+)
+
+// limits on the paths of saved files
+const (
+	MaxComponentLength = 255  // maximum length of a path component
+	MaxPathLength      = 4096 // maximum length of a path in a torrent
+)
+
+// PathError is returned when the path of a file in a torrent is unsafe to
+// create, like paths which would escape the destination directory.
+type PathError struct {
+	Path   []string // the path, as stored in the metainfo
+	Reason string   // why the path is unsafe
+}
+
+// Error implements the error interface.
+func (e *PathError) Error() string {
+	return fmt.Sprintf("file: unsafe path %q: %s", strings.Join(e.Path, "/"), e.Reason)
+}
+
+// reservedNames are file names which are reserved by Windows, even with
+// an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checkPath checks if the provided path of a file in a torrent, relative
+// to the destination directory, is safe to create.
+func checkPath(path []string) error {
+	if len(path) == 0 {
+		return &PathError{Path: path, Reason: "empty path"}
+	}
+
+	length := 0
+	for _, elem := range path {
+		if reason := checkComponent(elem); reason != "" {
+			return &PathError{Path: path, Reason: reason}
+		}
+
+		length += len(elem) + 1
+	}
+
+	if length > MaxPathLength {
+		return &PathError{Path: path, Reason: "path too long"}
+	}
+
+	return nil
+}
+
+// checkComponent checks if a single component of a path is safe, and
+// returns the reason if it isn't.
+func checkComponent(elem string) string {
+	switch {
+	case elem == "":
+		return "empty component"
+	case elem == "." || elem == "..":
+		return "relative component"
+	case strings.ContainsAny(elem, "/\\"):
+		return "component contains a path separator"
+	case strings.ContainsAny(elem, ":\x00"):
+		return "component contains an invalid character"
+	case len(elem) > MaxComponentLength:
+		return "component too long"
+	}
+
+	base, _, _ := strings.Cut(elem, ".")
+	if reservedNames[strings.ToUpper(base)] {
+		return "reserved name"
+	}
+
+	return ""
+}
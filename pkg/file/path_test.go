@@ -0,0 +1,46 @@
+package file_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestUnsafePaths(t *testing.T) {
+	// bencoded path lists of a multi-file torrent's only file
+	paths := []string{
+		"l2:..6:escapee",
+		"l0:e",
+		"le",
+		"l5:a/../e",
+		"l7:CON.txte",
+		"l" + "300:" + strings.Repeat("a", 300) + "e",
+	}
+
+	for _, path := range paths {
+		metainfo := "d8:announce9:localhost4:infod5:filesld6:lengthi1e4:path" + path +
+			"ee4:name4:test12:piece lengthi4e6:pieces20:" + strings.Repeat("x", 20) + "ee"
+
+		f, err := file.Open(strings.NewReader(metainfo))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dst := t.TempDir()
+		err = f.Storage(filepath.Join(dst, "dst")).Init()
+
+		var pathErr *file.PathError
+		if !errors.As(err, &pathErr) {
+			t.Errorf("path %s: got error %v, expected PathError", path, err)
+		}
+
+		// nothing is created
+		if entries, _ := os.ReadDir(dst); len(entries) != 0 {
+			t.Errorf("path %s: files created for unsafe torrent", path)
+		}
+	}
+}
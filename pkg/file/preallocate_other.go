@@ -0,0 +1,25 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package file
+
+import "os"
+
+// preallocate reserves the disk space of the first length bytes of the
+// file. Since preallocation isn't supported on this platform, the file is
+// created sparse by Init instead.
+func preallocate(file *os.File, length int64) error {
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"laptudirm.com/x/mtor/pkg/bencode"
+)
+
+// rawValue is a bencode value which is kept in its raw form, so that it
+// can be marshalled again without changes.
+type rawValue []byte
+
+// UnmarshalBencode stores the raw bencode of the value.
+func (r *rawValue) UnmarshalBencode(b []byte) error {
+	*r = append(rawValue{}, b...)
+	return nil
+}
+
+// MarshalBencode returns the stored raw bencode.
+func (r rawValue) MarshalBencode() ([]byte, error) {
+	return r, nil
+}
+
+// unknownKeys returns the keys of the bencode dictionary b which are not
+// known to the struct v, along with their raw values.
+func unknownKeys(b []byte, v any) (map[string]rawValue, error) {
+	var dict map[string]rawValue
+	if err := bencode.Unmarshal(b, &dict); err != nil {
+		return nil, err
+	}
+
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("bencode")
+		if name, _, _ := strings.Cut(tag, ","); tag != "-" {
+			delete(dict, name)
+		}
+	}
+
+	if len(dict) == 0 {
+		return nil, nil
+	}
+
+	return dict, nil
+}
+
+// marshalWith marshals the struct v, along with the provided extra keys.
+// Keys of v take precedence over the extra keys.
+func marshalWith(v any, extra map[string]rawValue) ([]byte, error) {
+	b, err := bencode.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return b, err
+	}
+
+	var dict map[string]rawValue
+	if err := bencode.Unmarshal(b, &dict); err != nil {
+		return nil, err
+	}
+
+	for key, value := range extra {
+		if _, ok := dict[key]; !ok {
+			dict[key] = value
+		}
+	}
+
+	return bencode.Marshal(dict)
+}
+
+// UnmarshalBencode unmarshals a metainfo file, and keeps its unknown keys.
+func (f *Metainfo) UnmarshalBencode(b []byte) error {
+	type plain Metainfo // Metainfo without the bencode methods
+	if err := bencode.Unmarshal(b, (*plain)(f)); err != nil {
+		return err
+	}
+
+	extra, err := unknownKeys(b, plain{})
+	f.extra = extra
+	return err
+}
+
+// MarshalBencode marshals a metainfo file, along with its unknown keys.
+func (f *Metainfo) MarshalBencode() ([]byte, error) {
+	type plain Metainfo // Metainfo without the bencode methods
+	return marshalWith((*plain)(f), f.extra)
+}
+
+// UnmarshalBencode unmarshals an info dictionary, and keeps its unknown
+// keys and its raw bencode to calculate the infohash.
+func (i *info) UnmarshalBencode(b []byte) error {
+	type plain info // info without the bencode methods
+	if err := bencode.Unmarshal(b, (*plain)(i)); err != nil {
+		return err
+	}
+
+	extra, err := unknownKeys(b, plain{})
+	if err != nil {
+		return err
+	}
+
+	i.extra = extra
+	i.raw = append([]byte{}, b...)
+	i.parsed, err = i.encode()
+	return err
+}
+
+// MarshalBencode marshals an info dictionary. If the dictionary hasn't
+// been modified since it was parsed, its raw bencode is returned, so that
+// its infohash doesn't change.
+func (i *info) MarshalBencode() ([]byte, error) {
+	b, err := i.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	if i.raw != nil && bytes.Equal(b, i.parsed) {
+		return i.raw, nil
+	}
+
+	return b, nil
+}
+
+// encode marshals an info dictionary, along with its unknown keys.
+func (i *info) encode() ([]byte, error) {
+	type plain info // info without the bencode methods
+	return marshalWith((*plain)(i), i.extra)
+}
+
+// UnmarshalBencode unmarshals a file of a multi-file torrent, and keeps its
+// unknown keys.
+func (s *singleFile) UnmarshalBencode(b []byte) error {
+	type plain singleFile // singleFile without the bencode methods
+	if err := bencode.Unmarshal(b, (*plain)(s)); err != nil {
+		return err
+	}
+
+	extra, err := unknownKeys(b, plain{})
+	s.extra = extra
+	return err
+}
+
+// MarshalBencode marshals a file of a multi-file torrent, along with its
+// unknown keys.
+func (s singleFile) MarshalBencode() ([]byte, error) {
+	type plain singleFile // singleFile without the bencode methods
+	return marshalWith(plain(s), s.extra)
+}
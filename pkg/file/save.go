@@ -0,0 +1,149 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/torrent"
+)
+
+// PartSuffix is appended to the names of files while they are being saved
+// atomically.
+const PartSuffix = ".part"
+
+// SaveOptions contains the options used to save a torrent.
+type SaveOptions struct {
+	// OnPiece is called after each piece is written, with the number of
+	// bytes written so far and the total number of bytes.
+	OnPiece func(index int, written, total int64)
+	// OnFile is called after each file is completely written.
+	OnFile func(file File)
+
+	// Sync commits the saved files to stable storage before returning.
+	Sync bool
+
+	// Files contains the indices, in the torrent's Files, of the files to
+	// save. Patterns contains path.Match patterns, which select the files
+	// whose slash separated paths inside the torrent match them. If both
+	// are empty, all the files are saved. Only the pieces spanning the
+	// selected files are fetched.
+	Files    []int
+	Patterns []string
+
+	// CheckMD5 checks the saved files against the optional md5 sums in the
+	// metainfo, like CheckMD5, after they are saved.
+	CheckMD5 bool
+
+	// Resume hash-checks the pieces in existing files, which are partial
+	// files if the torrent is saved atomically, and only writes the pieces
+	// which are missing or invalid. Have contains pieces which are known to
+	// be already written, like from a previous Verify, which are skipped
+	// without being checked.
+	Resume bool
+	Have   bitfield.Bitfield
+
+	// Remap overrides the locations where the files are saved.
+	Remap Remap
+
+	// Preallocate reserves the disk space of the files before writing to
+	// them, where supported, instead of creating sparse files.
+	Preallocate bool
+
+	// Atomic saves the files with PartSuffix appended to their names, and
+	// renames them once all of them are written, so that partially saved
+	// files are never mistaken for complete ones. The partial files are
+	// removed if saving fails.
+	Atomic bool
+}
+
+// Save saves the torrent into the directory dst, fetching pieces from the
+// provided piece manager. A single-file torrent is saved as the file
+// dst/name, while a multi-file torrent is saved inside the directory
+// dst/name, creating the directories in the files' paths. Pieces which span
+// multiple files are split at the file boundaries.
+func (f *Metainfo) Save(pieces torrent.PieceManager, dst string) error {
+	return f.SaveWith(pieces, dst, SaveOptions{})
+}
+
+// SaveWith is like Save, but uses the provided options.
+func (f *Metainfo) SaveWith(pieces torrent.PieceManager, dst string, opts SaveOptions) error {
+	w, err := f.NewWriter(dst, opts)
+	if err != nil {
+		return err
+	}
+
+	missing := w.Missing()
+	for i := 0; i < f.PieceCount(); i++ {
+		if !missing.Has(i) {
+			continue
+		}
+
+		piece, err := pieces.Get(i)
+		if err == nil {
+			err = w.WritePiece(i, piece)
+		}
+
+		if err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// selectFiles marks the files not selected by the options as skipped.
+func (f *Metainfo) selectFiles(s *Storage, opts SaveOptions) error {
+	if len(opts.Files) == 0 && len(opts.Patterns) == 0 {
+		return nil
+	}
+
+	selected := make([]bool, len(s.files))
+	for _, i := range opts.Files {
+		if i < 0 || i >= len(s.files) {
+			return fmt.Errorf("file: file index %v out of range", i)
+		}
+
+		selected[i] = true
+	}
+
+	for i, file := range f.Files() {
+		// paths inside multi-file torrents don't include the name
+		name := file.Path
+		if !f.isSingleFile() {
+			name = name[1:]
+		}
+
+		for _, pattern := range opts.Patterns {
+			ok, err := path.Match(pattern, strings.Join(name, "/"))
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				selected[i] = true
+			}
+		}
+	}
+
+	for i, file := range s.files {
+		file.skip = !selected[i]
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package file_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+// failingPieces is a PieceManager which fails to get a piece.
+type failingPieces struct {
+	pieceList
+	fail int // index of the failing piece
+}
+
+func (p failingPieces) Get(i int) ([]byte, error) {
+	if i == p.fail {
+		return nil, errors.New("piece unavailable")
+	}
+
+	return p.pieceList.Get(i)
+}
+
+func TestSaveWith(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written []int64
+	var completed []string
+
+	dst := t.TempDir()
+	err = f.SaveWith(pieceList{[]byte("abcd"), []byte("efgh"), []byte("i")}, dst, file.SaveOptions{
+		OnPiece: func(index int, n, total int64) {
+			if total != 9 {
+				t.Errorf("total is %d, expected 9", total)
+			}
+			written = append(written, n)
+		},
+		OnFile: func(file file.File) {
+			completed = append(completed, strings.Join(file.Path, "/"))
+		},
+		Sync:   true,
+		Atomic: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(written) != 3 || written[2] != 9 {
+		t.Errorf("progress reported as %v", written)
+	}
+
+	if strings.Join(completed, " ") != "test/a test/empty test/dir/b" {
+		t.Errorf("files completed in order %v", completed)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "test", "dir", "b"))
+	if err != nil || string(b) != "defghi" {
+		t.Errorf("saved file is %q, %v", b, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, "test", "a"+file.PartSuffix)); !os.IsNotExist(err) {
+		t.Error("partial file left after saving")
+	}
+}
+
+func TestSaveAtomicFailure(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	pieces := failingPieces{pieceList{[]byte("abcd"), []byte("efgh"), []byte("i")}, 2}
+	if err := f.SaveWith(pieces, dst, file.SaveOptions{Atomic: true}); err == nil {
+		t.Fatal("saved torrent with missing piece")
+	}
+
+	// neither complete nor partial files are left behind
+	for _, name := range []string{"a", "empty", "dir/b"} {
+		path := filepath.Join(dst, "test", filepath.FromSlash(name))
+		for _, p := range []string{path, path + file.PartSuffix} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("file %s exists after failed save", p)
+			}
+		}
+	}
+}
+
+func TestSaveSelected(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last piece only spans dir/b, so it is never fetched
+	dst := t.TempDir()
+	pieces := failingPieces{pieceList{[]byte("abcd"), []byte("efgh"), []byte("i")}, 2}
+
+	var completed []string
+	err = f.SaveWith(pieces, dst, file.SaveOptions{
+		Files:    []int{0},
+		Patterns: []string{"e*"},
+		OnFile: func(file file.File) {
+			completed = append(completed, strings.Join(file.Path, "/"))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(completed, " ") != "test/a test/empty" {
+		t.Errorf("files completed in order %v", completed)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "test", "a"))
+	if err != nil || string(b) != "abc" {
+		t.Errorf("saved file is %q, %v", b, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, "test", "dir", "b")); !os.IsNotExist(err) {
+		t.Error("unselected file was saved")
+	}
+
+	// boundary pieces are split correctly for the selected files
+	dst = t.TempDir()
+	err = f.SaveWith(pieceList{[]byte("abcd"), []byte("efgh"), []byte("i")}, dst, file.SaveOptions{
+		Patterns: []string{"dir/*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = os.ReadFile(filepath.Join(dst, "test", "dir", "b"))
+	if err != nil || string(b) != "defghi" {
+		t.Errorf("saved file is %q, %v", b, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, "test", "a")); !os.IsNotExist(err) {
+		t.Error("unselected file was saved")
+	}
+
+	if err := f.SaveWith(pieces, dst, file.SaveOptions{Patterns: []string{"["}}); err == nil {
+		t.Error("malformed pattern accepted")
+	}
+}
+
+// recordedPieces is a PieceManager which records the pieces it serves.
+type recordedPieces struct {
+	pieceList
+	got *[]int // indices of the served pieces
+}
+
+func (p recordedPieces) Get(i int) ([]byte, error) {
+	*p.got = append(*p.got, i)
+	return p.pieceList.Get(i)
+}
+
+func TestSaveResume(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "test")
+	if err := os.WriteFile(src, []byte("abcdefghij"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := file.Create([]string{src}, file.CreateOptions{PieceLength: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	pieces := recordedPieces{pieceList{[]byte("abcd"), []byte("efgh"), []byte("ij")}, &got}
+
+	dst := t.TempDir()
+	if err := m.Save(pieces, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// damage the second piece
+	path := filepath.Join(dst, "test")
+	if err := os.WriteFile(path, []byte("abcdXfghij"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got = nil
+	if err := m.SaveWith(pieces, dst, file.SaveOptions{Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0] != 1 {
+		t.Errorf("fetched pieces %v, expected [1]", got)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != "abcdefghij" {
+		t.Errorf("resumed file is %q, %v", b, err)
+	}
+
+	// pieces known to be written are trusted
+	report, err := m.Verify(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = nil
+	if err := m.SaveWith(pieces, dst, file.SaveOptions{Have: report.Bitfield}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 0 {
+		t.Errorf("fetched pieces %v, expected none", got)
+	}
+}
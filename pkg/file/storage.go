@@ -0,0 +1,343 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrStorageClosed is returned when the storage is not initialized, or
+// closed.
+var ErrStorageClosed = errors.New("file: storage is closed")
+
+// Storage is a torrent.PieceManager which writes pieces directly to their
+// final offsets in the torrent's files, so that the downloaded torrent
+// doesn't need to be saved separately. Closing the storage closes the
+// files, without removing them.
+type Storage struct {
+	files       []*storageFile // files of the torrent, in order
+	pieceLen    int            // length of each piece
+	length      int64          // total length of the torrent
+	open        bool           // whether the storage is initialized
+	preallocate bool           // whether to reserve the disk space of the files
+	err         error          // error in the torrent's paths, if any
+}
+
+// storageFile represents a single file of a Storage.
+type storageFile struct {
+	path   string   // path of the file
+	offset int64    // offset of the file in the torrent
+	length int64    // length of the file
+	file   *os.File // the opened file
+	skip   bool     // whether the file is left out of the storage
+}
+
+// Storage returns a Storage which writes the torrent's pieces into files
+// inside the directory dst. A single-file torrent is stored as the file
+// dst/name, while a multi-file torrent is stored inside the directory
+// dst/name. If any of the torrent's paths is unsafe, Init returns a
+// *PathError.
+func (f *Metainfo) Storage(dst string) *Storage {
+	return f.StorageWith(dst, Remap{})
+}
+
+// Remap overrides the locations where a torrent's files are stored, like
+// to flatten directory layouts, or to avoid collisions with existing files.
+type Remap struct {
+	// Root replaces the torrent's name as the name of the file or the
+	// directory which the torrent is stored in, if it isn't empty.
+	Root string
+
+	// Files maps the indices of files, in the torrent's Files, to their
+	// slash separated paths inside the destination directory, replacing
+	// their default paths.
+	Files map[int]string
+}
+
+// StorageWith is like Storage, but stores the files at the locations
+// provided by the remap table. If a remapped path is unsafe, or multiple
+// files are stored at the same path, Init returns a *PathError.
+func (f *Metainfo) StorageWith(dst string, remap Remap) *Storage {
+	s := &Storage{pieceLen: f.Info.PieceLen}
+	seen := make(map[string]bool) // paths of the added files
+
+	for i, file := range f.Files() {
+		if !f.isSingleFile() && len(f.Info.Files[i].Path) == 0 && s.err == nil {
+			s.err = &PathError{Reason: "empty path"}
+		}
+
+		elems := file.Path
+		if remap.Root != "" {
+			elems[0] = remap.Root
+		}
+
+		if path, ok := remap.Files[i]; ok {
+			elems = strings.Split(path, "/")
+		}
+
+		// remapped files may collide with each other
+		if key := path.Join(elems...); seen[key] && s.err == nil {
+			s.err = &PathError{Path: elems, Reason: "duplicate path"}
+		} else {
+			seen[key] = true
+		}
+
+		s.add(dst, elems, file.Length)
+	}
+
+	for i := range remap.Files {
+		if (i < 0 || i >= len(s.files)) && s.err == nil {
+			s.err = fmt.Errorf("file: file index %v out of range", i)
+		}
+	}
+
+	return s
+}
+
+// add adds a file of the provided length at the end of the storage, with
+// the provided path inside dst.
+func (s *Storage) add(dst string, elems []string, length int64) {
+	if err := checkPath(elems); err != nil && s.err == nil {
+		s.err = err
+	}
+
+	s.files = append(s.files, &storageFile{
+		path:   path.Join(append([]string{dst}, elems...)...),
+		offset: s.length,
+		length: length,
+	})
+
+	s.length += length
+}
+
+// Init creates the torrent's files and their directories, and truncates
+// them to their final lengths. Existing files are opened without losing
+// their data. Nothing is created if any of the torrent's paths is unsafe.
+func (s *Storage) Init() error {
+	if s.err != nil {
+		return s.err
+	}
+
+	for _, f := range s.files {
+		if f.skip {
+			continue
+		}
+
+		if err := os.MkdirAll(path.Dir(f.path), 0755); err != nil {
+			s.closeFiles()
+			return err
+		}
+
+		file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.closeFiles()
+			return err
+		}
+		f.file = file
+
+		if s.preallocate {
+			if err := preallocate(file, f.length); err != nil {
+				s.closeFiles()
+				return err
+			}
+		}
+
+		if err := file.Truncate(f.length); err != nil {
+			s.closeFiles()
+			return err
+		}
+	}
+
+	s.open = true
+	return nil
+}
+
+// Put writes the piece with the provided index to the files it spans.
+func (s *Storage) Put(i int, buf []byte) error {
+	if !s.open {
+		return ErrStorageClosed
+	}
+
+	return s.each(i, len(buf), func(f *storageFile, off int64, begin, end int) error {
+		_, err := f.file.WriteAt(buf[begin:end], off)
+		return err
+	})
+}
+
+// Get reads the piece with the provided index from the files it spans.
+func (s *Storage) Get(i int) ([]byte, error) {
+	if !s.open {
+		return nil, ErrStorageClosed
+	}
+
+	length := s.pieceLength(i)
+	if i < 0 || length <= 0 {
+		return nil, fmt.Errorf("file: piece index %v out of range", i)
+	}
+
+	buf := make([]byte, length)
+	err := s.each(i, len(buf), func(f *storageFile, off int64, begin, end int) error {
+		_, err := f.file.ReadAt(buf[begin:end], off)
+		return err
+	})
+
+	return buf, err
+}
+
+// WriteAt writes b at the provided offset of the torrent, across the files
+// it spans. It allows adjacent pieces to be written at once.
+func (s *Storage) WriteAt(b []byte, off int64) (int, error) {
+	if !s.open {
+		return 0, ErrStorageClosed
+	}
+
+	err := s.span(off, len(b), func(f *storageFile, fileOff int64, begin, end int) error {
+		_, err := f.file.WriteAt(b[begin:end], fileOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Sync commits the contents of the torrent's files to stable storage.
+func (s *Storage) Sync() error {
+	if !s.open {
+		return ErrStorageClosed
+	}
+
+	for _, f := range s.files {
+		if f.skip {
+			continue
+		}
+
+		if err := f.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the torrent's files.
+func (s *Storage) Close() error {
+	if !s.open {
+		return ErrStorageClosed
+	}
+
+	s.open = false
+	return s.closeFiles()
+}
+
+// remove closes and removes the storage's files.
+func (s *Storage) remove() {
+	s.open = false
+	s.closeFiles()
+
+	for _, f := range s.files {
+		if !f.skip {
+			os.Remove(f.path)
+		}
+	}
+}
+
+// closeFiles closes all the opened files, and returns the first error.
+func (s *Storage) closeFiles() error {
+	var firstErr error
+	for _, f := range s.files {
+		if f.file == nil {
+			continue
+		}
+
+		if err := f.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		f.file = nil
+	}
+
+	return firstErr
+}
+
+// each calls fn for every file spanned by the first length bytes of the
+// piece with the provided index, with the offset in the file and the
+// bounds of the corresponding part of the piece.
+func (s *Storage) each(i, length int, fn func(f *storageFile, off int64, begin, end int) error) error {
+	if i < 0 {
+		return fmt.Errorf("file: piece index %v out of range", i)
+	}
+
+	return s.span(int64(i)*int64(s.pieceLen), length, fn)
+}
+
+// pieceLength returns the length of the piece with the provided index. The
+// last piece is irregular in length.
+func (s *Storage) pieceLength(i int) int {
+	length := int64(s.pieceLen)
+	if rest := s.length - int64(i)*length; rest < length {
+		length = rest
+	}
+
+	return int(length)
+}
+
+// spans reports whether the piece with the provided index and length spans
+// any file which isn't skipped.
+func (s *Storage) spans(i, length int) bool {
+	found := false
+	s.each(i, length, func(*storageFile, int64, int, int) error {
+		found = true
+		return nil
+	})
+
+	return found
+}
+
+// span calls fn for every file spanned by length bytes at the provided
+// offset of the torrent, with the offset in the file and the bounds of the
+// corresponding part of the data.
+func (s *Storage) span(start int64, length int, fn func(f *storageFile, off int64, begin, end int) error) error {
+	stop := start + int64(length) // end of data in torrent
+
+	if start < 0 || stop > s.length {
+		return fmt.Errorf("file: %v bytes at offset %v out of range", length, start)
+	}
+
+	for _, f := range s.files {
+		// file doesn't overlap with the data, or is skipped
+		if f.offset+f.length <= start || f.offset >= stop || f.length == 0 || f.skip {
+			continue
+		}
+
+		// overlapping part of the file and the data
+		from, to := start, stop
+		if f.offset > from {
+			from = f.offset
+		}
+		if end := f.offset + f.length; end < to {
+			to = end
+		}
+
+		if err := fn(f, from-f.offset, int(from-start), int(to-start)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package file_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+// multiFile is a multi-file metainfo with 4 byte pieces, whose files have
+// lengths 3, 0, and 6.
+var multiFile = "d8:announce9:localhost4:infod5:filesl" +
+	"d6:lengthi3e4:pathl1:aee" +
+	"d6:lengthi0e4:pathl5:emptyee" +
+	"d6:lengthi6e4:pathl3:dir1:bee" +
+	"e4:name4:test12:piece lengthi4e6:pieces60:" + strings.Repeat("x", 60) + "ee"
+
+func TestStorage(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	s := f.Storage(dst)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// pieces are put out of order, and span multiple files
+	pieces := [][]byte{[]byte("abcd"), []byte("efgh"), []byte("i")}
+	for _, i := range []int{2, 0, 1} {
+		if err := s.Put(i, pieces[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, piece := range pieces {
+		got, err := s.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, piece) {
+			t.Errorf("piece %d is %q, expected %q", i, got, piece)
+		}
+	}
+
+	files := map[string]string{
+		"a":     "abc",
+		"empty": "",
+		"dir/b": "defghi",
+	}
+
+	for name, expected := range files {
+		b, err := os.ReadFile(filepath.Join(dst, "test", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != expected {
+			t.Errorf("file %s is %q, expected %q", name, b, expected)
+		}
+	}
+
+	if err := s.Put(3, []byte("j")); err == nil {
+		t.Error("put piece out of range")
+	}
+}
+
+func TestStorageRemap(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	pieces := pieceList{[]byte("abcd"), []byte("efgh"), []byte("i")}
+	err = f.SaveWith(pieces, dst, file.SaveOptions{
+		Remap: file.Remap{Root: "root", Files: map[int]string{2: "flat/b"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string]string{"root/a": "abc", "root/empty": "", "flat/b": "defghi"} {
+		b, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil || string(b) != data {
+			t.Errorf("file %s is %q, %v", name, b, err)
+		}
+	}
+
+	remaps := []file.Remap{
+		{Files: map[int]string{0: "test/dir/b"}},
+		{Files: map[int]string{1: "../escape"}},
+		{Files: map[int]string{3: "missing"}},
+	}
+
+	for _, remap := range remaps {
+		if err := f.StorageWith(t.TempDir(), remap).Init(); err == nil {
+			t.Errorf("remap %v accepted", remap.Files)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// contentTypes contains the content types accepted by OpenURL. Servers
+// often serve .torrent files as generic binary data.
+var contentTypes = map[string]bool{
+	"application/x-bittorrent": true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// OpenURL fetches a .torrent metainfo file over http(s) and opens it,
+// enforcing DefaultLimits. Responses which are not successful, or which
+// have a content type other than that of a .torrent file, like error pages,
+// are rejected.
+func OpenURL(ctx context.Context, url string) (*Metainfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file: fetching %s: %s", url, res.Status)
+	}
+
+	if header := res.Header.Get("Content-Type"); header != "" {
+		typ, _, err := mime.ParseMediaType(header)
+		if err != nil || !contentTypes[typ] {
+			return nil, fmt.Errorf("file: fetching %s: unexpected content type %q", url, header)
+		}
+	}
+
+	if max := DefaultLimits.MaxSize; res.ContentLength > max {
+		return nil, &LimitError{Limit: "size", Value: res.ContentLength, Max: max}
+	}
+
+	return OpenWith(res.Body, DefaultLimits)
+}
@@ -0,0 +1,53 @@
+package file_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestOpenURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/test.torrent":
+			w.Header().Set("Content-Type", "application/x-bittorrent")
+			w.Write([]byte(multiFile))
+		case "/login":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html></html>"))
+		case "/huge.torrent":
+			w.Header().Set("Content-Type", "application/x-bittorrent")
+			w.Write([]byte(strings.Repeat("x", int(file.DefaultLimits.MaxSize)+1)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	f, err := file.OpenURL(ctx, srv.URL+"/test.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Name() != "test" {
+		t.Errorf("name is %q", f.Name())
+	}
+
+	for _, path := range []string{"/login", "/missing"} {
+		if _, err := file.OpenURL(ctx, srv.URL+path); err == nil {
+			t.Errorf("opened %s", path)
+		}
+	}
+
+	var limitErr *file.LimitError
+	if _, err := file.OpenURL(ctx, srv.URL+"/huge.torrent"); !errors.As(err, &limitErr) {
+		t.Errorf("huge metainfo error is %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNotV2 is returned when v2 information is requested from a metainfo
+// file which doesn't describe a v2 torrent.
+var ErrNotV2 = errors.New("file: not a v2 torrent")
+
+// FileV2 describes a file of a v2 torrent.
+type FileV2 struct {
+	Path   []string // path of the file, starting with the torrent's name
+	Length int64    // length of the file
+
+	// root of the merkle tree of the file's blocks, which is zero for
+	// empty files
+	PiecesRoot [32]byte
+
+	// hashes of the file's pieces from the piece layers, which are only
+	// present for files longer than a piece
+	Layer [][32]byte
+}
+
+// IsV2 reports whether the metainfo describes a v2 torrent, which may be a
+// hybrid torrent.
+func (f *Metainfo) IsV2() bool {
+	return f.Info.MetaVersion == 2
+}
+
+// IsHybrid reports whether the metainfo describes a hybrid torrent, which
+// can be downloaded with both the v1 and the v2 protocols.
+func (f *Metainfo) IsHybrid() bool {
+	return f.IsV2() && f.Info.Pieces != ""
+}
+
+// InfoHashV2 returns the v2 infohash of the torrent, which is the sha256
+// hash of its info dictionary.
+func (f *Metainfo) InfoHashV2() ([32]byte, error) {
+	if !f.IsV2() {
+		return [32]byte{}, ErrNotV2
+	}
+
+	b, err := f.Info.MarshalBencode()
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return sha256.Sum256(b), nil
+}
+
+// FilesV2 returns the files of a v2 torrent from its file tree, in the
+// order of their paths, along with their piece layers. The name of the
+// torrent is prepended to each path.
+func (f *Metainfo) FilesV2() ([]FileV2, error) {
+	if !f.IsV2() {
+		return nil, ErrNotV2
+	}
+
+	var files []FileV2
+	err := walkTree(f.Info.FileTree, nil, 0, func(path []string, length int64, root string) error {
+		file := FileV2{
+			Path:   append([]string{f.name()}, path...),
+			Length: length,
+		}
+
+		if length > 0 {
+			if len(root) != 32 {
+				return fmt.Errorf("file: malformed pieces root of %q", path)
+			}
+			copy(file.PiecesRoot[:], root)
+		}
+
+		// files longer than a piece have a piece layer
+		if pieceLen := int64(f.Info.PieceLen); length > pieceLen {
+			layer, ok := f.PieceLayers[root]
+			if !ok {
+				return fmt.Errorf("file: missing piece layer of %q", path)
+			}
+
+			if n := (length + pieceLen - 1) / pieceLen; int64(len(layer)) != n*32 {
+				return fmt.Errorf("file: piece layer of %q has length %v, expected %v", path, len(layer), n*32)
+			}
+
+			file.Layer = make([][32]byte, len(layer)/32)
+			for i := range file.Layer {
+				copy(file.Layer[i][:], layer[i*32:])
+			}
+		}
+
+		files = append(files, file)
+		return nil
+	})
+
+	return files, err
+}
+
+// walkTree calls fn for every file in a v2 file tree, in the order of
+// their paths. Directories are dictionaries of their entries, while files
+// are dictionaries with the single key "", containing the file's length
+// and pieces root. The number of elements in a path is limited to
+// maxDepth, unless it is zero.
+func walkTree(tree map[string]any, path []string, maxDepth int, fn func(path []string, length int64, root string) error) error {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		elems := append(append([]string{}, path...), name)
+		if maxDepth > 0 && len(elems) > maxDepth {
+			return &LimitError{Limit: "path depth", Value: int64(len(elems)), Max: int64(maxDepth)}
+		}
+
+		entry, ok := tree[name].(map[string]any)
+		if !ok || name == "" {
+			return fmt.Errorf("file: malformed file tree entry %q", elems)
+		}
+
+		// file entries have a single key ""
+		leaf, ok := entry[""].(map[string]any)
+		if !ok {
+			if err := walkTree(entry, elems, maxDepth, fn); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		length, ok := leaf["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("file: malformed length of %q", elems)
+		}
+
+		root, _ := leaf["pieces root"].(string)
+		if err := fn(elems, length, root); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
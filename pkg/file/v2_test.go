@@ -0,0 +1,94 @@
+package file_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/bencode"
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestV2(t *testing.T) {
+	rootA := strings.Repeat("a", 32)
+	rootB := strings.Repeat("b", 32)
+
+	info := map[string]any{
+		"meta version": 2,
+		"name":         "test",
+		"piece length": 16384,
+		"file tree": map[string]any{
+			"a": map[string]any{"": map[string]any{"length": 5, "pieces root": rootA}},
+			"d": map[string]any{
+				"b":     map[string]any{"": map[string]any{"length": 20000, "pieces root": rootB}},
+				"empty": map[string]any{"": map[string]any{"length": 0}},
+			},
+		},
+	}
+
+	raw, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := bencode.Marshal(map[string]any{
+		"info":         info,
+		"piece layers": map[string]any{rootB: strings.Repeat("x", 64)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := file.Open(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.IsV2() || f.IsHybrid() {
+		t.Errorf("v2 %v, hybrid %v", f.IsV2(), f.IsHybrid())
+	}
+
+	hash, err := f.InfoHashV2()
+	if err != nil || hash != sha256.Sum256(raw) {
+		t.Errorf("v2 infohash is %x, %v", hash, err)
+	}
+
+	files, err := f.FilesV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, strings.Join(file.Path, "/"))
+	}
+
+	if strings.Join(paths, " ") != "test/a test/d/b test/d/empty" {
+		t.Errorf("files are %v", paths)
+	}
+
+	if string(files[0].PiecesRoot[:]) != rootA || files[0].Layer != nil {
+		t.Errorf("small file is %+v", files[0])
+	}
+
+	if len(files[1].Layer) != 2 {
+		t.Errorf("piece layer has %d hashes, expected 2", len(files[1].Layer))
+	}
+
+	m, err := f.Magnet()
+	if err != nil || !m.HasV2 || m.HasV1 || m.InfoHashV2 != hash {
+		t.Errorf("magnet is %+v, %v", m, err)
+	}
+
+	// v1 torrents have no v2 information
+	f, err = file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.FilesV2(); !errors.Is(err, file.ErrNotV2) {
+		t.Errorf("v1 files error is %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+)
+
+// errMissing is returned while reading a piece from a missing file.
+var errMissing = errors.New("file: file is missing")
+
+// VerifyReport contains the results of verifying a torrent's files.
+type VerifyReport struct {
+	Bitfield bitfield.Bitfield // pieces which are valid
+	Files    []FileReport      // reports of each file, in order
+}
+
+// Complete reports whether all the torrent's files are complete.
+func (r *VerifyReport) Complete() bool {
+	for _, f := range r.Files {
+		if !f.Complete() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FileReport contains the results of verifying a single file.
+type FileReport struct {
+	File   File  // the verified file
+	Exists bool  // whether the file exists
+	Size   int64 // size of the file on disk
+
+	Pieces int // number of pieces overlapping the file
+	Valid  int // number of those pieces which are valid
+}
+
+// Complete reports whether the file exists with the correct size, and all
+// of its pieces are valid.
+func (r *FileReport) Complete() bool {
+	return r.Exists && r.Size == r.File.Length && r.Valid == r.Pieces
+}
+
+// Verify checks the torrent's files inside the directory dir, laid out like
+// by Save, against the torrent's piece hashes. Missing and short files are
+// reported, and their pieces are invalid. The files are not modified.
+func (f *Metainfo) Verify(dir string) (*VerifyReport, error) {
+	s := f.Storage(dir)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	report := &VerifyReport{Bitfield: bitfield.Empty(f.PieceCount())}
+	for _, file := range f.Files() {
+		report.Files = append(report.Files, FileReport{File: file})
+	}
+
+	// open the existing files read-only
+	for i, sf := range s.files {
+		file, err := os.Open(sf.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			s.closeFiles()
+			return nil, err
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			s.closeFiles()
+			return nil, err
+		}
+
+		sf.file = file
+		report.Files[i].Exists = true
+		report.Files[i].Size = info.Size()
+	}
+	defer s.closeFiles()
+
+	hashes := []byte(f.Info.Pieces)
+	for i := 0; i < f.PieceCount(); i++ {
+		length := s.pieceLength(i)
+		buf := make([]byte, length)
+		err := s.each(i, length, func(sf *storageFile, off int64, begin, end int) error {
+			if sf.file == nil {
+				return errMissing
+			}
+
+			_, err := sf.file.ReadAt(buf[begin:end], off)
+			return err
+		})
+
+		sum := sha1.Sum(buf)
+		valid := err == nil && bytes.Equal(sum[:], hashes[i*sha1.Size:(i+1)*sha1.Size])
+		if valid {
+			report.Bitfield.Set(i)
+		}
+
+		for _, index := range s.overlapping(i, length) {
+			report.Files[index].Pieces++
+			if valid {
+				report.Files[index].Valid++
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// index returns the index of the provided file in the storage.
+func (s *Storage) index(f *storageFile) int {
+	for i, file := range s.files {
+		if file == f {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// overlapping returns the indices of the files spanned by the first length
+// bytes of the piece with the provided index.
+func (s *Storage) overlapping(i, length int) []int {
+	var indices []int
+	s.each(i, length, func(f *storageFile, _ int64, _, _ int) error {
+		indices = append(indices, s.index(f))
+		return nil
+	})
+
+	return indices
+}
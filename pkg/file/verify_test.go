@@ -0,0 +1,71 @@
+package file_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "test")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// pieces: "abcd", "efgh", "ij"
+	x, y := filepath.Join(src, "x"), filepath.Join(src, "y")
+	if err := os.WriteFile(x, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(y, []byte("defghij"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := file.Create([]string{src}, file.CreateOptions{PieceLength: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := m.Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Complete() || report.Bitfield.Count() != 3 {
+		t.Errorf("intact files reported as %+v", report)
+	}
+
+	// corrupt the last piece, and remove the first file
+	if err := os.WriteFile(y, []byte("defghiX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(x); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = m.Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Complete() {
+		t.Error("damaged files reported as complete")
+	}
+
+	for i, valid := range []bool{false, true, false} {
+		if report.Bitfield.Has(i) != valid {
+			t.Errorf("piece %d valid: %v, expected %v", i, report.Bitfield.Has(i), valid)
+		}
+	}
+
+	rx, ry := report.Files[0], report.Files[1]
+	if rx.Exists || rx.Pieces != 1 || rx.Valid != 0 {
+		t.Errorf("missing file reported as %+v", rx)
+	}
+	if !ry.Exists || ry.Size != 7 || ry.Pieces != 3 || ry.Valid != 1 {
+		t.Errorf("corrupt file reported as %+v", ry)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+)
+
+// Writer writes the pieces of a torrent into its files as they become
+// available, in any order, so that a torrent can be saved without holding
+// its pieces in memory. The files are created, and preallocated if
+// requested, when the Writer is created. Existing files are reused without
+// losing their data, so an interrupted save can be continued by writing the
+// missing pieces with a new Writer, which can find the pieces which were
+// already written using the Resume or Have options.
+type Writer struct {
+	f     *Metainfo
+	s     *Storage
+	opts  SaveOptions
+	files []File   // files of the torrent
+	paths []string // final paths of the files
+
+	needed  bitfield.Bitfield // pieces spanning the selected files
+	written bitfield.Bitfield // pieces which have been written
+	total   int64             // number of bytes in the needed pieces
+	n       int64             // number of bytes written
+	next    int               // next file to be reported as complete
+}
+
+// NewWriter creates a Writer which saves the torrent into the directory
+// dst, like SaveWith. The progress callbacks of the options are called as
+// pieces are written. Files are reported as complete in order, once they
+// and all the files before them are complete.
+func (f *Metainfo) NewWriter(dst string, opts SaveOptions) (*Writer, error) {
+	s := f.StorageWith(dst, opts.Remap)
+	s.preallocate = opts.Preallocate
+	if err := f.selectFiles(s, opts); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		f:       f,
+		s:       s,
+		opts:    opts,
+		files:   f.Files(),
+		paths:   make([]string, len(s.files)),
+		needed:  bitfield.Empty(f.PieceCount()),
+		written: bitfield.Empty(f.PieceCount()),
+	}
+
+	for i, file := range s.files {
+		w.paths[i] = file.path
+		if opts.Atomic {
+			file.path += PartSuffix
+		}
+	}
+
+	for i := 0; i < f.PieceCount(); i++ {
+		if length := s.pieceLength(i); s.spans(i, length) {
+			w.needed.Set(i)
+			w.total += int64(length)
+		}
+	}
+
+	if err := s.Init(); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	for i := 0; i < f.PieceCount(); i++ {
+		if w.needed.Has(i) && opts.Have.Has(i) {
+			w.done(i)
+		}
+	}
+
+	if opts.Resume {
+		w.resume()
+	}
+
+	w.complete()
+	return w, nil
+}
+
+// WritePiece writes the piece with the provided index into the files it
+// spans. Parts of the piece belonging to files which are not selected are
+// discarded. The piece's hash is not checked.
+func (w *Writer) WritePiece(i int, piece []byte) error {
+	if i < 0 || i >= w.f.PieceCount() {
+		return fmt.Errorf("file: piece index %v out of range", i)
+	}
+
+	if length := w.s.pieceLength(i); len(piece) != length {
+		return fmt.Errorf("file: piece %v has length %v, expected %v", i, len(piece), length)
+	}
+
+	if err := w.s.Put(i, piece); err != nil {
+		return err
+	}
+
+	if !w.needed.Has(i) || w.written.Has(i) {
+		return nil
+	}
+
+	w.done(i)
+	w.complete()
+	return nil
+}
+
+// done marks the needed piece with the provided index as written, and
+// reports the progress.
+func (w *Writer) done(i int) {
+	w.written.Set(i)
+	w.n += int64(w.s.pieceLength(i))
+	if w.opts.OnPiece != nil {
+		w.opts.OnPiece(i, w.n, w.total)
+	}
+}
+
+// resume hash-checks the needed pieces in the existing files, and marks
+// the valid ones as written.
+func (w *Writer) resume() {
+	hashes := w.f.Info.Pieces
+	for i := 0; i < w.f.PieceCount(); i++ {
+		if !w.needed.Has(i) || w.written.Has(i) {
+			continue
+		}
+
+		piece, err := w.s.Get(i)
+		if err != nil {
+			continue
+		}
+
+		if sum := sha1.Sum(piece); string(sum[:]) == hashes[i*sha1.Size:(i+1)*sha1.Size] {
+			w.done(i)
+		}
+	}
+}
+
+// WriteAt writes b at the provided offset of the torrent, across the files
+// it spans, implementing io.WriterAt. Data written this way isn't tracked
+// as written pieces.
+func (w *Writer) WriteAt(b []byte, off int64) (int, error) {
+	return w.s.WriteAt(b, off)
+}
+
+// Needed returns the pieces which span the selected files, and need to be
+// written.
+func (w *Writer) Needed() bitfield.Bitfield {
+	return w.needed.Clone()
+}
+
+// Missing returns the needed pieces which haven't been written.
+func (w *Writer) Missing() bitfield.Bitfield {
+	missing := bitfield.Empty(w.f.PieceCount())
+	for i := 0; i < w.f.PieceCount(); i++ {
+		if w.needed.Has(i) && !w.written.Has(i) {
+			missing.Set(i)
+		}
+	}
+
+	return missing
+}
+
+// Complete reports whether all the needed pieces have been written.
+func (w *Writer) Complete() bool {
+	for i := 0; i < w.f.PieceCount(); i++ {
+		if w.needed.Has(i) && !w.written.Has(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Close closes the torrent's files. If all the needed pieces have been
+// written, atomically saved files are renamed to their final names, and
+// the md5 sums are checked if requested. Otherwise, the partially written
+// files are left in place, so that saving can be continued later.
+func (w *Writer) Close() error {
+	if w.opts.Sync {
+		if err := w.s.Sync(); err != nil {
+			w.s.Close()
+			return err
+		}
+	}
+
+	if err := w.s.Close(); err != nil {
+		return err
+	}
+
+	if !w.Complete() {
+		return nil
+	}
+
+	if w.opts.Atomic {
+		for i, file := range w.s.files {
+			if file.skip {
+				continue
+			}
+
+			if err := os.Rename(file.path, w.paths[i]); err != nil {
+				return err
+			}
+
+			file.path = w.paths[i]
+		}
+	}
+
+	if w.opts.CheckMD5 {
+		return w.f.checkMD5(w.s)
+	}
+
+	return nil
+}
+
+// abort closes the torrent's files, and removes them if they are being
+// saved atomically.
+func (w *Writer) abort() {
+	if w.opts.Atomic {
+		w.s.remove()
+		return
+	}
+
+	w.s.Close()
+}
+
+// complete reports the selected files which are complete, in order.
+func (w *Writer) complete() {
+	for ; w.next < len(w.files); w.next++ {
+		file := w.files[w.next]
+
+		// an empty file spans no pieces
+		if file.Length > 0 && !w.s.files[w.next].skip {
+			pieceLen := int64(w.s.pieceLen)
+			for i := file.Offset / pieceLen; i <= (file.Offset+file.Length-1)/pieceLen; i++ {
+				if !w.written.Has(int(i)) {
+					return
+				}
+			}
+		}
+
+		if w.opts.OnFile != nil && !w.s.files[w.next].skip {
+			w.opts.OnFile(file)
+		}
+	}
+}
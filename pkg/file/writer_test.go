@@ -0,0 +1,91 @@
+package file_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/file"
+)
+
+func TestWriter(t *testing.T) {
+	f, err := file.Open(strings.NewReader(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var completed []string
+	opts := file.SaveOptions{
+		OnFile: func(file file.File) {
+			completed = append(completed, strings.Join(file.Path, "/"))
+		},
+		Preallocate: true,
+		Atomic:      true,
+	}
+
+	dst := t.TempDir()
+	w, err := f.NewWriter(dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pieces are written out of order
+	if err := w.WritePiece(2, []byte("i")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePiece(1, []byte("ef")); err == nil {
+		t.Error("short piece written")
+	}
+	if err := w.WritePiece(1, []byte("efgh")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(completed) != 0 || w.Complete() {
+		t.Errorf("files completed before the first piece: %v", completed)
+	}
+
+	// interrupted saves leave the partial files in place
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "test", "dir", "b"+file.PartSuffix))
+	if err != nil || string(b) != "\x00efghi" {
+		t.Errorf("partial file is %q, %v", b, err)
+	}
+
+	// reopening the files keeps their data
+	w, err = f.NewWriter(dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = os.ReadFile(filepath.Join(dst, "test", "dir", "b"+file.PartSuffix))
+	if err != nil || string(b) != "\x00efghi" {
+		t.Errorf("reopened partial file is %q, %v", b, err)
+	}
+
+	for i, piece := range []string{"abcd", "efgh", "i"} {
+		if err := w.WritePiece(i, []byte(piece)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !w.Complete() {
+		t.Error("writer is incomplete")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(completed, " ") != "test/a test/empty test/dir/b" {
+		t.Errorf("files completed in order %v", completed)
+	}
+
+	b, err = os.ReadFile(filepath.Join(dst, "test", "dir", "b"))
+	if err != nil || string(b) != "defghi" {
+		t.Errorf("saved file is %q, %v", b, err)
+	}
+}
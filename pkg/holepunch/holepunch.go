@@ -0,0 +1,233 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package holepunch implements the ut_holepunch extension (BEP 55), which
+// lets two peers behind NATs connect to each other through a relay peer
+// which is connected to both of them.
+//
+// The messages are carried as extended messages (BEP 10) under the name
+// ExtensionName. This package provides the wire format, the relay's
+// decision, and the connection attempts of the peers. The extension isn't
+// advertised or dispatched by packages peer and torrent yet, which is left
+// for when peers can be dialed through a relay.
+package holepunch
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ExtensionName is the name of the extension in the extended handshake.
+const ExtensionName = "ut_holepunch"
+
+// Type represents the various holepunch message types.
+type Type byte
+
+// various holepunch message types.
+const (
+	Rendezvous Type = 0 // initiator asks the relay to connect it to a peer
+	Connect    Type = 1 // relay asks the peers to connect to each other
+	Error      Type = 2 // relay couldn't complete the rendezvous
+)
+
+var types = [...]string{
+	Rendezvous: "rendezvous",
+	Connect:    "connect",
+	Error:      "error",
+}
+
+// String converts a Type into a readable string.
+func (t Type) String() string {
+	if int(t) < len(types) {
+		return types[t]
+	}
+
+	return fmt.Sprintf("type(%d)", t)
+}
+
+// ErrorCode represents the reason a rendezvous failed.
+type ErrorCode uint32
+
+// various holepunch error codes.
+const (
+	NoSuchPeer   ErrorCode = 1 // the target is not in the relay's swarm
+	NotConnected ErrorCode = 2 // the relay is not connected to the target
+	NoSupport    ErrorCode = 3 // the target doesn't support holepunching
+	NoSelf       ErrorCode = 4 // the target is the initiator
+)
+
+var codes = [...]string{
+	NoSuchPeer:   "no such peer",
+	NotConnected: "not connected",
+	NoSupport:    "no support",
+	NoSelf:       "no self",
+}
+
+// Error implements the error interface.
+func (e ErrorCode) Error() string {
+	if 0 < e && int(e) < len(codes) {
+		return "holepunch: " + codes[e]
+	}
+
+	return fmt.Sprintf("holepunch: error code %d", uint32(e))
+}
+
+// address types
+const (
+	addrIPv4 = 0
+	addrIPv6 = 1
+)
+
+// Message represents a ut_holepunch message.
+type Message struct {
+	Type Type         // message type
+	Addr *net.TCPAddr // address of the target peer
+	Err  ErrorCode    // reason of failure, for Error messages
+}
+
+// Serialize serializes a message into a byte slice.
+// [type] [addr type] [addr] [port] [err code]
+func (m *Message) Serialize() []byte {
+	addrType, ip := byte(addrIPv4), m.Addr.IP.To4()
+	if ip == nil {
+		addrType, ip = addrIPv6, m.Addr.IP.To16()
+	}
+
+	buf := make([]byte, 2+len(ip)+2+4)
+	buf[0] = byte(m.Type)
+	buf[1] = addrType
+	copy(buf[2:], ip)
+	binary.BigEndian.PutUint16(buf[2+len(ip):], uint16(m.Addr.Port))
+	binary.BigEndian.PutUint32(buf[4+len(ip):], uint32(m.Err))
+
+	return buf
+}
+
+// Parse parses a serialized ut_holepunch message.
+func Parse(b []byte) (*Message, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("holepunch: message too short with length %v", len(b))
+	}
+
+	var ipLen int
+	switch b[1] {
+	case addrIPv4:
+		ipLen = net.IPv4len
+	case addrIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, fmt.Errorf("holepunch: invalid address type %v", b[1])
+	}
+
+	if len(b) != 2+ipLen+2+4 {
+		return nil, fmt.Errorf("holepunch: invalid message length %v", len(b))
+	}
+
+	m := &Message{
+		Type: Type(b[0]),
+		Addr: &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, b[2:2+ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(b[2+ipLen:])),
+		},
+		Err: ErrorCode(binary.BigEndian.Uint32(b[4+ipLen:])),
+	}
+
+	if m.Type > Error {
+		return nil, fmt.Errorf("holepunch: invalid message type %v", m.Type)
+	}
+
+	return m, nil
+}
+
+// Target represents a peer of the relay's swarm, as seen by the relay.
+type Target struct {
+	Connected bool // whether the relay is connected to the peer
+	Supported bool // whether the peer supports the extension
+}
+
+// Relay handles a Rendezvous message received from the initiator at the
+// provided address. lookup reports the state of a peer in the relay's
+// swarm, and whether the peer is known at all.
+//
+// If the rendezvous is possible, a Connect message for the initiator and
+// one for the target is returned. Otherwise, an Error message for the
+// initiator is returned, and toTarget is nil.
+func Relay(from *net.TCPAddr, msg *Message, lookup func(*net.TCPAddr) (Target, bool)) (toInitiator, toTarget *Message) {
+	fail := func(code ErrorCode) (*Message, *Message) {
+		return &Message{Type: Error, Addr: msg.Addr, Err: code}, nil
+	}
+
+	if msg.Addr.IP.Equal(from.IP) && msg.Addr.Port == from.Port {
+		return fail(NoSelf)
+	}
+
+	target, ok := lookup(msg.Addr)
+	switch {
+	case !ok:
+		return fail(NoSuchPeer)
+	case !target.Connected:
+		return fail(NotConnected)
+	case !target.Supported:
+		return fail(NoSupport)
+	}
+
+	return &Message{Type: Connect, Addr: msg.Addr}, &Message{Type: Connect, Addr: from}
+}
+
+// DefaultPunchTime is the default amount of time spent trying to connect
+// to a peer after receiving a Connect message.
+const DefaultPunchTime = 10 * time.Second
+
+// punchInterval is the time between connection attempts.
+const punchInterval = 500 * time.Millisecond
+
+// Punch tries to connect to the peer at the provided address after a
+// Connect message has been received. Since both peers connect to each
+// other at the same time, the connection is retried until the NAT mapping
+// opens up, or the context is done. Attempts are abandoned after
+// DefaultPunchTime if the context has no deadline.
+//
+// Simultaneous open only works through a NAT if the connection is dialed
+// from the port we listen on, so the dialer should bind its LocalAddr with
+// SO_REUSEPORT, like the one returned by peer.Config.NetDialer with
+// ReusePort set. A nil dialer dials from an ephemeral port.
+func Punch(ctx context.Context, dialer *net.Dialer, addr *net.TCPAddr) (net.Conn, error) {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultPunchTime)
+		defer cancel()
+	}
+
+	for {
+		attempt, cancel := context.WithTimeout(ctx, punchInterval)
+		conn, err := dialer.DialContext(attempt, "tcp", addr.String())
+		cancel()
+
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("holepunch: connecting to %s: %w", addr, err)
+		case <-time.After(punchInterval / 2):
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package holepunch_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/holepunch"
+)
+
+func TestSerialize(t *testing.T) {
+	tests := []struct {
+		msg  *holepunch.Message
+		wire []byte
+	}{
+		{
+			&holepunch.Message{
+				Type: holepunch.Rendezvous,
+				Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881},
+			},
+			[]byte{0, 0, 10, 0, 0, 1, 0x1a, 0xe1, 0, 0, 0, 0},
+		},
+		{
+			&holepunch.Message{
+				Type: holepunch.Error,
+				Addr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1},
+				Err:  holepunch.NotConnected,
+			},
+			[]byte{2, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 2},
+		},
+	}
+
+	for _, test := range tests {
+		wire := test.msg.Serialize()
+		if !bytes.Equal(wire, test.wire) {
+			t.Errorf("serialized %v, expected %v", wire, test.wire)
+		}
+
+		msg, err := holepunch.Parse(wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type != test.msg.Type || msg.Err != test.msg.Err || msg.Addr.String() != test.msg.Addr.String() {
+			t.Errorf("parsed %+v, expected %+v", msg, test.msg)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, wire := range [][]byte{
+		{},
+		{0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 10, 0, 0, 1, 0x1a, 0xe1, 0, 0, 0},
+		{3, 0, 10, 0, 0, 1, 0x1a, 0xe1, 0, 0, 0, 0},
+	} {
+		if _, err := holepunch.Parse(wire); err == nil {
+			t.Errorf("parsed invalid message %v", wire)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	initiator := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	target := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+
+	tests := []struct {
+		addr   *net.TCPAddr
+		state  holepunch.Target
+		known  bool
+		expect holepunch.ErrorCode
+	}{
+		{target, holepunch.Target{Connected: true, Supported: true}, true, 0},
+		{initiator, holepunch.Target{Connected: true, Supported: true}, true, holepunch.NoSelf},
+		{target, holepunch.Target{}, false, holepunch.NoSuchPeer},
+		{target, holepunch.Target{Supported: true}, true, holepunch.NotConnected},
+		{target, holepunch.Target{Connected: true}, true, holepunch.NoSupport},
+	}
+
+	for _, test := range tests {
+		lookup := func(*net.TCPAddr) (holepunch.Target, bool) {
+			return test.state, test.known
+		}
+
+		msg := &holepunch.Message{Type: holepunch.Rendezvous, Addr: test.addr}
+		toInitiator, toTarget := holepunch.Relay(initiator, msg, lookup)
+
+		if test.expect != 0 {
+			if toInitiator.Type != holepunch.Error || toInitiator.Err != test.expect || toTarget != nil {
+				t.Errorf("relay returned %+v, %+v, expected error %v", toInitiator, toTarget, test.expect)
+			}
+			continue
+		}
+
+		if toInitiator.Type != holepunch.Connect || toInitiator.Addr != target {
+			t.Errorf("initiator sent %+v, expected connect to %v", toInitiator, target)
+		}
+
+		if toTarget == nil || toTarget.Type != holepunch.Connect || toTarget.Addr != initiator {
+			t.Errorf("target sent %+v, expected connect to %v", toTarget, initiator)
+		}
+	}
+}
+
+func TestPunch(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the connection is dialed from the dialer's local address
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := local.Addr().(*net.TCPAddr)
+	local.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := holepunch.Punch(context.Background(), &net.Dialer{LocalAddr: laddr}, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	remote := <-accepted
+	defer remote.Close()
+
+	if port := remote.RemoteAddr().(*net.TCPAddr).Port; port != laddr.Port {
+		t.Errorf("connection dialed from port %d, expected %d", port, laddr.Port)
+	}
+
+	// attempts stop when the context is done
+	ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := holepunch.Punch(ctx, nil, ln.Addr().(*net.TCPAddr)); err == nil {
+		t.Error("connected to a closed listener")
+	}
+}
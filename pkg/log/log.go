@@ -0,0 +1,151 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package log implements a minimal leveled logger with per-subsystem
+// scoping, which can be injected into the various parts of mtor.
+package log
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level represents the severity of a log message.
+type Level int
+
+// various log levels, in increasing order of severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levels = [...]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+// String converts a Level into a readable string.
+func (l Level) String() string {
+	if 0 <= l && l < Level(len(levels)) {
+		return levels[l]
+	}
+
+	return fmt.Sprintf("level(%d)", l)
+}
+
+// Logger is the interface implemented by values which can be used for
+// logging by mtor's subsystems.
+type Logger interface {
+	Debugf(format string, v ...any)
+	Infof(format string, v ...any)
+	Warnf(format string, v ...any)
+	Errorf(format string, v ...any)
+
+	// Scope returns a Logger for the named subsystem. Scopes nest, so
+	// scoping a scoped logger appends to its existing scope.
+	Scope(name string) Logger
+}
+
+// Discard is a Logger which discards all messages.
+var Discard Logger = discard{}
+
+// OrDiscard returns l if it is not nil, and Discard otherwise.
+func OrDiscard(l Logger) Logger {
+	if l == nil {
+		return Discard
+	}
+
+	return l
+}
+
+// discard is the type of Discard.
+type discard struct{}
+
+func (discard) Debugf(string, ...any) {}
+func (discard) Infof(string, ...any)  {}
+func (discard) Warnf(string, ...any)  {}
+func (discard) Errorf(string, ...any) {}
+
+func (d discard) Scope(string) Logger { return d }
+
+// New creates a Logger which writes messages with a severity of at least
+// level to w. Each message is written on its own line in the format:
+// <time> <level> [<scope>] <message>
+func New(w io.Writer, level Level) Logger {
+	return &logger{
+		out:   &output{w: w},
+		level: level,
+	}
+}
+
+// output is a writer shared by a logger and all of its scopes.
+type output struct {
+	mu sync.Mutex // guards w
+	w  io.Writer  // destination writer
+}
+
+// logger is the Logger returned by New.
+type logger struct {
+	out   *output // shared output
+	level Level   // minimum level to log
+	scope string  // subsystem name
+}
+
+func (l *logger) Debugf(format string, v ...any) { l.logf(LevelDebug, format, v...) }
+func (l *logger) Infof(format string, v ...any)  { l.logf(LevelInfo, format, v...) }
+func (l *logger) Warnf(format string, v ...any)  { l.logf(LevelWarn, format, v...) }
+func (l *logger) Errorf(format string, v ...any) { l.logf(LevelError, format, v...) }
+
+// Scope returns a Logger for the named subsystem.
+func (l *logger) Scope(name string) Logger {
+	scope := name
+	if l.scope != "" {
+		scope = l.scope + "." + name
+	}
+
+	return &logger{
+		out:   l.out,
+		level: l.level,
+		scope: scope,
+	}
+}
+
+// logf formats and writes a message with the provided level.
+func (l *logger) logf(level Level, format string, v ...any) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(time.Now().Format("2006/01/02 15:04:05 "))
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+
+	if l.scope != "" {
+		b.WriteString("[" + l.scope + "] ")
+	}
+
+	fmt.Fprintf(&b, format, v...)
+	b.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	io.WriteString(l.out.w, b.String())
+}
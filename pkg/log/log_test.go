@@ -0,0 +1,68 @@
+package log_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/log"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.New(&buf, log.LevelWarn)
+
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	l.Warnf("warn %d", 3)
+	l.Errorf("error %d", 4)
+
+	// messages below the level are dropped
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, expected 2 lines", buf.String())
+	}
+
+	for i, expected := range []string{"WARN warn 3", "ERROR error 4"} {
+		if !strings.HasSuffix(lines[i], expected) {
+			t.Errorf("logged %q, expected it to end with %q", lines[i], expected)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.New(&buf, log.LevelDebug)
+
+	// scopes nest, and share the output of the logger
+	l.Scope("download").Scope("tracker").Infof("announced")
+	l.Infof("unscoped")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, expected 2 lines", buf.String())
+	}
+
+	if !strings.HasSuffix(lines[0], "INFO [download.tracker] announced") {
+		t.Errorf("scoped logger logged %q", lines[0])
+	}
+
+	if strings.Contains(lines[1], "[") || !strings.HasSuffix(lines[1], "INFO unscoped") {
+		t.Errorf("unscoped logger logged %q", lines[1])
+	}
+}
+
+func TestOrDiscard(t *testing.T) {
+	if l := log.OrDiscard(nil); l != log.Discard {
+		t.Errorf("nil logger replaced by %v", l)
+	}
+
+	// discarded messages and scopes are no-ops
+	log.OrDiscard(nil).Scope("peer").Errorf("dropped")
+
+	var buf bytes.Buffer
+	l := log.New(&buf, log.LevelInfo)
+	if log.OrDiscard(l) != l {
+		t.Error("logger replaced by OrDiscard")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "io"
+
+// Codec reads and writes the framed messages of a connection with a peer,
+// so that transports which frame messages differently can replace the
+// standard framing without changing the consumers of the messages. A nil
+// Message is a keep-alive.
+type Codec interface {
+	ReadMessage() (*Message, error)
+	WriteMessage(msg *Message) error
+}
+
+// StreamCodec is the Codec of the standard framing of messages over a
+// stream, like a tcp or an encrypted connection, where each message is
+// prefixed by its length.
+type StreamCodec struct {
+	R io.Reader // stream which messages are read from
+	W io.Writer // stream which messages are written to
+
+	// MaxLength is the maximum length of the messages which are read, which
+	// defaults to DefaultMaxLength.
+	MaxLength int
+}
+
+// NewStreamCodec creates a new StreamCodec which reads messages from and
+// writes messages to the provided stream.
+func NewStreamCodec(rw io.ReadWriter) *StreamCodec {
+	return &StreamCodec{R: rw, W: rw}
+}
+
+// ReadMessage reads a message from the stream, like ReadLimit.
+func (c *StreamCodec) ReadMessage() (*Message, error) {
+	return ReadLimit(c.R, nil, c.MaxLength)
+}
+
+// WriteMessage writes a message to the stream, like WriteTo.
+func (c *StreamCodec) WriteMessage(msg *Message) error {
+	_, err := msg.WriteTo(c.W)
+	return err
+}
@@ -0,0 +1,39 @@
+package message_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+func TestStreamCodec(t *testing.T) {
+	var buf bytes.Buffer
+	codec := message.NewStreamCodec(&buf)
+
+	msgs := []*message.Message{message.NewHave(1), nil, message.NewPiece(1, 0, []byte("block"))}
+	for _, msg := range msgs {
+		if err := codec.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range msgs {
+		msg, err := codec.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.String() != expected.String() {
+			t.Errorf("read %v, expected %v", msg, expected)
+		}
+	}
+
+	// the maximum length is enforced
+	codec.MaxLength = 4
+	codec.WriteMessage(message.NewHave(1))
+	if _, err := codec.ReadMessage(); !errors.Is(err, message.ErrMessageTooLarge) {
+		t.Errorf("read message longer than the limit with error %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"fmt"
+	"net"
+
+	"laptudirm.com/x/mtor/pkg/bencode"
+)
+
+// ExtendedHandshakeID is the extended message id of the extended handshake.
+const ExtendedHandshakeID = 0
+
+// ExtendedHandshake represents the payload of an extended handshake (BEP
+// 10), which advertises the extensions supported by its sender.
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`                       // extended message ids
+	V            string         `bencode:"v,omitempty"`             // client name and version
+	Reqq         int            `bencode:"reqq,omitempty"`          // max outstanding requests
+	YourIP       string         `bencode:"yourip,omitempty"`        // receiver's compact ip
+	MetadataSize int            `bencode:"metadata_size,omitempty"` // length of the info dict
+}
+
+// NewExtendedHandshake formats the provided extended handshake into an
+// Extended Message value.
+func NewExtendedHandshake(h *ExtendedHandshake) (*Message, error) {
+	// the m dictionary is required, even if it is empty
+	if h.M == nil {
+		c := *h
+		c.M = map[string]int{}
+		h = &c
+	}
+
+	payload, err := bencode.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewExtended(ExtendedHandshakeID, payload), nil
+}
+
+// ParseExtendedHandshake parses an extended handshake Message.
+func ParseExtendedHandshake(msg *Message) (*ExtendedHandshake, error) {
+	extID, payload, err := ParseExtended(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if extID != ExtendedHandshakeID {
+		return nil, fmt.Errorf("expected extended handshake, received extended message %v", extID)
+	}
+
+	var h ExtendedHandshake
+	if err := bencode.Unmarshal(payload, &h); err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+// Lookup returns the extended message id which the sender of the handshake
+// assigned to the provided extension, and whether it supports it.
+func (h *ExtendedHandshake) Lookup(name string) (byte, bool) {
+	id, ok := h.M[name]
+	if !ok || id <= 0 || id > 255 {
+		return 0, false
+	}
+
+	return byte(id), true
+}
+
+// Merge updates the provided extended message ids with the ones in the
+// handshake, since later handshakes update the earlier ones, and returns
+// them. Extensions whose id is 0 are disabled, and removed from the ids.
+// If ids is nil, a new map is allocated.
+func (h *ExtendedHandshake) Merge(ids map[string]int) map[string]int {
+	if ids == nil {
+		ids = make(map[string]int, len(h.M))
+	}
+
+	for name := range h.M {
+		if id, ok := h.Lookup(name); ok {
+			ids[name] = int(id)
+		} else {
+			delete(ids, name)
+		}
+	}
+
+	return ids
+}
+
+// SetYourIP sets the receiver's ip address in the handshake, in its compact
+// form.
+func (h *ExtendedHandshake) SetYourIP(ip net.IP) {
+	if v4 := ip.To4(); v4 != nil {
+		h.YourIP = string(v4)
+	} else if v6 := ip.To16(); v6 != nil {
+		h.YourIP = string(v6)
+	}
+}
+
+// IP returns the receiver's ip address from the handshake, or nil if it
+// isn't provided, or isn't a valid compact ip address.
+func (h *ExtendedHandshake) IP() net.IP {
+	if len(h.YourIP) != net.IPv4len && len(h.YourIP) != net.IPv6len {
+		return nil
+	}
+
+	return net.IP(h.YourIP)
+}
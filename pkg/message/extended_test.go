@@ -0,0 +1,72 @@
+package message_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+func TestExtendedHandshake(t *testing.T) {
+	h := &message.ExtendedHandshake{
+		M:            map[string]int{"ut_metadata": 2, "ut_pex": 1},
+		V:            "mtor 0.1.0",
+		Reqq:         250,
+		MetadataSize: 31235,
+	}
+	h.SetYourIP(net.IPv4(10, 0, 0, 1))
+
+	msg, err := message.NewExtendedHandshake(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := message.ParseExtendedHandshake(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(parsed, h) {
+		t.Errorf("parsed handshake %+v, expected %+v", parsed, h)
+	}
+
+	if ip := parsed.IP(); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("parsed your ip %v", ip)
+	}
+
+	if id, ok := parsed.Lookup("ut_metadata"); !ok || id != 2 {
+		t.Errorf("ut_metadata has id %v, supported %v", id, ok)
+	}
+
+	if _, ok := parsed.Lookup("lt_donthave"); ok {
+		t.Error("unsupported extension found")
+	}
+
+	// the m dictionary is always sent
+	msg, err = message.NewExtendedHandshake(&message.ExtendedHandshake{})
+	if err != nil || string(msg.Payload) != "\x00d1:mdee" {
+		t.Errorf("empty handshake formatted as %q, error %v", msg.Payload, err)
+	}
+
+	// other extended messages aren't handshakes
+	if _, err := message.ParseExtendedHandshake(message.NewExtended(1, []byte("de"))); err == nil {
+		t.Error("extended message 1 parsed as handshake")
+	}
+}
+
+func TestMergeExtensions(t *testing.T) {
+	ids := (&message.ExtendedHandshake{
+		M: map[string]int{"ut_metadata": 2, "ut_pex": 1},
+	}).Merge(nil)
+
+	// later handshakes update and disable extensions
+	ids = (&message.ExtendedHandshake{
+		M: map[string]int{"ut_metadata": 3, "ut_pex": 0, "ut_holepunch": 4, "bad": 300},
+	}).Merge(ids)
+
+	expected := map[string]int{"ut_metadata": 3, "ut_holepunch": 4}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("merged ids %v, expected %v", ids, expected)
+	}
+}
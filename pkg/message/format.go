@@ -0,0 +1,90 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "fmt"
+
+// names maps the identifiers of the known messages to their names.
+var names = map[id]string{
+	Choke:         "Choke",
+	UnChoke:       "UnChoke",
+	Interested:    "Interested",
+	NotInterested: "NotInterested",
+	Have:          "Have",
+	Bitfield:      "Bitfield",
+	Request:       "Request",
+	Piece:         "Piece",
+	Cancel:        "Cancel",
+	Port:          "Port",
+	SuggestPiece:  "SuggestPiece",
+	HaveAll:       "HaveAll",
+	HaveNone:      "HaveNone",
+	RejectRequest: "RejectRequest",
+	AllowedFast:   "AllowedFast",
+	Extended:      "Extended",
+}
+
+// String returns the name of the message type, like "Request".
+func (i id) String() string {
+	if name, ok := names[i]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Unknown(%d)", byte(i))
+}
+
+// String formats the message for logs and traces, with its type and the
+// fields of its payload, like "Request idx=4 begin=16384 len=16384". A nil
+// Message is formatted as "KeepAlive", and the payloads of unknown or
+// invalid messages are shown by their length.
+func (m *Message) String() string {
+	if m == nil {
+		return "KeepAlive"
+	}
+
+	t, err := Parse(m)
+	if err != nil {
+		return fmt.Sprintf("%v len=%d", m.Identifier, len(m.Payload))
+	}
+
+	switch t := t.(type) {
+	case *HaveMsg:
+		return fmt.Sprintf("%v idx=%d", m.Identifier, t.Index)
+	case *SuggestPieceMsg:
+		return fmt.Sprintf("%v idx=%d", m.Identifier, t.Index)
+	case *AllowedFastMsg:
+		return fmt.Sprintf("%v idx=%d", m.Identifier, t.Index)
+	case *RequestMsg:
+		return formatBlock(m.Identifier, t.Index, t.Begin, t.Length)
+	case *CancelMsg:
+		return formatBlock(m.Identifier, t.Index, t.Begin, t.Length)
+	case *RejectRequestMsg:
+		return formatBlock(m.Identifier, t.Index, t.Begin, t.Length)
+	case *PieceMsg:
+		return formatBlock(m.Identifier, t.Index, t.Begin, len(t.Block))
+	case *BitfieldMsg:
+		return fmt.Sprintf("%v len=%d", m.Identifier, len(t.Bits))
+	case *PortMsg:
+		return fmt.Sprintf("%v port=%d", m.Identifier, t.Port)
+	case *ExtendedMsg:
+		return fmt.Sprintf("%v id=%d len=%d", m.Identifier, t.ID, len(t.Payload))
+	default:
+		return m.Identifier.String()
+	}
+}
+
+// formatBlock formats a message whose payload identifies a block.
+func formatBlock(identifier id, index, begin, length int) string {
+	return fmt.Sprintf("%v idx=%d begin=%d len=%d", identifier, index, begin, length)
+}
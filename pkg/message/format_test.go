@@ -0,0 +1,37 @@
+package message_test
+
+import (
+	"fmt"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+func TestString(t *testing.T) {
+	var keepAlive *message.Message
+
+	for _, c := range []struct {
+		msg      *message.Message
+		expected string
+	}{
+		{keepAlive, "KeepAlive"},
+		{&message.Message{Identifier: message.UnChoke}, "UnChoke"},
+		{message.NewHave(4), "Have idx=4"},
+		{message.NewRequest(4, 16384, 16384), "Request idx=4 begin=16384 len=16384"},
+		{message.NewRejectRequest(1, 0, 10), "RejectRequest idx=1 begin=0 len=10"},
+		{(&message.PieceMsg{Index: 2, Begin: 8, Block: make([]byte, 5)}).Encode(), "Piece idx=2 begin=8 len=5"},
+		{&message.Message{Identifier: message.Bitfield, Payload: []byte{0xff, 0}}, "Bitfield len=2"},
+		{message.NewPort(6881), "Port port=6881"},
+		{message.NewExtended(3, []byte("de")), "Extended id=3 len=2"},
+		{&message.Message{Identifier: message.Have, Payload: []byte{1}}, "Have len=1"},
+		{&message.Message{Identifier: 42, Payload: []byte{1, 2}}, "Unknown(42) len=2"},
+	} {
+		if s := fmt.Sprint(c.msg); s != c.expected {
+			t.Errorf("message formatted as %q, expected %q", s, c.expected)
+		}
+	}
+
+	if s := fmt.Sprint(message.AllowedFast); s != "AllowedFast" {
+		t.Errorf("message id formatted as %q", s)
+	}
+}
@@ -14,6 +14,7 @@
 package message
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
@@ -21,6 +22,63 @@ import (
 // ProtocolName is the protocol the client is following.
 const ProtocolName = "BitTorrent protocol"
 
+// HandshakeLength is the length of a serialized bittorrent handshake.
+const HandshakeLength = 1 + len(ProtocolName) + 48
+
+// ErrNotBitTorrent is returned when a handshake isn't for the bittorrent
+// protocol, like when something else connects to our port.
+var ErrNotBitTorrent = errors.New("not a bittorrent handshake")
+
+// InfoHashError is returned when a handshake is for a different torrent
+// than the expected one.
+type InfoHashError struct {
+	InfoHash [20]byte // infohash of the handshake
+}
+
+func (e *InfoHashError) Error() string {
+	return fmt.Sprintf("invalid infohash %x", e.InfoHash)
+}
+
+// Capabilities is a set of protocol extensions, which peers advertise using
+// the reserved bits of their handshakes.
+type Capabilities uint8
+
+// protocol extensions
+const (
+	CapDHT      Capabilities = 1 << iota // dht port messages (BEP 5)
+	CapFast                              // fast extension (BEP 6)
+	CapExtended                          // extension protocol (BEP 10)
+)
+
+// reserved bits of the extensions, as byte index and mask
+var reservedBits = []struct {
+	cap  Capabilities
+	byte int
+	mask byte
+}{
+	{CapDHT, 7, 0x01},
+	{CapFast, 7, 0x04},
+	{CapExtended, 5, 0x10},
+}
+
+// ParseReserved returns the extensions advertised by the provided reserved
+// bytes of a handshake. Unknown bits are ignored.
+func ParseReserved(reserved [8]byte) Capabilities {
+	var c Capabilities
+	for _, bit := range reservedBits {
+		if reserved[bit.byte]&bit.mask != 0 {
+			c |= bit.cap
+		}
+	}
+
+	return c
+}
+
+// Has checks if c contains all the extensions in d.
+func (c Capabilities) Has(d Capabilities) bool {
+	return c&d == d
+}
+
 // Handshake represents an initial handshake message.
 type Handshake struct {
 	Protocol   string   // protocol understood by the sender
@@ -48,72 +106,103 @@ func (h *Handshake) Serialize() []byte {
 }
 
 // Verify verifies the handshake, checking if the protocol and hash values
-// are equal.
+// are equal. It returns an error wrapping ErrNotBitTorrent if the protocol
+// isn't bittorrent, and an *InfoHashError if the infohash doesn't match.
 func (h *Handshake) Verify(hash [20]byte) error {
 	switch {
 	case h.Protocol != ProtocolName:
-		return fmt.Errorf("invalid protocol %v", h.Protocol)
+		return fmt.Errorf("%w: protocol %q", ErrNotBitTorrent, h.Protocol)
 	case h.InfoHash != hash:
-		return fmt.Errorf("invalid infohash %x", h.InfoHash)
+		return &InfoHashError{InfoHash: h.InfoHash}
 	default:
 		return nil
 	}
 }
 
+// Capabilities returns the extensions advertised by the reserved bits of
+// the handshake.
+func (h *Handshake) Capabilities() Capabilities {
+	return ParseReserved(h.Reserved)
+}
+
+// SetCapabilities sets the reserved bits of the provided extensions in the
+// handshake, leaving the other bits as they are.
+func (h *Handshake) SetCapabilities(c Capabilities) {
+	for _, bit := range reservedBits {
+		if c.Has(bit.cap) {
+			h.Reserved[bit.byte] |= bit.mask
+		}
+	}
+}
+
+// SupportsDHT checks if the sender of the handshake supports dht port
+// messages (BEP 5).
+func (h *Handshake) SupportsDHT() bool {
+	return h.Capabilities().Has(CapDHT)
+}
+
+// SupportsFast checks if the sender of the handshake supports the fast
+// extension (BEP 6).
+func (h *Handshake) SupportsFast() bool {
+	return h.Capabilities().Has(CapFast)
+}
+
+// SupportsExtended checks if the sender of the handshake supports the
+// extension protocol (BEP 10).
+func (h *Handshake) SupportsExtended() bool {
+	return h.Capabilities().Has(CapExtended)
+}
+
 // NewHandshake creates a new Handshake value with the provided identifier
-// and infohash.
+// and infohash, which advertises support for the fast extension and the
+// extension protocol.
 func NewHandshake(hash, name [20]byte) *Handshake {
-	return &Handshake{
+	h := &Handshake{
 		Protocol:   ProtocolName,
-		Reserved:   [8]byte{},
 		InfoHash:   hash,
 		Identifier: name,
 	}
+
+	h.SetCapabilities(CapFast | CapExtended)
+	return h
 }
 
-// ReadHandshake reads a serialized Handshake from an io.Reader.
+// ReadHandshake reads a serialized bittorrent Handshake from an io.Reader.
+// Handshakes of other protocols are rejected with ErrNotBitTorrent as soon
+// as their protocol is read, so at most HandshakeLength bytes are ever read
+// from the reader, and garbage connections are dropped cheaply.
 func ReadHandshake(r io.Reader) (*Handshake, error) {
-	// read protocol length
-	lenBuf := make([]byte, 1)
-	_, err := io.ReadFull(r, lenBuf)
-	if err != nil {
+	buf := make([]byte, HandshakeLength)
+
+	// read protocol length and name
+	// [length] [protocol]
+	protocol := buf[:1+len(ProtocolName)]
+	if _, err := io.ReadFull(r, protocol[:1]); err != nil {
 		return nil, err
 	}
-	length := lenBuf[0]
 
-	// read protocol name
-	protocolbuf := make([]byte, length)
-	_, err = io.ReadFull(r, protocolbuf)
-	if err != nil {
-		return nil, err
+	if int(protocol[0]) != len(ProtocolName) {
+		return nil, fmt.Errorf("%w: protocol length %d", ErrNotBitTorrent, protocol[0])
 	}
-	protocol := string(protocolbuf)
 
-	// read reserved bytes
-	var reservedBytes [8]byte
-	_, err = io.ReadFull(r, reservedBytes[:])
-	if err != nil {
+	if _, err := io.ReadFull(r, protocol[1:]); err != nil {
 		return nil, err
 	}
 
-	// read infohash
-	var hashBytes [20]byte
-	_, err = io.ReadFull(r, hashBytes[:])
-	if err != nil {
-		return nil, err
+	if string(protocol[1:]) != ProtocolName {
+		return nil, fmt.Errorf("%w: protocol %q", ErrNotBitTorrent, protocol[1:])
 	}
 
-	// read identifier
-	var idBytes [20]byte
-	_, err = io.ReadFull(r, idBytes[:])
-	if err != nil {
+	// read reserved bytes, infohash and identifier
+	// [reserved] [infohash] [id]
+	rest := buf[len(protocol):]
+	if _, err := io.ReadFull(r, rest); err != nil {
 		return nil, err
 	}
 
-	return &Handshake{
-		Protocol:   protocol,
-		Reserved:   reservedBytes,
-		InfoHash:   hashBytes,
-		Identifier: idBytes,
-	}, nil
+	h := &Handshake{Protocol: ProtocolName}
+	copy(h.Reserved[:], rest[:8])
+	copy(h.InfoHash[:], rest[8:28])
+	copy(h.Identifier[:], rest[28:48])
+	return h, nil
 }
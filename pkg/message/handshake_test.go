@@ -0,0 +1,83 @@
+package message_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+func TestReadHandshake(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+	data := message.NewHandshake(hash, [20]byte{'p'}).Serialize()
+
+	if len(data) != message.HandshakeLength {
+		t.Errorf("serialized handshake of length %d", len(data))
+	}
+
+	h, err := message.ReadHandshake(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Verify(hash); err != nil || h.Identifier != [20]byte{'p'} {
+		t.Errorf("handshake read as %+v, error %v", h, err)
+	}
+
+	// handshakes for other torrents fail verification
+	var hashErr *message.InfoHashError
+	if err := h.Verify([20]byte{9}); !errors.As(err, &hashErr) || hashErr.InfoHash != hash {
+		t.Errorf("verified with wrong infohash, error %v", err)
+	}
+
+	// garbage is rejected after its first byte
+	r := strings.NewReader("GET / HTTP/1.1\r\n\r\n")
+	if _, err := message.ReadHandshake(r); !errors.Is(err, message.ErrNotBitTorrent) {
+		t.Errorf("read http request with error %v", err)
+	}
+	if read := r.Size() - int64(r.Len()); read != 1 {
+		t.Errorf("read %d bytes of garbage", read)
+	}
+
+	// other protocols of the same length are rejected
+	other := append([]byte{}, data...)
+	copy(other[1:], "Bittorrent protocol")
+	if _, err := message.ReadHandshake(bytes.NewReader(other)); !errors.Is(err, message.ErrNotBitTorrent) {
+		t.Errorf("read other protocol with error %v", err)
+	}
+
+	// truncated handshakes fail
+	if _, err := message.ReadHandshake(bytes.NewReader(data[:40])); err != io.ErrUnexpectedEOF {
+		t.Errorf("read truncated handshake with error %v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	h := message.NewHandshake([20]byte{1}, [20]byte{2})
+	if h.Reserved != [8]byte{5: 0x10, 7: 0x04} {
+		t.Errorf("handshake reserved bits %v", h.Reserved)
+	}
+
+	if !h.SupportsFast() || !h.SupportsExtended() || h.SupportsDHT() {
+		t.Errorf("handshake advertises %b", h.Capabilities())
+	}
+
+	// setting capabilities keeps the other bits
+	h.Reserved[0] = 0x80
+	h.SetCapabilities(message.CapDHT)
+	if h.Reserved != [8]byte{0: 0x80, 5: 0x10, 7: 0x05} {
+		t.Errorf("handshake reserved bits %v", h.Reserved)
+	}
+
+	if c := h.Capabilities(); !c.Has(message.CapDHT | message.CapFast | message.CapExtended) {
+		t.Errorf("handshake advertises %b", c)
+	}
+
+	// unknown bits are ignored
+	if c := message.ParseReserved([8]byte{0: 0xff, 7: 0xf0}); c != 0 {
+		t.Errorf("unknown bits parsed as %b", c)
+	}
+}
@@ -15,8 +15,12 @@ package message
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"sync"
 )
 
 // id represents the various message types.
@@ -33,48 +37,172 @@ const (
 	Request       id = 6
 	Piece         id = 7
 	Cancel        id = 8
+
+	// dht, see BEP 5
+	Port id = 9
+
+	// fast extension, see BEP 6
+	SuggestPiece  id = 13
+	HaveAll       id = 14
+	HaveNone      id = 15
+	RejectRequest id = 16
+	AllowedFast   id = 17
+
+	// extension protocol, see BEP 10
+	Extended id = 20
 )
 
+// DefaultMaxLength is the default maximum length of the messages which are
+// read, which fits blocks of up to 128 kb, much larger than the usual 16 kb
+// blocks, and the bitfields of torrents with up to a million pieces.
+const DefaultMaxLength = 1<<17 + 9 // [id] [index] [begin] [128 kb block]
+
+// ErrMessageTooLarge is returned when a message is longer than the maximum
+// length, which protects readers from allocating huge buffers for bogus
+// length prefixes.
+var ErrMessageTooLarge = errors.New("message too large")
+
 // Message represents a bittorrent p2p message.
 type Message struct {
 	Identifier id     // message identifier
 	Payload    []byte // message payload
 }
 
+// HeaderLength is the length of the header of a message, which is its
+// length prefix and identifier.
+const HeaderLength = 5
+
+// headerPool pools the scratch buffers which headers are written into.
+var headerPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 64*HeaderLength)
+		return &b
+	},
+}
+
 // Serialize serializes a message into a byte slice.
 // [length] [id] [payload]
 func (m *Message) Serialize() []byte {
+	var header [HeaderLength]byte
+	n := m.PutHeader(header[:])
+
+	msg := make([]byte, n, n+m.payloadLength())
+	copy(msg, header[:n])
+	if m != nil {
+		msg = append(msg, m.Payload...)
+	}
+
+	return msg
+}
+
+// PutHeader writes the header of the message into b, which must be at least
+// HeaderLength bytes long, and returns the length of the header. The header
+// of a nil Message, which is a keep-alive, is only a zero length prefix.
+// [length] [id]
+func (m *Message) PutHeader(b []byte) int {
 	if m == nil {
-		return make([]byte, 4)
+		binary.BigEndian.PutUint32(b, 0)
+		return 4
 	}
 
-	length := uint32(len(m.Payload) + 1)
-	msg := make([]byte, length+4)
+	binary.BigEndian.PutUint32(b, uint32(len(m.Payload)+1))
+	b[4] = byte(m.Identifier)
+	return HeaderLength
+}
+
+// WriteTo writes the serialized message to w, implementing io.WriterTo.
+// Unlike writing the result of Serialize, the payload isn't copied into a
+// new buffer, and the header and payload are written in a single vectored
+// write where supported, like to a *net.TCPConn.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	return WriteBatch(w, m)
+}
 
-	binary.BigEndian.PutUint32(msg[:4], length)
-	msg[4] = byte(m.Identifier)
-	copy(msg[5:], m.Payload)
+// WriteBatch writes the provided messages to w at once, like a burst of
+// requests, using a single vectored write where supported, which reduces
+// the system calls needed to write many small messages. The payloads are
+// written without being copied. A nil Message is written as a keep-alive.
+func WriteBatch(w io.Writer, msgs ...*Message) (int64, error) {
+	p := headerPool.Get().(*[]byte)
+	defer headerPool.Put(p)
 
-	return msg
+	// grow the headers up front, so that the slices of it stay valid
+	if cap(*p) < len(msgs)*HeaderLength {
+		*p = make([]byte, 0, len(msgs)*HeaderLength)
+	}
+	headers := (*p)[:len(msgs)*HeaderLength]
+
+	bufs := make(net.Buffers, 0, 2*len(msgs))
+	for i, m := range msgs {
+		header := headers[i*HeaderLength : (i+1)*HeaderLength]
+
+		// [length] [id] [payload]
+		bufs = append(bufs, header[:m.PutHeader(header)])
+		if m.payloadLength() > 0 {
+			bufs = append(bufs, m.Payload)
+		}
+	}
+
+	return bufs.WriteTo(w)
+}
+
+// payloadLength returns the length of the message's payload.
+func (m *Message) payloadLength() int {
+	if m == nil {
+		return 0
+	}
+
+	return len(m.Payload)
 }
 
-// Read reads a serialized message from a io.Reader.
+// Read reads a serialized message from a io.Reader. Messages longer than
+// DefaultMaxLength fail with an error wrapping ErrMessageTooLarge.
 func Read(r io.Reader) (*Message, error) {
+	return ReadInto(r, nil)
+}
+
+// ReadInto is like Read, but the message is read into the provided buffer
+// if it is large enough, so that a buffer can be reused to read many
+// messages, like 16 kb blocks, without allocating. Otherwise, a new buffer
+// is allocated. The payload of the message shares the buffer, so it is only
+// valid until the buffer is reused.
+func ReadInto(r io.Reader, buf []byte) (*Message, error) {
+	return ReadLimit(r, buf, DefaultMaxLength)
+}
+
+// ReadLimit is like ReadInto, but messages longer than the provided maximum
+// length, or DefaultMaxLength if it isn't positive, fail with an error
+// wrapping ErrMessageTooLarge before they are read.
+func ReadLimit(r io.Reader, buf []byte, max int) (*Message, error) {
+	if max <= 0 {
+		max = DefaultMaxLength
+	}
+
 	// read length
-	lenBuf := make([]byte, 4) // 4 byte length prefix
-	_, err := io.ReadFull(r, lenBuf)
+	var lenBuf [4]byte // 4 byte length prefix
+	_, err := io.ReadFull(r, lenBuf[:])
 	if err != nil {
 		return nil, err
 	}
-	length := binary.BigEndian.Uint32(lenBuf)
+	length := binary.BigEndian.Uint32(lenBuf[:])
 
 	// keep-alive message
 	if length == 0 {
 		return nil, nil
 	}
 
+	if uint64(length) > uint64(max) {
+		return nil, fmt.Errorf("%w: length %v exceeds %v", ErrMessageTooLarge, length, max)
+	}
+
 	// read id and payload
-	msgBuf := make([]byte, length)
+	var msgBuf []byte
+	if uint64(length) <= uint64(cap(buf)) {
+		msgBuf = buf[:length]
+	} else {
+		msgBuf = make([]byte, length)
+	}
+
 	_, err = io.ReadFull(r, msgBuf)
 	if err != nil {
 		return nil, err
@@ -86,29 +214,200 @@ func Read(r io.Reader) (*Message, error) {
 	}, nil
 }
 
+// NewChoke formats a choke message into a Message value.
+func NewChoke() *Message {
+	return &Message{Identifier: Choke}
+}
+
+// NewUnChoke formats an unchoke message into a Message value.
+func NewUnChoke() *Message {
+	return &Message{Identifier: UnChoke}
+}
+
+// NewInterested formats an interested message into a Message value.
+func NewInterested() *Message {
+	return &Message{Identifier: Interested}
+}
+
+// NewNotInterested formats a not interested message into a Message value.
+func NewNotInterested() *Message {
+	return &Message{Identifier: NotInterested}
+}
+
+// NewBitfield formats a bitfield message into a Message value. The bits
+// aren't copied.
+func NewBitfield(bits []byte) *Message {
+	return &Message{Identifier: Bitfield, Payload: bits}
+}
+
 // NewRequest formats a request message into a Message value.
+func NewRequest(index, begin, length int) *Message {
+	return encodeBlock(Request, index, begin, length)
+}
+
+// NewReqest formats a request message into a Message value.
+//
+// Deprecated: Use NewRequest.
 func NewReqest(index, begin, length int) *Message {
-	payload := make([]byte, 12)
+	return NewRequest(index, begin, length)
+}
 
-	// [index] [begin] [length]
+// NewPiece formats a piece message with the provided block into a Message
+// value.
+func NewPiece(index, begin int, block []byte) *Message {
+	return (&PieceMsg{Index: index, Begin: begin, Block: block}).Encode()
+}
+
+// NewPieceBuffer formats a piece message with an empty block of the
+// provided length into a Message value, and returns the block, which is
+// part of the payload, so that it can be read into without being copied.
+func NewPieceBuffer(index, begin, length int) (*Message, []byte) {
+	payload := make([]byte, 8+length)
+
+	// [index] [begin] [block]
 	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
 	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
-	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
 
-	return &Message{
-		Identifier: Request,
-		Payload:    payload,
-	}
+	return &Message{Identifier: Piece, Payload: payload}, payload[8:]
+}
+
+// NewCancel formats a cancel message into a Message value.
+func NewCancel(index, begin, length int) *Message {
+	return encodeBlock(Cancel, index, begin, length)
+}
+
+// NewRejectRequest formats a reject request message into a Message value.
+func NewRejectRequest(index, begin, length int) *Message {
+	return encodeBlock(RejectRequest, index, begin, length)
+}
+
+// NewHave formats a have message into a Message value.
+func NewHave(index int) *Message {
+	return encodeIndex(Have, index)
+}
+
+// NewSuggestPiece formats a suggest piece message into a Message value.
+func NewSuggestPiece(index int) *Message {
+	return encodeIndex(SuggestPiece, index)
+}
+
+// NewAllowedFast formats an allowed fast message into a Message value.
+func NewAllowedFast(index int) *Message {
+	return encodeIndex(AllowedFast, index)
+}
+
+// NewHaveAll formats a have all message into a Message value.
+func NewHaveAll() *Message {
+	return &Message{Identifier: HaveAll}
+}
+
+// NewHaveNone formats a have none message into a Message value.
+func NewHaveNone() *Message {
+	return &Message{Identifier: HaveNone}
+}
+
+// NewPort formats a port message, which advertises the port of our dht
+// node, into a Message value.
+func NewPort(port uint16) *Message {
+	return (&PortMsg{Port: port}).Encode()
+}
+
+// ParsePort parses a Port Message to get the port of the peer's dht node.
+func ParsePort(msg *Message) (uint16, error) {
+	var m PortMsg
+	err := m.Decode(msg)
+	return m.Port, err
+}
+
+// NewExtended formats an extended message with the provided extended
+// message id and payload into a Message value.
+func NewExtended(extID byte, payload []byte) *Message {
+	return (&ExtendedMsg{ID: extID, Payload: payload}).Encode()
+}
+
+// ParseExtended parses an Extended Message to get the extended message id
+// and the payload of the extension's message.
+func ParseExtended(msg *Message) (extID byte, payload []byte, err error) {
+	var m ExtendedMsg
+	err = m.Decode(msg)
+	return m.ID, m.Payload, err
 }
 
 // ParseHave parses a Have Message to get the piece index.
 func ParseHave(msg *Message) (int, error) {
-	if msg.Identifier != Have {
-		return 0, fmt.Errorf("expected Have message, received %v", msg.Identifier)
+	return parseIndex(Have, msg)
+}
+
+// ParseSuggestPiece parses a SuggestPiece Message to get the piece index.
+func ParseSuggestPiece(msg *Message) (int, error) {
+	return parseIndex(SuggestPiece, msg)
+}
+
+// ParseAllowedFast parses an AllowedFast Message to get the piece index.
+func ParseAllowedFast(msg *Message) (int, error) {
+	return parseIndex(AllowedFast, msg)
+}
+
+// ErrInvalidBlock is returned when the block identified by a Request, Cancel
+// or RejectRequest message is empty, or out of the range of any piece.
+var ErrInvalidBlock = errors.New("invalid block")
+
+// ParseRequest parses a Request Message to get the index, begin, and
+// length of the requested block. Empty blocks, and blocks which can't be
+// within any piece, fail with an error wrapping ErrInvalidBlock.
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	return parseBlock(Request, msg)
+}
+
+// ParseCancel parses a Cancel Message to get the index, begin, and length
+// of the cancelled request, which are validated like ParseRequest's.
+func ParseCancel(msg *Message) (index, begin, length int, err error) {
+	return parseBlock(Cancel, msg)
+}
+
+// ParseRejectRequest parses a RejectRequest Message to get the index,
+// begin, and length of the rejected request.
+func ParseRejectRequest(msg *Message) (index, begin, length int, err error) {
+	return parseBlock(RejectRequest, msg)
+}
+
+// parseBlock parses a Message of the provided type whose payload identifies
+// a block, like a Request. Empty blocks, and blocks which end beyond the
+// range of an int32, are invalid.
+func parseBlock(expected id, msg *Message) (index, begin, length int, err error) {
+	if err := expect(expected, msg); err != nil {
+		return 0, 0, 0, err
+	}
+
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, malformed(msg, "expected payload of length 12, received %v", len(msg.Payload))
+	}
+
+	// [index] [begin] [length]
+	i := binary.BigEndian.Uint32(msg.Payload[0:4])
+	b := binary.BigEndian.Uint32(msg.Payload[4:8])
+	l := binary.BigEndian.Uint32(msg.Payload[8:12])
+
+	// the block must fit in an int on every platform
+	switch {
+	case l == 0:
+		return 0, 0, 0, malformed(msg, "%w: empty block at %v of piece %v", ErrInvalidBlock, b, i)
+	case i > math.MaxInt32 || uint64(b)+uint64(l) > math.MaxInt32:
+		return 0, 0, 0, malformed(msg, "%w: block of length %v at %v of piece %v out of range", ErrInvalidBlock, l, b, i)
+	}
+
+	return int(i), int(b), int(l), nil
+}
+
+// parseIndex parses a Message of the provided type whose payload is a
+// single piece index.
+func parseIndex(expected id, msg *Message) (int, error) {
+	if err := expect(expected, msg); err != nil {
+		return 0, err
 	}
 
 	if len(msg.Payload) != 4 {
-		return 0, fmt.Errorf("expected payload of length 4, received %v", len(msg.Payload))
+		return 0, malformed(msg, "expected payload of length 4, received %v", len(msg.Payload))
 	}
 
 	return int(binary.BigEndian.Uint32(msg.Payload)), nil
@@ -116,25 +415,19 @@ func ParseHave(msg *Message) (int, error) {
 
 // ParsePiece parses a PieceMessage and puts the payload into the provided buffer.
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
-	if msg.Identifier != Piece {
-		return 0, fmt.Errorf("expected Piece message, received %v", msg.Identifier)
-	}
-
-	if len(msg.Payload) < 8 {
-		return 0, fmt.Errorf("payload too short with length %v", len(msg.Payload))
+	recIndex, begin, block, err := ParsePieceBlock(msg)
+	if err != nil {
+		return 0, err
 	}
 
-	recIndex := int(binary.BigEndian.Uint32(msg.Payload[:4]))
 	if recIndex != index {
 		return 0, fmt.Errorf("expected piece %v, received %v", index, recIndex)
 	}
 
-	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
 	if begin >= len(buf) {
 		return 0, fmt.Errorf("begin index too high at %v", begin)
 	}
 
-	block := msg.Payload[8:]
 	if begin+len(block) > len(buf) {
 		return 0, fmt.Errorf("block size too big at %v bytes", len(block))
 	}
@@ -142,3 +435,16 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	copy(buf[begin:], block)
 	return len(block), nil
 }
+
+// ParsePieceBlock parses a Piece Message to get the index of the piece, and
+// the offset and data of the block. Unlike ParsePiece, the block isn't
+// copied, but is a slice of the message's payload, so that the caller can
+// copy it into its own buffer, or write it to disk directly.
+func ParsePieceBlock(msg *Message) (index, begin int, block []byte, err error) {
+	var m PieceMsg
+	if err := m.Decode(msg); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return m.Index, m.Begin, m.Block, nil
+}
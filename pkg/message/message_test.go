@@ -0,0 +1,280 @@
+package message_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+func TestFastMessages(t *testing.T) {
+	// messages survive a round trip through the wire format
+	roundTrip := func(msg *message.Message) *message.Message {
+		read, err := message.Read(bytes.NewReader(msg.Serialize()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return read
+	}
+
+	index, begin, length, err := message.ParseRejectRequest(roundTrip(message.NewRejectRequest(1, 2, 3)))
+	if err != nil || index != 1 || begin != 2 || length != 3 {
+		t.Errorf("parsed reject request %d %d %d, %v", index, begin, length, err)
+	}
+
+	indexed := []struct {
+		msg   *message.Message
+		parse func(*message.Message) (int, error)
+	}{
+		{&message.Message{Identifier: message.SuggestPiece, Payload: []byte{0, 0, 1, 2}}, message.ParseSuggestPiece},
+		{&message.Message{Identifier: message.AllowedFast, Payload: []byte{0, 0, 1, 2}}, message.ParseAllowedFast},
+		{message.NewSuggestPiece(0x102), message.ParseSuggestPiece},
+		{message.NewAllowedFast(0x102), message.ParseAllowedFast},
+	}
+
+	for _, m := range indexed {
+		if index, err := m.parse(roundTrip(m.msg)); err != nil || index != 0x102 {
+			t.Errorf("parsed %v index %d, %v", m.msg.Identifier, index, err)
+		}
+	}
+
+	// messages of other types are refused
+	if _, _, _, err := message.ParseRejectRequest(message.NewCancel(1, 2, 3)); err == nil {
+		t.Error("cancel parsed as reject request")
+	}
+
+	if _, err := message.ParseAllowedFast(&message.Message{Identifier: message.AllowedFast}); err == nil {
+		t.Error("allowed fast without an index parsed")
+	}
+
+	// the fast extension is advertised in handshakes
+	h, err := message.ReadHandshake(bytes.NewReader(message.NewHandshake([20]byte{1}, [20]byte{2}).Serialize()))
+	if err != nil || !h.SupportsFast() || !h.SupportsExtended() {
+		t.Errorf("handshake read as %+v, %v", h, err)
+	}
+}
+
+func TestExtended(t *testing.T) {
+	msg := message.NewExtended(2, []byte("d1:ai1ee"))
+	if msg.Identifier != message.Extended || string(msg.Payload) != "\x02d1:ai1ee" {
+		t.Fatalf("extended message formatted as %v %q", msg.Identifier, msg.Payload)
+	}
+
+	extID, payload, err := message.ParseExtended(msg)
+	if err != nil || extID != 2 || string(payload) != "d1:ai1ee" {
+		t.Errorf("parsed extended message %v %q, error %v", extID, payload, err)
+	}
+
+	// the extended message id is required
+	if _, _, err := message.ParseExtended(&message.Message{Identifier: message.Extended}); err == nil {
+		t.Error("extended message without id parsed")
+	}
+
+	if _, _, err := message.ParseExtended(message.NewHave(1)); err == nil {
+		t.Error("have parsed as extended message")
+	}
+}
+
+func TestPort(t *testing.T) {
+	msg := message.NewPort(6881)
+	if msg.Identifier != message.Port || string(msg.Payload) != "\x1a\xe1" {
+		t.Fatalf("port message formatted as %v %v", msg.Identifier, msg.Payload)
+	}
+
+	if port, err := message.ParsePort(msg); err != nil || port != 6881 {
+		t.Errorf("parsed port %v, error %v", port, err)
+	}
+
+	if _, err := message.ParsePort(&message.Message{Identifier: message.Port, Payload: []byte{1, 2, 3}}); err == nil {
+		t.Error("port of length 3 parsed")
+	}
+}
+
+func TestReadInto(t *testing.T) {
+	block := &message.Message{Identifier: message.Piece, Payload: bytes.Repeat([]byte{'b'}, 16<<10+8)}
+	data := bytes.Repeat(block.Serialize(), 2)
+
+	// messages are read into the buffer when it is large enough
+	buf := make([]byte, 32<<10)
+	r := bytes.NewReader(data)
+
+	msg, err := message.ReadInto(r, buf)
+	if err != nil || msg.Identifier != message.Piece || !bytes.Equal(msg.Payload, block.Payload) {
+		t.Fatalf("read %v of length %d, error %v", msg.Identifier, len(msg.Payload), err)
+	}
+
+	if &msg.Payload[0] != &buf[1] {
+		t.Error("message not read into the buffer")
+	}
+
+	// smaller buffers are replaced
+	small := make([]byte, 1024)
+	msg, err = message.ReadInto(r, small)
+	if err != nil || !bytes.Equal(msg.Payload, block.Payload) {
+		t.Fatalf("read message of length %d, error %v", len(msg.Payload), err)
+	}
+
+	// reusing a buffer doesn't allocate it again
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Reset(data)
+		message.ReadInto(r, buf)
+	})
+
+	if allocs > 2 {
+		t.Errorf("%v allocations per read", allocs)
+	}
+}
+
+func TestMaxLength(t *testing.T) {
+	// huge length prefixes are refused without reading the message
+	r := bytes.NewReader([]byte{0x40, 0, 0, 0, byte(message.Piece)})
+	if _, err := message.Read(r); !errors.Is(err, message.ErrMessageTooLarge) {
+		t.Errorf("read 1 gb message with error %v", err)
+	}
+
+	block := &message.Message{Identifier: message.Piece, Payload: make([]byte, 8+16<<10)}
+	if _, err := message.Read(bytes.NewReader(block.Serialize())); err != nil {
+		t.Errorf("read 16 kb block with error %v", err)
+	}
+
+	// the maximum length is configurable
+	if _, err := message.ReadLimit(bytes.NewReader(block.Serialize()), nil, 1024); !errors.Is(err, message.ErrMessageTooLarge) {
+		t.Errorf("read 16 kb block with limit 1 kb, error %v", err)
+	}
+
+	if _, err := message.ReadLimit(bytes.NewReader(message.NewHave(1).Serialize()), nil, 5); err != nil {
+		t.Errorf("read have with limit 5, error %v", err)
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	for _, c := range []struct {
+		msg      *message.Message
+		expected string
+	}{
+		{message.NewChoke(), "Choke"},
+		{message.NewUnChoke(), "UnChoke"},
+		{message.NewInterested(), "Interested"},
+		{message.NewNotInterested(), "NotInterested"},
+		{message.NewBitfield([]byte{0x80}), "Bitfield len=1"},
+		{message.NewRequest(1, 2, 3), "Request idx=1 begin=2 len=3"},
+		{message.NewCancel(1, 2, 3), "Cancel idx=1 begin=2 len=3"},
+		{message.NewPiece(1, 2, []byte("abc")), "Piece idx=1 begin=2 len=3"},
+	} {
+		if s := c.msg.String(); s != c.expected {
+			t.Errorf("constructed %q, expected %q", s, c.expected)
+		}
+	}
+
+	var piece message.PieceMsg
+	if err := piece.Decode(message.NewPiece(1, 2, []byte("abc"))); err != nil || string(piece.Block) != "abc" {
+		t.Errorf("constructed piece with block %q, error %v", piece.Block, err)
+	}
+
+	// blocks are read into piece buffers in place
+	msg, block := message.NewPieceBuffer(1, 2, 3)
+	copy(block, "abc")
+
+	if err := piece.Decode(msg); err != nil || piece.Index != 1 || piece.Begin != 2 || string(piece.Block) != "abc" {
+		t.Errorf("constructed piece buffer %+v, error %v", piece, err)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	var keepAlive *message.Message
+
+	for _, msg := range []*message.Message{
+		keepAlive,
+		message.NewChoke(),
+		message.NewPiece(1, 2, []byte("block")),
+	} {
+		var buf bytes.Buffer
+		n, err := msg.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := msg.Serialize(); n != int64(len(expected)) || !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("%v written as %v, expected %v", msg, buf.Bytes(), expected)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	index, begin, length, err := message.ParseRequest(message.NewRequest(3, 16384, 16384))
+	if err != nil || index != 3 || begin != 16384 || length != 16384 {
+		t.Errorf("parsed request %d %d %d, error %v", index, begin, length, err)
+	}
+
+	index, begin, length, err = message.ParseCancel(message.NewCancel(3, 0, 1))
+	if err != nil || index != 3 || begin != 0 || length != 1 {
+		t.Errorf("parsed cancel %d %d %d, error %v", index, begin, length, err)
+	}
+
+	// blocks which can't be in any piece are refused
+	for _, block := range [][3]uint32{{1, 0, 0}, {1, 1 << 31, 1}, {1, 1<<31 - 1, 2}, {1 << 31, 0, 1}} {
+		msg := &message.Message{Identifier: message.Request, Payload: make([]byte, 12)}
+		for i, field := range block {
+			binary.BigEndian.PutUint32(msg.Payload[4*i:], field)
+		}
+
+		if _, _, _, err := message.ParseRequest(msg); !errors.Is(err, message.ErrInvalidBlock) {
+			t.Errorf("request for block %v parsed with error %v", block, err)
+		}
+
+		msg.Identifier = message.Cancel
+		if _, _, _, err := message.ParseCancel(msg); !errors.Is(err, message.ErrInvalidBlock) {
+			t.Errorf("cancel of block %v parsed with error %v", block, err)
+		}
+	}
+
+	if _, _, _, err := message.ParseRequest(&message.Message{Identifier: message.Request, Payload: make([]byte, 8)}); err == nil {
+		t.Error("truncated request parsed")
+	}
+}
+
+func TestParsePieceBlock(t *testing.T) {
+	msg := message.NewPiece(2, 16384, []byte("block"))
+
+	index, begin, block, err := message.ParsePieceBlock(msg)
+	if err != nil || index != 2 || begin != 16384 || string(block) != "block" {
+		t.Fatalf("parsed piece %d %d %q, error %v", index, begin, block, err)
+	}
+
+	// the block isn't copied
+	if &block[0] != &msg.Payload[8] {
+		t.Error("block copied from the payload")
+	}
+
+	// ParsePiece copies the block into the piece
+	buf := make([]byte, 16384+8)
+	if n, err := message.ParsePiece(2, buf, msg); err != nil || n != 5 || string(buf[16384:16389]) != "block" {
+		t.Errorf("copied %d bytes %q, error %v", n, buf[16384:16389], err)
+	}
+
+	if _, err := message.ParsePiece(3, buf, msg); err == nil {
+		t.Error("block of another piece copied")
+	}
+
+	if _, _, _, err := message.ParsePieceBlock(message.NewHave(2)); err == nil {
+		t.Error("have parsed as piece")
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	var keepAlive *message.Message
+	msgs := []*message.Message{message.NewUnChoke(), message.NewInterested(), keepAlive, message.NewRequest(1, 0, 16384)}
+
+	var expected []byte
+	for _, msg := range msgs {
+		expected = append(expected, msg.Serialize()...)
+	}
+
+	var buf bytes.Buffer
+	if n, err := message.WriteBatch(&buf, msgs...); err != nil || n != int64(len(expected)) || !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("batch written as %v, error %v, expected %v", buf.Bytes(), err, expected)
+	}
+}
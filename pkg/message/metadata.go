@@ -0,0 +1,183 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"errors"
+	"fmt"
+
+	"laptudirm.com/x/mtor/pkg/bencode"
+	"laptudirm.com/x/mtor/pkg/bencode/scanner"
+)
+
+// MetadataExtension is the name of the metadata exchange extension (BEP 9)
+// in extended handshakes.
+const MetadataExtension = "ut_metadata"
+
+// MetadataPieceSize is the size of the pieces in which the info dict of a
+// torrent is exchanged. Only the last piece may be shorter.
+const MetadataPieceSize = 16 << 10
+
+// ErrInvalidMetadata is returned for metadata messages which are invalid.
+var ErrInvalidMetadata = errors.New("invalid metadata message")
+
+// MetadataType is the type of a metadata message.
+type MetadataType int
+
+const (
+	MetadataRequest MetadataType = iota // request for a piece
+	MetadataData                        // piece of the info dict
+	MetadataReject                      // rejection of a request
+)
+
+// MetadataMsg represents a message of the metadata exchange extension. Its
+// payload is a bencoded header, followed by the piece for data messages.
+type MetadataMsg struct {
+	Type      MetadataType `bencode:"msg_type"`
+	Piece     int          `bencode:"piece"`
+	TotalSize int          `bencode:"total_size,omitempty"` // length of the info dict, only in data messages
+	Data      []byte       `bencode:"-"`                    // the piece, only in data messages
+}
+
+// NewMetadataRequest creates a new metadata request for the provided piece,
+// with the peer's extended message id of the extension.
+func NewMetadataRequest(extID byte, piece int) *Message {
+	return (&MetadataMsg{Type: MetadataRequest, Piece: piece}).Encode(extID)
+}
+
+// NewMetadataData creates a new metadata data message with the provided
+// piece of an info dict of length totalSize, with the peer's extended
+// message id of the extension.
+func NewMetadataData(extID byte, piece, totalSize int, data []byte) *Message {
+	return (&MetadataMsg{Type: MetadataData, Piece: piece, TotalSize: totalSize, Data: data}).Encode(extID)
+}
+
+// NewMetadataReject creates a new metadata reject message for the provided
+// piece, with the peer's extended message id of the extension.
+func NewMetadataReject(extID byte, piece int) *Message {
+	return (&MetadataMsg{Type: MetadataReject, Piece: piece}).Encode(extID)
+}
+
+// Encode formats the metadata message into an Extended Message value, with
+// the peer's extended message id of the extension.
+func (m *MetadataMsg) Encode(extID byte) *Message {
+	return NewExtended(extID, m.Payload())
+}
+
+// Payload returns the payload of the metadata message, which is its header
+// followed by its data.
+func (m *MetadataMsg) Payload() []byte {
+	header := fmt.Sprintf("d8:msg_typei%de5:piecei%de", m.Type, m.Piece)
+	if m.Type == MetadataData {
+		header += fmt.Sprintf("10:total_sizei%de", m.TotalSize)
+	}
+
+	payload := make([]byte, 0, len(header)+1+len(m.Data))
+	payload = append(payload, header...)
+	payload = append(payload, 'e')
+	return append(payload, m.Data...)
+}
+
+// ParseMetadata parses a metadata Message. The extended message id isn't
+// checked, since it is the one we assigned to the extension.
+func ParseMetadata(msg *Message) (*MetadataMsg, error) {
+	_, payload, err := ParseExtended(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMetadataPayload(payload)
+}
+
+// ParseMetadataPayload parses the payload of a metadata message, like the
+// ones passed to extended message handlers. The data of the message refers
+// to the payload, and isn't copied.
+func ParseMetadataPayload(payload []byte) (*MetadataMsg, error) {
+	// the header is followed by raw data, so find where it ends
+	s := scanner.New(payload)
+	if err := s.Next(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+
+	last := s.Tokens[len(s.Tokens)-1]
+	end := last.Offset + len(last.Literal)
+
+	var m MetadataMsg
+	if err := bencode.Unmarshal(payload[:end], &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+
+	if m.Piece < 0 {
+		return nil, fmt.Errorf("%w: negative piece %d", ErrInvalidMetadata, m.Piece)
+	}
+
+	if data := payload[end:]; len(data) > 0 {
+		m.Data = data
+	}
+
+	switch m.Type {
+	case MetadataRequest, MetadataReject:
+		if len(m.Data) != 0 {
+			return nil, fmt.Errorf("%w: %d bytes of data after %v", ErrInvalidMetadata, len(m.Data), m.Type)
+		}
+	case MetadataData:
+		pieces := MetadataPieces(m.TotalSize)
+		if m.Piece >= pieces {
+			return nil, fmt.Errorf("%w: piece %d of %d", ErrInvalidMetadata, m.Piece, pieces)
+		}
+
+		if length := MetadataPieceLength(m.TotalSize, m.Piece); len(m.Data) != length {
+			return nil, fmt.Errorf("%w: piece %d of length %d, expected %d", ErrInvalidMetadata, m.Piece, len(m.Data), length)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown type %d", ErrInvalidMetadata, m.Type)
+	}
+
+	return &m, nil
+}
+
+// MetadataPieces returns the number of pieces of an info dict of length
+// totalSize.
+func MetadataPieces(totalSize int) int {
+	if totalSize <= 0 {
+		return 0
+	}
+
+	return (totalSize + MetadataPieceSize - 1) / MetadataPieceSize
+}
+
+// MetadataPieceLength returns the length of the provided piece of an info
+// dict of length totalSize.
+func MetadataPieceLength(totalSize, piece int) int {
+	length := totalSize - piece*MetadataPieceSize
+	if length > MetadataPieceSize {
+		return MetadataPieceSize
+	}
+
+	return length
+}
+
+// String returns the name of the metadata message type.
+func (t MetadataType) String() string {
+	switch t {
+	case MetadataRequest:
+		return "request"
+	case MetadataData:
+		return "data"
+	case MetadataReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("type(%d)", int(t))
+	}
+}
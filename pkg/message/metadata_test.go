@@ -0,0 +1,102 @@
+package message_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+func TestMetadata(t *testing.T) {
+	total := message.MetadataPieceSize + 5
+	last := []byte("d1:xe")
+
+	tests := []struct {
+		msg      *message.Message
+		expected *message.MetadataMsg
+	}{
+		{
+			message.NewMetadataRequest(3, 0),
+			&message.MetadataMsg{Type: message.MetadataRequest, Piece: 0},
+		},
+		{
+			message.NewMetadataData(3, 1, total, last),
+			&message.MetadataMsg{Type: message.MetadataData, Piece: 1, TotalSize: total, Data: last},
+		},
+		{
+			message.NewMetadataReject(3, 1),
+			&message.MetadataMsg{Type: message.MetadataReject, Piece: 1},
+		},
+	}
+
+	for _, test := range tests {
+		msg, err := message.Read(bytes.NewReader(test.msg.Serialize()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := message.ParseMetadata(msg)
+		if err != nil {
+			t.Errorf("%v: %v", test.expected.Type, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parsed, test.expected) {
+			t.Errorf("parsed %+v, expected %+v", parsed, test.expected)
+		}
+	}
+
+	// the header is split from the data, which may contain bencode
+	payload := message.NewMetadataData(3, 1, total, last).Payload[1:]
+	if expected := "d8:msg_typei1e5:piecei1e10:total_sizei16389eed1:xe"; string(payload) != expected {
+		t.Errorf("payload %q, expected %q", payload, expected)
+	}
+
+	invalid := []string{
+		"",
+		"d8:msg_typei0e5:piecei0e",      // unterminated header
+		"d8:msg_typei3e5:piecei0ee",     // unknown type
+		"d8:msg_typei0e5:piecei-1ee",    // negative piece
+		"d8:msg_typei0e5:piecei0eedata", // request with data
+		"d8:msg_typei1e5:piecei1e10:total_sizei5eexxxxx",     // piece out of range
+		"d8:msg_typei1e5:piecei0e10:total_sizei5eexxxx",      // short piece
+		"d8:msg_typei1e5:piecei0e10:total_sizei16389eexxxxx", // short full piece
+	}
+
+	for _, payload := range invalid {
+		if _, err := message.ParseMetadataPayload([]byte(payload)); !errors.Is(err, message.ErrInvalidMetadata) {
+			t.Errorf("payload %q returned %v", payload, err)
+		}
+	}
+}
+
+func TestMetadataPieces(t *testing.T) {
+	size := message.MetadataPieceSize
+	tests := []struct {
+		total, pieces, last int
+	}{
+		{1, 1, 1},
+		{size, 1, size},
+		{size + 1, 2, 1},
+		{3*size - 7, 3, size - 7},
+	}
+
+	for _, test := range tests {
+		pieces := message.MetadataPieces(test.total)
+		last := message.MetadataPieceLength(test.total, pieces-1)
+		if pieces != test.pieces || last != test.last {
+			t.Errorf("info dict of length %d has %d pieces, last of length %d, expected %d and %d",
+				test.total, pieces, last, test.pieces, test.last)
+		}
+
+		if pieces > 1 && message.MetadataPieceLength(test.total, 0) != size {
+			t.Errorf("info dict of length %d has a short first piece", test.total)
+		}
+	}
+
+	if pieces := message.MetadataPieces(0); pieces != 0 {
+		t.Errorf("empty info dict has %d pieces", pieces)
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Typed is the typed representation of a message, which is encoded into
+// and decoded from a Message.
+type Typed interface {
+	// Encode encodes the message into a Message value.
+	Encode() *Message
+	// Decode decodes the provided Message into the message. It fails if the
+	// Message is of another type, or if its payload is invalid.
+	Decode(msg *Message) error
+}
+
+// types maps the identifiers of the known messages to constructors of
+// their typed representations.
+var types = map[id]func() Typed{
+	Choke:         func() Typed { return &ChokeMsg{} },
+	UnChoke:       func() Typed { return &UnChokeMsg{} },
+	Interested:    func() Typed { return &InterestedMsg{} },
+	NotInterested: func() Typed { return &NotInterestedMsg{} },
+	Have:          func() Typed { return &HaveMsg{} },
+	Bitfield:      func() Typed { return &BitfieldMsg{} },
+	Request:       func() Typed { return &RequestMsg{} },
+	Piece:         func() Typed { return &PieceMsg{} },
+	Cancel:        func() Typed { return &CancelMsg{} },
+	Port:          func() Typed { return &PortMsg{} },
+	SuggestPiece:  func() Typed { return &SuggestPieceMsg{} },
+	HaveAll:       func() Typed { return &HaveAllMsg{} },
+	HaveNone:      func() Typed { return &HaveNoneMsg{} },
+	RejectRequest: func() Typed { return &RejectRequestMsg{} },
+	AllowedFast:   func() Typed { return &AllowedFastMsg{} },
+	Extended:      func() Typed { return &ExtendedMsg{} },
+}
+
+// Parse decodes the provided Message into its typed representation, like
+// a *HaveMsg for a Have message. A nil Message, which is a keep-alive, is
+// parsed as nil. Unknown messages fail with an *UnknownError, and messages
+// with invalid payloads with a *MalformedError.
+func Parse(msg *Message) (Typed, error) {
+	if msg == nil {
+		return nil, nil
+	}
+
+	newTyped, ok := types[msg.Identifier]
+	if !ok {
+		return nil, &UnknownError{Identifier: msg.Identifier}
+	}
+
+	t := newTyped()
+	if err := t.Decode(msg); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// ChokeMsg is a Choke message.
+type ChokeMsg struct{}
+
+// Encode encodes the message into a Message value.
+func (m *ChokeMsg) Encode() *Message { return &Message{Identifier: Choke} }
+
+// Decode decodes a Choke Message into the message.
+func (m *ChokeMsg) Decode(msg *Message) error { return expectEmpty(Choke, msg) }
+
+// UnChokeMsg is an UnChoke message.
+type UnChokeMsg struct{}
+
+// Encode encodes the message into a Message value.
+func (m *UnChokeMsg) Encode() *Message { return &Message{Identifier: UnChoke} }
+
+// Decode decodes an UnChoke Message into the message.
+func (m *UnChokeMsg) Decode(msg *Message) error { return expectEmpty(UnChoke, msg) }
+
+// InterestedMsg is an Interested message.
+type InterestedMsg struct{}
+
+// Encode encodes the message into a Message value.
+func (m *InterestedMsg) Encode() *Message { return &Message{Identifier: Interested} }
+
+// Decode decodes an Interested Message into the message.
+func (m *InterestedMsg) Decode(msg *Message) error { return expectEmpty(Interested, msg) }
+
+// NotInterestedMsg is a NotInterested message.
+type NotInterestedMsg struct{}
+
+// Encode encodes the message into a Message value.
+func (m *NotInterestedMsg) Encode() *Message { return &Message{Identifier: NotInterested} }
+
+// Decode decodes a NotInterested Message into the message.
+func (m *NotInterestedMsg) Decode(msg *Message) error { return expectEmpty(NotInterested, msg) }
+
+// HaveMsg is a Have message, which announces a piece the sender has.
+type HaveMsg struct {
+	Index int // index of the piece
+}
+
+// Encode encodes the message into a Message value.
+func (m *HaveMsg) Encode() *Message { return encodeIndex(Have, m.Index) }
+
+// Decode decodes a Have Message into the message.
+func (m *HaveMsg) Decode(msg *Message) (err error) {
+	m.Index, err = parseIndex(Have, msg)
+	return err
+}
+
+// BitfieldMsg is a Bitfield message, which announces all the pieces the
+// sender has.
+type BitfieldMsg struct {
+	Bits []byte // the sender's bitfield
+}
+
+// Encode encodes the message into a Message value. The bits aren't copied.
+func (m *BitfieldMsg) Encode() *Message {
+	return &Message{Identifier: Bitfield, Payload: m.Bits}
+}
+
+// Decode decodes a Bitfield Message into the message. The bits aren't
+// copied from the Message's payload.
+func (m *BitfieldMsg) Decode(msg *Message) error {
+	if err := expect(Bitfield, msg); err != nil {
+		return err
+	}
+
+	m.Bits = msg.Payload
+	return nil
+}
+
+// RequestMsg is a Request message, which requests a block of a piece.
+type RequestMsg struct {
+	Index  int // index of the piece
+	Begin  int // offset of the block in the piece
+	Length int // length of the block
+}
+
+// Encode encodes the message into a Message value.
+func (m *RequestMsg) Encode() *Message {
+	return encodeBlock(Request, m.Index, m.Begin, m.Length)
+}
+
+// Decode decodes a Request Message into the message.
+func (m *RequestMsg) Decode(msg *Message) (err error) {
+	m.Index, m.Begin, m.Length, err = parseBlock(Request, msg)
+	return err
+}
+
+// CancelMsg is a Cancel message, which cancels a previous request.
+type CancelMsg struct {
+	Index  int // index of the piece
+	Begin  int // offset of the block in the piece
+	Length int // length of the block
+}
+
+// Encode encodes the message into a Message value.
+func (m *CancelMsg) Encode() *Message {
+	return encodeBlock(Cancel, m.Index, m.Begin, m.Length)
+}
+
+// Decode decodes a Cancel Message into the message.
+func (m *CancelMsg) Decode(msg *Message) (err error) {
+	m.Index, m.Begin, m.Length, err = parseBlock(Cancel, msg)
+	return err
+}
+
+// PieceMsg is a Piece message, which carries a requested block.
+type PieceMsg struct {
+	Index int    // index of the piece
+	Begin int    // offset of the block in the piece
+	Block []byte // data of the block
+}
+
+// Encode encodes the message into a Message value.
+func (m *PieceMsg) Encode() *Message {
+	msg, block := NewPieceBuffer(m.Index, m.Begin, len(m.Block))
+	copy(block, m.Block)
+	return msg
+}
+
+// Decode decodes a Piece Message into the message. The block isn't copied
+// from the Message's payload.
+func (m *PieceMsg) Decode(msg *Message) error {
+	if err := expect(Piece, msg); err != nil {
+		return err
+	}
+
+	if len(msg.Payload) < 8 {
+		return malformed(msg, "expected payload of length at least 8, received %v", len(msg.Payload))
+	}
+
+	// [index] [begin] [block]
+	m.Index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	m.Begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	m.Block = msg.Payload[8:]
+	return nil
+}
+
+// PortMsg is a Port message (BEP 5), which advertises the port of the
+// sender's dht node.
+type PortMsg struct {
+	Port uint16 // udp port of the dht node
+}
+
+// Encode encodes the message into a Message value.
+func (m *PortMsg) Encode() *Message {
+	payload := make([]byte, 2)
+
+	// [port]
+	binary.BigEndian.PutUint16(payload, m.Port)
+
+	return &Message{Identifier: Port, Payload: payload}
+}
+
+// Decode decodes a Port Message into the message.
+func (m *PortMsg) Decode(msg *Message) error {
+	if err := expect(Port, msg); err != nil {
+		return err
+	}
+
+	if len(msg.Payload) != 2 {
+		return malformed(msg, "expected payload of length 2, received %v", len(msg.Payload))
+	}
+
+	m.Port = binary.BigEndian.Uint16(msg.Payload)
+	return nil
+}
+
+// SuggestPieceMsg is a SuggestPiece message of the fast extension (BEP 6),
+// which suggests a piece for the receiver to download.
+type SuggestPieceMsg struct {
+	Index int // index of the piece
+}
+
+// Encode encodes the message into a Message value.
+func (m *SuggestPieceMsg) Encode() *Message { return encodeIndex(SuggestPiece, m.Index) }
+
+// Decode decodes a SuggestPiece Message into the message.
+func (m *SuggestPieceMsg) Decode(msg *Message) (err error) {
+	m.Index, err = parseIndex(SuggestPiece, msg)
+	return err
+}
+
+// HaveAllMsg is a HaveAll message of the fast extension, which replaces
+// the bitfield of a sender which has all the pieces.
+type HaveAllMsg struct{}
+
+// Encode encodes the message into a Message value.
+func (m *HaveAllMsg) Encode() *Message { return &Message{Identifier: HaveAll} }
+
+// Decode decodes a HaveAll Message into the message.
+func (m *HaveAllMsg) Decode(msg *Message) error { return expectEmpty(HaveAll, msg) }
+
+// HaveNoneMsg is a HaveNone message of the fast extension, which replaces
+// the bitfield of a sender which has none of the pieces.
+type HaveNoneMsg struct{}
+
+// Encode encodes the message into a Message value.
+func (m *HaveNoneMsg) Encode() *Message { return &Message{Identifier: HaveNone} }
+
+// Decode decodes a HaveNone Message into the message.
+func (m *HaveNoneMsg) Decode(msg *Message) error { return expectEmpty(HaveNone, msg) }
+
+// RejectRequestMsg is a RejectRequest message of the fast extension, which
+// rejects a request instead of silently dropping it.
+type RejectRequestMsg struct {
+	Index  int // index of the piece
+	Begin  int // offset of the block in the piece
+	Length int // length of the block
+}
+
+// Encode encodes the message into a Message value.
+func (m *RejectRequestMsg) Encode() *Message {
+	return encodeBlock(RejectRequest, m.Index, m.Begin, m.Length)
+}
+
+// Decode decodes a RejectRequest Message into the message.
+func (m *RejectRequestMsg) Decode(msg *Message) (err error) {
+	m.Index, m.Begin, m.Length, err = parseBlock(RejectRequest, msg)
+	return err
+}
+
+// AllowedFastMsg is an AllowedFast message of the fast extension, which
+// allows the receiver to request a piece even while it is choked.
+type AllowedFastMsg struct {
+	Index int // index of the piece
+}
+
+// Encode encodes the message into a Message value.
+func (m *AllowedFastMsg) Encode() *Message { return encodeIndex(AllowedFast, m.Index) }
+
+// Decode decodes an AllowedFast Message into the message.
+func (m *AllowedFastMsg) Decode(msg *Message) (err error) {
+	m.Index, err = parseIndex(AllowedFast, msg)
+	return err
+}
+
+// ExtendedMsg is an Extended message of the extension protocol (BEP 10),
+// which carries a message of an extension, like ut_metadata.
+type ExtendedMsg struct {
+	// ID is the extended message id, which is 0 for the extended handshake,
+	// and otherwise the id which the receiver assigned to the extension in
+	// its extended handshake.
+	ID byte
+	// Payload is the payload of the extension's message, which is usually
+	// bencoded, followed by binary data for some extensions.
+	Payload []byte
+}
+
+// Encode encodes the message into a Message value.
+func (m *ExtendedMsg) Encode() *Message {
+	// [extended id] [payload]
+	payload := make([]byte, 1+len(m.Payload))
+	payload[0] = m.ID
+	copy(payload[1:], m.Payload)
+
+	return &Message{Identifier: Extended, Payload: payload}
+}
+
+// Decode decodes an Extended Message into the message. The payload isn't
+// copied from the Message's payload.
+func (m *ExtendedMsg) Decode(msg *Message) error {
+	if err := expect(Extended, msg); err != nil {
+		return err
+	}
+
+	if len(msg.Payload) == 0 {
+		return malformed(msg, "expected extended message id, received empty payload")
+	}
+
+	// [extended id] [payload]
+	m.ID = msg.Payload[0]
+	m.Payload = msg.Payload[1:]
+	return nil
+}
+
+// expect checks that the provided Message is of the expected type.
+func expect(expected id, msg *Message) error {
+	if msg.Identifier != expected {
+		return fmt.Errorf("expected message %v, received %v", expected, msg.Identifier)
+	}
+
+	return nil
+}
+
+// expectEmpty checks that the provided Message is of the expected type,
+// and has no payload.
+func expectEmpty(expected id, msg *Message) error {
+	if err := expect(expected, msg); err != nil {
+		return err
+	}
+
+	if len(msg.Payload) != 0 {
+		return malformed(msg, "expected empty payload, received length %v", len(msg.Payload))
+	}
+
+	return nil
+}
+
+// encodeIndex encodes a Message of the provided type whose payload is a
+// single piece index.
+func encodeIndex(identifier id, index int) *Message {
+	payload := make([]byte, 4)
+
+	// [index]
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	return &Message{Identifier: identifier, Payload: payload}
+}
+
+// encodeBlock encodes a Message of the provided type whose payload
+// identifies a block, like a Request.
+func encodeBlock(identifier id, index, begin, length int) *Message {
+	payload := make([]byte, 12)
+
+	// [index] [begin] [length]
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+
+	return &Message{Identifier: identifier, Payload: payload}
+}
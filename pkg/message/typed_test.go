@@ -0,0 +1,94 @@
+package message_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+func TestParse(t *testing.T) {
+	msgs := []message.Typed{
+		&message.ChokeMsg{},
+		&message.UnChokeMsg{},
+		&message.InterestedMsg{},
+		&message.NotInterestedMsg{},
+		&message.HaveMsg{Index: 7},
+		&message.BitfieldMsg{Bits: []byte{0xa0, 0x40}},
+		&message.RequestMsg{Index: 1, Begin: 16384, Length: 16384},
+		&message.PieceMsg{Index: 2, Begin: 4, Block: []byte("block")},
+		&message.CancelMsg{Index: 3, Begin: 0, Length: 100},
+		&message.PortMsg{Port: 6881},
+		&message.SuggestPieceMsg{Index: 4},
+		&message.HaveAllMsg{},
+		&message.HaveNoneMsg{},
+		&message.RejectRequestMsg{Index: 5, Begin: 16384, Length: 1},
+		&message.AllowedFastMsg{Index: 6},
+		&message.ExtendedMsg{ID: 3, Payload: []byte("d8:msg_typei0e5:piecei0ee")},
+	}
+
+	// messages survive a round trip through the wire format
+	for _, expected := range msgs {
+		msg, err := message.Read(bytes.NewReader(expected.Encode().Serialize()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := message.Parse(msg)
+		if err != nil {
+			t.Errorf("%T: %v", expected, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parsed, expected) {
+			t.Errorf("parsed %+v, expected %+v", parsed, expected)
+		}
+	}
+
+	// keep-alives are parsed as nil
+	if parsed, err := message.Parse(nil); parsed != nil || err != nil {
+		t.Errorf("keep-alive parsed as %v, error %v", parsed, err)
+	}
+
+	invalid := []*message.Message{
+		{Identifier: message.Choke, Payload: []byte{1}},
+		{Identifier: message.Have, Payload: []byte{1, 2}},
+		{Identifier: message.Request, Payload: make([]byte, 13)},
+		{Identifier: message.Piece, Payload: make([]byte, 7)},
+		{Identifier: message.Port, Payload: []byte{1}},
+		{Identifier: message.HaveAll, Payload: []byte{1}},
+		{Identifier: message.AllowedFast, Payload: make([]byte, 5)},
+		{Identifier: message.Extended},
+		{Identifier: 99},
+	}
+
+	for _, msg := range invalid {
+		if parsed, err := message.Parse(msg); err == nil {
+			t.Errorf("invalid message %v %v parsed as %+v", msg.Identifier, msg.Payload, parsed)
+		}
+	}
+
+	// messages of other types aren't decoded
+	var have message.HaveMsg
+	if err := have.Decode(message.NewCancel(1, 2, 3)); err == nil {
+		t.Error("cancel decoded as have")
+	}
+}
+
+func TestFastConstructors(t *testing.T) {
+	for _, c := range []struct {
+		msg      *message.Message
+		expected message.Typed
+	}{
+		{message.NewHaveAll(), &message.HaveAllMsg{}},
+		{message.NewHaveNone(), &message.HaveNoneMsg{}},
+		{message.NewSuggestPiece(3), &message.SuggestPieceMsg{Index: 3}},
+		{message.NewAllowedFast(4), &message.AllowedFastMsg{Index: 4}},
+		{message.NewRejectRequest(1, 2, 3), &message.RejectRequestMsg{Index: 1, Begin: 2, Length: 3}},
+	} {
+		if parsed, err := message.Parse(c.msg); err != nil || !reflect.DeepEqual(parsed, c.expected) {
+			t.Errorf("parsed %+v, error %v, expected %+v", parsed, err, c.expected)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "fmt"
+
+// UnknownError is returned for messages whose identifiers aren't known,
+// which may be extensions we don't support, or protocol violations.
+type UnknownError struct {
+	Identifier id // identifier of the message
+}
+
+func (e *UnknownError) Error() string {
+	return fmt.Sprintf("unknown message %v", e.Identifier)
+}
+
+// MalformedError is returned for known messages whose payloads are invalid,
+// which are protocol violations.
+type MalformedError struct {
+	Identifier id    // identifier of the message
+	Err        error // what is wrong with the payload
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("malformed %v message: %v", e.Identifier, e.Err)
+}
+
+// Unwrap returns the error describing the payload, like ErrInvalidBlock.
+func (e *MalformedError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks that the provided message is known and well formed. It
+// returns an *UnknownError or a *MalformedError otherwise. Keep-alives are
+// valid.
+func Validate(msg *Message) error {
+	_, err := Parse(msg)
+	return err
+}
+
+// malformed returns a *MalformedError for the provided message, whose error
+// is formatted like fmt.Errorf.
+func malformed(msg *Message, format string, a ...any) error {
+	return &MalformedError{Identifier: msg.Identifier, Err: fmt.Errorf(format, a...)}
+}
@@ -0,0 +1,40 @@
+package message_test
+
+import (
+	"errors"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+func TestValidate(t *testing.T) {
+	for _, msg := range []*message.Message{
+		nil, // keep-alive
+		message.NewHave(3),
+		message.NewRequest(1, 0, 16384),
+		message.NewHaveAll(),
+	} {
+		if err := message.Validate(msg); err != nil {
+			t.Errorf("valid message %v: %v", msg, err)
+		}
+	}
+
+	// unknown messages are classified as such
+	var unknown *message.UnknownError
+	err := message.Validate(&message.Message{Identifier: 42, Payload: []byte{1}})
+	if !errors.As(err, &unknown) || unknown.Identifier != 42 {
+		t.Errorf("unknown message returned %v", err)
+	}
+
+	// so are malformed ones, whose causes are kept
+	var malformed *message.MalformedError
+	err = message.Validate(&message.Message{Identifier: message.Have, Payload: []byte{1}})
+	if !errors.As(err, &malformed) || malformed.Identifier != message.Have {
+		t.Errorf("malformed message returned %v", err)
+	}
+
+	err = message.Validate(message.NewRequest(1, 0, 0))
+	if !errors.As(err, &malformed) || !errors.Is(err, message.ErrInvalidBlock) {
+		t.Errorf("empty request returned %v", err)
+	}
+}
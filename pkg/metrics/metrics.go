@@ -0,0 +1,281 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics collects metrics of downloads, and exposes them over
+// http in the Prometheus text exposition format.
+//
+// Metrics are collected by installing the hooks returned by Events in the
+// download's configuration, and tracking the download using Track:
+//
+//	m := metrics.New()
+//	config.Events = m.Events(config.Events)
+//
+//	d := t.NewDownload(manager, config)
+//	m.Track(d)
+//
+//	http.Handle("/metrics", m)
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+	"laptudirm.com/x/mtor/pkg/torrent"
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+// DefaultBuckets are the upper bounds of the buckets of the piece download
+// latency histogram, in seconds.
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}
+
+// Metrics collects the metrics of downloads. It implements http.Handler,
+// serving the metrics in the Prometheus text exposition format.
+type Metrics struct {
+	mu sync.Mutex // guards the fields below
+
+	piecesVerified uint64            // pieces which passed verification
+	hashFailures   uint64            // pieces which failed verification
+	announces      uint64            // successful announces
+	trackerErrors  map[string]uint64 // failed announces by cause
+	latency        *histogram        // piece download latency
+
+	downloads map[*torrent.Download]struct{} // active downloads
+	finished  torrent.Stats                  // totals of finished downloads
+}
+
+// New creates a new Metrics collector.
+func New() *Metrics {
+	return &Metrics{
+		trackerErrors: make(map[string]uint64),
+		latency:       newHistogram(DefaultBuckets),
+		downloads:     make(map[*torrent.Download]struct{}),
+	}
+}
+
+// Events returns download hooks which record metrics, and then call the
+// corresponding hooks of next, which may be nil.
+func (m *Metrics) Events(next *torrent.Events) *torrent.Events {
+	if next == nil {
+		next = &torrent.Events{}
+	}
+
+	return &torrent.Events{
+		OnPieceVerified: func(index, done, total int) {
+			m.mu.Lock()
+			m.piecesVerified++
+			m.mu.Unlock()
+
+			if next.OnPieceVerified != nil {
+				next.OnPieceVerified(index, done, total)
+			}
+		},
+		OnPieceDownloaded: func(index int, p peer.Peer, taken time.Duration) {
+			m.mu.Lock()
+			m.latency.observe(taken.Seconds())
+			m.mu.Unlock()
+
+			if next.OnPieceDownloaded != nil {
+				next.OnPieceDownloaded(index, p, taken)
+			}
+		},
+		OnHashFailure: func(index int, p peer.Peer) {
+			m.mu.Lock()
+			m.hashFailures++
+			m.mu.Unlock()
+
+			if next.OnHashFailure != nil {
+				next.OnHashFailure(index, p)
+			}
+		},
+		OnTrackerAnnounce: func(peers []peer.Peer, err error) {
+			m.mu.Lock()
+			if err != nil {
+				m.trackerErrors[errorKind(err)]++
+			} else {
+				m.announces++
+			}
+			m.mu.Unlock()
+
+			if next.OnTrackerAnnounce != nil {
+				next.OnTrackerAnnounce(peers, err)
+			}
+		},
+		OnPeerConnected:    next.OnPeerConnected,
+		OnPeerDisconnected: next.OnPeerDisconnected,
+		OnComplete:         next.OnComplete,
+	}
+}
+
+// errorKind returns the label describing the cause of a tracker error.
+func errorKind(err error) string {
+	var tErr *tracker.TrackerError
+	if !errors.As(err, &tErr) {
+		return "other"
+	}
+
+	return strings.ReplaceAll(tErr.Kind.String(), " ", "_")
+}
+
+// Track adds the statistics of the provided download, like the number of
+// bytes transferred and connected peers, to the metrics. Finished
+// downloads stop being tracked, but their totals are kept.
+func (m *Metrics) Track(d *torrent.Download) {
+	m.mu.Lock()
+	m.downloads[d] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		<-d.Done()
+		stats := d.Stats()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		delete(m.downloads, d)
+		m.finished.Downloaded += stats.Downloaded
+		m.finished.Uploaded += stats.Uploaded
+	}()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// sum up the statistics of the active downloads
+	total := m.finished
+	for d := range m.downloads {
+		stats := d.Stats()
+		total.Downloaded += stats.Downloaded
+		total.Uploaded += stats.Uploaded
+		total.ConnectedPeers += stats.ConnectedPeers
+		total.KnownPeers += stats.KnownPeers
+	}
+
+	var b strings.Builder
+
+	metric(&b, "mtor_pieces_verified_total", "counter", "Number of pieces which passed verification.")
+	sample(&b, "mtor_pieces_verified_total", "", float64(m.piecesVerified))
+
+	metric(&b, "mtor_hash_failures_total", "counter", "Number of pieces which failed verification.")
+	sample(&b, "mtor_hash_failures_total", "", float64(m.hashFailures))
+
+	metric(&b, "mtor_downloaded_bytes_total", "counter", "Number of bytes downloaded from peers.")
+	sample(&b, "mtor_downloaded_bytes_total", "", float64(total.Downloaded))
+
+	metric(&b, "mtor_uploaded_bytes_total", "counter", "Number of bytes uploaded to peers.")
+	sample(&b, "mtor_uploaded_bytes_total", "", float64(total.Uploaded))
+
+	metric(&b, "mtor_peers_connected", "gauge", "Number of connected peers.")
+	sample(&b, "mtor_peers_connected", "", float64(total.ConnectedPeers))
+
+	metric(&b, "mtor_peers_known", "gauge", "Number of known peers.")
+	sample(&b, "mtor_peers_known", "", float64(total.KnownPeers))
+
+	metric(&b, "mtor_downloads_active", "gauge", "Number of active downloads.")
+	sample(&b, "mtor_downloads_active", "", float64(len(m.downloads)))
+
+	metric(&b, "mtor_tracker_announces_total", "counter", "Number of successful tracker announces.")
+	sample(&b, "mtor_tracker_announces_total", "", float64(m.announces))
+
+	metric(&b, "mtor_tracker_errors_total", "counter", "Number of failed tracker announces, by cause.")
+	kinds := make([]string, 0, len(m.trackerErrors))
+	for kind := range m.trackerErrors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		sample(&b, "mtor_tracker_errors_total", `kind="`+kind+`"`, float64(m.trackerErrors[kind]))
+	}
+
+	metric(&b, "mtor_piece_download_seconds", "histogram", "Time taken to download a piece from a peer.")
+	m.latency.write(&b, "mtor_piece_download_seconds")
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// metric writes the help and type comments of a metric.
+func metric(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of a metric, with the provided labels.
+func sample(b *strings.Builder, name, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+
+	fmt.Fprintf(b, "%s %s\n", name, formatFloat(value))
+}
+
+// formatFloat formats a sample value.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// histogram represents a histogram with cumulative buckets.
+type histogram struct {
+	bounds []float64 // upper bounds of the buckets
+	counts []uint64  // number of observations in each bucket
+	count  uint64    // total number of observations
+	sum    float64   // sum of all observations
+}
+
+// newHistogram creates a new histogram with the provided bucket bounds.
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// observe adds an observation to the histogram.
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sum += v
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+// write writes the samples of the histogram.
+func (h *histogram) write(b *strings.Builder, name string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		sample(b, name+"_bucket", `le="`+formatFloat(bound)+`"`, float64(cumulative))
+	}
+
+	sample(b, name+"_bucket", `le="+Inf"`, float64(h.count))
+	sample(b, name+"_sum", "", h.sum)
+	sample(b, name+"_count", "", float64(h.count))
+}
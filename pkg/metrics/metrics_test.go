@@ -0,0 +1,61 @@
+package metrics_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/metrics"
+	"laptudirm.com/x/mtor/pkg/peer"
+	"laptudirm.com/x/mtor/pkg/torrent"
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+func TestMetrics(t *testing.T) {
+	m := metrics.New()
+
+	verified := 0
+	events := m.Events(&torrent.Events{
+		OnPieceVerified: func(index, done, total int) { verified++ },
+	})
+
+	p := peer.Peer{}
+	events.OnPieceVerified(0, 1, 2)
+	events.OnPieceVerified(1, 2, 2)
+	events.OnHashFailure(1, p)
+	events.OnPieceDownloaded(0, p, 300*time.Millisecond)
+	events.OnPieceDownloaded(1, p, time.Minute)
+	events.OnTrackerAnnounce(nil, nil)
+	events.OnTrackerAnnounce(nil, &tracker.TrackerError{Kind: tracker.KindTimeout})
+	events.OnTrackerAnnounce(nil, errors.New("unknown"))
+
+	if verified != 2 {
+		t.Errorf("next hook called %d times, expected 2", verified)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE mtor_pieces_verified_total counter",
+		"mtor_pieces_verified_total 2",
+		"mtor_hash_failures_total 1",
+		"mtor_tracker_announces_total 1",
+		`mtor_tracker_errors_total{kind="timeout"} 1`,
+		`mtor_tracker_errors_total{kind="other"} 1`,
+		`mtor_piece_download_seconds_bucket{le="0.25"} 0`,
+		`mtor_piece_download_seconds_bucket{le="0.5"} 1`,
+		`mtor_piece_download_seconds_bucket{le="20"} 1`,
+		`mtor_piece_download_seconds_bucket{le="+Inf"} 2`,
+		"mtor_piece_download_seconds_sum 60.3",
+		"mtor_piece_download_seconds_count 2",
+		"mtor_downloads_active 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing line %q", line)
+		}
+	}
+}
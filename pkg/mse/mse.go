@@ -0,0 +1,451 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mse implements the Message Stream Encryption protocol, also
+// known as Protocol Encryption, which obfuscates peer connections using a
+// Diffie-Hellman key exchange and RC4 stream encryption.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// Policy represents how encryption is used for peer connections.
+type Policy int
+
+// various encryption policies.
+const (
+	Disabled Policy = iota // never use encryption
+	Enabled                // prefer encryption, fall back to plaintext
+	Required               // only allow encrypted connections
+)
+
+var policies = [...]string{
+	Disabled: "disabled",
+	Enabled:  "enabled",
+	Required: "required",
+}
+
+// String converts a Policy into a readable string.
+func (p Policy) String() string {
+	if 0 <= p && p < Policy(len(policies)) {
+		return policies[p]
+	}
+
+	return fmt.Sprintf("policy(%d)", p)
+}
+
+// Methods returns the crypto methods allowed by the policy.
+func (p Policy) Methods() Method {
+	switch p {
+	case Disabled:
+		return Plaintext
+	case Required:
+		return RC4
+	default:
+		return Plaintext | RC4
+	}
+}
+
+// Method is a bitmask of crypto methods negotiated by the handshake.
+type Method uint32
+
+// various crypto methods.
+const (
+	Plaintext Method = 0x01 // header obfuscation only
+	RC4       Method = 0x02 // full stream encryption
+)
+
+// protocol constants.
+const (
+	keyLen = 96  // length of the public keys
+	maxPad = 512 // maximum length of the padding
+)
+
+// dhPrime is the 768 bit prime used for the key exchange.
+var dhPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+// dhGenerator is the generator used for the key exchange.
+var dhGenerator = big.NewInt(2)
+
+// vc is the verification constant.
+var vc = make([]byte, 8)
+
+// ErrNoCommonMethod is returned when the peers don't support a common
+// crypto method.
+var ErrNoCommonMethod = errors.New("mse: no common crypto method")
+
+// ErrSyncFailed is returned when the synchronization point of the
+// handshake isn't found within the maximum padding length.
+var ErrSyncFailed = errors.New("mse: handshake synchronization failed")
+
+// ErrUnknownSKey is returned when the receiver doesn't know the torrent
+// the initiator is trying to connect for.
+var ErrUnknownSKey = errors.New("mse: unknown torrent")
+
+// Conn is a connection which has completed the handshake. Reads and writes
+// are encrypted if the negotiated method is RC4.
+type Conn struct {
+	net.Conn
+
+	Method Method // negotiated crypto method
+
+	r io.Reader // decrypted stream
+	w io.Writer // encrypted stream
+}
+
+// Read reads decrypted data from the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write encrypts and writes data to the connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// Initiate performs the initiating side of the handshake over conn for the
+// torrent with the provided infohash, offering the provided methods.
+func Initiate(conn net.Conn, skey [20]byte, provide Method) (*Conn, error) {
+	x, ya, err := keypair()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	if err := writeWithPad(conn, ya); err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	br := bufio.NewReader(conn)
+	yb := make([]byte, keyLen)
+	if _, err := io.ReadFull(br, yb); err != nil {
+		return nil, err
+	}
+
+	s := secret(x, yb)
+	encrypt := newCipher("keyA", s, skey[:])
+	decrypt := newCipher("keyB", s, skey[:])
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	var msg bytes.Buffer
+	msg.Write(hash("req1", s))
+	msg.Write(xor(hash("req2", skey[:]), hash("req3", s)))
+
+	plain := make([]byte, 8+4+2+2) // no PadC or IA
+	binary.BigEndian.PutUint32(plain[8:12], uint32(provide))
+	encrypt.XORKeyStream(plain, plain)
+	msg.Write(plain)
+
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// find the encrypted VC, after PadB
+	pattern := make([]byte, len(vc))
+	newCipher("keyB", s, skey[:]).XORKeyStream(pattern, vc)
+	if err := synchronize(br, pattern, maxPad); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(make([]byte, len(vc)), vc) // advance past VC
+
+	header := make([]byte, 4+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	selected := Method(binary.BigEndian.Uint32(header[:4]))
+	if selected&provide == 0 || selected&(selected-1) != 0 {
+		return nil, fmt.Errorf("mse: invalid crypto method %#x selected", selected)
+	}
+
+	// discard padD
+	padD := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+	if len(padD) > maxPad {
+		return nil, fmt.Errorf("mse: padding too long at %d bytes", len(padD))
+	}
+	if _, err := io.ReadFull(br, padD); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padD, padD)
+
+	return newConn(conn, br, selected, encrypt, decrypt), nil
+}
+
+// SKeyHash returns HASH('req2', SKEY) for the torrent with the provided
+// infohash, which identifies the torrent during the handshake.
+func SKeyHash(skey [20]byte) [20]byte {
+	var h [20]byte
+	copy(h[:], hash("req2", skey[:]))
+	return h
+}
+
+// Accept performs the receiving side of the handshake over conn, allowing
+// the provided methods. lookup is called with the SKeyHash sent by the
+// initiator, and should return the infohash of the corresponding torrent.
+// The initial payload sent by the initiator, if any, is returned as the
+// first data read from the returned Conn.
+func Accept(conn net.Conn, lookup func(hash [20]byte) ([20]byte, bool), allow Method) (*Conn, error) {
+	br := bufio.NewReader(conn)
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	ya := make([]byte, keyLen)
+	if _, err := io.ReadFull(br, ya); err != nil {
+		return nil, err
+	}
+
+	y, yb, err := keypair()
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	if err := writeWithPad(conn, yb); err != nil {
+		return nil, err
+	}
+
+	s := secret(y, ya)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	// find HASH('req1', S), after PadA
+	if err := synchronize(br, hash("req1", s), maxPad); err != nil {
+		return nil, err
+	}
+
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(br, obfuscated); err != nil {
+		return nil, err
+	}
+
+	var req2 [20]byte
+	copy(req2[:], xor(obfuscated, hash("req3", s)))
+
+	skey, ok := lookup(req2)
+	if !ok {
+		return nil, ErrUnknownSKey
+	}
+
+	encrypt := newCipher("keyB", s, skey[:])
+	decrypt := newCipher("keyA", s, skey[:])
+
+	header := make([]byte, 8+4+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	if !bytes.Equal(header[:8], vc) {
+		return nil, errors.New("mse: invalid verification constant")
+	}
+
+	provide := Method(binary.BigEndian.Uint32(header[8:12]))
+
+	// discard PadC and read IA
+	padC := make([]byte, binary.BigEndian.Uint16(header[12:14]))
+	if len(padC) > maxPad {
+		return nil, fmt.Errorf("mse: padding too long at %d bytes", len(padC))
+	}
+	if _, err := io.ReadFull(br, padC); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padC, padC)
+
+	iaLen := make([]byte, 2)
+	if _, err := io.ReadFull(br, iaLen); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(iaLen, iaLen)
+
+	ia := make([]byte, binary.BigEndian.Uint16(iaLen))
+	if _, err := io.ReadFull(br, ia); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(ia, ia)
+
+	// select the strongest common method
+	var selected Method
+	switch common := provide & allow; {
+	case common&RC4 != 0:
+		selected = RC4
+	case common&Plaintext != 0:
+		selected = Plaintext
+	default:
+		return nil, ErrNoCommonMethod
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	res := make([]byte, 8+4+2) // no padD
+	binary.BigEndian.PutUint32(res[8:12], uint32(selected))
+	encrypt.XORKeyStream(res, res)
+	if _, err := conn.Write(res); err != nil {
+		return nil, err
+	}
+
+	c := newConn(conn, br, selected, encrypt, decrypt)
+	c.r = io.MultiReader(bytes.NewReader(ia), c.r)
+	return c, nil
+}
+
+// newConn creates a new Conn with the provided method, where r contains
+// the buffered data read from conn.
+func newConn(conn net.Conn, r io.Reader, method Method, encrypt, decrypt *rc4.Cipher) *Conn {
+	c := &Conn{
+		Conn:   conn,
+		Method: method,
+		r:      r,
+		w:      conn,
+	}
+
+	if method == RC4 {
+		c.r = &streamReader{c: decrypt, r: r}
+		c.w = &streamWriter{c: encrypt, w: conn}
+	}
+
+	return c
+}
+
+// streamReader decrypts data read from r.
+type streamReader struct {
+	c *rc4.Cipher
+	r io.Reader
+}
+
+func (s *streamReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	s.c.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+// streamWriter encrypts data written to w.
+type streamWriter struct {
+	c *rc4.Cipher
+	w io.Writer
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	buf := make([]byte, len(b))
+	s.c.XORKeyStream(buf, b)
+	return s.w.Write(buf)
+}
+
+// keypair generates a new private key and the corresponding public key.
+func keypair() (*big.Int, []byte, error) {
+	priv := make([]byte, 20) // 160 bits
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+
+	x := new(big.Int).SetBytes(priv)
+	pub := new(big.Int).Exp(dhGenerator, x, dhPrime)
+	return x, pad(pub.Bytes()), nil
+}
+
+// secret calculates the shared secret from our private key and the other
+// side's public key.
+func secret(x *big.Int, pub []byte) []byte {
+	y := new(big.Int).SetBytes(pub)
+	return pad(new(big.Int).Exp(y, x, dhPrime).Bytes())
+}
+
+// pad left pads b with zeroes to keyLen bytes.
+func pad(b []byte) []byte {
+	padded := make([]byte, keyLen)
+	copy(padded[keyLen-len(b):], b)
+	return padded
+}
+
+// writeWithPad writes b followed by random padding of random length.
+func writeWithPad(w io.Writer, b []byte) error {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return err
+	}
+
+	padding := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	if _, err := rand.Read(padding); err != nil {
+		return err
+	}
+
+	_, err := w.Write(append(append([]byte{}, b...), padding...))
+	return err
+}
+
+// synchronize consumes data from r until the provided pattern has been
+// consumed, failing if it isn't found within max bytes.
+func synchronize(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max+len(pattern))
+
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return ErrSyncFailed
+}
+
+// hash returns the sha1 hash of the concatenation of the provided name and
+// the provided data.
+func hash(name string, data ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(name))
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+// xor returns the bitwise xor of a and b, which must be of equal length.
+func xor(a, b []byte) []byte {
+	res := make([]byte, len(a))
+	for i := range a {
+		res[i] = a[i] ^ b[i]
+	}
+
+	return res
+}
+
+// newCipher creates a new RC4 cipher keyed with HASH(name, S, SKEY), and
+// discards the first 1024 bytes of its keystream.
+func newCipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash(name, s, skey)) // key length is always valid
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
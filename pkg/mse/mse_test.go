@@ -0,0 +1,95 @@
+package mse_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/mse"
+)
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		provide, allow mse.Method
+		selected       mse.Method
+	}{
+		{mse.Plaintext | mse.RC4, mse.Plaintext | mse.RC4, mse.RC4},
+		{mse.Plaintext | mse.RC4, mse.Plaintext, mse.Plaintext},
+		{mse.RC4, mse.RC4, mse.RC4},
+	}
+
+	skey := [20]byte{1, 2, 3}
+	lookup := func(hash [20]byte) ([20]byte, bool) {
+		return skey, hash == mse.SKeyHash(skey)
+	}
+
+	for _, test := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// receiver echoes back everything it reads
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			c, err := mse.Accept(conn, lookup, test.allow)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			io.Copy(c, c)
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := mse.Initiate(conn, skey, test.provide)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Method != test.selected {
+			t.Errorf("selected method %#x, expected %#x", c.Method, test.selected)
+		}
+
+		msg := []byte("\x13BitTorrent protocol")
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		echo := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, echo); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(echo) != string(msg) {
+			t.Errorf("echo %q, expected %q", echo, msg)
+		}
+
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestUnknownTorrent(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go mse.Initiate(client, [20]byte{1}, mse.RC4)
+
+	_, err := mse.Accept(server, func([20]byte) ([20]byte, bool) {
+		return [20]byte{}, false
+	}, mse.RC4)
+	if err != mse.ErrUnknownSKey {
+		t.Errorf("error %v, expected %v", err, mse.ErrUnknownSKey)
+	}
+	server.Close()
+}
@@ -0,0 +1,42 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package nat
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultGateway returns the address of the default ipv4 gateway. Since
+// the routing table can't be read on this platform, the gateway is guessed
+// to be the first address of the local network.
+func DefaultGateway() (net.IP, error) {
+	conn, err := net.Dial("udp4", "192.0.2.1:80") // TEST-NET-1, never sent
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ip := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	if ip == nil {
+		return nil, errors.New("nat: no default gateway found")
+	}
+
+	gateway := make(net.IP, net.IPv4len)
+	copy(gateway, ip)
+	gateway[3] = 1
+	return gateway, nil
+}
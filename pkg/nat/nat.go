@@ -0,0 +1,165 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nat implements automatic port forwarding on home routers using
+// the NAT-PMP and UPnP IGD protocols, so that peers can connect to the
+// client from outside the local network.
+package nat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/log"
+)
+
+// Mapper is the interface implemented by port mapping protocols.
+type Mapper interface {
+	// AddMapping maps the external port on the router to the internal port
+	// on this host for the provided protocol ("tcp" or "udp"), for the
+	// provided lifetime. It returns the external port which was actually
+	// mapped and the lifetime granted by the router.
+	AddMapping(ctx context.Context, protocol string, internal, external int, lifetime time.Duration) (int, time.Duration, error)
+
+	// DeleteMapping removes a mapping created by AddMapping.
+	DeleteMapping(ctx context.Context, protocol string, internal, external int) error
+
+	// ExternalIP returns the external ip address of the router.
+	ExternalIP(ctx context.Context) (net.IP, error)
+
+	// String returns the name of the protocol.
+	String() string
+}
+
+// ErrNoRouter is returned when no router supporting a port mapping
+// protocol is found.
+var ErrNoRouter = errors.New("nat: no port mapping capable router found")
+
+// Discover tries to find a router on the local network which supports port
+// mapping, first using NAT-PMP on the default gateway and then UPnP.
+func Discover(ctx context.Context) (Mapper, error) {
+	if gateway, err := DefaultGateway(); err == nil {
+		pmp := NewNATPMP(gateway)
+		if _, err := pmp.ExternalIP(ctx); err == nil {
+			return pmp, nil
+		}
+	}
+
+	if igd, err := DiscoverUPnP(ctx); err == nil {
+		return igd, nil
+	}
+
+	return nil, ErrNoRouter
+}
+
+// DefaultLifetime is the lifetime requested for port mappings by Map.
+const DefaultLifetime = time.Hour
+
+// minRenewal is the minimum interval between the renewals of a mapping.
+var minRenewal = time.Minute
+
+// Mapping represents a port mapping which is renewed in the background
+// before its lease expires, until it is closed.
+type Mapping struct {
+	mapper   Mapper
+	protocol string
+	internal int
+	external int
+	log      log.Logger
+
+	mu     sync.Mutex    // guards external
+	quit   chan struct{} // closed to stop renewal
+	done   chan struct{} // closed when renewal has stopped
+	closed sync.Once     // guards closing quit
+}
+
+// Map maps the provided port for protocol using mapper, and keeps renewing
+// the mapping until Close is called. The external port requested is the
+// same as the internal port, but the router may assign a different one.
+func Map(ctx context.Context, mapper Mapper, protocol string, port int, logger log.Logger) (*Mapping, error) {
+	external, lifetime, err := mapper.AddMapping(ctx, protocol, port, port, DefaultLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mapping{
+		mapper:   mapper,
+		protocol: protocol,
+		internal: port,
+		external: external,
+		log:      log.OrDiscard(logger).Scope("nat"),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	m.log.Infof("mapped %s port %d to external port %d using %s", protocol, port, external, mapper)
+	go m.renew(lifetime)
+	return m, nil
+}
+
+// ExternalPort returns the external port of the mapping.
+func (m *Mapping) ExternalPort() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.external
+}
+
+// renew renews the mapping at half of its lifetime until it is closed.
+func (m *Mapping) renew(lifetime time.Duration) {
+	defer close(m.done)
+
+	for {
+		wait := lifetime / 2
+		if wait < minRenewal {
+			wait = minRenewal
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-m.quit:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		external, granted, err := m.mapper.AddMapping(ctx, m.protocol, m.internal, m.ExternalPort(), DefaultLifetime)
+		cancel()
+
+		if err != nil {
+			m.log.Warnf("renewing mapping: %v", err)
+			continue // retry after a while
+		}
+
+		m.mu.Lock()
+		m.external = external
+		m.mu.Unlock()
+
+		lifetime = granted
+	}
+}
+
+// Close stops renewing the mapping and removes it from the router.
+func (m *Mapping) Close() error {
+	m.closed.Do(func() {
+		close(m.quit)
+	})
+	<-m.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return m.mapper.DeleteMapping(ctx, m.protocol, m.internal, m.ExternalPort())
+}
@@ -0,0 +1,94 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMapper is a Mapper which assigns external ports from a counter, and
+// records the calls made to it.
+type fakeMapper struct {
+	mu       sync.Mutex
+	next     int
+	lifetime time.Duration
+	calls    []string
+	renewed  chan int
+}
+
+func (m *fakeMapper) String() string { return "fake" }
+
+func (m *fakeMapper) ExternalIP(context.Context) (net.IP, error) {
+	return nil, errors.New("unsupported")
+}
+
+func (m *fakeMapper) AddMapping(_ context.Context, protocol string, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls = append(m.calls, "add")
+	m.next++
+
+	if len(m.calls) > 1 {
+		select {
+		case m.renewed <- external:
+		default:
+		}
+	}
+
+	return m.next, m.lifetime, nil
+}
+
+func (m *fakeMapper) DeleteMapping(_ context.Context, protocol string, internal, external int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if external != m.next {
+		return errors.New("unknown mapping")
+	}
+
+	m.calls = append(m.calls, "delete")
+	return nil
+}
+
+func TestMapping(t *testing.T) {
+	defer func(d time.Duration) { minRenewal = d }(minRenewal)
+	minRenewal = 0
+
+	mapper := &fakeMapper{next: 100, lifetime: 20 * time.Millisecond, renewed: make(chan int, 1)}
+
+	m, err := Map(context.Background(), mapper, "tcp", 6881, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port := m.ExternalPort(); port != 101 {
+		t.Errorf("mapped external port %d", port)
+	}
+
+	// the mapping is renewed before its lease expires, with the port which
+	// was assigned to it
+	select {
+	case port := <-mapper.renewed:
+		if port != 101 {
+			t.Errorf("renewed external port %d", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("mapping not renewed")
+	}
+
+	// closing stops renewal, and removes the current mapping
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mapper.mu.Lock()
+	defer mapper.mu.Unlock()
+
+	if last := mapper.calls[len(mapper.calls)-1]; last != "delete" {
+		t.Errorf("calls %v don't end with a delete", mapper.calls)
+	}
+}
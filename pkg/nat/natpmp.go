@@ -0,0 +1,171 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// NAT-PMP protocol constants, see RFC 6886.
+const (
+	natpmpPort    = 5351
+	natpmpVersion = 0
+
+	natpmpOpExternal = 0
+	natpmpOpUDP      = 1
+	natpmpOpTCP      = 2
+
+	// number of times a request is sent, doubling the wait each time
+	natpmpTries       = 4
+	natpmpInitialWait = 250 * time.Millisecond
+)
+
+// natpmpResults are the messages for the NAT-PMP result codes.
+var natpmpResults = [...]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// NATPMP is a Mapper which uses the NAT-PMP protocol.
+type NATPMP struct {
+	Gateway net.IP // address of the router
+}
+
+// NewNATPMP creates a new NAT-PMP Mapper for the provided gateway.
+func NewNATPMP(gateway net.IP) *NATPMP {
+	return &NATPMP{Gateway: gateway}
+}
+
+// String returns the name of the protocol.
+func (n *NATPMP) String() string {
+	return "NAT-PMP"
+}
+
+// ExternalIP returns the external ip address of the router.
+func (n *NATPMP) ExternalIP(ctx context.Context) (net.IP, error) {
+	res, err := n.request(ctx, []byte{natpmpVersion, natpmpOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	// [version] [op] [result] [epoch] [ip]
+	return net.IP(res[8:12]), nil
+}
+
+// AddMapping maps the external port on the router to the internal port.
+func (n *NATPMP) AddMapping(ctx context.Context, protocol string, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	return n.mapping(ctx, protocol, internal, external, lifetime)
+}
+
+// DeleteMapping removes a mapping, by requesting a zero lifetime.
+func (n *NATPMP) DeleteMapping(ctx context.Context, protocol string, internal, external int) error {
+	_, _, err := n.mapping(ctx, protocol, internal, 0, 0)
+	return err
+}
+
+// mapping sends a mapping request to the router.
+func (n *NATPMP) mapping(ctx context.Context, protocol string, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	var op byte
+	switch protocol {
+	case "udp":
+		op = natpmpOpUDP
+	case "tcp":
+		op = natpmpOpTCP
+	default:
+		return 0, 0, fmt.Errorf("nat: unsupported protocol %s", protocol)
+	}
+
+	// [version] [op] [reserved] [internal port] [external port] [lifetime]
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:8], uint16(external))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	res, err := n.request(ctx, req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// [version] [op] [result] [epoch] [internal port] [external port] [lifetime]
+	mapped := int(binary.BigEndian.Uint16(res[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(res[12:16])) * time.Second
+	return mapped, granted, nil
+}
+
+// request sends a request to the router, retrying with exponential backoff,
+// and returns a valid response of the provided length.
+func (n *NATPMP) request(ctx context.Context, req []byte, length int) ([]byte, error) {
+	addr := net.JoinHostPort(n.Gateway.String(), strconv.Itoa(natpmpPort))
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res := make([]byte, 16)
+	wait := natpmpInitialWait
+
+	for try := 0; try < natpmpTries; try++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(wait)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+
+		read, err := conn.Read(res)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			// timed out, retry with a longer wait
+			wait *= 2
+			continue
+		}
+
+		// check if response is for the request
+		if read < length || res[0] != natpmpVersion || res[1] != req[1]+128 {
+			continue
+		}
+
+		if result := binary.BigEndian.Uint16(res[2:4]); result != 0 {
+			msg := "unknown failure"
+			if int(result) < len(natpmpResults) {
+				msg = natpmpResults[result]
+			}
+
+			return nil, fmt.Errorf("nat: NAT-PMP: %s", msg)
+		}
+
+		return res[:length], nil
+	}
+
+	return nil, fmt.Errorf("nat: NAT-PMP: no response from %s", addr)
+}
@@ -0,0 +1,84 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeGateway answers NAT-PMP requests on the loopback address, mapping
+// ports to themselves plus one. Mappings of port 1 aren't authorized.
+func fakeGateway(t *testing.T) net.IP {
+	gateway := net.IPv4(127, 0, 0, 1)
+
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort(gateway.String(), strconv.Itoa(natpmpPort)))
+	if err != nil {
+		t.Skipf("NAT-PMP port unavailable: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			req := buf[:n]
+			res := make([]byte, 16)
+			res[1] = req[1] + 128
+
+			switch req[1] {
+			case natpmpOpExternal:
+				copy(res[8:12], []byte{203, 0, 113, 7})
+				res = res[:12]
+			default:
+				internal := binary.BigEndian.Uint16(req[4:6])
+				if internal == 1 {
+					binary.BigEndian.PutUint16(res[2:4], 2)
+				}
+
+				copy(res[8:10], req[4:6])
+				binary.BigEndian.PutUint16(res[10:12], internal+1)
+				copy(res[12:16], req[8:12])
+			}
+
+			conn.WriteTo(res, addr)
+		}
+	}()
+
+	return gateway
+}
+
+func TestNATPMP(t *testing.T) {
+	pmp := NewNATPMP(fakeGateway(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if ip, err := pmp.ExternalIP(ctx); err != nil || !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Errorf("external ip %v, %v", ip, err)
+	}
+
+	external, lifetime, err := pmp.AddMapping(ctx, "tcp", 6881, 6881, time.Hour)
+	if err != nil || external != 6882 || lifetime != time.Hour {
+		t.Errorf("mapped to port %d for %v, %v", external, lifetime, err)
+	}
+
+	if err := pmp.DeleteMapping(ctx, "udp", 6881, external); err != nil {
+		t.Error(err)
+	}
+
+	// result codes are reported as errors
+	if _, _, err := pmp.AddMapping(ctx, "tcp", 1, 1, time.Hour); err == nil {
+		t.Error("unauthorized mapping succeeded")
+	}
+
+	if _, _, err := pmp.AddMapping(ctx, "sctp", 6881, 6881, time.Hour); err == nil {
+		t.Error("mapping of unsupported protocol succeeded")
+	}
+}
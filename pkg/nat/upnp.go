@@ -0,0 +1,329 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UPnP protocol constants.
+const (
+	ssdpAddr = "239.255.255.250:1900"
+	ssdpWait = 2 * time.Second
+
+	igdDevice = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+)
+
+// igdServices are the service types which support port mapping, in order
+// of preference.
+var igdServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP is a Mapper which uses the UPnP Internet Gateway Device protocol.
+type UPnP struct {
+	ControlURL  string // url of the port mapping service
+	ServiceType string // type of the port mapping service
+	LocalIP     net.IP // address of this host on the router's network
+
+	Client *http.Client // client used for requests
+}
+
+// String returns the name of the protocol.
+func (u *UPnP) String() string {
+	return "UPnP"
+}
+
+// DiscoverUPnP finds an internet gateway device on the local network using
+// SSDP, and returns a Mapper for its port mapping service.
+func DiscoverUPnP(ctx context.Context) (*UPnP, error) {
+	location, err := ssdpSearch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	return newUPnP(ctx, client, location)
+}
+
+// ssdpSearch sends a SSDP M-SEARCH for internet gateway devices and returns
+// the location of the first device's description.
+func ssdpSearch(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: " + igdDevice + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+
+	if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(ssdpWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", ErrNoRouter
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue // ignore malformed responses
+		}
+		res.Body.Close()
+
+		if location := res.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// upnpRoot represents the root of a UPnP device description.
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// upnpDevice represents a device in a UPnP device description.
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+// upnpService represents a service in a UPnP device description.
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// find searches the device tree for a service of the provided type.
+func (d *upnpDevice) find(serviceType string) (upnpService, bool) {
+	for _, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return s, true
+		}
+	}
+
+	for i := range d.Devices {
+		if s, ok := d.Devices[i].find(serviceType); ok {
+			return s, true
+		}
+	}
+
+	return upnpService{}, false
+}
+
+// newUPnP fetches the device description at location and creates a Mapper
+// for its port mapping service.
+func newUPnP(ctx context.Context, client *http.Client, location string) (*UPnP, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+
+	for _, serviceType := range igdServices {
+		service, ok := root.Device.find(serviceType)
+		if !ok {
+			continue
+		}
+
+		control, err := base.Parse(service.ControlURL)
+		if err != nil {
+			return nil, err
+		}
+
+		local, err := localIP(base.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		return &UPnP{
+			ControlURL:  control.String(),
+			ServiceType: serviceType,
+			LocalIP:     local,
+			Client:      client,
+		}, nil
+	}
+
+	return nil, ErrNoRouter
+}
+
+// localIP returns the local address used to reach the provided host.
+func localIP(host string) (net.IP, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	conn, err := net.Dial("udp4", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// ExternalIP returns the external ip address of the router.
+func (u *UPnP) ExternalIP(ctx context.Context) (net.IP, error) {
+	var res struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+
+	if err := u.soap(ctx, "GetExternalIPAddress", nil, &res); err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(res.IP)
+	if ip == nil {
+		return nil, fmt.Errorf("nat: UPnP: invalid external ip %q", res.IP)
+	}
+
+	return ip, nil
+}
+
+// AddMapping maps the external port on the router to the internal port.
+// Routers which don't support lease durations are retried with a permanent
+// mapping, in which case a zero lifetime is returned.
+func (u *UPnP) AddMapping(ctx context.Context, protocol string, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	args := [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+		{"NewInternalPort", strconv.Itoa(internal)},
+		{"NewInternalClient", u.LocalIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "mtor"},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	}
+
+	err := u.soap(ctx, "AddPortMapping", args, nil)
+	if err != nil && lifetime != 0 {
+		// some routers only support permanent mappings
+		args[len(args)-1][1] = "0"
+		if u.soap(ctx, "AddPortMapping", args, nil) == nil {
+			return external, 0, nil
+		}
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return external, lifetime, nil
+}
+
+// DeleteMapping removes a mapping created by AddMapping.
+func (u *UPnP) DeleteMapping(ctx context.Context, protocol string, internal, external int) error {
+	args := [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+	}
+
+	return u.soap(ctx, "DeletePortMapping", args, nil)
+}
+
+// soap calls the provided action of the port mapping service with the
+// provided arguments, and decodes the response envelope into res.
+func (u *UPnP) soap(ctx context.Context, action string, args [][2]string, res any) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + u.ServiceType + `">`)
+
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.ControlURL, &body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.ServiceType+"#"+action+`"`)
+
+	r, err := u.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("nat: UPnP: %s: %s", action, r.Status)
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	return xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(res)
+}
@@ -0,0 +1,112 @@
+package nat
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const upnpDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+        <serviceList>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+            <controlURL>/control</controlURL>
+          </service>
+        </serviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+const upnpExternalIP = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+      <NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>
+    </u:GetExternalIPAddressResponse>
+  </s:Body>
+</s:Envelope>`
+
+func TestUPnP(t *testing.T) {
+	var mu sync.Mutex
+	var actions []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/description.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, upnpDescription)
+	})
+	mux.HandleFunc("/control", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+
+		mu.Lock()
+		actions = append(actions, action)
+		mu.Unlock()
+
+		switch {
+		case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+			io.WriteString(w, upnpExternalIP)
+		case strings.HasSuffix(action, `#AddPortMapping"`):
+			// the router only supports permanent mappings
+			if !strings.Contains(string(body), "<NewLeaseDuration>0</NewLeaseDuration>") {
+				http.Error(w, "OnlyPermanentLeasesSupported", http.StatusInternalServerError)
+			}
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	igd, err := newUPnP(ctx, server.Client(), server.URL+"/description.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if igd.ControlURL != server.URL+"/control" || igd.ServiceType != igdServices[1] || !igd.LocalIP.IsLoopback() {
+		t.Errorf("found service %+v", igd)
+	}
+
+	if ip, err := igd.ExternalIP(ctx); err != nil || !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Errorf("external ip %v, %v", ip, err)
+	}
+
+	// leases are retried as permanent mappings
+	external, lifetime, err := igd.AddMapping(ctx, "tcp", 6881, 6881, time.Hour)
+	if err != nil || external != 6881 || lifetime != 0 {
+		t.Errorf("mapped to port %d for %v, %v", external, lifetime, err)
+	}
+
+	if err := igd.DeleteMapping(ctx, "tcp", 6881, external); err != nil {
+		t.Error(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := []string{"GetExternalIPAddress", "AddPortMapping", "AddPortMapping", "DeletePortMapping"}
+	if len(actions) != len(expected) {
+		t.Fatalf("called actions %v", actions)
+	}
+
+	for i, action := range expected {
+		if actions[i] != `"`+igdServices[1]+"#"+action+`"` {
+			t.Errorf("called actions %v, expected %v", actions, expected)
+			break
+		}
+	}
+}
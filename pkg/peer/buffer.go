@@ -0,0 +1,91 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"bufio"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+// ReadBufferSize is the size of the buffer which messages are read through,
+// which is large enough to hold many small messages, like requests and
+// haves, so that they are read in a single system call.
+const ReadBufferSize = 16 << 10 // 16 kb
+
+// reader returns the buffered reader of the Conn, creating it if needed.
+func (c *Conn) reader() *bufio.Reader {
+	if c.buf == nil {
+		c.buf = bufio.NewReaderSize(c.Conn, ReadBufferSize)
+	}
+
+	return c.buf
+}
+
+// WriteMessages writes the provided messages to the Conn at once, using a
+// single vectored write where supported. The payloads are written without
+// being copied. A nil Message is written as a keep-alive.
+//
+// It is safe to write from multiple goroutines, and the messages of each
+// call are never interleaved with those of other calls. Since a failed
+// write may have been partially sent, the stream can't be recovered, and
+// all later writes fail with the same error.
+func (c *Conn) WriteMessages(msgs ...*message.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+
+	if c.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+		defer c.Conn.SetWriteDeadline(time.Time{}) // disable deadline
+	}
+
+	start := time.Now()
+	if err := c.writeFramed(msgs); err != nil {
+		c.writeErr = err
+		return err
+	}
+
+	c.touch(&c.lastSend)
+	for _, m := range msgs {
+		c.trace(true, m, start)
+	}
+	return nil
+}
+
+// writeFramed writes the provided messages to the Conn, through its Codec
+// if it has one, and otherwise with the standard framing, in a single
+// vectored write.
+func (c *Conn) writeFramed(msgs []*message.Message) error {
+	if c.Codec != nil {
+		for _, m := range msgs {
+			if err := c.Codec.WriteMessage(m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	_, err := message.WriteBatch(c.Conn, msgs...)
+	return err
+}
@@ -0,0 +1,150 @@
+package peer_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestWriteMessages(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local}
+	in := &peer.Conn{Conn: remote}
+
+	msgs := []*message.Message{
+		message.NewHave(1),
+		nil, // keep-alive
+		{Identifier: message.UnChoke},
+		{Identifier: message.Piece, Payload: []byte("12345678block")},
+	}
+
+	written := make(chan error, 1)
+	go func() { written <- conn.WriteMessages(msgs...) }()
+
+	for i, expected := range msgs {
+		msg, err := in.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (msg == nil) != (expected == nil) {
+			t.Fatalf("message %v: read %v, expected %v", i, msg, expected)
+		}
+
+		if msg != nil && (msg.Identifier != expected.Identifier || string(msg.Payload) != string(expected.Payload)) {
+			t.Errorf("message %v: read %v %q, expected %v %q", i, msg.Identifier, msg.Payload, expected.Identifier, expected.Payload)
+		}
+	}
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local}
+	in := &peer.Conn{Conn: remote}
+
+	// writers send haves of their own pieces, along with requests
+	const writers, writes = 8, 50
+	for w := 0; w < writers; w++ {
+		w := w
+		go func() {
+			for i := 0; i < writes; i++ {
+				conn.WriteMessages(message.NewHave(w), message.NewRequest(w, i, 1))
+			}
+		}()
+	}
+
+	for i := 0; i < writers*writes; i++ {
+		have, err := in.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := in.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the messages of a write are never interleaved
+		index, err := message.ParseHave(have)
+		if reqIndex, _, _, reqErr := message.ParseRequest(req); err != nil || reqErr != nil || reqIndex != index {
+			t.Fatalf("read %v %x, then %v %x", have.Identifier, have.Payload, req.Identifier, req.Payload)
+		}
+	}
+
+	// writes fail once a write has failed, even if the peer recovers
+	conn.WriteTimeout = 10 * time.Millisecond
+	if err := conn.Interested(); err == nil {
+		t.Fatal("write to blocked peer didn't time out")
+	}
+
+	go io.Copy(io.Discard, remote)
+	if err := conn.UnChoke(); err == nil {
+		t.Error("write after failed write succeeded")
+	}
+}
+
+// chanCodec is a message.Codec which exchanges messages over channels.
+type chanCodec struct {
+	in, out chan *message.Message
+}
+
+func (c *chanCodec) ReadMessage() (*message.Message, error) {
+	msg, ok := <-c.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+func (c *chanCodec) WriteMessage(msg *message.Message) error {
+	c.out <- msg
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	var _ message.Codec = (*peer.Conn)(nil)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	codec := &chanCodec{in: make(chan *message.Message, 4), out: make(chan *message.Message, 4)}
+	conn := &peer.Conn{Conn: local, Codec: codec}
+
+	// messages are written through the codec
+	if err := conn.WriteMessages(message.NewHave(3), message.NewInterested()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"Have idx=3", "Interested"} {
+		if msg := <-codec.out; msg.String() != expected {
+			t.Errorf("wrote %v, expected %v", msg, expected)
+		}
+	}
+
+	// and read through it
+	codec.in <- message.NewRequest(1, 2, 3)
+	close(codec.in)
+
+	if msg, err := conn.Read(); err != nil || msg.String() != "Request idx=1 begin=2 len=3" {
+		t.Errorf("read %v, error %v", msg, err)
+	}
+
+	if _, err := conn.ReadMessage(); err != io.EOF {
+		t.Errorf("read from closed codec with error %v", err)
+	}
+}
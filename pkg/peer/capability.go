@@ -0,0 +1,40 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import "laptudirm.com/x/mtor/pkg/message"
+
+// Capability is a set of protocol extensions, which peers advertise using
+// the reserved bits of their handshakes.
+type Capability = message.Capabilities
+
+// protocol extensions
+const (
+	ExtDHT  = message.CapDHT      // dht port messages (BEP 5)
+	ExtFast = message.CapFast     // fast extension (BEP 6)
+	ExtLTEP = message.CapExtended // extension protocol (BEP 10)
+)
+
+// ParseCapabilities returns the extensions advertised by the provided
+// reserved bytes of a handshake. Unknown bits are ignored.
+func ParseCapabilities(reserved [8]byte) Capability {
+	return message.ParseReserved(reserved)
+}
+
+// Supports checks if the peer advertised support for all the provided
+// extensions in its handshake. Extensions which we also need to support,
+// like the fast extension, are only used if Fast or Extended is set.
+func (c *Conn) Supports(ext Capability) bool {
+	return c.Capabilities.Has(ext)
+}
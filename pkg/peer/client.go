@@ -0,0 +1,155 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ClientInfo identifies the client software of a peer, as decoded from its
+// peer id.
+type ClientInfo struct {
+	Name    string   // name of the client, or empty if unknown
+	Version string   // version of the client, or empty if unknown
+	ID      [20]byte // the raw peer id
+}
+
+// String returns the name and version of the client, or the quoted peer
+// id if the client is unknown.
+func (c ClientInfo) String() string {
+	switch {
+	case c.Name == "":
+		return strconv.Quote(string(c.ID[:]))
+	case c.Version == "":
+		return c.Name
+	default:
+		return c.Name + " " + c.Version
+	}
+}
+
+// azureusClients maps the two letter codes of Azureus-style peer ids to
+// client names.
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"MT": "mtor",
+	"TR": "Transmission",
+	"TX": "Tixati",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+	"UW": "µTorrent Web",
+	"lt": "libTorrent (Rakshasa)",
+	"qB": "qBittorrent",
+}
+
+// shadowClients maps the letters of Shadow-style peer ids to client names.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT BitTorrent",
+}
+
+// DecodeClient decodes the client software from a peer id, which can be
+// Azureus-style (-XX1234-...), Shadow-style (S58B-----...), or Mainline
+// style (M4-3-6--...). The Name of unknown clients is empty.
+func DecodeClient(id [20]byte) ClientInfo {
+	info := ClientInfo{ID: id}
+
+	switch {
+	case id[0] == '-' && id[7] == '-':
+		// Azureus-style: '-', client code, four version characters, '-'
+		info.Name = azureusClients[string(id[1:3])]
+		if info.Name != "" {
+			info.Version = decodeVersion(id[3:7])
+		}
+	case id[0] == 'M' && isMainline(id):
+		// Mainline: 'M', version numbers separated by dashes
+		info.Name = "Mainline"
+		info.Version = strings.ReplaceAll(strings.TrimRight(string(id[1:8]), "-"), "-", ".")
+	default:
+		// Shadow-style: client letter, up to five version characters,
+		// padded with dashes
+		name, ok := shadowClients[id[0]]
+		end := strings.IndexByte(string(id[1:7]), '-')
+		if ok && end > 0 && string(id[end+1:end+3]) == "--" {
+			info.Name = name
+			info.Version = decodeVersion(id[1 : end+1])
+		}
+	}
+
+	return info
+}
+
+// RemoteClient returns the client software of the peer, decoded from the
+// peer id in its handshake.
+func (c *Conn) RemoteClient() ClientInfo {
+	return DecodeClient(c.PeerID)
+}
+
+// decodeVersion decodes version characters into a dotted version, where
+// digits are themselves, and letters are 10 onwards.
+func decodeVersion(chars []byte) string {
+	parts := make([]string, 0, len(chars))
+	for _, c := range chars {
+		var n int
+		switch {
+		case '0' <= c && c <= '9':
+			n = int(c - '0')
+		case 'A' <= c && c <= 'Z':
+			n = int(c-'A') + 10
+		case 'a' <= c && c <= 'z':
+			n = int(c-'a') + 36
+		default:
+			return ""
+		}
+
+		parts = append(parts, strconv.Itoa(n))
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// isMainline checks if the peer id has a Mainline style version, like
+// M4-3-6-- or M4-20-8-.
+func isMainline(id [20]byte) bool {
+	dashes := 0
+	for i, c := range id[1:8] {
+		switch {
+		case c == '-':
+			// the first three dashes end version numbers, which can't
+			// be empty
+			dashes++
+			if dashes <= 3 && (i == 0 || id[i] == '-') {
+				return false
+			}
+		case '0' <= c && c <= '9':
+			if dashes >= 3 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return dashes >= 3
+}
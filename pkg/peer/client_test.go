@@ -0,0 +1,82 @@
+package peer_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/mse"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestDecodeClient(t *testing.T) {
+	tests := []struct {
+		id      string
+		name    string
+		version string
+	}{
+		{"-qB4250-abcdefghijkl", "qBittorrent", "4.2.5.0"},
+		{"-TR300Z-abcdefghijkl", "Transmission", "3.0.0.35"},
+		{"-XX1234-abcdefghijkl", "", ""},
+		{"S58B-----abcdefghijk", "Shadow", "5.8.11"},
+		{"T03I--00abcdefghijkl", "BitTornado", "0.3.18"},
+		{"M4-3-6--abcdefghijkl", "Mainline", "4.3.6"},
+		{"M4-20-8-abcdefghijkl", "Mainline", "4.20.8"},
+		{"M4--6--abcdefghijklm", "", ""},
+		{"abcdefghijklmnopqrst", "", ""},
+	}
+
+	for _, test := range tests {
+		var id [20]byte
+		copy(id[:], test.id)
+
+		info := peer.DecodeClient(id)
+		if info.Name != test.name || info.Version != test.version || info.ID != id {
+			t.Errorf("%q decoded as %q %q", test.id, info.Name, info.Version)
+		}
+	}
+
+	var id [20]byte
+	copy(id[:], "-UT3550-abcdefghijkl")
+	if s := peer.DecodeClient(id).String(); s != "µTorrent 3.5.5.0" {
+		t.Errorf("client formatted as %q", s)
+	}
+}
+
+func TestRemoteClient(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+	name, err := peer.NewID("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+		Name:    name,
+		Timeout: time.Second,
+		Lookup: func(h [20]byte) (*peer.Config, bool) {
+			return &peer.Config{Timeout: time.Second}, h == hash
+		},
+		Encryption: mse.Disabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	conn, err := peer.NewConn(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, hash, [20]byte{'c'}, &peer.Config{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Conn.Close()
+
+	if info := conn.RemoteClient(); info.Name != "mtor" || info.Version != "0.1.0.0" || info.ID != name {
+		t.Errorf("remote client decoded as %+v", info)
+	}
+}
@@ -14,55 +14,427 @@
 package peer
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/log"
 	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/mse"
 )
 
 // Conn represents a p2p connection to a peer.
 type Conn struct {
 	Conn     net.Conn          // the connection with the peer
 	Choked   bool              // wether the peer is choking
+	Choking  bool              // whether we are choking the peer, see Choke
 	Peer     Peer              // the peer with the connection
 	Bitfield bitfield.Bitfield // peer's bitfield
 	InfoHash [20]byte          // torrent infohash
-	Name     [20]byte          // peer's identifier
+	Name     [20]byte          // our peer id
+	PeerID   [20]byte          // peer's id, from its handshake
 	Timeout  time.Duration     // conn's timeout
+	Logger   log.Logger        // conn's logger
+
+	// PeerInterested reports whether the peer is interested in us.
+	PeerInterested bool
+	// Inbound reports whether the peer connected to us, in which case it
+	// can't be dialed at the address of the connection.
+	Inbound bool
+
+	// WriteTimeout limits the time each write to the peer may take, if it
+	// is positive, so that writes to peers which stop reading fail.
+	WriteTimeout time.Duration
+	// IdleTimeout limits the time Run waits for a message from the peer,
+	// including keep-alives, if it is positive, so that dead peers are
+	// dropped.
+	IdleTimeout time.Duration
+
+	// MaxMessageLength limits the length of the messages received from the
+	// peer, which defaults to message.DefaultMaxLength. It is raised to fit
+	// the bitfield of the torrent if needed.
+	MaxMessageLength int
+
+	// StrictMessages makes Run fail with a *message.UnknownError or a
+	// *message.MalformedError when the peer sends an unknown or malformed
+	// message, instead of passing unknown messages on to the handlers.
+	StrictMessages bool
+
+	// Codec replaces the standard framing of the messages exchanged with
+	// the peer, if it isn't nil, for transports which frame them otherwise.
+	// Conn is still used for deadlines and closing the connection.
+	Codec message.Codec
+
+	// DownloadLimiter is consulted before requesting blocks from the peer,
+	// and UploadLimiter before sending blocks to the peer, if they aren't
+	// nil, with the lengths of the blocks.
+	DownloadLimiter Limiter
+	UploadLimiter   Limiter
+
+	// Tracer is called with every message sent to and received from the
+	// peer, if it isn't nil.
+	Tracer Tracer
+
+	// OurBitfield is our bitfield, as sent to the peer after the handshake.
+	OurBitfield bitfield.Bitfield
+
+	// Capabilities contains the extensions advertised by the peer in its
+	// handshake.
+	Capabilities Capability
+
+	// Fast reports whether both sides support the fast extension (BEP 6).
+	Fast bool
+	// AllowedFast contains the pieces which can be requested from the peer
+	// even while it is choking us.
+	AllowedFast bitfield.Bitfield
+
+	// Extended reports whether both sides support the extension protocol
+	// (BEP 10). Extensions maps the names of the extensions supported by
+	// the peer, like ut_metadata and ut_pex, to the extended message ids
+	// which should be used to send their messages.
+	Extended   bool
+	Extensions map[string]int
+
+	PeerVersion     string // peer's client name and version, if provided
+	PeerMaxRequests int    // peer's max outstanding requests, if provided
+	YourIP          net.IP // our ip address as seen by the peer, if provided
+
+	pieces   int         // number of pieces in the torrent
+	handlers []*Handlers // handlers registered for Run
+	servers  []*server   // servers registered by HandleRequests
+
+	chokeMu sync.Mutex // guards Choking once requests are being served
+
+	failMu  sync.Mutex // guards failure
+	failure error      // error which stops Run, set by background work
+
+	requestsMu sync.Mutex          // guards requests, lastPiece and the rtt
+	requests   map[Block]time.Time // outstanding requests, with send times
+	lastPiece  time.Time           // time of the last requested block received
+	srtt       time.Duration       // smoothed round-trip time of requests
+	rttvar     time.Duration       // mean deviation of the round-trip time
+
+	buf      *bufio.Reader    // buffered reader of the connection
+	unread   *message.Message // message to be returned by the next Read
+	writeMu  sync.Mutex       // serializes writes to the connection
+	writeErr error            // error of the first failed write
+
+	timeMu      sync.Mutex // guards the times of the last messages
+	lastSend    time.Time  // time the last message was sent
+	lastReceive time.Time  // time the last message was received
+
+	doneOnce sync.Once          // guards creating done
+	done     context.Context    // done when the Conn is closed
+	cancel   context.CancelFunc // cancels done
+}
+
+// Config contains the configuration used to establish a Conn.
+type Config struct {
+	Timeout time.Duration // connection timeout, default of the timeouts below
+	Logger  log.Logger    // logger, or nil to discard logs
+
+	// HandshakeTimeout limits dialing the peer, and completing the
+	// encryption and bittorrent handshakes. ExchangeTimeout limits waiting
+	// for the peer's bitfield after the handshake. They default to Timeout.
+	HandshakeTimeout time.Duration
+	ExchangeTimeout  time.Duration
+	// IdleTimeout limits the time Run waits for a message from the peer
+	// once the Conn is established. It is disabled if it is zero, since
+	// slow peers may legitimately only send keep-alives for a while.
+	IdleTimeout time.Duration
+
+	// Dialer is used to dial the peer, for example through a proxy. If it
+	// is nil, a direct tcp connection is dialed.
+	Dialer Dialer
+	// LocalAddr is the local address which peers are dialed from, to bind
+	// the connections to an interface, or to the port we listen on. It is
+	// ignored if Dialer is set.
+	LocalAddr *net.TCPAddr
+	// ReusePort sets SO_REUSEPORT on the dialed connections, so that they
+	// can share the port of LocalAddr with each other, and with a Listener
+	// which sets it too. It is only supported on linux.
+	ReusePort bool
+
+	// Encryption is the message stream encryption policy. If it is Enabled,
+	// connections which fail the encrypted handshake are retried in
+	// plaintext.
+	Encryption mse.Policy
+
+	// Bitfield is our bitfield, which is sent to the peer after the
+	// handshake if we have any pieces.
+	Bitfield bitfield.Bitfield
+	// Pieces is the number of pieces in the torrent.
+	Pieces int
+
+	// Extensions maps the names of the extensions we support to the
+	// extended message ids which peers should use to send their messages,
+	// which are advertised in the extended handshake.
+	Extensions map[string]int
+
+	// WriteTimeout limits the time each write to the peer may take, if it
+	// is positive.
+	WriteTimeout time.Duration
+
+	// MaxMessageLength limits the length of the messages received from the
+	// peer, see Conn.MaxMessageLength.
+	MaxMessageLength int
+
+	// StrictMessages makes Run fail on unknown or malformed messages, see
+	// Conn.StrictMessages.
+	StrictMessages bool
+
+	// DownloadLimiter and UploadLimiter shape the bandwidth of the Conn,
+	// if they aren't nil.
+	DownloadLimiter Limiter
+	UploadLimiter   Limiter
+
+	// Tracer is called with every message sent to and received from the
+	// peer after the handshake, if it isn't nil.
+	Tracer Tracer
+
+	// KeepAlive is the interval after which a keep-alive message is sent
+	// if nothing else was sent to the peer. It defaults to
+	// KeepAliveInterval, and keep-alives are disabled if it is negative.
+	KeepAlive time.Duration
+}
+
+// NetDialer returns the dialer of the direct tcp connections to peers,
+// which dials from LocalAddr, sharing its port if ReusePort is set. It is
+// also useful to dial peers from the port we listen on in other ways, like
+// holepunching.
+func (config *Config) NetDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: config.handshakeTimeout()}
+	if config.LocalAddr != nil {
+		d.LocalAddr = config.LocalAddr
+	}
+
+	if config.ReusePort {
+		d.Control = reusePort
+	}
+
+	return d
+}
+
+// handshakeTimeout returns the timeout of the handshakes.
+func (config *Config) handshakeTimeout() time.Duration {
+	if config.HandshakeTimeout > 0 {
+		return config.HandshakeTimeout
+	}
+
+	return config.Timeout
+}
+
+// exchangeTimeout returns the timeout of the bitfield exchange.
+func (config *Config) exchangeTimeout() time.Duration {
+	if config.ExchangeTimeout > 0 {
+		return config.ExchangeTimeout
+	}
+
+	return config.Timeout
+}
+
+// Dialer dials connections to peers. It is implemented by *net.Dialer and
+// *proxy.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
 // Read reads a Message from the Conn.
 func (c *Conn) Read() (*message.Message, error) {
-	return message.Read(c.Conn)
+	// return the message read while waiting for the bitfield
+	if msg := c.unread; msg != nil {
+		c.unread = nil
+		return msg, nil
+	}
+
+	start := time.Now()
+	msg, err := c.readFramed()
+	if err != nil {
+		return nil, err
+	}
+	c.touch(&c.lastReceive)
+	c.trace(false, msg, start)
+
+	if msg == nil {
+		c.logger().Debugf("received keep-alive")
+		return nil, nil
+	}
+
+	c.logger().Debugf("received message %v", msg)
+	c.trackRequests(msg)
+
+	if c.Extended && isExtendedHandshake(msg) {
+		if err := c.readExtendedHandshake(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// readFramed reads a message from the Conn, through its Codec if it has
+// one, and otherwise with the standard framing.
+func (c *Conn) readFramed() (*message.Message, error) {
+	if c.Codec != nil {
+		return c.Codec.ReadMessage()
+	}
+
+	return message.ReadLimit(c.reader(), nil, c.maxMessageLength())
+}
+
+// ReadMessage reads a Message from the Conn, like Read. Together with
+// WriteMessage, it implements message.Codec.
+func (c *Conn) ReadMessage() (*message.Message, error) {
+	return c.Read()
+}
+
+// WriteMessage writes a Message to the Conn, like WriteMessages.
+func (c *Conn) WriteMessage(msg *message.Message) error {
+	return c.WriteMessages(msg)
+}
+
+// maxMessageLength returns the maximum length of the messages received from
+// the peer, which fits the bitfield of the torrent.
+func (c *Conn) maxMessageLength() int {
+	max := c.MaxMessageLength
+	if max <= 0 {
+		max = message.DefaultMaxLength
+	}
+
+	// [id] [bitfield]
+	if bitfield := 1 + (c.pieces+7)/8; bitfield > max {
+		max = bitfield
+	}
+
+	return max
+}
+
+// logger returns the Conn's logger, which discards the logs if Logger is
+// nil, so that Conns can be created without NewConn.
+func (c *Conn) logger() log.Logger {
+	return log.OrDiscard(c.Logger)
+}
+
+// Choke sends a Choke message to the Conn. The peer's queued requests
+// are no longer served, and are rejected if the peer supports the fast
+// extension.
+func (c *Conn) Choke() error {
+	c.setChoking(true)
+	if err := c.write(message.NewChoke()); err != nil {
+		return err
+	}
+
+	for _, s := range c.servers {
+		if err := s.choke(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // UnChoke sends an UnChoke message to the Conn.
 func (c *Conn) UnChoke() error {
-	m := &message.Message{Identifier: message.UnChoke}
-	_, err := c.Conn.Write(m.Serialize())
-	return err
+	c.setChoking(false)
+	return c.write(message.NewUnChoke())
+}
+
+// choking reports whether we are choking the peer.
+func (c *Conn) choking() bool {
+	c.chokeMu.Lock()
+	defer c.chokeMu.Unlock()
+
+	return c.Choking
+}
+
+// setChoking records whether we are choking the peer.
+func (c *Conn) setChoking(choking bool) {
+	c.chokeMu.Lock()
+	defer c.chokeMu.Unlock()
+
+	c.Choking = choking
 }
 
 // Interested sends an Interested message to the Conn.
 func (c *Conn) Interested() error {
-	m := &message.Message{Identifier: message.Interested}
-	_, err := c.Conn.Write(m.Serialize())
-	return err
+	return c.write(message.NewInterested())
+}
+
+// NotInterested sends a NotInterested message to the Conn.
+func (c *Conn) NotInterested() error {
+	return c.write(message.NewNotInterested())
 }
 
-// Request sends a Request message to the Conn.
+// Request sends a Request message to the Conn, and records it as
+// outstanding until the block is received, cancelled, or rejected. The
+// DownloadLimiter is waited for before the request is sent.
 func (c *Conn) Request(index, begin, length int) error {
-	req := message.NewReqest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.RequestBlocks(Block{Index: index, Begin: begin, Length: length})
+}
+
+// RequestBlocks requests the provided blocks from the Conn like Request,
+// but sends the burst of requests in a single write, which reduces the
+// system calls and keeps the requests together on high latency links.
+// The DownloadLimiter is waited for all the blocks before any is sent.
+func (c *Conn) RequestBlocks(blocks ...Block) error {
+	msgs := make([]*message.Message, len(blocks))
+	for i, b := range blocks {
+		if err := c.wait(c.DownloadLimiter, b.Length); err != nil {
+			return err
+		}
+
+		msgs[i] = message.NewRequest(b.Index, b.Begin, b.Length)
+	}
+
+	// record the requests first, as the blocks may arrive before write
+	// returns
+	for _, b := range blocks {
+		c.addRequest(b)
+	}
+
+	if err := c.WriteMessages(msgs...); err != nil {
+		for _, b := range blocks {
+			c.removeRequest(b)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Cancel sends a Cancel message to the Conn, and forgets the request.
+func (c *Conn) Cancel(index, begin, length int) error {
+	c.removeRequest(Block{Index: index, Begin: begin, Length: length})
+	return c.write(message.NewCancel(index, begin, length))
+}
+
+// Have sends a Have message to the Conn.
+func (c *Conn) Have(index int) error {
+	return c.write(message.NewHave(index))
+}
+
+// Port sends a Port message to the Conn, which advertises the port of our
+// dht node.
+func (c *Conn) Port(port uint16) error {
+	return c.write(message.NewPort(port))
+}
+
+// SendBitfield sends a Bitfield message with the provided bitfield to the
+// Conn.
+func (c *Conn) SendBitfield(b bitfield.Bitfield) error {
+	return c.write(message.NewBitfield(b.Bytes()))
 }
 
 // handshake tries to complete a proper handshake with the peer.
-func (c *Conn) handshake(hash, name [20]byte) (*message.Handshake, error) {
+func (c *Conn) handshake(ctx context.Context, timeout time.Duration, hash, name [20]byte) (*message.Handshake, error) {
 	// set handshake deadline
-	c.Conn.SetDeadline(time.Now().Add(c.Timeout))
+	c.Conn.SetDeadline(deadline(ctx, timeout))
 	defer c.Conn.SetDeadline(time.Time{}) // disable deadline
 
 	// send a handshake to the peer
@@ -86,55 +458,242 @@ func (c *Conn) handshake(hash, name [20]byte) (*message.Handshake, error) {
 	return res, nil
 }
 
-// getBitfield reads a serialized bitfield from the Conn.
-func (c *Conn) getBitfield() (bitfield.Bitfield, error) {
+// getBitfield reads the peer's bitfield from the Conn, for a torrent with
+// the provided number of pieces, which the bitfield's length must match. If
+// the fast extension is enabled, HaveAll and HaveNone messages are also
+// accepted. The bitfield is optional for peers without any pieces, so if
+// the peer sends another message first, or nothing within the timeout, its
+// bitfield is empty, and the message is returned by the next Read. The
+// peer's extended handshake is processed if it is sent first.
+func (c *Conn) getBitfield(ctx context.Context, timeout time.Duration, pieces int) (bitfield.Bitfield, error) {
 	// set bitfield deadline
-	c.Conn.SetDeadline(time.Now().Add(c.Timeout))
+	c.Conn.SetDeadline(deadline(ctx, timeout))
 	defer c.Conn.SetDeadline(time.Time{}) // disable deadline
 
-	// await message from peer
-	msg, err := message.Read(c.Conn)
-	if err != nil {
-		return bitfield.Bitfield{}, err
+	for {
+		// timing out before a message starts leaves the stream intact, which
+		// can't be known for the messages of a Codec
+		if c.Codec == nil {
+			if _, err := c.reader().Peek(1); err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+					return bitfield.Empty(pieces), nil
+				}
+
+				return bitfield.Bitfield{}, err
+			}
+		}
+
+		// await message from peer
+		msg, err := c.Read()
+		if err != nil {
+			return bitfield.Bitfield{}, err
+		}
+
+		switch {
+		case msg == nil, c.Extended && isExtendedHandshake(msg):
+			continue // keep waiting for the bitfield
+		case msg.Identifier == message.Bitfield:
+			return c.parseBitfield(msg.Payload)
+		case c.Fast && msg.Identifier == message.HaveAll:
+			return bitfield.Full(pieces), nil
+		case c.Fast && msg.Identifier == message.HaveNone:
+			return bitfield.Empty(pieces), nil
+		default:
+			// the bitfield was skipped
+			c.unread = msg
+			return bitfield.Empty(pieces), nil
+		}
 	}
+}
+
+// parseBitfield parses a bitfield received from the peer, checking that it
+// matches the number of pieces in the torrent, if it is known.
+func (c *Conn) parseBitfield(bits []byte) (bitfield.Bitfield, error) {
+	if c.pieces == 0 {
+		return bitfield.New(bits), nil
+	}
+
+	return bitfield.Parse(bits, c.pieces)
+}
+
+// sendBitfield sends our bitfield to the Conn. Peers supporting the fast
+// extension are sent HaveAll or HaveNone messages where possible, while
+// other peers aren't sent an empty bitfield.
+func (c *Conn) sendBitfield(b bitfield.Bitfield, pieces int) error {
+	have := b.Count()
 
-	// expect Message of type Bitfield
-	if msg.Identifier != message.Bitfield {
-		return bitfield.Bitfield{}, fmt.Errorf("expected bitfield message, received %v", msg.Identifier)
+	switch {
+	case c.Fast && pieces > 0 && have == pieces:
+		return c.write(message.NewHaveAll())
+	case c.Fast && have == 0:
+		return c.write(message.NewHaveNone())
+	case have == 0:
+		return nil
+	default:
+		return c.SendBitfield(b)
 	}
+}
 
-	return bitfield.New(msg.Payload), nil
+// write writes the provided Message to the Conn. A nil Message is written
+// as a keep-alive.
+func (c *Conn) write(m *message.Message) error {
+	return c.WriteMessages(m)
 }
 
 // NewConn creates a new p2p Conn with the provided peer.
-func NewConn(peer Peer, hash, name [20]byte, timeout time.Duration) (*Conn, error) {
+func NewConn(peer Peer, hash, name [20]byte, config *Config) (*Conn, error) {
+	return NewConnContext(context.Background(), peer, hash, name, config)
+}
+
+// NewConnContext is like NewConn, but the connection attempt is bounded by
+// the provided context. If the context is cancelled before the Conn is
+// established, the connection is closed and the context's error returned.
+func NewConnContext(ctx context.Context, peer Peer, hash, name [20]byte, config *Config) (*Conn, error) {
+	logger := log.OrDiscard(config.Logger).Scope(peer.String())
+
 	// dial a tcp connection with peer
-	netConn, err := net.DialTimeout("tcp", peer.String(), timeout)
+	netConn, err := dial(ctx, peer, hash, config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := newConn(ctx, netConn, peer, hash, name, config, logger)
+
+	// the deadlines of the connection are unusable once it is interrupted
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		if conn != nil {
+			conn.Close(ctx)
+		}
+	}
+
 	if err != nil {
+		netConn.Close()
 		return nil, err
 	}
 
+	return conn, nil
+}
+
+// newConn completes the handshake with a dialed peer, and sets up the Conn.
+func newConn(ctx context.Context, netConn net.Conn, peer Peer, hash, name [20]byte, config *Config, logger log.Logger) (*Conn, error) {
+	defer interrupt(ctx, netConn)()
+
 	conn := &Conn{
 		Conn:     netConn,
 		Choked:   true,
+		Choking:  true,
 		Peer:     peer,
 		InfoHash: hash,
 		Name:     name,
-		Timeout:  timeout,
+		Timeout:  config.Timeout,
+		Logger:   logger,
 	}
 
 	// try to complete handshake with peer
-	_, err = conn.handshake(hash, name)
+	res, err := conn.handshake(ctx, config.handshakeTimeout(), hash, name)
 	if err != nil {
 		return nil, err
 	}
+	logger.Debugf("handshake complete, peer id %x", res.Identifier)
+
+	// verify the peer id advertised for the peer
+	if peer.ID != ([20]byte{}) && res.Identifier != peer.ID {
+		return nil, fmt.Errorf("peer id %x doesn't match advertised %x", res.Identifier, peer.ID)
+	}
+
+	if err := conn.setup(ctx, res, config); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// setup negotiates the extensions supported by both sides using the peer's
+// handshake, and exchanges bitfields and extended handshakes with the peer.
+// The peer's extended handshake is processed by Read whenever it arrives.
+func (c *Conn) setup(ctx context.Context, res *message.Handshake, config *Config) error {
+	c.PeerID = res.Identifier
+	c.Capabilities = res.Capabilities()
+	c.Fast = c.Supports(ExtFast)
+	c.Extended = c.Supports(ExtLTEP)
+	c.pieces = config.Pieces
+	c.WriteTimeout = config.WriteTimeout
+	c.IdleTimeout = config.IdleTimeout
+	c.MaxMessageLength = config.MaxMessageLength
+	c.StrictMessages = config.StrictMessages
+	c.DownloadLimiter = config.DownloadLimiter
+	c.UploadLimiter = config.UploadLimiter
+	c.Tracer = config.Tracer
+	c.AllowedFast = bitfield.Empty(config.Pieces)
+	c.OurBitfield = config.Bitfield
+
+	// send our bitfield
+	if err := c.sendBitfield(config.Bitfield, config.Pieces); err != nil {
+		return err
+	}
+
+	// send our extended handshake
+	if c.Extended {
+		if err := c.sendExtendedHandshake(config.Extensions); err != nil {
+			return err
+		}
+	}
 
 	// get peer's bitfield
-	b, err := conn.getBitfield()
+	b, err := c.getBitfield(ctx, config.exchangeTimeout(), config.Pieces)
 	if err != nil {
+		return err
+	}
+	c.Bitfield = b
+	c.logger().Debugf("received bitfield")
+
+	c.startKeepAlive(config.KeepAlive)
+	return nil
+}
+
+// dial dials a connection with the peer, and completes the encryption
+// handshake according to the encryption policy.
+func dial(ctx context.Context, peer Peer, hash [20]byte, config *Config) (net.Conn, error) {
+	timeout := config.handshakeTimeout()
+
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = config.NetDialer()
+	}
+
+	connect := func(network, address string) (net.Conn, error) {
+		ctx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	netConn, err := connect("tcp", peer.String())
+	if err != nil || config.Encryption == mse.Disabled {
+		return netConn, err
+	}
+
+	// set encryption handshake deadline
+	netConn.SetDeadline(deadline(ctx, timeout))
+	stop := interrupt(ctx, netConn)
+	encConn, err := mse.Initiate(netConn, hash, config.Encryption.Methods())
+	stop()
+	if err == nil {
+		netConn.SetDeadline(time.Time{}) // disable deadline
+		return encConn, nil
+	}
+
+	netConn.Close()
+	if config.Encryption == mse.Required || ctx.Err() != nil {
 		return nil, err
 	}
-	conn.Bitfield = b
 
-	return conn, nil
+	// peer may not support encryption, retry in plaintext
+	return connect("tcp", peer.String())
 }
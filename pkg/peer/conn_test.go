@@ -0,0 +1,275 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/mse"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestSend(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local}
+
+	sends := []struct {
+		send func() error
+		msg  message.Message
+	}{
+		{conn.Choke, message.Message{Identifier: message.Choke}},
+		{conn.UnChoke, message.Message{Identifier: message.UnChoke}},
+		{conn.Interested, message.Message{Identifier: message.Interested}},
+		{conn.NotInterested, message.Message{Identifier: message.NotInterested}},
+		{func() error { return conn.Have(3) }, *message.NewHave(3)},
+		{func() error { return conn.Port(6881) }, message.Message{Identifier: message.Port, Payload: []byte{0x1a, 0xe1}}},
+		{func() error { return conn.SendBitfield(bitfield.Full(8)) }, message.Message{Identifier: message.Bitfield, Payload: []byte{0xff}}},
+	}
+
+	for _, s := range sends {
+		errs := make(chan error, 1)
+		go func() { errs <- s.send() }()
+
+		msg, err := message.Read(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Identifier != s.msg.Identifier || string(msg.Payload) != string(s.msg.Payload) {
+			t.Errorf("sent %v %x, expected %v %x", msg.Identifier, msg.Payload, s.msg.Identifier, s.msg.Payload)
+		}
+
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// writes to peers which don't read time out
+	conn.WriteTimeout = 10 * time.Millisecond
+	if err := conn.Interested(); err == nil {
+		t.Error("write to blocked peer didn't time out")
+	}
+}
+
+func TestFastBitfields(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+
+	ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+		Name:    [20]byte{'s'},
+		Timeout: time.Second,
+		Lookup: func(h [20]byte) (*peer.Config, bool) {
+			return &peer.Config{Timeout: time.Second, Bitfield: bitfield.Full(10), Pieces: 10}, h == hash
+		},
+		Encryption: mse.Disabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, fast := range []bool{true, false} {
+		netConn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer netConn.Close()
+		netConn.SetDeadline(time.Now().Add(time.Second))
+
+		req := message.NewHandshake(hash, [20]byte{'c'})
+		if !fast {
+			req.Reserved = [8]byte{}
+		}
+
+		if _, err := netConn.Write(req.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := message.ReadHandshake(netConn); err != nil {
+			t.Fatal(err)
+		}
+
+		// a full bitfield is sent as HaveAll to fast peers
+		expected := message.Bitfield
+		if fast {
+			expected = message.HaveAll
+		}
+
+		if msg, err := message.Read(netConn); err != nil || msg == nil || msg.Identifier != expected {
+			t.Fatalf("fast %v: received %v, %v instead of %v", fast, msg, err, expected)
+		}
+
+		// HaveNone is only understood by fast peers
+		if fast {
+			netConn.Write((&message.Message{Identifier: message.HaveNone}).Serialize())
+		} else {
+			netConn.Write((&message.Message{Identifier: message.Bitfield, Payload: make([]byte, 2)}).Serialize())
+		}
+
+		in, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if in.Fast != fast || in.Bitfield.Any() || len(in.Bitfield.Bytes()) != 2 {
+			t.Errorf("fast %v: negotiated fast %v, bitfield %v", fast, in.Fast, in.Bitfield.Bytes())
+		}
+
+		if !fast {
+			in.Conn.Close()
+			continue
+		}
+
+		// HaveAll replaces the bitfield while running
+		received := make(chan bitfield.Bitfield, 1)
+		in.Handle(&peer.Handlers{
+			Bitfield: func(b bitfield.Bitfield) error {
+				received <- b.Clone()
+				return nil
+			},
+		})
+
+		done := make(chan error, 1)
+		go func() { done <- in.Run(context.Background()) }()
+
+		netConn.Write((&message.Message{Identifier: message.HaveAll}).Serialize())
+		if b := <-received; b.Count() != 10 {
+			t.Errorf("HaveAll set bitfield %v", b.Bytes())
+		}
+
+		in.Conn.Close()
+		<-done
+	}
+}
+
+// rawPeer returns a peer which completes the handshake without any
+// extensions, and then sends the provided messages.
+func rawPeer(t *testing.T, hash [20]byte, msgs ...*message.Message) peer.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		netConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+
+		if _, err := message.ReadHandshake(netConn); err != nil {
+			return
+		}
+
+		res := message.NewHandshake(hash, [20]byte{'s'})
+		res.Reserved = [8]byte{}
+		netConn.Write(res.Serialize())
+
+		for _, msg := range msgs {
+			netConn.Write(msg.Serialize())
+		}
+		io.Copy(io.Discard, netConn)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestInvalidBitfield(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+
+	// the bitfields don't match the 10 pieces
+	for _, bits := range [][]byte{{0xff}, {0xff, 0xe0}} {
+		remote := rawPeer(t, hash, &message.Message{Identifier: message.Bitfield, Payload: bits})
+
+		_, err := peer.NewConn(remote, hash, [20]byte{'c'}, &peer.Config{
+			Timeout:    time.Second,
+			Encryption: mse.Disabled,
+			Pieces:     10,
+		})
+		if err == nil || !strings.Contains(err.Error(), "bitfield") {
+			t.Errorf("bitfield %08b accepted with error %v", bits, err)
+		}
+	}
+}
+
+func TestOptionalBitfield(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+
+	// the peer skips the bitfield, and sends haves later
+	remote := rawPeer(t, hash, message.NewHave(3))
+	conn, err := peer.NewConn(remote, hash, [20]byte{'c'}, &peer.Config{
+		Timeout:    time.Second,
+		Encryption: mse.Disabled,
+		Pieces:     10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Conn.Close()
+
+	if conn.Bitfield.Any() {
+		t.Errorf("implicit bitfield is %08b", conn.Bitfield.Bytes())
+	}
+
+	// the message read instead of the bitfield is handled by Run
+	haves := make(chan int, 1)
+	conn.Handle(&peer.Handlers{
+		Have: func(index int) error {
+			haves <- index
+			return nil
+		},
+	})
+	go conn.Run(context.Background())
+
+	if index := <-haves; index != 3 || !conn.Bitfield.Has(3) {
+		t.Errorf("received have %d, bitfield %08b", index, conn.Bitfield.Bytes())
+	}
+
+	// the peer sends nothing
+	remote = rawPeer(t, hash)
+	conn, err = peer.NewConn(remote, hash, [20]byte{'c'}, &peer.Config{
+		Timeout:         time.Second,
+		ExchangeTimeout: 20 * time.Millisecond,
+		Encryption:      mse.Disabled,
+		Pieces:          10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Conn.Close()
+
+	if conn.Bitfield.Any() {
+		t.Errorf("implicit bitfield is %08b", conn.Bitfield.Bytes())
+	}
+}
+
+func TestMaxMessageLength(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local, MaxMessageLength: 64}
+
+	go func() {
+		remote.Write(message.NewHave(1).Serialize())
+		remote.Write((&message.Message{Identifier: message.Piece, Payload: make([]byte, 100)}).Serialize())
+	}()
+
+	if _, err := conn.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Read(); !errors.Is(err, message.ErrMessageTooLarge) {
+		t.Errorf("read message longer than the limit with error %v", err)
+	}
+}
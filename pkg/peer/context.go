@@ -0,0 +1,123 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+// ReadContext is like Read, but the read is aborted when the context is
+// done, in which case the context's error is returned. The Conn shouldn't
+// be used after an aborted read, since a partial message may have been
+// read.
+func (c *Conn) ReadContext(ctx context.Context) (*message.Message, error) {
+	stop := interrupt(ctx, c.Conn)
+	msg, err := c.Read()
+	stop()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return msg, err
+}
+
+// Close shuts down the Conn in an orderly manner. It stops the keep-alives
+// and the waits for the limiters, forgets the outstanding requests, waits
+// for the write in progress, and closes the writing side of the connection,
+// so that the peer receives all the sent messages, before closing it.
+// Waiting for the write is bounded by the context, and the connection is
+// closed immediately if the context is already done.
+func (c *Conn) Close(ctx context.Context) error {
+	c.ClearRequests()
+	c.closed()
+	c.cancel()
+
+	if ctx.Err() == nil {
+		// abort a blocked write when the context is done
+		if d, ok := ctx.Deadline(); ok {
+			c.Conn.SetWriteDeadline(d)
+		}
+		stop := interrupt(ctx, c.Conn)
+
+		c.writeMu.Lock()
+		if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		c.writeMu.Unlock()
+
+		stop()
+	}
+
+	return c.Conn.Close()
+}
+
+// closed returns a context which is done once the Conn is closed. It is
+// created lazily, so that Conns can be created without NewConn.
+func (c *Conn) closed() context.Context {
+	c.doneOnce.Do(func() {
+		c.done, c.cancel = context.WithCancel(context.Background())
+	})
+
+	return c.done
+}
+
+// deadline returns the deadline of an operation which times out after the
+// provided timeout, if it is positive, or when the context's deadline
+// expires, whichever is earlier. The deadline has passed if the context is
+// done, and is zero if there is no deadline.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	if ctx.Err() != nil {
+		return time.Now()
+	}
+
+	d, ok := ctx.Deadline()
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); !ok || t.Before(d) {
+			d = t
+		}
+	}
+
+	return d
+}
+
+// interrupt aborts blocked reads and writes on the connection when the
+// context is done, until the returned function is called.
+func interrupt(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {} // never done
+	}
+
+	stopped := make(chan struct{}) // closed by stop
+	done := make(chan struct{})    // closed when the watcher exits
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
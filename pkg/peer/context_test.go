@@ -0,0 +1,103 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/mse"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestNewConnContext(t *testing.T) {
+	// a peer which accepts connections, but never completes the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	remote := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = peer.NewConnContext(ctx, remote, [20]byte{1}, [20]byte{'c'}, &peer.Config{
+		Timeout:    10 * time.Second,
+		Encryption: mse.Disabled,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled handshake returned %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled handshake took %v", elapsed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	netConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: netConn}
+	if err := conn.Have(1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer receives the sent messages before the end of the stream
+	if msg, err := message.Read(remote); err != nil || msg.Identifier != message.Have {
+		t.Errorf("read %v with error %v", msg, err)
+	}
+
+	if _, err := message.Read(remote); err != io.EOF {
+		t.Errorf("read after close returned %v, expected EOF", err)
+	}
+
+	// reads are aborted by their context
+	local, other := net.Pipe()
+	defer other.Close()
+
+	in := &peer.Conn{Conn: local}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	if _, err := in.ReadContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled read returned %v", err)
+	}
+}
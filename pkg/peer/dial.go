@@ -0,0 +1,213 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultMaxHalfOpen is the default maximum number of dials which a
+// DialQueue keeps in progress.
+const DefaultMaxHalfOpen = 32
+
+// ErrDialQueueStopped is reported for the peers which were not dialed
+// because the DialQueue stopped.
+var ErrDialQueueStopped = errors.New("peer: dial queue stopped")
+
+// DialQueueConfig contains the configuration of a DialQueue.
+type DialQueueConfig struct {
+	// MaxHalfOpen is the maximum number of dials in progress. It defaults
+	// to DefaultMaxHalfOpen.
+	MaxHalfOpen int
+
+	// Timeout limits each attempt to connect to a peer, if it is positive.
+	Timeout time.Duration
+
+	// Score returns the priority of a peer, like its Reputation score.
+	// Queued peers with higher scores are dialed first, while peers with
+	// equal scores are dialed in order. If it is nil, all the peers are
+	// dialed in order.
+	Score func(p Peer) float64
+
+	// Dial connects to the provided peer, like NewConn.
+	Dial func(ctx context.Context, p Peer) (*Conn, error)
+
+	// OnConnect is called with each established connection, and OnFailure
+	// with the error of each failed attempt. They are called concurrently,
+	// and should not block.
+	OnConnect func(p Peer, conn *Conn)
+	OnFailure func(p Peer, err error)
+}
+
+// DialQueue dials a stream of candidate peers, keeping a limited number of
+// dials in progress at a time, so that connecting to a large number of
+// peers doesn't exhaust the available sockets.
+type DialQueue struct {
+	config DialQueueConfig
+
+	mu      sync.Mutex
+	pending []Peer        // peers waiting to be dialed
+	stopped bool          // whether Run has stopped
+	notify  chan struct{} // signalled when peers are pushed
+}
+
+// NewDialQueue creates a new empty DialQueue.
+func NewDialQueue(config DialQueueConfig) *DialQueue {
+	if config.MaxHalfOpen <= 0 {
+		config.MaxHalfOpen = DefaultMaxHalfOpen
+	}
+
+	return &DialQueue{
+		config: config,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Push adds the provided peers to the end of the queue. If the queue has
+// stopped, the peers are reported as failed with ErrDialQueueStopped.
+func (q *DialQueue) Push(peers ...Peer) {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		q.fail(peers, ErrDialQueueStopped)
+		return
+	}
+
+	q.pending = append(q.pending, peers...)
+	q.mu.Unlock()
+
+	// signal Run without blocking
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the number of peers waiting to be dialed.
+func (q *DialQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending)
+}
+
+// Run dials the queued peers in order of priority, until the context is
+// cancelled. It then waits for the dials in progress, reports the remaining
+// peers as failed with ErrDialQueueStopped, and returns the context's error.
+func (q *DialQueue) Run(ctx context.Context) error {
+	slots := make(chan struct{}, q.config.MaxHalfOpen)
+
+	var dials sync.WaitGroup
+	defer dials.Wait()
+
+	for {
+		// wait for a free slot
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return q.stop(ctx)
+		}
+
+		// wait for a peer to dial
+		p, ok := q.pop()
+		for !ok {
+			select {
+			case <-q.notify:
+				p, ok = q.pop()
+			case <-ctx.Done():
+				return q.stop(ctx)
+			}
+		}
+
+		dials.Add(1)
+		go func() {
+			defer dials.Done()
+
+			conn, err := q.dial(ctx, p)
+			<-slots // free the slot before the callbacks
+
+			if err != nil {
+				q.fail([]Peer{p}, err)
+				return
+			}
+
+			if q.config.OnConnect != nil {
+				q.config.OnConnect(p, conn)
+			}
+		}()
+	}
+}
+
+// dial tries to connect to the provided peer, within the attempt timeout.
+func (q *DialQueue) dial(ctx context.Context, p Peer) (*Conn, error) {
+	if q.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.config.Timeout)
+		defer cancel()
+	}
+
+	return q.config.Dial(ctx, p)
+}
+
+// pop removes the first peer with the highest score from the queue, and
+// reports whether the queue wasn't empty.
+func (q *DialQueue) pop() (Peer, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return Peer{}, false
+	}
+
+	best := 0
+	if q.config.Score != nil {
+		bestScore := q.config.Score(q.pending[0])
+		for i, p := range q.pending[1:] {
+			if score := q.config.Score(p); score > bestScore {
+				best, bestScore = i+1, score
+			}
+		}
+	}
+
+	p := q.pending[best]
+	q.pending = append(q.pending[:best], q.pending[best+1:]...)
+	return p, true
+}
+
+// stop marks the queue as stopped, and reports the remaining peers as
+// failed.
+func (q *DialQueue) stop(ctx context.Context) error {
+	q.mu.Lock()
+	q.stopped = true
+	pending := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	q.fail(pending, ErrDialQueueStopped)
+	return ctx.Err()
+}
+
+// fail reports the provided peers as failed with the provided error.
+func (q *DialQueue) fail(peers []Peer, err error) {
+	if q.config.OnFailure == nil {
+		return
+	}
+
+	for _, p := range peers {
+		q.config.OnFailure(p, err)
+	}
+}
@@ -0,0 +1,87 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestDialQueue(t *testing.T) {
+	var mu sync.Mutex
+	open, maxOpen := 0, 0 // dials in progress
+	failed := make(chan error, 20)
+	connected := make(chan peer.Peer, 20)
+
+	q := peer.NewDialQueue(peer.DialQueueConfig{
+		MaxHalfOpen: 2,
+		Timeout:     50 * time.Millisecond,
+		Dial: func(ctx context.Context, p peer.Peer) (*peer.Conn, error) {
+			mu.Lock()
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				open--
+				mu.Unlock()
+			}()
+
+			// odd ports never answer, and time out
+			if p.Port%2 == 1 {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			return &peer.Conn{Peer: p}, nil
+		},
+		OnConnect: func(p peer.Peer, conn *peer.Conn) { connected <- p },
+		OnFailure: func(p peer.Peer, err error) { failed <- err },
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- q.Run(ctx) }()
+
+	for port := uint16(1); port <= 6; port++ {
+		q.Push(peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	}
+
+	for i := 0; i < 6; i++ {
+		select {
+		case p := <-connected:
+			if p.Port%2 == 1 {
+				t.Errorf("connected to unreachable peer %v", p)
+			}
+		case err := <-failed:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("dial failed with %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("dials didn't finish")
+		}
+	}
+
+	if maxOpen > 2 {
+		t.Errorf("%v dials in progress, expected at most 2", maxOpen)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v", err)
+	}
+
+	// peers pushed after the queue stops are failed
+	q.Push(peer.Peer{Port: 2})
+	if err := <-failed; err != peer.ErrDialQueueStopped {
+		t.Errorf("peer pushed after stop failed with %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import "laptudirm.com/x/mtor/pkg/message"
+
+// ClientVersion is the client name and version sent to peers in the
+// extended handshake.
+const ClientVersion = "mtor 0.1.0"
+
+// sendExtendedHandshake sends our extended handshake to the Conn, which
+// advertises the provided extensions.
+func (c *Conn) sendExtendedHandshake(extensions map[string]int) error {
+	h := &message.ExtendedHandshake{
+		M:    extensions,
+		V:    ClientVersion,
+		Reqq: DefaultMaxRequests,
+	}
+	h.SetYourIP(c.Peer.IP)
+
+	msg, err := message.NewExtendedHandshake(h)
+	if err != nil {
+		return err
+	}
+
+	return c.write(msg)
+}
+
+// readExtendedHandshake parses the peer's extended handshake, and stores
+// the extensions it supports. Extensions are disabled if the message id
+// advertised for them is 0. Later handshakes update the earlier ones.
+func (c *Conn) readExtendedHandshake(msg *message.Message) error {
+	h, err := message.ParseExtendedHandshake(msg)
+	if err != nil {
+		return err
+	}
+
+	c.Extensions = h.Merge(c.Extensions)
+
+	if h.V != "" {
+		c.PeerVersion = h.V
+	}
+
+	if h.Reqq > 0 {
+		c.PeerMaxRequests = h.Reqq
+	}
+
+	if ip := h.IP(); ip != nil {
+		c.YourIP = ip
+	}
+
+	return nil
+}
+
+// isExtendedHandshake checks if the provided message is an extended
+// handshake.
+func isExtendedHandshake(msg *message.Message) bool {
+	if msg == nil {
+		return false
+	}
+
+	extID, _, err := message.ParseExtended(msg)
+	return err == nil && extID == message.ExtendedHandshakeID
+}
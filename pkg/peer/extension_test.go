@@ -0,0 +1,101 @@
+package peer_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/mse"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestExtendedHandshake(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+
+	ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+		Name:    [20]byte{'s'},
+		Timeout: time.Second,
+		Lookup: func(h [20]byte) (*peer.Config, bool) {
+			return &peer.Config{
+				Timeout:    time.Second,
+				Pieces:     10,
+				Extensions: map[string]int{"ut_metadata": 3},
+			}, h == hash
+		},
+		Encryption: mse.Disabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan *peer.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	conn, err := peer.NewConn(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, hash, [20]byte{'c'}, &peer.Config{
+		Timeout:    time.Second,
+		Pieces:     10,
+		Extensions: map[string]int{"ut_pex": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Conn.Close()
+
+	in := <-accepted
+	if in == nil {
+		t.FailNow()
+	}
+	defer in.Conn.Close()
+
+	if !conn.Extended || !in.Extended {
+		t.Fatalf("extension protocol not negotiated")
+	}
+
+	if !conn.Supports(peer.ExtLTEP|peer.ExtFast) || conn.Supports(peer.ExtDHT) {
+		t.Errorf("peer advertised capabilities %b", conn.Capabilities)
+	}
+
+	// the extended handshakes are sent after the bitfields
+	for _, c := range []*peer.Conn{conn, in} {
+		if c.Extensions == nil {
+			if _, err := c.Read(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if id := conn.Extensions["ut_metadata"]; id != 3 || len(conn.Extensions) != 1 {
+		t.Errorf("client received extensions %v", conn.Extensions)
+	}
+
+	if id := in.Extensions["ut_pex"]; id != 1 || len(in.Extensions) != 1 {
+		t.Errorf("listener received extensions %v", in.Extensions)
+	}
+
+	if conn.PeerVersion != peer.ClientVersion || conn.PeerMaxRequests != peer.DefaultMaxRequests {
+		t.Errorf("client received version %q, reqq %v", conn.PeerVersion, conn.PeerMaxRequests)
+	}
+
+	if !in.YourIP.Equal(addr.IP) {
+		t.Errorf("listener received yourip %v, expected %v", in.YourIP, addr.IP)
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	c := peer.ParseCapabilities([8]byte{5: 0x10, 7: 0x01})
+	if !c.Has(peer.ExtLTEP|peer.ExtDHT) || c.Has(peer.ExtFast) {
+		t.Errorf("parsed capabilities %b", c)
+	}
+
+	if c := peer.ParseCapabilities([8]byte{0: 0xff}); c != 0 {
+		t.Errorf("unknown bits parsed as capabilities %b", c)
+	}
+}
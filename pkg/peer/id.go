@@ -0,0 +1,74 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// ClientPrefix is the Azureus-style prefix of the generated peer ids, which
+// identifies the client as mtor 0.1.0.
+const ClientPrefix = "-MT0100-"
+
+// idChars are the characters used for the random part of peer ids, which
+// keeps them readable in tracker logs and urls.
+const idChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// NewID generates a new peer id starting with the provided prefix, followed
+// by random alphanumeric characters. If prefix is empty, ClientPrefix is
+// used.
+func NewID(prefix string) ([20]byte, error) {
+	var id [20]byte
+
+	if prefix == "" {
+		prefix = ClientPrefix
+	}
+
+	if len(prefix) > len(id) {
+		return id, fmt.Errorf("peer id prefix %q longer than %v bytes", prefix, len(id))
+	}
+
+	n := copy(id[:], prefix)
+	if _, err := rand.Read(id[n:]); err != nil {
+		return id, err
+	}
+
+	for i := n; i < len(id); i++ {
+		id[i] = idChars[int(id[i])%len(idChars)]
+	}
+
+	return id, nil
+}
+
+var (
+	sessionID   [20]byte  // peer id of the session
+	sessionOnce sync.Once // guards generating sessionID
+)
+
+// SessionID returns a peer id with ClientPrefix, which is generated once
+// and reused for the rest of the process's lifetime.
+func SessionID() [20]byte {
+	sessionOnce.Do(func() {
+		id, err := NewID(ClientPrefix)
+		if err != nil {
+			panic(fmt.Sprintf("peer: generating session id: %v", err))
+		}
+
+		sessionID = id
+	})
+
+	return sessionID
+}
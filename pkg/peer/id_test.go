@@ -0,0 +1,39 @@
+package peer_test
+
+import (
+	"strings"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestNewID(t *testing.T) {
+	id, err := peer.NewID("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(id[:]), peer.ClientPrefix) {
+		t.Errorf("id %q doesn't start with %q", id, peer.ClientPrefix)
+	}
+
+	for _, c := range id[len(peer.ClientPrefix):] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			t.Errorf("id %q has non-alphanumeric random part", id)
+			break
+		}
+	}
+
+	id, err = peer.NewID("-XX1234-")
+	if err != nil || !strings.HasPrefix(string(id[:]), "-XX1234-") {
+		t.Errorf("id %q with error %v, expected prefix -XX1234-", id, err)
+	}
+
+	if _, err := peer.NewID(strings.Repeat("x", 21)); err == nil {
+		t.Error("generated id with prefix longer than 20 bytes")
+	}
+
+	if peer.SessionID() != peer.SessionID() {
+		t.Error("session id changed")
+	}
+}
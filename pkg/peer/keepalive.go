@@ -0,0 +1,88 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import "time"
+
+// KeepAliveInterval is the default interval after which a keep-alive
+// message is sent to an idle peer. Peers usually drop connections which are
+// silent for more than two minutes.
+const KeepAliveInterval = 2 * time.Minute
+
+// LastSend returns the time the last message was sent to the peer.
+func (c *Conn) LastSend() time.Time {
+	c.timeMu.Lock()
+	defer c.timeMu.Unlock()
+
+	return c.lastSend
+}
+
+// LastReceive returns the time the last message was received from the
+// peer, including keep-alives.
+func (c *Conn) LastReceive() time.Time {
+	c.timeMu.Lock()
+	defer c.timeMu.Unlock()
+
+	return c.lastReceive
+}
+
+// touch sets the provided time to the current time.
+func (c *Conn) touch(t *time.Time) {
+	c.timeMu.Lock()
+	defer c.timeMu.Unlock()
+
+	*t = time.Now()
+}
+
+// startKeepAlive starts sending keep-alives at the provided interval, until
+// the Conn is closed or writing fails.
+func (c *Conn) startKeepAlive(interval time.Duration) {
+	if interval < 0 {
+		return
+	}
+
+	if interval == 0 {
+		interval = KeepAliveInterval
+	}
+
+	go c.keepAlive(interval)
+}
+
+// keepAlive sends a keep-alive whenever nothing was sent to the peer for
+// the provided interval.
+func (c *Conn) keepAlive(interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.closed().Done():
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(c.LastSend())
+		if idle >= interval {
+			if err := c.write(nil); err != nil {
+				c.logger().Debugf("keep-alive failed: %v", err)
+				return
+			}
+			c.logger().Debugf("sent keep-alive")
+
+			idle = 0
+		}
+
+		timer.Reset(interval - idle)
+	}
+}
@@ -0,0 +1,78 @@
+package peer_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/mse"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestKeepAlive(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+
+	ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+		Timeout: time.Second,
+		Lookup: func(h [20]byte) (*peer.Config, bool) {
+			return &peer.Config{Timeout: time.Second, KeepAlive: -1}, h == hash
+		},
+		Encryption: mse.Disabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan *peer.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	conn, err := peer.NewConn(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, hash, [20]byte{'c'}, &peer.Config{
+		Timeout:   time.Second,
+		KeepAlive: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+
+	in := <-accepted
+	if in == nil {
+		t.FailNow()
+	}
+	defer in.Close(context.Background())
+
+	sent := conn.LastSend()
+	in.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		msg, err := in.Read()
+		if err != nil {
+			t.Fatalf("no keep-alive received: %v", err)
+		}
+
+		if msg == nil {
+			break
+		}
+	}
+
+	// the send time is recorded after the write returns
+	for i := 0; i < 100 && !conn.LastSend().After(sent); i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if !conn.LastSend().After(sent) {
+		t.Errorf("last send %v not updated from %v", conn.LastSend(), sent)
+	}
+
+	if time.Since(in.LastReceive()) > time.Second {
+		t.Errorf("last receive %v not updated", in.LastReceive())
+	}
+}
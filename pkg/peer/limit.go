@@ -0,0 +1,112 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limiter shapes the bandwidth of a Conn. It is implemented by
+// *rate.Limiter from golang.org/x/time/rate, and by the token buckets
+// returned by NewLimiter. A Limiter may be shared by many Conns to shape
+// the bandwidth of the whole client, while each Conn may also have its own.
+type Limiter interface {
+	// WaitN blocks until n bytes may be transferred, or the context is
+	// done. It fails if n is larger than the Limiter's burst.
+	WaitN(ctx context.Context, n int) error
+
+	// Burst returns the maximum number of bytes which may be transferred
+	// at once.
+	Burst() int
+}
+
+// NewLimiter returns a token bucket Limiter which allows rate bytes per
+// second to be transferred on average, with bursts of up to burst bytes.
+func NewLimiter(rate, burst int) Limiter {
+	return &bucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// bucket is a token bucket Limiter.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64   // tokens added per second
+	burst  int       // capacity of the bucket
+	tokens float64   // tokens in the bucket, negative if reserved ahead
+	last   time.Time // time tokens were last added
+}
+
+// Burst implements Limiter.
+func (b *bucket) Burst() int {
+	return b.burst
+}
+
+// WaitN implements Limiter.
+func (b *bucket) WaitN(ctx context.Context, n int) error {
+	if n > b.burst {
+		return fmt.Errorf("limiter: wait of %d bytes exceeds burst of %d", n, b.burst)
+	}
+
+	// reserve the tokens, and wait till they are available
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// return the unused reservation
+		b.mu.Lock()
+		b.tokens += float64(n)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// wait waits for the Limiter, if any, to allow n bytes to be transferred.
+// Waits longer than the Limiter's burst are clamped to it, since they could
+// never succeed, and waiting is aborted when the Conn is closed.
+func (c *Conn) wait(l Limiter, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	if burst := l.Burst(); n > burst {
+		n = burst
+	}
+
+	return l.WaitN(c.closed(), n)
+}
@@ -0,0 +1,117 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// recordingLimiter records the waits without limiting.
+type recordingLimiter struct {
+	waits []int
+}
+
+func (l *recordingLimiter) Burst() int {
+	return 8
+}
+
+func (l *recordingLimiter) WaitN(_ context.Context, n int) error {
+	l.waits = append(l.waits, n)
+	return nil
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := peer.NewLimiter(1000, 100)
+
+	// the burst is available immediately
+	start := time.Now()
+	if err := limiter.WaitN(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next 50 bytes take 50ms at 1000 bytes per second
+	if err := limiter.WaitN(context.Background(), 50); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("waited %v for 150 bytes", elapsed)
+	}
+
+	if err := limiter.WaitN(context.Background(), 101); err == nil {
+		t.Error("waited for more than the burst")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.WaitN(ctx, 100); err == nil {
+		t.Error("waited with a cancelled context")
+	}
+
+	// closing the conn aborts waits for its limiters
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local, DownloadLimiter: limiter}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Close(context.Background())
+	}()
+
+	if err := conn.Request(0, 0, 100); err == nil {
+		t.Error("request sent after conn was closed")
+	}
+}
+
+func TestConnLimiters(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	download, upload := &recordingLimiter{}, &recordingLimiter{}
+	conn := &peer.Conn{
+		Conn:            local,
+		DownloadLimiter: download,
+		UploadLimiter:   upload,
+	}
+
+	go func() {
+		message.Read(remote)
+		remote.Write(message.NewRequest(0, 0, 4).Serialize())
+		message.Read(remote)
+		remote.Close() // stop serving
+	}()
+
+	if err := conn.Request(0, 0, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Serve(&peer.ServeConfig{
+		Reader:       peer.FromPieces(pieceList{[]byte("abcd")}),
+		MaxBlockSize: 4,
+	})
+
+	// waits are clamped to the burst
+	if len(download.waits) != 1 || download.waits[0] != 8 {
+		t.Errorf("download limiter waited for %v", download.waits)
+	}
+	if len(upload.waits) != 1 || upload.waits[0] != 4 {
+		t.Errorf("upload limiter waited for %v", upload.waits)
+	}
+}
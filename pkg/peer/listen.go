@@ -0,0 +1,268 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/log"
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/mse"
+)
+
+// ErrUnknownTorrent is returned when a peer connects for a torrent which
+// isn't being served.
+var ErrUnknownTorrent = errors.New("peer: unknown torrent")
+
+// DefaultHandshakeTimeout is the handshake timeout of inbound connections
+// if none is configured, so that connections which never complete their
+// handshakes are always dropped.
+const DefaultHandshakeTimeout = 30 * time.Second
+
+// ListenConfig contains the configuration used to accept inbound Conns.
+type ListenConfig struct {
+	Name    [20]byte      // our peer id
+	Timeout time.Duration // handshake timeout, DefaultHandshakeTimeout if 0
+	Logger  log.Logger    // logger, or nil to discard logs
+
+	// Lookup returns the configuration of the torrent with the provided
+	// infohash, and whether it is being served.
+	Lookup func(hash [20]byte) (*Config, bool)
+
+	// Encryption is the message stream encryption policy. If it is Enabled,
+	// both encrypted and plaintext connections are accepted.
+	Encryption mse.Policy
+	// Hashes returns the infohashes of the torrents being served, which
+	// are needed to identify the torrent of an encrypted connection. It is
+	// required unless encryption is Disabled.
+	Hashes func() [][20]byte
+
+	// ReusePort sets SO_REUSEPORT on the listener, so that outbound Conns
+	// with ReusePort set can be dialed from its port. It is only supported
+	// on linux.
+	ReusePort bool
+}
+
+// Listener accepts inbound connections from peers, completing their
+// handshakes concurrently.
+type Listener struct {
+	ln     net.Listener
+	config *ListenConfig
+	logger log.Logger
+
+	conns chan *Conn    // connections which completed the handshake
+	done  chan struct{} // closed when the listener stops
+	err   error         // error which stopped the listener
+	once  sync.Once     // guards closing done
+
+	ctx    context.Context    // cancelled when the listener is closed
+	cancel context.CancelFunc // cancels ctx
+}
+
+// Listen listens for peer connections on the provided tcp address.
+func Listen(addr string, config *ListenConfig) (*Listener, error) {
+	if config.Encryption != mse.Disabled && config.Hashes == nil {
+		return nil, errors.New("peer: encrypted listener without infohashes")
+	}
+
+	lc := &net.ListenConfig{}
+	if config.ReusePort {
+		lc.Control = reusePort
+	}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		ln:     ln,
+		config: config,
+		logger: log.OrDiscard(config.Logger).Scope("listener"),
+		conns:  make(chan *Conn),
+		done:   make(chan struct{}),
+	}
+
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+
+	go l.run()
+	return l, nil
+}
+
+// Accept waits for the next peer to complete its handshake, and returns
+// its Conn. Peers which fail the handshake are dropped.
+func (l *Listener) Accept() (*Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Addr returns the address the listener is listening on.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Close stops the listener. Connections which are completing their
+// handshakes are aborted and closed.
+func (l *Listener) Close() error {
+	l.cancel()
+	return l.ln.Close()
+}
+
+// run accepts connections until the listener is closed.
+func (l *Listener) run() {
+	for {
+		netConn, err := l.ln.Accept()
+		if err != nil {
+			l.once.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+
+		go l.accept(netConn)
+	}
+}
+
+// accept completes the handshake of an inbound connection, and passes it
+// on to Accept.
+func (l *Listener) accept(netConn net.Conn) {
+	conn, err := l.handshake(l.ctx, netConn)
+	if err != nil {
+		l.logger.Debugf("inbound handshake with %s failed: %v", netConn.RemoteAddr(), err)
+		netConn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close(context.Background())
+	}
+}
+
+// handshake completes the handshake of an inbound connection. The peer's
+// handshake is read first, to find the torrent it is connecting for. The
+// handshake is aborted when the context is done.
+func (l *Listener) handshake(ctx context.Context, netConn net.Conn) (*Conn, error) {
+	timeout := l.config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	netConn.SetDeadline(deadline(ctx, timeout))
+	defer netConn.SetDeadline(time.Time{}) // disable deadline
+	defer interrupt(ctx, netConn)()
+
+	netConn, err := l.decrypt(netConn)
+	if err != nil {
+		return nil, err
+	}
+
+	// await a handshake from the peer
+	res, err := message.ReadHandshake(netConn)
+	if err != nil {
+		return nil, err
+	}
+
+	config, ok := l.config.Lookup(res.InfoHash)
+	if !ok {
+		return nil, ErrUnknownTorrent
+	}
+
+	// reply with our handshake
+	req := message.NewHandshake(res.InfoHash, l.config.Name)
+	if _, err := netConn.Write(req.Serialize()); err != nil {
+		return nil, err
+	}
+
+	peer := Peer{}
+	if addr, ok := netConn.RemoteAddr().(*net.TCPAddr); ok {
+		peer = Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	conn := &Conn{
+		Conn:     netConn,
+		Choked:   true,
+		Choking:  true,
+		Inbound:  true,
+		Peer:     peer,
+		InfoHash: res.InfoHash,
+		Name:     l.config.Name,
+		Timeout:  config.Timeout,
+		Logger:   log.OrDiscard(config.Logger).Scope(peer.String()),
+	}
+	conn.logger().Debugf("inbound handshake complete, peer id %x", res.Identifier)
+
+	if err := conn.setup(ctx, res, config); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// decrypt completes the encryption handshake of an inbound connection, if
+// it doesn't start with a plaintext handshake, according to the encryption
+// policy.
+func (l *Listener) decrypt(netConn net.Conn) (net.Conn, error) {
+	conn := &peekedConn{Conn: netConn, r: bufio.NewReader(netConn)}
+
+	// a plaintext connection starts with the protocol name
+	prefix := append([]byte{byte(len(message.ProtocolName))}, message.ProtocolName...)
+	start, err := conn.r.Peek(len(prefix))
+	plaintext := err == nil && bytes.Equal(start, prefix)
+
+	switch {
+	case plaintext && l.config.Encryption != mse.Required:
+		return conn, nil
+	case plaintext:
+		return nil, errors.New("peer: plaintext connection refused")
+	case l.config.Encryption == mse.Disabled:
+		return nil, errors.New("peer: encrypted connection refused")
+	}
+
+	lookup := func(skeyHash [20]byte) ([20]byte, bool) {
+		for _, hash := range l.config.Hashes() {
+			if mse.SKeyHash(hash) == skeyHash {
+				return hash, true
+			}
+		}
+
+		return [20]byte{}, false
+	}
+
+	return mse.Accept(conn, lookup, l.config.Encryption.Methods())
+}
+
+// peekedConn is a net.Conn whose reads go through a buffered reader, so
+// that data peeked from the connection isn't lost.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads data from the buffered reader.
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
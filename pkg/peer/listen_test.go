@@ -0,0 +1,239 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/mse"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestListen(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+	served := bitfield.Empty(10)
+	served.Set(3)
+
+	for _, policy := range []mse.Policy{mse.Disabled, mse.Enabled, mse.Required} {
+		ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+			Name:    [20]byte{'s'},
+			Timeout: time.Second,
+			Lookup: func(h [20]byte) (*peer.Config, bool) {
+				return &peer.Config{Timeout: time.Second, Bitfield: served, Pieces: 10}, h == hash
+			},
+			Encryption: policy,
+			Hashes:     func() [][20]byte { return [][20]byte{hash} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := ln.Addr().(*net.TCPAddr)
+		remote := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+		accepted := make(chan *peer.Conn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Error(err)
+			}
+			accepted <- conn
+		}()
+
+		conn, err := peer.NewConn(remote, hash, [20]byte{'c'}, &peer.Config{
+			Timeout:    time.Second,
+			Encryption: policy,
+			Pieces:     10,
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", policy, err)
+		}
+
+		if !conn.Bitfield.Has(3) || conn.Bitfield.Count() != 1 {
+			t.Errorf("%v: received bitfield %v", policy, conn.Bitfield.Bytes())
+		}
+
+		in := <-accepted
+		if in == nil || in.InfoHash != hash || !in.Fast {
+			t.Fatalf("%v: accepted conn %+v", policy, in)
+		}
+
+		// unknown torrents are refused
+		if _, err := peer.NewConn(remote, [20]byte{9}, [20]byte{'c'}, &peer.Config{
+			Timeout:    time.Second,
+			Encryption: policy,
+		}); err == nil {
+			t.Errorf("%v: connected for unknown torrent", policy)
+		}
+
+		conn.Conn.Close()
+		in.Conn.Close()
+		ln.Close()
+
+		if _, err := ln.Accept(); err == nil {
+			t.Errorf("%v: accepted from closed listener", policy)
+		}
+	}
+}
+
+// recordingDialer dials direct connections, recording the dialed addresses.
+type recordingDialer struct {
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.addrs = append(d.addrs, address)
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestDialer(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+
+	ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+		Timeout: time.Second,
+		Lookup: func(h [20]byte) (*peer.Config, bool) {
+			return &peer.Config{Timeout: time.Second}, h == hash
+		},
+		Encryption: mse.Disabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	remote := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	dialer := &recordingDialer{}
+	conn, err := peer.NewConn(remote, hash, [20]byte{'c'}, &peer.Config{
+		Timeout: time.Second,
+		Dialer:  dialer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Conn.Close()
+
+	if len(dialer.addrs) != 1 || dialer.addrs[0] != remote.String() {
+		t.Errorf("dialed %v, expected %v", dialer.addrs, remote)
+	}
+
+	// the peer id advertised for a peer is verified
+	go ln.Accept()
+	remote.ID = [20]byte{'x'}
+	if _, err := peer.NewConn(remote, hash, [20]byte{'c'}, &peer.Config{Timeout: time.Second}); err == nil {
+		t.Error("connected to peer with mismatched id")
+	}
+}
+
+func TestListenerHandshakes(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+
+	// handshakes don't time out without a timeout
+	ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+		Lookup: func(h [20]byte) (*peer.Config, bool) {
+			return &peer.Config{}, h == hash
+		},
+		Encryption: mse.Disabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	remote := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	conn, err := peer.NewConn(remote, hash, [20]byte{'c'}, &peer.Config{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Conn.Close()
+
+	// closing the listener aborts handshakes in progress
+	netConn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+
+	time.Sleep(10 * time.Millisecond) // let the handshake start
+	ln.Close()
+
+	netConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := netConn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("handshake in progress wasn't closed, read failed with %v", err)
+	}
+}
+
+// isTimeout checks if err is caused by a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestReusePort(t *testing.T) {
+	hash := [20]byte{1, 2, 3}
+
+	listen := func(reuse bool) *peer.Listener {
+		ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+			Name:    [20]byte{'s'},
+			Timeout: time.Second,
+			Lookup: func(h [20]byte) (*peer.Config, bool) {
+				return &peer.Config{Timeout: time.Second, Pieces: 10}, h == hash
+			},
+			ReusePort: reuse,
+		})
+		if err != nil {
+			t.Skipf("reusing ports isn't supported: %v", err)
+		}
+
+		t.Cleanup(func() { ln.Close() })
+		return ln
+	}
+
+	// dial a remote peer from the port of our listener
+	local, ln := listen(true), listen(false)
+
+	accepted := make(chan *peer.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	conn, err := peer.NewConn(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, hash, [20]byte{'c'}, &peer.Config{
+		Timeout:   time.Second,
+		Pieces:    10,
+		LocalAddr: local.Addr().(*net.TCPAddr),
+		ReusePort: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Conn.Close()
+
+	in := <-accepted
+	if in == nil {
+		t.Fatal("connection not accepted")
+	}
+	defer in.Conn.Close()
+
+	if port := local.Addr().(*net.TCPAddr).Port; int(in.Peer.Port) != port {
+		t.Errorf("peer connected from port %d, expected %d", in.Peer.Port, port)
+	}
+}
@@ -17,22 +17,39 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
+
+	"laptudirm.com/x/mtor/pkg/bencode"
 )
 
 // Peer represents a torrent peer.
 type Peer struct {
-	IP   net.IP // ip of the peer
-	Port uint16 // port of the peer
+	IP   net.IP   // ip of the peer
+	Port uint16   // port of the peer
+	ID   [20]byte // peer id of the peer, or zero if unknown
 }
 
-// String converts Peer to a string with the format ip:port.
+// String converts Peer to a string with the format ip:port, or [ip]:port
+// for ipv6 peers, which can be dialed.
 func (p Peer) String() string {
-	return fmt.Sprintf("%s:%v", p.IP, p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
-// Unmarshal parses peers from a byte array.
+// Unmarshal parses peers from a byte array of compact ipv4 peers.
 func Unmarshal(buffer []byte) ([]Peer, error) {
-	const peerLen = 6 // [4 bytes ip] [2 bytes port]
+	return unmarshal(buffer, net.IPv4len)
+}
+
+// Unmarshal6 parses peers from a byte array of compact ipv6 peers, like the
+// peers6 list of tracker responses (BEP 7).
+func Unmarshal6(buffer []byte) ([]Peer, error) {
+	return unmarshal(buffer, net.IPv6len)
+}
+
+// unmarshal parses peers from a byte array of compact peers with ips of the
+// provided length.
+func unmarshal(buffer []byte, ipLen int) ([]Peer, error) {
+	peerLen := ipLen + 2 // [ip] [2 bytes port]
 
 	length := len(buffer)
 	number := length / peerLen
@@ -43,8 +60,89 @@ func Unmarshal(buffer []byte) ([]Peer, error) {
 	peers := make([]Peer, number)
 	for i := 0; i < number; i++ {
 		offset := i * peerLen
-		peers[i].IP = net.IP(buffer[offset : offset+4])                      // get IP
-		peers[i].Port = binary.BigEndian.Uint16(buffer[offset+4 : offset+6]) // get port
+		peers[i].IP = net.IP(buffer[offset : offset+ipLen])                            // get IP
+		peers[i].Port = binary.BigEndian.Uint16(buffer[offset+ipLen : offset+peerLen]) // get port
 	}
 	return peers, nil
 }
+
+// Marshal encodes the ipv4 peers as a compact peer list, the inverse of
+// Unmarshal. Peers with ipv6 addresses are skipped.
+func Marshal(peers []Peer) []byte {
+	return marshal(peers, net.IPv4len)
+}
+
+// Marshal6 encodes the ipv6 peers as a compact peer list, the inverse of
+// Unmarshal6. Peers with ipv4 addresses, including ipv4-mapped ones, are
+// skipped.
+func Marshal6(peers []Peer) []byte {
+	return marshal(peers, net.IPv6len)
+}
+
+// marshal encodes the peers with ips of the provided length as a compact
+// peer list.
+func marshal(peers []Peer, ipLen int) []byte {
+	buffer := make([]byte, 0, len(peers)*(ipLen+2))
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue // ipv4 peer
+			}
+			ip = p.IP.To16()
+		}
+
+		if len(ip) != ipLen {
+			continue
+		}
+
+		// [ip] [2 bytes port]
+		buffer = append(buffer, ip...)
+		buffer = append(buffer, byte(p.Port>>8), byte(p.Port))
+	}
+
+	return buffer
+}
+
+// dictPeer represents a peer in the dictionary model of peer lists.
+type dictPeer struct {
+	IP   string `bencode:"ip"`      // ip or dns name of the peer
+	Port int    `bencode:"port"`    // port of the peer
+	ID   string `bencode:"peer id"` // optional peer id of the peer
+}
+
+// UnmarshalDict parses peers from a bencoded list of dictionaries with the
+// ip, port, and optional peer id of each peer, like the non-compact peer
+// lists of tracker responses. Peers with dns names instead of ips are
+// skipped.
+func UnmarshalDict(b []byte) ([]Peer, error) {
+	var list []dictPeer
+	if err := bencode.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+
+	peers := make([]Peer, 0, len(list))
+	for _, p := range list {
+		if p.Port <= 0 || p.Port > 65535 {
+			return nil, fmt.Errorf("invalid port %v of peer %s", p.Port, p.IP)
+		}
+
+		ip := net.ParseIP(p.IP)
+		if ip == nil {
+			continue
+		}
+
+		peer := Peer{IP: ip, Port: uint16(p.Port)}
+		switch len(p.ID) {
+		case 0:
+		case len(peer.ID):
+			copy(peer.ID[:], p.ID)
+		default:
+			return nil, fmt.Errorf("malformed peer id of length %v", len(p.ID))
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,100 @@
+package peer_test
+
+import (
+	"net"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestUnmarshal6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	buf := append(append([]byte{}, ip...), 0x1a, 0xe1)
+
+	peers, err := peer.Unmarshal6(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 1 || !peers[0].IP.Equal(ip) || peers[0].Port != 6881 {
+		t.Fatalf("unmarshalled %v", peers)
+	}
+
+	if s := peers[0].String(); s != "[2001:db8::1]:6881" {
+		t.Errorf("formatted peer as %q", s)
+	}
+
+	if _, err := peer.Unmarshal6(buf[:17]); err == nil {
+		t.Error("unmarshalled truncated peer list")
+	}
+
+	// ipv4 peers are formatted without brackets
+	peers, err = peer.Unmarshal([]byte{127, 0, 0, 1, 0x1a, 0xe1})
+	if err != nil || len(peers) != 1 || peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("unmarshalled %v with error %v", peers, err)
+	}
+}
+
+func TestUnmarshalDict(t *testing.T) {
+	id := "-XX1234-abcdefghijkl"
+	list := "l" +
+		"d2:ip9:127.0.0.17:peer id20:" + id + "4:porti6881ee" +
+		"d2:ip11:2001:db8::14:porti51413ee" +
+		"d2:ip11:example.com4:porti80ee" + // dns names are skipped
+		"e"
+
+	peers, err := peer.UnmarshalDict([]byte(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 2 {
+		t.Fatalf("unmarshalled %v", peers)
+	}
+
+	if peers[0].String() != "127.0.0.1:6881" || string(peers[0].ID[:]) != id {
+		t.Errorf("unmarshalled %v with id %q", peers[0], peers[0].ID)
+	}
+
+	if peers[1].String() != "[2001:db8::1]:51413" || peers[1].ID != ([20]byte{}) {
+		t.Errorf("unmarshalled %v with id %q", peers[1], peers[1].ID)
+	}
+
+	for _, list := range []string{
+		"ld2:ip9:127.0.0.14:porti0eee",
+		"ld2:ip9:127.0.0.17:peer id3:abc4:porti1eee",
+	} {
+		if _, err := peer.UnmarshalDict([]byte(list)); err == nil {
+			t.Errorf("unmarshalled invalid list %q", list)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	peers := []peer.Peer{
+		{IP: net.IPv4(127, 0, 0, 1), Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 51413},
+		{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 80},
+	}
+
+	v4 := peer.Marshal(peers)
+	if len(v4) != 12 {
+		t.Fatalf("marshalled %x", v4)
+	}
+
+	v6 := peer.Marshal6(peers)
+	if len(v6) != 18 {
+		t.Fatalf("marshalled %x", v6)
+	}
+
+	// marshalling is the inverse of unmarshalling
+	parsed, err := peer.Unmarshal(v4)
+	if err != nil || len(parsed) != 2 || parsed[0].String() != "127.0.0.1:6881" || parsed[1].String() != "10.0.0.1:80" {
+		t.Errorf("unmarshalled %v with error %v", parsed, err)
+	}
+
+	parsed, err = peer.Unmarshal6(v6)
+	if err != nil || len(parsed) != 1 || parsed[0].String() != "[2001:db8::1]:51413" {
+		t.Errorf("unmarshalled %v with error %v", parsed, err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+)
+
+// Defaults of ReconnectConfig.
+const (
+	DefaultReconnectAttempts = 5
+	DefaultReconnectDelay    = time.Second
+	DefaultMaxReconnectDelay = time.Minute
+)
+
+// ReconnectConfig contains the configuration used by Reconnect.
+type ReconnectConfig struct {
+	// MaxAttempts is the maximum number of dials. It defaults to
+	// DefaultReconnectAttempts.
+	MaxAttempts int
+
+	// Delay is the time waited before the first dial, which is doubled
+	// after each failed dial, up to MaxDelay. They default to
+	// DefaultReconnectDelay and DefaultMaxReconnectDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// Dial connects to the provided peer, like NewConnContext.
+	Dial func(ctx context.Context, p Peer) (*Conn, error)
+}
+
+// Reconnect re-dials a peer which was disconnected, waiting with
+// exponential backoff before each attempt, until a connection is
+// established, the attempts run out, or the context is done. The pieces
+// which the peer was known to have are merged into the bitfield of the new
+// connection, since they aren't lost by reconnecting.
+func Reconnect(ctx context.Context, p Peer, known bitfield.Bitfield, config ReconnectConfig) (*Conn, error) {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultReconnectAttempts
+	}
+
+	if config.Delay <= 0 {
+		config.Delay = DefaultReconnectDelay
+	}
+
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = DefaultMaxReconnectDelay
+	}
+
+	delay := config.Delay
+	var err error
+
+	for attempt := 0; attempt < config.MaxAttempts; attempt++ {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+
+		var conn *Conn
+		if conn, err = config.Dial(ctx, p); err == nil {
+			conn.Bitfield.Merge(known)
+			return conn, nil
+		}
+
+		if delay *= 2; delay > config.MaxDelay {
+			delay = config.MaxDelay
+		}
+	}
+
+	return nil, fmt.Errorf("peer: reconnecting to %s failed after %d attempts: %w", p, config.MaxAttempts, err)
+}
@@ -0,0 +1,63 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestReconnect(t *testing.T) {
+	refused := errors.New("refused")
+	known := bitfield.Empty(10)
+	known.Set(2)
+
+	var dials []time.Time
+	config := peer.ReconnectConfig{
+		MaxAttempts: 3,
+		Delay:       10 * time.Millisecond,
+		Dial: func(ctx context.Context, p peer.Peer) (*peer.Conn, error) {
+			dials = append(dials, time.Now())
+			if len(dials) < 3 {
+				return nil, refused
+			}
+
+			b := bitfield.Empty(10)
+			b.Set(5)
+			return &peer.Conn{Peer: p, Bitfield: b}, nil
+		},
+	}
+
+	start := time.Now()
+	conn, err := peer.Reconnect(context.Background(), peer.Peer{Port: 1}, known, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pieces known before the disconnect are kept
+	if !conn.Bitfield.Has(2) || !conn.Bitfield.Has(5) || conn.Bitfield.Count() != 2 {
+		t.Errorf("reconnected with bitfield %08b", conn.Bitfield.Bytes())
+	}
+
+	// the delay doubles after each failed dial
+	if elapsed := dials[2].Sub(start); elapsed < 70*time.Millisecond {
+		t.Errorf("dialed for the third time after %v", elapsed)
+	}
+
+	// the attempts run out
+	dials = nil
+	config.MaxAttempts = 2
+	if _, err := peer.Reconnect(context.Background(), peer.Peer{Port: 1}, known, config); !errors.Is(err, refused) || len(dials) != 2 {
+		t.Errorf("reconnect returned %v after %d dials", err, len(dials))
+	}
+
+	// reconnecting stops with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := peer.Reconnect(ctx, peer.Peer{Port: 1}, known, config); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled reconnect returned %v", err)
+	}
+}
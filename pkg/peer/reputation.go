@@ -0,0 +1,129 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Record contains the history of a peer within a session.
+type Record struct {
+	Connects     int // successful connections with the peer
+	Disconnects  int // connections lost or failed with an error
+	HashFailures int // pieces from the peer which failed verification
+	Snubs        int // times the peer stopped sending requested blocks
+
+	Downloaded int64         // bytes downloaded from the peer
+	Elapsed    time.Duration // time spent downloading from the peer
+}
+
+// Throughput returns the average download speed of the peer, in bytes per
+// second.
+func (r Record) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(r.Downloaded) / r.Elapsed.Seconds()
+}
+
+// Score returns the reputation score of the peer, which is higher for
+// better peers. Unknown peers have a score of 0. Throughput increases the
+// score logarithmically, while hash failures, snubs, and disconnects
+// decrease it linearly, with hash failures weighing the most.
+func (r Record) Score() float64 {
+	score := math.Log1p(r.Throughput() / 1024) // kb/s
+	score -= 5 * float64(r.HashFailures)
+	score -= 2 * float64(r.Snubs)
+	score -= float64(r.Disconnects)
+	return score
+}
+
+// Reputation stores the records of peers, keyed by their normalized
+// addresses, so that historically good peers can be preferred when dialing
+// and unchoking. It is safe for concurrent use.
+type Reputation struct {
+	mu      sync.Mutex
+	records map[string]*Record
+}
+
+// NewReputation creates a new empty Reputation store.
+func NewReputation() *Reputation {
+	return &Reputation{records: make(map[string]*Record)}
+}
+
+// Get returns the record of the peer.
+func (r *Reputation) Get(p Peer) Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rec, ok := r.records[addrKey(normalize(p))]; ok {
+		return *rec
+	}
+
+	return Record{}
+}
+
+// Score returns the reputation score of the peer.
+func (r *Reputation) Score(p Peer) float64 {
+	return r.Get(p).Score()
+}
+
+// Connected records a successful connection with the peer.
+func (r *Reputation) Connected(p Peer) {
+	r.update(p, func(rec *Record) { rec.Connects++ })
+}
+
+// Disconnected records a connection with the peer which was lost or failed
+// with an error.
+func (r *Reputation) Disconnected(p Peer) {
+	r.update(p, func(rec *Record) { rec.Disconnects++ })
+}
+
+// HashFailed records a piece from the peer which failed verification.
+func (r *Reputation) HashFailed(p Peer) {
+	r.update(p, func(rec *Record) { rec.HashFailures++ })
+}
+
+// Snubbed records the peer snubbing us.
+func (r *Reputation) Snubbed(p Peer) {
+	r.update(p, func(rec *Record) { rec.Snubs++ })
+}
+
+// Downloaded records n bytes downloaded from the peer in the provided
+// amount of time.
+func (r *Reputation) Downloaded(p Peer, n int64, elapsed time.Duration) {
+	r.update(p, func(rec *Record) {
+		rec.Downloaded += n
+		rec.Elapsed += elapsed
+	})
+}
+
+// update calls fn with the record of the peer, creating it if needed.
+func (r *Reputation) update(p Peer, fn func(rec *Record)) {
+	key := addrKey(normalize(p))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.records[key]
+	if !ok {
+		rec = &Record{}
+		r.records[key] = rec
+	}
+
+	fn(rec)
+}
@@ -0,0 +1,61 @@
+package peer_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestReputation(t *testing.T) {
+	r := peer.NewReputation()
+
+	good := peer.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	bad := peer.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+	unknown := peer.Peer{IP: net.IPv4(10, 0, 0, 3), Port: 3}
+
+	r.Connected(good)
+	r.Downloaded(good, 1<<20, time.Second)
+	r.Connected(bad)
+	r.HashFailed(bad)
+	r.Snubbed(bad)
+	r.Disconnected(bad)
+
+	// records are keyed by normalized addresses
+	rec := r.Get(peer.Peer{IP: good.IP.To16(), Port: 1})
+	if rec.Connects != 1 || rec.Throughput() != 1<<20 {
+		t.Errorf("record of good peer %+v", rec)
+	}
+
+	if rec := r.Get(bad); rec.HashFailures != 1 || rec.Snubs != 1 || rec.Disconnects != 1 {
+		t.Errorf("record of bad peer %+v", rec)
+	}
+
+	if !(r.Score(good) > r.Score(unknown) && r.Score(unknown) > r.Score(bad)) {
+		t.Errorf("scores good %v, unknown %v, bad %v", r.Score(good), r.Score(unknown), r.Score(bad))
+	}
+
+	// the dial queue prefers peers with better scores
+	dialed := make(chan peer.Peer, 3)
+	q := peer.NewDialQueue(peer.DialQueueConfig{
+		MaxHalfOpen: 1,
+		Score:       r.Score,
+		Dial: func(ctx context.Context, p peer.Peer) (*peer.Conn, error) {
+			dialed <- p
+			return &peer.Conn{}, nil
+		},
+	})
+	q.Push(bad, unknown, good)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	for _, expected := range []peer.Peer{good, unknown, bad} {
+		if p := <-dialed; p.Port != expected.Port {
+			t.Errorf("dialed %v, expected %v", p, expected)
+		}
+	}
+}
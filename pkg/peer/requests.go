@@ -0,0 +1,189 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+// Block identifies a block of a piece.
+type Block struct {
+	Index  int // index of the piece
+	Begin  int // offset of the block in the piece
+	Length int // length of the block
+}
+
+// Outstanding reports whether we have requested the block from the peer,
+// and haven't received, cancelled, or had it rejected yet.
+func (c *Conn) Outstanding(b Block) bool {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	_, ok := c.requests[b]
+	return ok
+}
+
+// PendingRequests returns the number of outstanding requests to the peer.
+func (c *Conn) PendingRequests() int {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	return len(c.requests)
+}
+
+// ExpiredRequests returns the outstanding requests which were sent more
+// than timeout ago, which are still outstanding until they are cancelled.
+func (c *Conn) ExpiredRequests(timeout time.Duration) []Block {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	var expired []Block
+	for b, sent := range c.requests {
+		if time.Since(sent) > timeout {
+			expired = append(expired, b)
+		}
+	}
+
+	return expired
+}
+
+// Snubbed reports whether the peer is snubbing us, which is when it has
+// outstanding requests, but hasn't sent any requested block for longer
+// than threshold, since the last block or the oldest outstanding request.
+func (c *Conn) Snubbed(threshold time.Duration) bool {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	if len(c.requests) == 0 {
+		return false
+	}
+
+	var oldest time.Time
+	for _, sent := range c.requests {
+		if oldest.IsZero() || sent.Before(oldest) {
+			oldest = sent
+		}
+	}
+
+	// the peer can't deliver before being asked for something
+	since := c.lastPiece
+	if oldest.After(since) {
+		since = oldest
+	}
+
+	return time.Since(since) > threshold
+}
+
+// RTT returns the smoothed round-trip time of the requests to the peer, from
+// sending a request to receiving its block, and its mean deviation, which
+// are estimated like tcp's (RFC 6298). They are zero until the first block
+// is received. Since requests are pipelined, the round-trip time includes
+// the time a request waits in the peer's queue.
+func (c *Conn) RTT() (rtt, variance time.Duration) {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	return c.srtt, c.rttvar
+}
+
+// sampleRTT updates the smoothed round-trip time with the provided sample.
+// It must be called with requestsMu held.
+func (c *Conn) sampleRTT(sample time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = sample, sample/2
+		return
+	}
+
+	// rttvar = 3/4 rttvar + 1/4 |srtt - sample|
+	// srtt = 7/8 srtt + 1/8 sample
+	delta := c.srtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+
+	c.rttvar += (delta - c.rttvar) / 4
+	c.srtt += (sample - c.srtt) / 8
+}
+
+// ClearRequests forgets all the outstanding requests, and returns them, so
+// that they can be requested from other peers.
+func (c *Conn) ClearRequests() []Block {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	blocks := make([]Block, 0, len(c.requests))
+	for b := range c.requests {
+		blocks = append(blocks, b)
+	}
+
+	c.requests = nil
+	return blocks
+}
+
+// addRequest records an outstanding request.
+func (c *Conn) addRequest(b Block) {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	if c.requests == nil {
+		c.requests = make(map[Block]time.Time)
+	}
+
+	c.requests[b] = time.Now()
+}
+
+// removeRequest forgets an outstanding request.
+func (c *Conn) removeRequest(b Block) {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	delete(c.requests, b)
+}
+
+// receiveBlock forgets an outstanding request which was fulfilled by the
+// peer, recording the time it was received and its round-trip time.
+func (c *Conn) receiveBlock(b Block) {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	if sent, ok := c.requests[b]; ok {
+		delete(c.requests, b)
+		c.lastPiece = time.Now()
+		c.sampleRTT(c.lastPiece.Sub(sent))
+	}
+}
+
+// trackRequests updates the outstanding requests according to a message
+// received from the peer. Received and rejected blocks are no longer
+// outstanding, while peers without the fast extension silently discard all
+// outstanding requests when they choke us.
+func (c *Conn) trackRequests(msg *message.Message) {
+	switch msg.Identifier {
+	case message.Piece:
+		var piece message.PieceMsg
+		if err := piece.Decode(msg); err == nil {
+			c.receiveBlock(Block{Index: piece.Index, Begin: piece.Begin, Length: len(piece.Block)})
+		}
+	case message.RejectRequest:
+		if index, begin, length, err := message.ParseRejectRequest(msg); err == nil {
+			c.removeRequest(Block{Index: index, Begin: begin, Length: length})
+		}
+	case message.Choke:
+		if !c.Fast {
+			c.ClearRequests()
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package peer_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestRequests(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local, Fast: true}
+
+	// discard the requests sent to the peer
+	go func() {
+		for {
+			if _, err := message.Read(remote); err != nil {
+				return
+			}
+		}
+	}()
+
+	blocks := []peer.Block{{0, 0, 4}, {0, 4, 4}, {1, 0, 4}}
+	for _, b := range blocks {
+		if err := conn.Request(b.Index, b.Begin, b.Length); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if conn.PendingRequests() != 3 || !conn.Outstanding(blocks[1]) {
+		t.Fatalf("%v outstanding requests", conn.PendingRequests())
+	}
+
+	if expired := conn.ExpiredRequests(-time.Second); len(expired) != 3 {
+		t.Errorf("expired requests %v", expired)
+	}
+	if expired := conn.ExpiredRequests(time.Hour); len(expired) != 0 {
+		t.Errorf("expired requests %v", expired)
+	}
+
+	if !conn.Snubbed(-time.Second) || conn.Snubbed(time.Hour) {
+		t.Error("snubbing not detected from outstanding requests")
+	}
+
+	if err := conn.Cancel(1, 0, 4); err != nil || conn.Outstanding(blocks[2]) {
+		t.Errorf("cancelled request still outstanding, error %v", err)
+	}
+
+	// received and rejected blocks aren't outstanding
+	go func() {
+		remote.Write((&message.Message{Identifier: message.Piece, Payload: append(make([]byte, 8), "abcd"...)}).Serialize())
+		reject := message.NewRequest(0, 4, 4)
+		reject.Identifier = message.RejectRequest
+		remote.Write(reject.Serialize())
+	}()
+
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := conn.PendingRequests(); n != 0 {
+		t.Errorf("%v requests outstanding after response", n)
+	}
+
+	// peers without outstanding requests aren't snubbing
+	if conn.Snubbed(-time.Second) {
+		t.Error("peer without requests snubbing")
+	}
+
+	conn.Request(2, 0, 4)
+	if cleared := conn.ClearRequests(); len(cleared) != 1 || conn.PendingRequests() != 0 {
+		t.Errorf("cleared requests %v", cleared)
+	}
+}
+
+func TestRTT(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local}
+
+	if rtt, variance := conn.RTT(); rtt != 0 || variance != 0 {
+		t.Errorf("rtt %v and variance %v without samples", rtt, variance)
+	}
+
+	// the peer answers each request after the provided delay
+	respond := func(delay time.Duration) {
+		go func() {
+			msg, err := message.Read(remote)
+			if err != nil {
+				return
+			}
+
+			time.Sleep(delay)
+			block := append(msg.Payload[:8:8], "abcd"...)
+			remote.Write((&message.Message{Identifier: message.Piece, Payload: block}).Serialize())
+		}()
+
+		if err := conn.Request(0, 0, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const delay = 40 * time.Millisecond
+
+	respond(delay)
+	first, variance := conn.RTT()
+	if first < delay || variance != first/2 {
+		t.Fatalf("rtt %v and variance %v, expected at least %v", first, variance, delay)
+	}
+
+	// faster responses lower the smoothed rtt gradually
+	respond(0)
+	rtt, _ := conn.RTT()
+	if rtt >= first || rtt < first*7/8 {
+		t.Errorf("rtt %v after a fast response, from %v", rtt, first)
+	}
+}
+
+func TestRequestBlocks(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local}
+	blocks := []peer.Block{{0, 0, 16384}, {0, 16384, 16384}, {1, 0, 100}}
+
+	requested := make(chan error, 1)
+	go func() { requested <- conn.RequestBlocks(blocks...) }()
+
+	for _, b := range blocks {
+		msg, err := message.Read(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil || (peer.Block{Index: index, Begin: begin, Length: length}) != b {
+			t.Errorf("requested %v, expected %v", msg, b)
+		}
+	}
+
+	if err := <-requested; err != nil {
+		t.Fatal(err)
+	}
+
+	if n := conn.PendingRequests(); n != len(blocks) {
+		t.Errorf("%d outstanding requests, expected %d", n, len(blocks))
+	}
+
+	// failed requests aren't outstanding
+	conn.ClearRequests()
+	remote.Close()
+
+	if err := conn.RequestBlocks(blocks...); err == nil || conn.PendingRequests() != 0 {
+		t.Errorf("failed requests outstanding, error %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package peer
+
+import "syscall"
+
+// soReusePort is the SO_REUSEPORT socket option, which package syscall
+// doesn't define on every architecture.
+const soReusePort = 0xf
+
+// reusePort is a socket control function which sets SO_REUSEADDR and
+// SO_REUSEPORT, so that many sockets can be bound to the same port.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
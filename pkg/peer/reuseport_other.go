@@ -0,0 +1,27 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package peer
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort is a socket control function which would set SO_REUSEPORT, but
+// it isn't supported on this platform.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("peer: SO_REUSEPORT is not supported on this platform")
+}
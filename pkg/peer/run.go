@@ -0,0 +1,303 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"context"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+// Handlers contains the functions which Run calls for the messages received
+// from the peer. The Conn's state, like Choked and Bitfield, is updated
+// before they are called. Nil functions are skipped, and an error returned
+// by any function stops Run.
+type Handlers struct {
+	Choke         func() error // peer choked us
+	UnChoke       func() error // peer un-choked us
+	Interested    func() error // peer is interested in us
+	NotInterested func() error // peer isn't interested in us
+
+	// Have is called when the peer has a new piece, and Bitfield when the
+	// peer sends its whole bitfield, including as HaveAll or HaveNone.
+	Have     func(index int) error
+	Bitfield func(b bitfield.Bitfield) error
+
+	// Request and Cancel are called when the peer requests a block, or
+	// cancels a request, and Reject when the peer rejects our request.
+	Request func(index, begin, length int) error
+	Cancel  func(index, begin, length int) error
+	Reject  func(index, begin, length int) error
+
+	// Piece is called when the peer sends a block of a piece.
+	Piece func(index, begin int, block []byte) error
+
+	// Port is called when the peer advertises the port of its dht node.
+	Port func(port uint16) error
+
+	// Extended is called for messages of the extension protocol, with the
+	// extended message id and the payload. The extended handshake, whose
+	// id is 0, is processed by the Conn before it is passed on.
+	Extended func(id byte, payload []byte) error
+
+	// Message is called for the messages without a function of their own.
+	Message func(msg *message.Message) error
+}
+
+// Handle registers the provided handlers, which are called by Run in the
+// order they were registered, so that multiple components, like downloads
+// and seeding, can share a Conn. It must not be called while Run is running.
+func (c *Conn) Handle(h *Handlers) {
+	c.handlers = append(c.handlers, h)
+}
+
+// Run reads messages from the Conn, and dispatches them to the registered
+// handlers, until reading fails, a handler returns an error, or the context
+// is cancelled, in which case the context's error is returned. Reading fails
+// if nothing is received from the peer for the Conn's IdleTimeout. Run is
+// also stopped by failures of the work done in its background, like serving
+// the peer's requests.
+func (c *Conn) Run(ctx context.Context) error {
+	// abort the blocked read when the context is cancelled
+	stop := interrupt(ctx, c.Conn)
+	defer func() {
+		stop()
+
+		if ctx.Err() != nil || c.IdleTimeout > 0 || c.failed() != nil {
+			c.Conn.SetDeadline(time.Time{}) // disable deadline
+		}
+	}()
+
+	for {
+		// drop peers which stay silent for too long
+		if c.IdleTimeout > 0 {
+			c.Conn.SetReadDeadline(deadline(ctx, c.IdleTimeout))
+		}
+
+		// checked after setting the deadline, which can't override the
+		// deadline which interrupts reads after a failure
+		if err := c.failed(); err != nil {
+			return err
+		}
+
+		msg, err := c.Read()
+		if err != nil {
+			switch {
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case c.failed() != nil:
+				return c.failed()
+			}
+
+			return err
+		}
+
+		if msg == nil {
+			continue // keep-alive
+		}
+
+		if err := c.dispatch(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// dispatch updates the Conn's state according to the provided message, and
+// calls the handlers of the message. Unknown and malformed messages are
+// rejected first if the Conn is strict.
+func (c *Conn) dispatch(msg *message.Message) error {
+	if c.StrictMessages {
+		if err := message.Validate(msg); err != nil {
+			return err
+		}
+	}
+
+	switch msg.Identifier {
+	case message.Choke:
+		c.Choked = true
+		return c.each(func(h *Handlers) error { return call(h.Choke) })
+	case message.UnChoke:
+		c.Choked = false
+		return c.each(func(h *Handlers) error { return call(h.UnChoke) })
+	case message.Interested:
+		c.PeerInterested = true
+		return c.each(func(h *Handlers) error { return call(h.Interested) })
+	case message.NotInterested:
+		c.PeerInterested = false
+		return c.each(func(h *Handlers) error { return call(h.NotInterested) })
+
+	case message.Have:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+
+		c.Bitfield.Set(index)
+		return c.each(func(h *Handlers) error {
+			if h.Have == nil {
+				return nil
+			}
+			return h.Have(index)
+		})
+
+	case message.Bitfield, message.HaveAll, message.HaveNone:
+		switch msg.Identifier {
+		case message.Bitfield:
+			b, err := c.parseBitfield(msg.Payload)
+			if err != nil {
+				return err
+			}
+			c.Bitfield = b
+		case message.HaveAll:
+			c.Bitfield = bitfield.Full(c.pieces)
+		default:
+			c.Bitfield = bitfield.Empty(c.pieces)
+		}
+
+		return c.each(func(h *Handlers) error {
+			if h.Bitfield == nil {
+				return nil
+			}
+			return h.Bitfield(c.Bitfield)
+		})
+
+	case message.Request:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		return c.each(func(h *Handlers) error { return callBlock(h.Request, index, begin, length) })
+	case message.Cancel:
+		index, begin, length, err := message.ParseCancel(msg)
+		if err != nil {
+			return err
+		}
+
+		return c.each(func(h *Handlers) error { return callBlock(h.Cancel, index, begin, length) })
+	case message.RejectRequest:
+		index, begin, length, err := message.ParseRejectRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		return c.each(func(h *Handlers) error { return callBlock(h.Reject, index, begin, length) })
+
+	case message.Piece:
+		var piece message.PieceMsg
+		if err := piece.Decode(msg); err != nil {
+			return err
+		}
+
+		return c.each(func(h *Handlers) error {
+			if h.Piece == nil {
+				return nil
+			}
+			return h.Piece(piece.Index, piece.Begin, piece.Block)
+		})
+
+	case message.AllowedFast:
+		index, err := message.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+
+		c.AllowedFast.Set(index)
+
+	case message.Port:
+		port, err := message.ParsePort(msg)
+		if err != nil {
+			return err
+		}
+
+		return c.each(func(h *Handlers) error {
+			if h.Port == nil {
+				return nil
+			}
+			return h.Port(port)
+		})
+
+	case message.Extended:
+		extID, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return err
+		}
+
+		return c.each(func(h *Handlers) error {
+			if h.Extended == nil {
+				return nil
+			}
+			return h.Extended(extID, payload)
+		})
+	}
+
+	return c.each(func(h *Handlers) error {
+		if h.Message == nil {
+			return nil
+		}
+		return h.Message(msg)
+	})
+}
+
+// fail stops Run with the provided error, interrupting the read in
+// progress. Only the first failure is kept.
+func (c *Conn) fail(err error) {
+	c.failMu.Lock()
+	if c.failure == nil {
+		c.failure = err
+	}
+	c.failMu.Unlock()
+
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+// failed returns the error which stops Run, if any.
+func (c *Conn) failed() error {
+	c.failMu.Lock()
+	defer c.failMu.Unlock()
+
+	return c.failure
+}
+
+// each calls fn with each of the registered handlers, stopping at the first
+// error.
+func (c *Conn) each(fn func(h *Handlers) error) error {
+	for _, h := range c.handlers {
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// call calls the provided function, if it isn't nil.
+func call(fn func() error) error {
+	if fn == nil {
+		return nil
+	}
+
+	return fn()
+}
+
+// callBlock calls the provided function with a block, if it isn't nil.
+func callBlock(fn func(index, begin, length int) error, index, begin, length int) error {
+	if fn == nil {
+		return nil
+	}
+
+	return fn(index, begin, length)
+}
@@ -0,0 +1,185 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestRun(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := &peer.Conn{
+		Conn:     local,
+		Choked:   true,
+		Bitfield: bitfield.Empty(8),
+	}
+
+	var haves []int
+	var blocks []string
+	var ports []uint16
+	extended := make(chan string, 1)
+
+	conn.Handle(&peer.Handlers{
+		Have: func(index int) error {
+			haves = append(haves, index)
+			return nil
+		},
+		Piece: func(index, begin int, block []byte) error {
+			blocks = append(blocks, string(block))
+			return nil
+		},
+		Port: func(port uint16) error {
+			ports = append(ports, port)
+			return nil
+		},
+	})
+
+	// multiple handlers can share the connection
+	conn.Handle(&peer.Handlers{
+		Extended: func(id byte, payload []byte) error {
+			extended <- string(payload)
+			return nil
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- conn.Run(ctx) }()
+
+	piece := &message.Message{Identifier: message.Piece, Payload: append(make([]byte, 8), "abcd"...)}
+	for _, msg := range []*message.Message{
+		{Identifier: message.UnChoke},
+		message.NewHave(5),
+		nil, // keep-alive
+		piece,
+		message.NewPort(6881),
+		{Identifier: message.Extended, Payload: []byte("\x03hello")},
+	} {
+		if _, err := remote.Write(msg.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// messages are handled in order
+	if payload := <-extended; payload != "hello" {
+		t.Errorf("extended handler received %q", payload)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v after cancel", err)
+	}
+
+	if conn.Choked || !conn.Bitfield.Has(5) {
+		t.Errorf("state not updated: choked %v, bitfield %v", conn.Choked, conn.Bitfield.Bytes())
+	}
+
+	if len(haves) != 1 || haves[0] != 5 || len(blocks) != 1 || blocks[0] != "abcd" {
+		t.Errorf("handled haves %v, blocks %q", haves, blocks)
+	}
+
+	if len(ports) != 1 || ports[0] != 6881 {
+		t.Errorf("handled ports %v", ports)
+	}
+
+	// handler errors stop the loop
+	stop := errors.New("stop")
+	conn.Handle(&peer.Handlers{Choke: func() error { return stop }})
+
+	go func() { done <- conn.Run(context.Background()) }()
+	remote.Write((&message.Message{Identifier: message.Choke}).Serialize())
+
+	if err := <-done; err != stop || !conn.Choked {
+		t.Errorf("Run returned %v, choked %v", err, conn.Choked)
+	}
+}
+
+func TestRunIdleTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local, IdleTimeout: 20 * time.Millisecond}
+
+	// keep-alives keep the connection alive
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			remote.Write(make([]byte, 4))
+		}
+	}()
+
+	start := time.Now()
+	err := conn.Run(context.Background())
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("idle connection returned %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("connection with keep-alives timed out after %v", elapsed)
+	}
+}
+
+func TestRunStrict(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	var unknown []*message.Message
+	conn := &peer.Conn{Conn: local}
+	conn.Handle(&peer.Handlers{
+		Message: func(msg *message.Message) error {
+			unknown = append(unknown, msg)
+			return nil
+		},
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- conn.Run(context.Background()) }()
+
+	// unknown messages are passed on to the handlers by default
+	unknownMsg := &message.Message{Identifier: 42, Payload: []byte{1}}
+	remote.Write(unknownMsg.Serialize())
+	remote.Write(message.NewUnChoke().Serialize())
+	remote.Close()
+
+	if err := <-done; err == nil || len(unknown) != 1 {
+		t.Fatalf("Run returned %v, handled %v", err, unknown)
+	}
+
+	// strict connections reject them
+	local, remote = net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn = &peer.Conn{Conn: local, StrictMessages: true}
+	go func() { done <- conn.Run(context.Background()) }()
+	remote.Write(unknownMsg.Serialize())
+
+	var unknownErr *message.UnknownError
+	if err := <-done; !errors.As(err, &unknownErr) {
+		t.Errorf("strict Run returned %v for an unknown message", err)
+	}
+
+	// as well as malformed messages
+	local, remote = net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn = &peer.Conn{Conn: local, StrictMessages: true}
+	go func() { done <- conn.Run(context.Background()) }()
+	remote.Write((&message.Message{Identifier: message.Choke, Payload: []byte{1}}).Serialize())
+
+	var malformedErr *message.MalformedError
+	if err := <-done; !errors.As(err, &malformedErr) {
+		t.Errorf("strict Run returned %v for a malformed message", err)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+// limits of the requests served to peers
+const (
+	DefaultMaxRequests  = 250       // outstanding requests per peer
+	DefaultMaxBlockSize = 128 << 10 // 128 kb, the largest block clients request
+)
+
+// BlockReader reads the blocks of pieces which are served to peers.
+type BlockReader interface {
+	// ReadBlock reads the block at offset begin of the piece with the
+	// provided index into buf.
+	ReadBlock(index, begin int, buf []byte) error
+}
+
+// PieceGetter gets the data of whole pieces, like a torrent.PieceManager.
+type PieceGetter interface {
+	Get(int) ([]byte, error)
+}
+
+// FromPieces returns a BlockReader which reads blocks from the whole pieces
+// returned by the provided PieceGetter.
+func FromPieces(p PieceGetter) BlockReader {
+	return pieceReader{p}
+}
+
+// pieceReader is a BlockReader which reads blocks from whole pieces.
+type pieceReader struct {
+	pieces PieceGetter
+}
+
+// ReadBlock reads a block from the piece with the provided index.
+func (r pieceReader) ReadBlock(index, begin int, buf []byte) error {
+	piece, err := r.pieces.Get(index)
+	if err != nil {
+		return err
+	}
+
+	if begin < 0 || begin+len(buf) > len(piece) {
+		return fmt.Errorf("block of length %v at %v out of range of piece %v", len(buf), begin, index)
+	}
+
+	copy(buf, piece[begin:])
+	return nil
+}
+
+// ServeConfig contains the configuration used to serve a peer's requests.
+type ServeConfig struct {
+	Reader BlockReader // reader of the served blocks
+
+	// MaxRequests is the maximum number of outstanding requests of the
+	// peer, and MaxBlockSize is the maximum length of a requested block.
+	// They default to DefaultMaxRequests and DefaultMaxBlockSize.
+	MaxRequests  int
+	MaxBlockSize int
+
+	// OnUpload is called after a block is sent to the peer.
+	OnUpload func(index, begin, length int)
+}
+
+// Serve serves the peer's requests, as registered by HandleRequests, and
+// runs the Conn until it fails, like Run.
+func (c *Conn) Serve(config *ServeConfig) error {
+	stop := c.HandleRequests(config)
+	defer stop()
+
+	return c.Run(context.Background())
+}
+
+// HandleRequests registers handlers which serve the peer's requests with
+// blocks read from the config's reader, while the Conn is run by Run.
+// Requests are served in order in the background, so that cancels are seen
+// while serving, and cancelled requests are dropped. Requests received
+// while we are choking the peer, requests beyond the outstanding request
+// limit, and requests for blocks which can't be read are rejected if the
+// peer supports the fast extension, and dropped otherwise. Requests for
+// blocks larger than the block size limit are a protocol violation, which
+// stops Run with an error, as does failing to send a block.
+//
+// The returned function drops the queued requests, and waits for the block
+// being served. It should be called once Run has returned.
+func (c *Conn) HandleRequests(config *ServeConfig) (stop func()) {
+	s := &server{conn: c, config: *config}
+	if s.config.MaxRequests <= 0 {
+		s.config.MaxRequests = DefaultMaxRequests
+	}
+
+	if s.config.MaxBlockSize <= 0 {
+		s.config.MaxBlockSize = DefaultMaxBlockSize
+	}
+
+	c.servers = append(c.servers, s)
+	c.Handle(&Handlers{
+		Request: s.request,
+		Cancel:  s.cancel,
+	})
+
+	return s.stop
+}
+
+// server serves the requests of a peer in the background.
+type server struct {
+	conn   *Conn
+	config ServeConfig
+
+	mu      sync.Mutex     // guards queue and serving
+	queue   []Block        // requests waiting to be served
+	serving bool           // whether the serving goroutine is running
+	wg      sync.WaitGroup // running serving goroutine
+}
+
+// request queues a request of the peer, starting the serving goroutine if
+// it isn't running.
+func (s *server) request(index, begin, length int) error {
+	req := Block{Index: index, Begin: begin, Length: length}
+	if length <= 0 || length > s.config.MaxBlockSize {
+		return fmt.Errorf("peer requested block of length %v", length)
+	}
+
+	// choking is checked with the queue locked, so that Choke drops every
+	// request queued before it
+	s.mu.Lock()
+	if s.conn.choking() || len(s.queue) >= s.config.MaxRequests {
+		s.mu.Unlock()
+		return s.conn.reject(req)
+	}
+
+	s.queue = append(s.queue, req)
+	if !s.serving {
+		s.serving = true
+		s.wg.Add(1)
+		go s.serve()
+	}
+	s.mu.Unlock()
+
+	return nil
+}
+
+// cancel drops a queued request of the peer.
+func (s *server) cancel(index, begin, length int) error {
+	req := Block{Index: index, Begin: begin, Length: length}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, queued := range s.queue {
+		if queued == req {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// choke drops the queued requests once we have choked the peer, rejecting
+// them if the peer supports the fast extension.
+func (s *server) choke() error {
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+
+	for _, req := range queue {
+		if err := s.conn.reject(req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serve serves the queued requests until the queue is empty, stopping Run
+// if a block can't be sent.
+func (s *server) serve() {
+	defer s.wg.Done()
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.serving = false
+			s.mu.Unlock()
+			return
+		}
+
+		req := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		if err := s.conn.serveBlock(req, &s.config); err != nil {
+			s.conn.fail(err)
+
+			// the remaining requests can't be served either
+			s.mu.Lock()
+			s.queue = nil
+			s.serving = false
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// stop drops the queued requests, and waits for the serving goroutine.
+func (s *server) stop() {
+	s.mu.Lock()
+	s.queue = nil
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// serveBlock reads the requested block and sends it to the peer once the
+// UploadLimiter allows it, or rejects the request if the block can't be
+// read.
+func (c *Conn) serveBlock(req Block, config *ServeConfig) error {
+	msg, block := message.NewPieceBuffer(req.Index, req.Begin, req.Length)
+	if err := config.Reader.ReadBlock(req.Index, req.Begin, block); err != nil {
+		c.logger().Debugf("can't serve block %v of piece %v: %v", req.Begin, req.Index, err)
+		return c.reject(req)
+	}
+
+	if err := c.wait(c.UploadLimiter, req.Length); err != nil {
+		return err
+	}
+
+	if err := c.write(msg); err != nil {
+		return err
+	}
+
+	if config.OnUpload != nil {
+		config.OnUpload(req.Index, req.Begin, req.Length)
+	}
+
+	return nil
+}
+
+// reject rejects the provided request, if the peer supports the fast
+// extension.
+func (c *Conn) reject(req Block) error {
+	if !c.Fast {
+		return nil
+	}
+
+	return c.write(message.NewRejectRequest(req.Index, req.Begin, req.Length))
+}
@@ -0,0 +1,143 @@
+package peer_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// pieceList serves pieces from memory.
+type pieceList [][]byte
+
+func (p pieceList) Get(i int) ([]byte, error) {
+	if i < 0 || i >= len(p) {
+		return nil, errors.New("piece not found")
+	}
+
+	return p[i], nil
+}
+
+func TestServe(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local, Fast: true}
+
+	var uploaded int
+	served := make(chan error, 1)
+	go func() {
+		served <- conn.Serve(&peer.ServeConfig{
+			Reader:       peer.FromPieces(pieceList{[]byte("abcdefgh")}),
+			MaxBlockSize: 4,
+			OnUpload:     func(_, _, length int) { uploaded += length },
+		})
+	}()
+
+	request := func(index, begin, length int) *message.Message {
+		if _, err := remote.Write(message.NewRequest(index, begin, length).Serialize()); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := message.Read(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return msg
+	}
+
+	if msg := request(0, 4, 4); msg.Identifier != message.Piece || string(msg.Payload[8:]) != "efgh" {
+		t.Errorf("served %v %q", msg.Identifier, msg.Payload)
+	}
+
+	if msg := request(1, 0, 4); msg.Identifier != message.RejectRequest {
+		t.Errorf("missing piece answered with %v", msg.Identifier)
+	}
+
+	// oversized blocks stop serving
+	remote.Write(message.NewRequest(0, 0, 8).Serialize())
+	if err := <-served; err == nil {
+		t.Error("oversized request served")
+	}
+
+	if uploaded != 4 {
+		t.Errorf("uploaded %d bytes, expected 4", uploaded)
+	}
+}
+
+// blockingReader blocks reading blocks until it is released.
+type blockingReader struct {
+	peer.BlockReader
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReader) ReadBlock(index, begin int, buf []byte) error {
+	r.reading <- struct{}{}
+	<-r.release
+	return r.BlockReader.ReadBlock(index, begin, buf)
+}
+
+func TestServeChoke(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local, Fast: true}
+	reader := &blockingReader{
+		BlockReader: peer.FromPieces(pieceList{[]byte("abcdefgh")}),
+		reading:     make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- conn.Serve(&peer.ServeConfig{Reader: reader}) }()
+
+	for _, msg := range []*message.Message{
+		{Identifier: message.Interested},
+		message.NewRequest(0, 0, 4),
+		message.NewRequest(0, 4, 4),
+		nil, // read once the requests are queued
+	} {
+		if _, err := remote.Write(msg.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-reader.reading
+	if !conn.PeerInterested {
+		t.Error("peer interest not recorded")
+	}
+
+	// choking rejects the queued request, but not the one being served
+	go conn.Choke()
+	for _, expected := range []message.Message{
+		{Identifier: message.Choke},
+		{Identifier: message.RejectRequest, Payload: message.NewRequest(0, 4, 4).Payload},
+	} {
+		msg, err := message.Read(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Identifier != expected.Identifier || string(msg.Payload) != string(expected.Payload) {
+			t.Errorf("received %v %v, expected %v %v", msg.Identifier, msg.Payload, expected.Identifier, expected.Payload)
+		}
+	}
+
+	close(reader.release)
+	if msg, err := message.Read(remote); err != nil || msg.Identifier != message.Piece || string(msg.Payload[8:]) != "abcd" {
+		t.Errorf("served %v, %v", msg, err)
+	}
+
+	// requests received while choking are rejected
+	remote.Write(message.NewRequest(0, 0, 4).Serialize())
+	if msg, err := message.Read(remote); err != nil || msg.Identifier != message.RejectRequest {
+		t.Errorf("request while choking answered with %v, %v", msg, err)
+	}
+
+	remote.Close()
+	<-served
+}
@@ -0,0 +1,206 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Source is a set of the mechanisms which a peer was discovered from.
+type Source uint8
+
+// peer discovery mechanisms
+const (
+	SourceTracker  Source = 1 << iota // tracker announce
+	SourceDHT                         // distributed hash table
+	SourcePEX                         // peer exchange
+	SourceIncoming                    // inbound connection
+	SourceManual                      // added by the user
+)
+
+// Has checks if s contains all the sources in t.
+func (s Source) Has(t Source) bool {
+	return s&t == t
+}
+
+// String returns the names of the sources in s, separated by |.
+func (s Source) String() string {
+	names := []string{"tracker", "dht", "pex", "incoming", "manual"}
+
+	str := ""
+	for i, name := range names {
+		if s&(1<<i) == 0 {
+			continue
+		}
+
+		if str != "" {
+			str += "|"
+		}
+		str += name
+	}
+
+	if str == "" {
+		return "none"
+	}
+
+	return str
+}
+
+// Entry describes a peer in a Set.
+type Entry struct {
+	Peer     Peer      // the normalized peer
+	Source   Source    // sources the peer was discovered from
+	LastSeen time.Time // time the peer was last added
+}
+
+// Set is a set of peers discovered from multiple sources, like trackers,
+// the DHT, and peer exchange. Peers are deduplicated by their normalized
+// addresses, so an ipv4-mapped ipv6 address is the same peer as the ipv4
+// address. It is safe for concurrent use.
+type Set struct {
+	mu    sync.Mutex
+	index map[string]int // indices of the peers in entries, by address
+	peers []*Entry       // entries of the peers, in no particular order
+	rand  *rand.Rand     // source of random samples
+}
+
+// NewSet creates a new empty Set.
+func NewSet() *Set {
+	return &Set{
+		index: make(map[string]int),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Add adds the peer to the set, discovered from the provided source, and
+// reports whether the peer is new. The sources of known peers are merged,
+// and their last seen time is updated, along with their peer id if it
+// wasn't known.
+func (s *Set) Add(p Peer, source Source) bool {
+	p = normalize(p)
+	key := addrKey(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, ok := s.index[key]; ok {
+		e := s.peers[i]
+		e.Source |= source
+		e.LastSeen = time.Now()
+		if e.Peer.ID == ([20]byte{}) {
+			e.Peer.ID = p.ID
+		}
+
+		return false
+	}
+
+	s.index[key] = len(s.peers)
+	s.peers = append(s.peers, &Entry{Peer: p, Source: source, LastSeen: time.Now()})
+	return true
+}
+
+// Remove removes the peer from the set, and reports whether it was found.
+func (s *Set) Remove(p Peer) bool {
+	key := addrKey(normalize(p))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.index[key]
+	if !ok {
+		return false
+	}
+
+	// move the last entry into the hole
+	last := len(s.peers) - 1
+	s.peers[i] = s.peers[last]
+	s.index[addrKey(s.peers[i].Peer)] = i
+
+	s.peers[last] = nil
+	s.peers = s.peers[:last]
+	delete(s.index, key)
+	return true
+}
+
+// Get returns the entry of the peer, and whether it is in the set.
+func (s *Set) Get(p Peer) (Entry, bool) {
+	key := addrKey(normalize(p))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, ok := s.index[key]; ok {
+		return *s.peers[i], true
+	}
+
+	return Entry{}, false
+}
+
+// Len returns the number of peers in the set.
+func (s *Set) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.peers)
+}
+
+// Entries returns the entries of all the peers in the set.
+func (s *Set) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]Entry, len(s.peers))
+	for i, e := range s.peers {
+		entries[i] = *e
+	}
+
+	return entries
+}
+
+// Sample returns up to n distinct peers chosen at random from the set.
+func (s *Set) Sample(n int) []Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(s.peers) {
+		n = len(s.peers)
+	}
+
+	// the first n indices of a random permutation
+	indices := s.rand.Perm(len(s.peers))[:n]
+
+	peers := make([]Peer, n)
+	for i, j := range indices {
+		peers[i] = s.peers[j].Peer
+	}
+
+	return peers
+}
+
+// normalize converts ipv4-mapped ipv6 addresses of peers into ipv4
+// addresses.
+func normalize(p Peer) Peer {
+	if ip := p.IP.To4(); ip != nil {
+		p.IP = ip
+	}
+
+	return p
+}
+
+// addrKey returns the key of a normalized peer's address.
+func addrKey(p Peer) string {
+	return p.String()
+}
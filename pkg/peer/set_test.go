@@ -0,0 +1,46 @@
+package peer_test
+
+import (
+	"net"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestSet(t *testing.T) {
+	s := peer.NewSet()
+
+	v4 := peer.Peer{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}
+	mapped := peer.Peer{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 6881, ID: [20]byte{'a'}}
+	v6 := peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+
+	if !s.Add(v4, peer.SourceTracker) || !s.Add(v6, peer.SourceDHT) {
+		t.Fatal("new peers not added")
+	}
+
+	// ipv4-mapped addresses are the same peer
+	if s.Add(mapped, peer.SourcePEX) {
+		t.Error("ipv4-mapped peer added as a new peer")
+	}
+
+	e, ok := s.Get(mapped)
+	if !ok || !e.Source.Has(peer.SourceTracker|peer.SourcePEX) || e.Peer.ID != mapped.ID || len(e.Peer.IP) != net.IPv4len {
+		t.Errorf("entry %+v, found %v", e, ok)
+	}
+
+	if e.Source.String() != "tracker|pex" {
+		t.Errorf("sources formatted as %q", e.Source)
+	}
+
+	if sample := s.Sample(10); len(sample) != 2 || sample[0].String() == sample[1].String() {
+		t.Errorf("sampled %v", sample)
+	}
+
+	if !s.Remove(v4) || s.Remove(v4) || s.Len() != 1 {
+		t.Errorf("removing peer left %v peers", s.Len())
+	}
+
+	if _, ok := s.Get(v6); !ok || len(s.Entries()) != 1 || len(s.Sample(1)) != 1 {
+		t.Error("remaining peer not found")
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+)
+
+// Trace describes a message sent to or received from a peer.
+type Trace struct {
+	Outbound bool             // whether the message was sent to the peer
+	Message  *message.Message // the message, or nil for a keep-alive
+	Length   int              // length prefix of the message
+	Time     time.Time        // time the message was sent or received
+
+	// Duration is the time the message took to be written, or to be read,
+	// including the time spent waiting for it to arrive.
+	Duration time.Duration
+}
+
+// Tracer is called with every message sent to or received from a peer, so
+// that full protocol traces can be logged or recorded for debugging. It is
+// called from the goroutines reading from and writing to the Conn, possibly
+// concurrently, so it should be fast, and must not modify the message.
+type Tracer func(t Trace)
+
+// trace reports the provided message to the Conn's Tracer, if it has one,
+// as read or written since start.
+func (c *Conn) trace(outbound bool, msg *message.Message, start time.Time) {
+	if c.Tracer == nil {
+		return
+	}
+
+	length := 0
+	if msg != nil {
+		length = len(msg.Payload) + 1
+	}
+
+	now := time.Now()
+	c.Tracer(Trace{
+		Outbound: outbound,
+		Message:  msg,
+		Length:   length,
+		Time:     now,
+		Duration: now.Sub(start),
+	})
+}
@@ -0,0 +1,74 @@
+package peer_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestTracer(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	var mu sync.Mutex
+	var traces []peer.Trace
+	tracer := func(trace peer.Trace) {
+		mu.Lock()
+		defer mu.Unlock()
+		traces = append(traces, trace)
+	}
+
+	conn := &peer.Conn{Conn: local, Tracer: tracer}
+	in := &peer.Conn{Conn: remote, Tracer: tracer}
+
+	written := make(chan error, 1)
+	go func() { written <- conn.WriteMessages(message.NewHave(7), nil) }()
+
+	for i := 0; i < 2; i++ {
+		if _, err := in.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(traces) != 4 {
+		t.Fatalf("%d messages traced, expected 4", len(traces))
+	}
+
+	var sent, received []peer.Trace
+	for _, trace := range traces {
+		if trace.Time.IsZero() || trace.Duration < 0 {
+			t.Errorf("trace %+v has invalid timing", trace)
+		}
+
+		if trace.Outbound {
+			sent = append(sent, trace)
+		} else {
+			received = append(received, trace)
+		}
+	}
+
+	for _, traces := range [][]peer.Trace{sent, received} {
+		if len(traces) != 2 {
+			t.Fatalf("traced %d messages in one direction, expected 2", len(traces))
+		}
+
+		if msg := traces[0].Message; msg == nil || msg.Identifier != message.Have || traces[0].Length != 5 {
+			t.Errorf("traced %v of length %d, expected have of length 5", msg, traces[0].Length)
+		}
+
+		if traces[1].Message != nil || traces[1].Length != 0 {
+			t.Errorf("traced %v of length %d, expected keep-alive", traces[1].Message, traces[1].Length)
+		}
+	}
+}
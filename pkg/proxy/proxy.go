@@ -0,0 +1,361 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxy implements dialers which establish connections through
+// SOCKS5 and HTTP CONNECT proxies, along with configuration specifying
+// which classes of traffic should be proxied.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Type represents the protocol spoken by a proxy.
+type Type int
+
+// various proxy types.
+const (
+	SOCKS5 Type = iota // SOCKS version 5
+	HTTP               // HTTP CONNECT tunneling
+)
+
+var types = [...]string{
+	SOCKS5: "socks5",
+	HTTP:   "http",
+}
+
+// String converts a Type into a readable string.
+func (t Type) String() string {
+	if 0 <= t && t < Type(len(types)) {
+		return types[t]
+	}
+
+	return fmt.Sprintf("proxy(%d)", t)
+}
+
+// Config contains the configuration of a proxy.
+type Config struct {
+	Type    Type   // protocol of the proxy
+	Address string // address of the proxy, in the format host:port
+
+	// credentials, leave empty if the proxy doesn't need authentication
+	Username string
+	Password string
+
+	// traffic classes to send through the proxy
+	Trackers bool // tracker announces
+	Peers    bool // peer connections
+}
+
+// Dialer returns a Dialer which connects through the proxy, with the
+// provided timeout for each connection.
+func (c *Config) Dialer(timeout time.Duration) *Dialer {
+	return &Dialer{
+		Config:  c,
+		Forward: &net.Dialer{Timeout: timeout},
+	}
+}
+
+// Transport returns a http.Transport which sends requests through the
+// proxy.
+func (c *Config) Transport(timeout time.Duration) *http.Transport {
+	switch c.Type {
+	case HTTP:
+		u := &url.URL{Scheme: "http", Host: c.Address}
+		if c.Username != "" {
+			u.User = url.UserPassword(c.Username, c.Password)
+		}
+
+		return &http.Transport{Proxy: http.ProxyURL(u)}
+	default:
+		return &http.Transport{DialContext: c.Dialer(timeout).DialContext}
+	}
+}
+
+// Dialer dials connections through a proxy.
+type Dialer struct {
+	Config  *Config     // proxy configuration
+	Forward *net.Dialer // dialer used to connect to the proxy
+}
+
+// Error represents an error returned by a proxy.
+type Error struct {
+	Type Type   // type of the proxy
+	Msg  string // error message
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("proxy: %s: %s", e.Type, e.Msg)
+}
+
+// Dial connects to the address on the named network through the proxy.
+// Only tcp networks are supported.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but takes a context.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy: unsupported network %s", network)
+	}
+
+	conn, err := d.Forward.DialContext(ctx, "tcp", d.Config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// bound the proxy negotiation by the context and dialer timeout
+	deadline, ok := ctx.Deadline()
+	if d.Forward.Timeout > 0 {
+		if timeout := time.Now().Add(d.Forward.Timeout); !ok || timeout.Before(deadline) {
+			deadline, ok = timeout, true
+		}
+	}
+	if ok {
+		conn.SetDeadline(deadline)
+	}
+
+	switch d.Config.Type {
+	case SOCKS5:
+		err = d.socks5(conn, address)
+	case HTTP:
+		err = d.connect(conn, address)
+	default:
+		err = fmt.Errorf("proxy: unknown proxy type %v", d.Config.Type)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{}) // disable deadline
+	return conn, nil
+}
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthNoAccept = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+)
+
+// socksReplies are the messages for the SOCKS5 reply codes.
+var socksReplies = [...]string{
+	1: "general server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5 negotiates a connection to address over the SOCKS5 proxy conn.
+func (d *Dialer) socks5(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("proxy: invalid port %s", portStr)
+	}
+
+	// greeting: [version] [number of methods] [methods...]
+	methods := []byte{socksAuthNone}
+	if d.Config.Username != "" {
+		methods = append(methods, socksAuthPassword)
+	}
+
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	// method selection: [version] [method]
+	var selection [2]byte
+	if _, err := io.ReadFull(conn, selection[:]); err != nil {
+		return err
+	}
+
+	if selection[0] != socksVersion {
+		return d.error("invalid version %d", selection[0])
+	}
+
+	switch selection[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if err := d.socks5Auth(conn); err != nil {
+			return err
+		}
+	case socksAuthNoAccept:
+		return d.error("no acceptable authentication methods")
+	default:
+		return d.error("unsupported authentication method %d", selection[1])
+	}
+
+	// request: [version] [command] [reserved] [address type] [address] [port]
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socksIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socksIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return d.error("host name %s too long", host)
+		}
+
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+
+	var portBuf [2]byte
+	binary.BigEndian.PutUint16(portBuf[:], uint16(port))
+	req = append(req, portBuf[:]...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// reply: [version] [reply] [reserved] [address type] [address] [port]
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		msg := "unknown failure"
+		if int(reply[1]) < len(socksReplies) {
+			msg = socksReplies[reply[1]]
+		}
+
+		return d.error("connect to %s: %s", address, msg)
+	}
+
+	// discard the bound address
+	var skip int
+	switch reply[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return d.error("invalid bound address type %d", reply[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, skip+2)) // address + port
+	return err
+}
+
+// socks5Auth performs username/password authentication with the SOCKS5
+// proxy conn.
+func (d *Dialer) socks5Auth(conn net.Conn) error {
+	user, pass := d.Config.Username, d.Config.Password
+	if len(user) > 255 || len(pass) > 255 {
+		return d.error("credentials too long")
+	}
+
+	// [version] [username length] [username] [password length] [password]
+	req := []byte{1, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// [version] [status]
+	var res [2]byte
+	if _, err := io.ReadFull(conn, res[:]); err != nil {
+		return err
+	}
+
+	if res[1] != 0 {
+		return d.error("authentication failed")
+	}
+
+	return nil
+}
+
+// connect negotiates a tunnel to address over the HTTP proxy conn.
+func (d *Dialer) connect(conn net.Conn, address string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if d.Config.Username != "" {
+		auth := d.Config.Username + ":" + d.Config.Password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// the proxy doesn't send anything after the response until we send
+	// something, so the reader can't consume any tunnelled data
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return d.error("connect to %s: %s", address, res.Status)
+	}
+
+	return nil
+}
+
+// error creates a new proxy Error with the provided formatted message.
+func (d *Dialer) error(format string, v ...any) error {
+	return &Error{Type: d.Config.Type, Msg: fmt.Sprintf(format, v...)}
+}
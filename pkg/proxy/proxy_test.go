@@ -0,0 +1,117 @@
+package proxy_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/proxy"
+)
+
+// serveSOCKS5 accepts a single connection on l, and acts as a SOCKS5 proxy
+// requiring the provided credentials, which echoes back tunnelled data.
+func serveSOCKS5(t *testing.T, l net.Listener, user, pass string) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Error(err)
+		}
+		return buf
+	}
+
+	// greeting
+	greeting := read(2)
+	methods := read(int(greeting[1]))
+	if !bytes.Contains(methods, []byte{2}) {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	// authentication
+	read(1)
+	gotUser := string(read(int(read(1)[0])))
+	gotPass := string(read(int(read(1)[0])))
+	if gotUser != user || gotPass != pass {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// connect request with a domain address
+	req := read(4)
+	if req[3] != 3 {
+		t.Errorf("address type %d, expected domain", req[3])
+	}
+	host := string(read(int(read(1)[0])))
+	read(2) // port
+	if host != "example.com" {
+		t.Errorf("host %s, expected example.com", host)
+	}
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 80})
+
+	// echo
+	io.Copy(conn, conn)
+}
+
+func TestSOCKS5(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		pass string
+		ok   bool
+	}{
+		{"valid credentials", "user", "pass", true},
+		{"invalid credentials", "user", "wrong", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			go serveSOCKS5(t, l, "user", "pass")
+
+			config := &proxy.Config{
+				Type:     proxy.SOCKS5,
+				Address:  l.Addr().String(),
+				Username: test.user,
+				Password: test.pass,
+			}
+
+			conn, err := config.Dialer(time.Second).Dial("tcp", "example.com:80")
+			if !test.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("Dial: expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+
+			msg := []byte("hello")
+			conn.Write(msg)
+
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+				t.Errorf("tunnel returned %q, %v", buf, err)
+			}
+		})
+	}
+}
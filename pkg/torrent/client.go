@@ -0,0 +1,418 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"laptudirm.com/x/mtor/pkg/log"
+	"laptudirm.com/x/mtor/pkg/nat"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// Client manages multiple active downloads, and owns the resources which
+// are shared between them, like the client's peer id, configuration, rate
+// limiters, and the listener for inbound peer connections.
+type Client struct {
+	mu        sync.Mutex             // guards the fields below
+	downloads map[[20]byte]*Download // active downloads by infohash
+	closed    bool                   // whether the client is closed
+
+	mappings []*nat.Mapping // active port mappings
+	listener *peer.Listener // listener for inbound peers, or nil
+	port     uint16         // port of the listener
+
+	name   [20]byte        // client's peer id
+	config *DownloadConfig // config shared by all downloads
+	log    log.Logger      // client logger
+
+	// shared bandwidth limiters, whose waits are aborted when the client
+	// is closed
+	downloadLimiter, uploadLimiter peer.Limiter
+	quit                           chan struct{} // closed when the client is closed
+}
+
+// ErrClientClosed is returned when a closed client is used.
+var ErrClientClosed = errors.New("client: the client is closed")
+
+// DuplicateError is returned when a torrent which is already being
+// downloaded is added to a client.
+type DuplicateError struct {
+	InfoHash [20]byte // infohash of the torrent
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("client: torrent %x is already added", e.InfoHash)
+}
+
+// NewClient creates a new Client which downloads torrents using the
+// provided config.
+func NewClient(c *DownloadConfig) (*Client, error) {
+	name, err := peer.NewID(c.PeerIDPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		downloads: make(map[[20]byte]*Download),
+		name:      name,
+		config:    c,
+		log:       log.OrDiscard(c.Logger).Scope("client"),
+		quit:      make(chan struct{}),
+	}
+
+	client.downloadLimiter = client.limiter(c.DownloadLimiter, c.MaxDownloadRate)
+	client.uploadLimiter = client.limiter(c.UploadLimiter, c.MaxUploadRate)
+	return client, nil
+}
+
+// limiter returns the shared limiter of the client, which is the provided
+// limiter, or a limiter of the provided rate if it is nil. It returns nil
+// if there is no limit.
+func (c *Client) limiter(l peer.Limiter, rate int) peer.Limiter {
+	if l == nil {
+		if rate <= 0 {
+			return nil
+		}
+
+		// allow bursts of a second worth of transfer
+		l = peer.NewLimiter(rate, rate)
+	}
+
+	return &sharedLimiter{Limiter: l, quit: c.quit}
+}
+
+// Listen starts accepting inbound peer connections on the provided tcp
+// address, like ":6881", for all of the client's downloads. The port is
+// announced to the trackers of the downloads added afterwards.
+func (c *Client) Listen(addr string) error {
+	ln, err := peer.Listen(addr, &peer.ListenConfig{
+		Name:       c.name,
+		Timeout:    c.config.ConnTimeout,
+		Logger:     c.config.Logger,
+		Lookup:     c.lookup,
+		Encryption: c.config.Encryption,
+		Hashes:     c.hashes,
+		ReusePort:  c.config.ReusePort,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.closed:
+		ln.Close()
+		return ErrClientClosed
+	case c.listener != nil:
+		ln.Close()
+		return errors.New("client: already listening")
+	}
+
+	c.listener = ln
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		c.port = uint16(addr.Port)
+	}
+
+	go c.accept(ln)
+	return nil
+}
+
+// Addr returns the address of the client's listener, or nil if it isn't
+// listening.
+func (c *Client) Addr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.listener == nil {
+		return nil
+	}
+
+	return c.listener.Addr()
+}
+
+// accept hands the inbound connections over to their downloads, until the
+// listener is closed. Connections are handed over concurrently, so that
+// downloads which aren't taking connections yet, like ones rehashing their
+// pieces, don't stall the others.
+func (c *Client) accept(ln *peer.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			d, ok := c.Get(conn.InfoHash)
+			if !ok || !d.accept(conn) {
+				conn.Close(context.Background())
+			}
+		}()
+	}
+}
+
+// lookup returns the configuration of the inbound connections of the
+// download of the torrent with the provided infohash.
+func (c *Client) lookup(hash [20]byte) (*peer.Config, bool) {
+	d, ok := c.Get(hash)
+	if !ok {
+		return nil, false
+	}
+
+	return d.peerConfig(d.ourBitfield()), true
+}
+
+// hashes returns the infohashes of the client's downloads.
+func (c *Client) hashes() [][20]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hashes := make([][20]byte, 0, len(c.downloads))
+	for hash := range c.downloads {
+		hashes = append(hashes, hash)
+	}
+
+	return hashes
+}
+
+// PeerID returns the peer id used by the client for all of its torrents.
+func (c *Client) PeerID() [20]byte {
+	return c.name
+}
+
+// Add starts downloading the provided torrent in the background, storing
+// its pieces in the provided PieceManager. The torrent's Name is replaced
+// by the client's peer id. The download is removed from the client once it
+// has finished.
+func (c *Client) Add(t *Torrent, p PieceManager) (*Download, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+
+	if _, ok := c.downloads[t.InfoHash]; ok {
+		return nil, &DuplicateError{InfoHash: t.InfoHash}
+	}
+
+	// use client's identity and listener
+	torrent := *t
+	torrent.Name = c.name
+	if c.listener != nil {
+		torrent.Port = c.port
+	}
+
+	// share client's limiters
+	config := *c.config
+	config.DownloadLimiter = c.downloadLimiter
+	config.UploadLimiter = c.uploadLimiter
+
+	d := torrent.NewDownload(p, &config)
+	c.downloads[t.InfoHash] = d
+
+	go func() {
+		err := d.Run()
+		if err != nil {
+			c.log.Warnf("download of %x failed: %v", t.InfoHash, err)
+		}
+
+		c.forget(d)
+	}()
+
+	c.log.Infof("added torrent %x", t.InfoHash)
+	return d, nil
+}
+
+// Get returns the active download of the torrent with the provided
+// infohash, if any.
+func (c *Client) Get(hash [20]byte) (*Download, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.downloads[hash]
+	return d, ok
+}
+
+// Remove closes the download of the torrent with the provided infohash and
+// removes it from the client, waiting for it to shut down. It reports
+// whether the torrent was found.
+func (c *Client) Remove(hash [20]byte) bool {
+	c.mu.Lock()
+	d, ok := c.downloads[hash]
+	delete(c.downloads, hash)
+	c.mu.Unlock()
+
+	if ok {
+		if err := d.Close(); err != nil {
+			c.log.Warnf("closing download of %x: %v", hash, err)
+		}
+
+		c.log.Infof("removed torrent %x", hash)
+	}
+
+	return ok
+}
+
+// List returns all of the client's active downloads.
+func (c *Client) List() []*Download {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := make([]*Download, 0, len(c.downloads))
+	for _, d := range c.downloads {
+		list = append(list, d)
+	}
+
+	return list
+}
+
+// Close gracefully closes all the active downloads and the client. The
+// listener is closed first, and the waits for the shared limiters are
+// aborted.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+
+	c.closed = true
+	downloads := c.downloads
+	c.downloads = make(map[[20]byte]*Download)
+	listener := c.listener
+	c.mu.Unlock()
+
+	close(c.quit)
+
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+
+	// close the downloads concurrently, keeping the first error
+	var (
+		errMu sync.Mutex
+		wg    sync.WaitGroup
+	)
+
+	for _, d := range downloads {
+		wg.Add(1)
+		go func(d *Download) {
+			defer wg.Done()
+
+			if e := d.Close(); e != nil {
+				errMu.Lock()
+				if err == nil {
+					err = e
+				}
+				errMu.Unlock()
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	// remove port mappings from the router
+	for _, m := range c.mappings {
+		if e := m.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// MapPort forwards the provided tcp port on the local network's router to
+// this host using NAT-PMP or UPnP, so that peers outside the network can
+// connect to the client. The mapping is renewed until the client is closed.
+// It returns the external port, which may differ from port.
+func (c *Client) MapPort(ctx context.Context, port int) (int, error) {
+	mapper, err := nat.Discover(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	m, err := nat.Map(ctx, mapper, "tcp", port, c.log)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		m.Close()
+		return 0, ErrClientClosed
+	}
+
+	c.mappings = append(c.mappings, m)
+	return m.ExternalPort(), nil
+}
+
+// forget removes the provided download from the client, if it is still
+// present.
+func (c *Client) forget(d *Download) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hash := d.torrent.InfoHash
+	if c.downloads[hash] == d {
+		delete(c.downloads, hash)
+	}
+}
+
+// sharedLimiter is a peer.Limiter shared by the downloads of a Client,
+// whose waits are aborted once the client is closed.
+type sharedLimiter struct {
+	peer.Limiter
+	quit <-chan struct{} // closed when the client is closed
+}
+
+// WaitN waits for the underlying limiter, until the context is done or the
+// client is closed.
+func (l *sharedLimiter) WaitN(ctx context.Context, n int) error {
+	select {
+	case <-l.quit:
+		return ErrClientClosed
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-l.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := l.Limiter.WaitN(ctx, n); err != nil {
+		select {
+		case <-l.quit:
+			return ErrClientClosed
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
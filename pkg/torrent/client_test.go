@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestClientListen(t *testing.T) {
+	c, err := NewClient(&DownloadConfig{
+		ConnTimeout:   time.Second,
+		MaxUploadRate: 1 << 20,
+		Tracker:       staticTracker{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	tor := &Torrent{InfoHash: [20]byte{'h'}, PieceLength: 4, Length: 8, PieceHashes: make([][20]byte, 2)}
+	d, err := c.Add(tor, &pieceMap{pieces: make(map[int][]byte)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// downloads share the client's listener and limiters
+	if d.torrent.Port == 0 || d.config.UploadLimiter == nil || d.config.DownloadLimiter != nil {
+		t.Errorf("download port %d, limiters %v and %v", d.torrent.Port, d.config.DownloadLimiter, d.config.UploadLimiter)
+	}
+
+	// inbound peers are handed over to the download
+	addr := c.Addr().(*net.TCPAddr)
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	conn, err := peer.NewConn(p, tor.InfoHash, [20]byte{'r'}, &peer.Config{Timeout: time.Second, Pieces: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+
+	msg, err := conn.Read()
+	for err == nil && msg.Identifier == message.Extended {
+		msg, err = conn.Read()
+	}
+
+	if err != nil || msg.Identifier != message.UnChoke {
+		t.Errorf("inbound peer received %v, %v", msg, err)
+	}
+
+	// closing the client closes the listener and the limiters
+	limiter := d.config.UploadLimiter
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := peer.NewConn(p, tor.InfoHash, [20]byte{'r'}, &peer.Config{Timeout: time.Second}); err == nil {
+		t.Error("connected to a closed client")
+	}
+
+	if err := limiter.WaitN(context.Background(), 1<<20); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("wait for closed limiter returned %v", err)
+	}
+}
+
+// blockingLister is a listingMap whose Indices blocks until release is
+// closed, like a slow rehash.
+type blockingLister struct {
+	listingMap
+	release chan struct{}
+}
+
+func (m *blockingLister) Indices() ([]int, error) {
+	<-m.release
+	return m.listingMap.Indices()
+}
+
+func TestClientAcceptStalled(t *testing.T) {
+	c, err := NewClient(&DownloadConfig{ConnTimeout: time.Second, Tracker: staticTracker{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first download is still resuming, so it doesn't take connections
+	release := make(chan struct{})
+	defer close(release)
+
+	stalled := &Torrent{InfoHash: [20]byte{'s'}, PieceLength: 4, Length: 8, PieceHashes: make([][20]byte, 2)}
+	lister := &blockingLister{listingMap{pieceMap{pieces: make(map[int][]byte)}}, release}
+	if _, err := c.Add(stalled, lister); err != nil {
+		t.Fatal(err)
+	}
+
+	tor := &Torrent{InfoHash: [20]byte{'h'}, PieceLength: 4, Length: 8, PieceHashes: make([][20]byte, 2)}
+	if _, err := c.Add(tor, &pieceMap{pieces: make(map[int][]byte)}); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := c.Addr().(*net.TCPAddr)
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	config := &peer.Config{Timeout: time.Second, Pieces: 2}
+
+	first, err := peer.NewConn(p, stalled.InfoHash, [20]byte{'r'}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close(context.Background())
+
+	// inbound peers of the other download are still handed over
+	conn, err := peer.NewConn(p, tor.InfoHash, [20]byte{'r'}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+
+	conn.Conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	msg, err := conn.Read()
+	for err == nil && msg.Identifier == message.Extended {
+		msg, err = conn.Read()
+	}
+
+	if err != nil || msg.Identifier != message.UnChoke {
+		t.Errorf("inbound peer received %v, %v", msg, err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"context"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+// StoppedTimeout is the maximum amount of time spent announcing the stopped
+// event to the tracker when a download is closed.
+const StoppedTimeout = 10 * time.Second
+
+// Close shuts the download down gracefully. It stops scheduling work,
+// closes the peer connections and waits for the workers to exit, writes the
+// pieces waiting to be stored, syncs the PieceManager if it implements
+// PieceSyncer, and announces the stopped event to the tracker. Close can be
+// called multiple times, and always returns the result of the first call.
+func (d *Download) Close() error {
+	d.closeOnce.Do(func() {
+		d.lifeMu.Lock()
+		d.closed = true
+		running := d.running
+		d.lifeMu.Unlock()
+
+		d.stop()
+		if !running {
+			return
+		}
+
+		// Run returns after the workers and the disk queue have stopped
+		<-d.done
+
+		if syncer, ok := d.manager.(PieceSyncer); ok {
+			d.closeErr = syncer.Sync()
+		}
+
+		if err := d.announceStopped(); err != nil {
+			d.log.Warnf("announcing stop failed: %v", err)
+		}
+	})
+
+	return d.closeErr
+}
+
+// begin marks the download as running, and reports false if it has
+// already been closed.
+func (d *Download) begin() bool {
+	d.lifeMu.Lock()
+	defer d.lifeMu.Unlock()
+
+	d.running = !d.closed
+	return d.running
+}
+
+// drain stops the download, and waits for its workers and peer sources to
+// exit and for the verified pieces to be written to the PieceManager. No
+// announces are in progress once it returns.
+func (d *Download) drain() {
+	d.stop()
+
+	<-d.checked // no more workers or sources will be started
+	d.workers.Wait()
+	d.sources.Wait()
+	<-d.flushed
+}
+
+// quitting checks if the download has been stopped.
+func (d *Download) quitting() bool {
+	select {
+	case <-d.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// announceStopped announces to the tracker that the download has stopped,
+// if it was announced as started. Failed announces are not retried.
+func (d *Download) announceStopped() error {
+	if !d.started {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), StoppedTimeout)
+	defer cancel()
+
+	req := d.announceRequest()
+	req.Event = tracker.Stopped
+
+	_, err := d.tracker.Transport.Announce(ctx, req)
+	return err
+}
@@ -0,0 +1,90 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+func TestCloseBeforeRun(t *testing.T) {
+	tor := &Torrent{PieceLength: 1, Length: 1, PieceHashes: make([][20]byte, 1)}
+	d := tor.NewDownload(&memoryManager{}, &DownloadConfig{})
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("closing download: %v", err)
+	}
+
+	if err := d.Run(); !errors.Is(err, ErrDownloadStopped) {
+		t.Errorf("closed download returned %v", err)
+	}
+
+	if res := d.Result(); res == nil || !errors.Is(res.Err, ErrDownloadStopped) {
+		t.Errorf("closed download has result %+v", res)
+	}
+}
+
+// blockingTracker is a tracker.Transport whose first announce returns its
+// peers, and whose later announces block until they are cancelled, except
+// for the stopped event. It records the events in order.
+type blockingTracker struct {
+	mu      sync.Mutex
+	peers   []peer.Peer
+	events  []string
+	blocked chan struct{} // closed when an announce blocks
+}
+
+func (t *blockingTracker) record(event string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.events = append(t.events, event)
+	return len(t.events)
+}
+
+func (t *blockingTracker) Announce(ctx context.Context, req *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error) {
+	if req.Event == tracker.Stopped {
+		t.record("stopped")
+		return &tracker.AnnounceResponse{}, nil
+	}
+
+	if t.record("announce") == 1 {
+		return &tracker.AnnounceResponse{MinInterval: time.Millisecond, Peers: t.peers}, nil
+	}
+
+	close(t.blocked)
+	<-ctx.Done()
+	t.record("cancelled")
+	return nil, ctx.Err()
+}
+
+func TestCloseAnnounce(t *testing.T) {
+	tor, _ := splitPieces(make([]byte, MaxBlockSize), MaxBlockSize)
+	tr := &blockingTracker{peers: []peer.Peer{deadPeer(t)}, blocked: make(chan struct{})}
+
+	d := tor.NewDownload(&pieceMap{pieces: make(map[int][]byte)}, &DownloadConfig{
+		ConnTimeout: time.Second,
+		Tracker:     &tracker.Retry{Transport: tr},
+	})
+
+	go d.Run()
+	<-tr.blocked
+
+	// the reannounce is cancelled before the stopped event is announced
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	expected := []string{"announce", "announce", "cancelled", "stopped"}
+	if !reflect.DeepEqual(tr.events, expected) {
+		t.Errorf("tracker received %v, expected %v", tr.events, expected)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// DefaultDiskQueueSize is the default maximum number of bytes of verified
+// pieces waiting to be written to the PieceManager.
+const DefaultDiskQueueSize = 32 << 20 // 32 mb
+
+// diskQueue is a queue of verified pieces which need to be stored in the
+// PieceManager. Pieces are written in the background, and pushing to the
+// queue blocks while it is full, which slows down the workers when the
+// disk falls behind the network.
+//
+// If the PieceManager implements io.WriterAt, the queued pieces are written
+// in order at their offsets in the torrent, so that runs of adjacent pieces
+// are written sequentially. Pieces aren't copied into a larger buffer, which
+// would double the memory used by a full queue.
+type diskQueue struct {
+	manager  PieceManager // manager storing the pieces
+	pieceLen int          // length of each piece
+	limit    int          // maximum number of bytes in the queue
+
+	mu      sync.Mutex     // guards the fields below
+	cond    *sync.Cond     // signalled when the queue changes
+	pending []*pieceResult // pieces waiting to be written
+	queued  int            // number of bytes in pending
+	closed  bool           // whether the queue has been closed
+}
+
+// newDiskQueue creates a new diskQueue which stores pieces in manager.
+func newDiskQueue(manager PieceManager, pieceLen, limit int) *diskQueue {
+	if limit <= 0 {
+		limit = DefaultDiskQueueSize
+	}
+
+	q := &diskQueue{
+		manager:  manager,
+		pieceLen: pieceLen,
+		limit:    limit,
+	}
+
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds a piece to the queue, blocking while the queue is full. It
+// reports false if the queue has been closed.
+func (q *diskQueue) push(p *pieceResult) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// a piece is always accepted into an empty queue
+	for !q.closed && q.queued > 0 && q.queued+len(p.value) > q.limit {
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return false
+	}
+
+	q.pending = append(q.pending, p)
+	q.queued += len(p.value)
+	q.cond.Broadcast()
+	return true
+}
+
+// close closes the queue, waking up any blocked goroutines.
+func (q *diskQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// run writes the queued pieces until the queue is closed and empty,
+// calling written with each piece and the result of its write.
+func (q *diskQueue) run(written func(*pieceResult, error)) {
+	for {
+		q.mu.Lock()
+		for !q.closed && len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+
+		// pieces queued before closing are still written
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return
+		}
+
+		batch := q.pending
+		q.pending = nil
+		q.mu.Unlock()
+
+		q.write(batch, written)
+
+		// free up space only after the batch is written, so that the
+		// queue's limit bounds the memory used by pending writes
+		q.mu.Lock()
+		for _, p := range batch {
+			q.queued -= len(p.value)
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+// write writes a batch of pieces to the manager.
+func (q *diskQueue) write(batch []*pieceResult, written func(*pieceResult, error)) {
+	w, ok := q.manager.(io.WriterAt)
+	if !ok {
+		for _, p := range batch {
+			written(p, q.manager.Put(p.index, p.value))
+		}
+		return
+	}
+
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].index < batch[j].index
+	})
+
+	for _, p := range batch {
+		_, err := w.WriteAt(p.value, int64(p.index)*int64(q.pieceLen))
+		written(p, err)
+	}
+}
@@ -0,0 +1,123 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// memoryManager is a PieceManager which stores the torrent in memory and
+// records the offsets of the writes made to it.
+type memoryManager struct {
+	data   []byte
+	writes []int64
+}
+
+func (m *memoryManager) Init() error                 { return nil }
+func (m *memoryManager) Close() error                { return nil }
+func (m *memoryManager) Get(int) ([]byte, error)     { return nil, errors.New("unimplemented") }
+func (m *memoryManager) Put(i int, buf []byte) error { return errors.New("unexpected put") }
+
+func (m *memoryManager) WriteAt(b []byte, off int64) (int, error) {
+	m.writes = append(m.writes, off)
+	return copy(m.data[off:], b), nil
+}
+
+func TestDiskQueueWriteAt(t *testing.T) {
+	m := &memoryManager{data: make([]byte, 10)}
+	q := newDiskQueue(m, 2, 0)
+
+	// pieces are written in order, without being copied
+	for _, i := range []int{2, 0, 4, 1} {
+		q.push(&pieceResult{index: i, value: []byte{byte('a' + 2*i), byte('b' + 2*i)}})
+	}
+
+	written := 0
+	q.write(q.pending, func(p *pieceResult, err error) {
+		if err != nil {
+			t.Errorf("writing piece %d: %v", p.index, err)
+		}
+		written++
+	})
+
+	if written != 4 {
+		t.Errorf("%d pieces written, expected 4", written)
+	}
+
+	if expected := []int64{0, 2, 4, 8}; !reflect.DeepEqual(m.writes, expected) {
+		t.Errorf("writes made at %v, expected %v", m.writes, expected)
+	}
+
+	if expected := []byte("abcdef\x00\x00ij"); !bytes.Equal(m.data, expected) {
+		t.Errorf("data is %q, expected %q", m.data, expected)
+	}
+}
+
+func TestDiskQueueBackpressure(t *testing.T) {
+	q := newDiskQueue(&memoryManager{}, 4, 8)
+
+	q.push(&pieceResult{index: 0, value: make([]byte, 4)})
+	q.push(&pieceResult{index: 1, value: make([]byte, 4)})
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(&pieceResult{index: 2, value: make([]byte, 4)})
+	}()
+
+	// the queue is full, so the push blocks until it is closed
+	q.close()
+	if <-pushed {
+		t.Error("piece pushed into a full queue")
+	}
+}
+
+func TestDiskQueueDrain(t *testing.T) {
+	m := &memoryManager{data: make([]byte, 4)}
+	q := newDiskQueue(m, 2, 0)
+
+	q.push(&pieceResult{index: 0, value: []byte("ab")})
+	q.push(&pieceResult{index: 1, value: []byte("cd")})
+	q.close()
+
+	// pieces queued before closing are written
+	written := 0
+	q.run(func(*pieceResult, error) { written++ })
+
+	if written != 2 || string(m.data) != "abcd" {
+		t.Errorf("%d pieces written with data %q after closing", written, m.data)
+	}
+}
+
+// failingManager is a PieceManager which fails to store pieces.
+type failingManager struct {
+	memoryManager
+}
+
+func (failingManager) WriteAt([]byte, int64) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWritePiecesFailure(t *testing.T) {
+	tor := &Torrent{PieceLength: 2, Length: 4, PieceHashes: make([][20]byte, 2)}
+	d := tor.NewDownload(&failingManager{}, &DownloadConfig{})
+	d.init()
+	defer d.stop()
+
+	d.disk.push(&pieceResult{index: 1, value: []byte("cd")})
+	go d.writePieces()
+
+	if res := <-d.result; res != resultStorageFailed {
+		t.Fatalf("download result %v, expected storage failure", res)
+	}
+
+	var sErr *StorageError
+	if !errors.As(d.storeErr, &sErr) || sErr.Index != 1 {
+		t.Errorf("storage error %v", d.storeErr)
+	}
+
+	// pieces which weren't stored aren't marked as verified
+	if len(d.pieces) != 0 {
+		t.Errorf("%d unstored pieces sent as stored", len(d.pieces))
+	}
+}
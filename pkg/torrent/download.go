@@ -14,38 +14,200 @@
 package torrent
 
 import (
-	"crypto/sha1"
+	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
+	"net"
+	"net/http"
+	"sync"
 	"time"
 
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/log"
+	"laptudirm.com/x/mtor/pkg/mse"
 	"laptudirm.com/x/mtor/pkg/peer"
+	"laptudirm.com/x/mtor/pkg/proxy"
+	"laptudirm.com/x/mtor/pkg/tracker"
 )
 
-// download represents the state of a torrent thats being downloaded.
-type download struct {
+// Download represents the state of a torrent thats being downloaded.
+type Download struct {
 	// communication channels
 	work   workChan   // work channel
 	pieces pieceChan  // pieces channel
+	verify verifyChan // verification channel
+	disk   *diskQueue // disk write queue
 	death  deathChan  // death channel
 	result resultChan // result channel
 
 	// state information
-	torrent *Torrent     // the torrent being downloaded
-	manager PieceManager // the piece manager
-	peers   []peer.Peer  // the peerlist
-	peerNum int          // number of peers connected to
+	torrent    *Torrent         // the torrent being downloaded
+	manager    PieceManager     // the piece manager
+	peers      []peer.Peer      // the peerlist
+	peerNum    int              // number of peers connected to
+	stored     int              // number of pieces stored before starting
+	pool       *peerPool        // peers from all sources
+	dials      *peer.DialQueue  // peers waiting to be connected to
+	reputation *peer.Reputation // history of the peers
+	stats      *stats           // download statistics
+
+	// tracker information
+	tracker      *tracker.Retry // transport used to announce
+	nextAnnounce time.Time      // earliest time to reannounce
+	started      bool           // whether the started event was announced
+	trackerID    string         // tracker id to send in later announces
+
+	// our bitfield, containing the verified pieces
+	bitfield   bitfield.Bitfield
+	bitfieldMu sync.Mutex // guards bitfield
+
+	// pieces whose downloads failed midway
+	partials   map[int]*partialPiece
+	partialsMu sync.Mutex // guards partials
+
+	// pieces being downloaded, which may be duplicated in endgame mode
+	inflight   map[int]*inflightPiece
+	claimed    map[int]bool // downloaded pieces sent for verification
+	scheduled  bool         // whether all pieces have been scheduled
+	inflightMu sync.Mutex   // guards inflight, claimed, and scheduled
+
+	// outcome of the download, built while it runs
+	outcome   *DownloadResult
+	outcomeMu sync.Mutex // guards outcome
+
+	// connection information
+	inbound   chan *peer.Conn           // accepted connections to run workers with
+	haves     map[*haveQueue]struct{}   // have queues of open connections
+	connHaves map[*peer.Conn]*haveQueue // have queues of workers to start
+	havesMu   sync.Mutex                // guards haves and connHaves
+
+	// lifetime information
+	quit     chan struct{}  // closed to stop the download
+	quitOnce sync.Once      // guards closing quit
+	done     chan struct{}  // closed when the download has finished
+	err      error          // result of the download
+	storeErr error          // error which failed storing a piece
+	checked  chan struct{}  // closed when no more workers will be started
+	flushed  chan struct{}  // closed when the disk queue has been written
+	workers  sync.WaitGroup // running workers
+	sources  sync.WaitGroup // running peer sources
+
+	running   bool       // whether Run has been called
+	closed    bool       // whether Close has been called
+	lifeMu    sync.Mutex // guards running and closed
+	closeOnce sync.Once  // guards closing the download
+	closeErr  error      // result of closing the download
 
 	// config information
 	config *DownloadConfig
+	log    log.Logger // download logger
 }
 
+// DownloadConfig contains the configuration of a download.
 type DownloadConfig struct {
-	Backlog int // number of requests to keep in backlog
 	PeerAmt int // number of peers to request from tracker
 
+	// PeerIDPrefix is the Azureus-style prefix of the peer id generated by
+	// a Client, like "-MT0100-". Defaults to peer.ClientPrefix.
+	PeerIDPrefix string
+
+	// MaxBacklog is the maximum number of outstanding block requests per
+	// peer. The actual backlog adapts to each peer's speed.
+	MaxBacklog int
+	// QueueTime is the amount of transfer time worth of block requests to
+	// keep outstanding with each peer.
+	QueueTime time.Duration
+
 	DownTimeout time.Duration // download timeout
 	ConnTimeout time.Duration // connection timeout
+
+	// MaxHalfOpen is the maximum number of peers which are being connected
+	// to at once. Defaults to peer.DefaultMaxHalfOpen.
+	MaxHalfOpen int
+
+	// ReconnectAttempts is the maximum number of times a peer which drops
+	// after sending us blocks is redialed, waiting ReconnectDelay before
+	// the first attempt and twice as long before each next one. They
+	// default to peer.DefaultReconnectAttempts and
+	// peer.DefaultReconnectDelay, and reconnecting is disabled if
+	// ReconnectAttempts is negative.
+	ReconnectAttempts int
+	ReconnectDelay    time.Duration
+
+	// BlockTimeout is the amount of time after which an outstanding block
+	// request is cancelled and requested again. Defaults to
+	// DefaultBlockTimeout.
+	BlockTimeout time.Duration
+
+	// SnubTimeout is the amount of time after which a peer which isn't
+	// choking us, but hasn't sent any requested block, is disconnected and
+	// its piece is requeued. Defaults to DefaultSnubTimeout.
+	SnubTimeout time.Duration
+
+	// Verifiers is the number of goroutines which verify the hashes of
+	// downloaded pieces. Defaults to the number of CPUs.
+	Verifiers int
+	// DiskQueueSize is the maximum number of bytes of verified pieces
+	// waiting to be stored. Workers are slowed down when the queue is full.
+	// Defaults to DefaultDiskQueueSize.
+	DiskQueueSize int
+
+	// MinPeers is the minimum number of live peer connections. When fewer
+	// peers are alive, more peers are requested from the peer sources, and
+	// the tracker is reannounced to, respecting its min interval. Defaults
+	// to 1.
+	MinPeers int
+
+	// PeerSources are the sources of peers used in addition to the tracker.
+	// They aren't used for private torrents.
+	PeerSources []PeerSource
+
+	// Reputation records the history of the peers, and peers with better
+	// scores are connected to first. It may be shared by multiple downloads
+	// in a session. If it is nil, each download uses its own.
+	Reputation *peer.Reputation
+
+	Proxy *proxy.Config // proxy configuration, or nil to connect directly
+
+	Encryption mse.Policy // peer connection encryption policy
+
+	// LocalAddr is the local address which peers are dialed from, if it
+	// isn't nil. ReusePort allows the connections to share its port with
+	// each other and with the Client's listener, so that peers see us
+	// connecting from the port we announce. See peer.Config.
+	LocalAddr *net.TCPAddr
+	ReusePort bool
+
+	// DownloadLimiter and UploadLimiter shape the bandwidth of all the peer
+	// connections of the download, if they aren't nil. A Client shares its
+	// limiters between its downloads.
+	DownloadLimiter peer.Limiter
+	UploadLimiter   peer.Limiter
+
+	// MaxDownloadRate and MaxUploadRate are the bandwidth limits in bytes
+	// per second of the limiters created by a Client, if they are positive
+	// and the limiters aren't set.
+	MaxDownloadRate int
+	MaxUploadRate   int
+
+	// HTTPClient is used to announce to http trackers. If it is nil, a
+	// client which respects Proxy is used.
+	HTTPClient *http.Client
+	// TrackerTLS configures the connections to https trackers made by the
+	// default client. It is ignored if HTTPClient is set.
+	TrackerTLS *tls.Config
+	// Tracker is used to announce to trackers. If it is nil, the default
+	// transports from package tracker are used with HTTPClient. Failed
+	// announces are retried with the default policy, unless Tracker is a
+	// *tracker.Retry.
+	Tracker tracker.Transport
+
+	Events *Events    // download event hooks
+	Logger log.Logger // download logger, or nil to discard logs
+
+	// Tracer is called with every message exchanged with the peers of the
+	// download, if it isn't nil, to record protocol traces for debugging.
+	Tracer peer.Tracer
 }
 
 // workChan represtents a work channel consisting of pieces which need to be
@@ -69,207 +231,489 @@ type result int
 const (
 	resultDownloadComplete result = iota // download successful
 	resultAllWorkersDead                 // all workers died
+	resultStorageFailed                  // a verified piece couldn't be stored
 )
 
+// ErrWorkersDead is matched by the *WorkersDeadError returned when all the
+// workers of a download are dead.
 var ErrWorkersDead = errors.New("download: all workers are dead")
 
+// ErrDownloadStopped is returned when a download is stopped before it is
+// complete.
+var ErrDownloadStopped = errors.New("download: stopped")
+
+// ErrSnubbed is returned when a peer stops sending requested blocks while
+// it isn't choking us.
+var ErrSnubbed = errors.New("download: peer is snubbing us")
+
+// DefaultBlockTimeout is the default amount of time after which a block
+// request is cancelled and sent again.
+const DefaultBlockTimeout = 10 * time.Second
+
+// MaxBlockTimeouts is the number of block requests of a piece which may
+// time out with a peer before the piece is left for another peer.
+const MaxBlockTimeouts = 4
+
+// DefaultSnubTimeout is the default amount of time after which a peer
+// which hasn't sent any requested block is considered to be snubbing us.
+const DefaultSnubTimeout = 15 * time.Second
+
 const MaxBlockSize = 16384 // 16 kb
 
-// start starts downloading the provided download
-func (d *download) start() error {
-	d.init() // initialize channels
+// Run starts downloading the provided download, and blocks until it is
+// complete or has failed. Run should only be called once.
+func (d *Download) Run() error {
+	defer close(d.done)
+
+	if !d.begin() {
+		d.err = ErrDownloadStopped
+		d.finish(d.err)
+		return d.err
+	}
+
+	d.err = d.run()
+	d.finish(d.err)
+	if d.err == nil {
+		d.config.Events.complete(time.Since(d.stats.start))
+	}
+
+	return d.err
+}
+
+// Wait blocks until the download has finished, and returns its result.
+func (d *Download) Wait() error {
+	<-d.done
+	return d.err
+}
+
+// Done returns a channel which is closed when the download has finished.
+func (d *Download) Done() <-chan struct{} {
+	return d.done
+}
+
+// stop stops the download if it is running.
+func (d *Download) stop() {
+	d.quitOnce.Do(func() {
+		close(d.quit)
+	})
+}
+
+// run runs the download and returns its result.
+func (d *Download) run() error {
+	// fail early on inconsistent torrents
+	if err := d.torrent.Validate().Err(); err != nil {
+		return err
+	}
 
-	// get peers
+	d.init()       // initialize channels
+	defer d.stop() // stop background goroutines
+
+	// skip pieces which are already stored
+	if err := d.resume(); err != nil {
+		return err
+	}
+
+	// get peers, which may also be found by the other peer sources
 	err := d.loadPeers()
 	if err != nil {
-		return err
+		if len(d.peerSources()) == 0 {
+			return err
+		}
+
+		d.log.Warnf("continuing with the other peer sources")
 	}
 
-	go d.checkWorkers() // check if workers are working
+	go d.checkWorkers() // check if workers are working and start them
 	go d.managePieces() // manage the downloaded pieces
+	d.startVerifiers()  // verify the downloaded pieces
+	go d.writePieces()  // write the verified pieces
 	go d.scheduleWork() // schedule pieces to download
-	go d.startWorkers() // start workers with peers
-
-	switch <-d.result {
-	case resultDownloadComplete: // download complete
-		err = nil
-	case resultAllWorkersDead: // all workers are dead
-		err = ErrWorkersDead
-	default: // unreachable
-		panic("fatal: unknown download result")
+	defer d.drain()     // wait for the goroutines to exit
+
+	select {
+	case res := <-d.result:
+		switch res {
+		case resultDownloadComplete: // download complete
+			err = nil
+		case resultAllWorkersDead: // all workers are dead
+			err = &WorkersDeadError{Result: d.outcome}
+		case resultStorageFailed: // storing a piece failed
+			err = d.storeErr
+		default: // unreachable
+			panic("fatal: unknown download result")
+		}
+	case <-d.quit: // download stopped
+		err = ErrDownloadStopped
 	}
 
 	return err
 }
 
 // init initializes the channels in the provided download.
-func (d *download) init() {
+func (d *Download) init() {
 	pieceNum := len(d.torrent.PieceHashes)
 
 	d.work = make(workChan, pieceNum)
 	d.pieces = make(pieceChan, pieceNum)
+	d.verify = make(verifyChan, d.verifiers())
+	d.disk = newDiskQueue(d.manager, d.torrent.PieceLength, d.config.DiskQueueSize)
 	d.death = make(deathChan)
 	d.result = make(resultChan)
+	d.pool = newPeerPool(d.quit)
+	d.checked = make(chan struct{})
+	d.flushed = make(chan struct{})
+
+	d.reputation = d.config.Reputation
+	if d.reputation == nil {
+		d.reputation = peer.NewReputation()
+	}
+}
+
+// resume marks the pieces which have already been stored by the piece
+// manager as verified, if it implements PieceLister.
+func (d *Download) resume() error {
+	lister, ok := d.manager.(PieceLister)
+	if !ok {
+		return nil
+	}
+
+	indices, err := lister.Indices()
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indices {
+		if index < 0 || index >= len(d.torrent.PieceHashes) || d.has(index) {
+			continue
+		}
+
+		d.setHave(index)
+		d.stats.verify(d.torrent.pieceLen(index))
+		d.stored++
+	}
+
+	if d.stored > 0 {
+		d.log.Infof("resuming with %d stored pieces", d.stored)
+	}
+
+	return nil
 }
 
 // loadPeers fetches the peers of the torrent being downloaded, and puts
 // them in the state.
-func (d *download) loadPeers() error {
-	// get peers from tracker
-	peers, err := d.torrent.Peers(d.config.PeerAmt)
+func (d *Download) loadPeers() error {
+	ctx, cancel := d.quitContext()
+	defer cancel()
+
+	peers, err := d.announce(ctx)
 	d.peers = peers
 	return err
 }
 
-// checkWorkers manages the lifetime of the workers, and checks if all the
-// workers are dead or not.
-func (d *download) checkWorkers() {
-	for range d.death {
-		d.peerNum--
+// DefaultMinInterval is the minimum interval between announces used when
+// the tracker doesn't specify one.
+const DefaultMinInterval = 30 * time.Second
+
+// announce announces to the torrent's tracker and returns the received
+// peers. It also records the earliest time the tracker can be reannounced
+// to. The announce is aborted when the context is done.
+func (d *Download) announce(ctx context.Context) ([]peer.Peer, error) {
+	logger := d.log.Scope("tracker")
+	logger.Debugf("announcing to %s", d.torrent.Announce)
 
-		if d.peerNum == 0 {
-			d.result <- resultAllWorkersDead
-			close(d.death) // no death left to report
+	req := d.announceRequest()
+	if !d.started {
+		req.Event = tracker.Started
+	}
+
+	// get peers from tracker
+	res, err := d.tracker.Announce(ctx, req)
+
+	interval := DefaultMinInterval
+	var peers []peer.Peer
+
+	if err != nil {
+		logger.Errorf("announce failed: %v", err)
+		d.recordTrackerError(err)
+
+		// back off from failing trackers
+		if backoff := d.tracker.Backoff(req.Announce); backoff > interval {
+			interval = backoff
+		}
+	} else {
+		d.started = true
+		peers = res.Peers
+		if res.TrackerID != "" {
+			d.trackerID = res.TrackerID
+		}
+		logger.Infof("received %d peers", len(peers))
+
+		if res.Warning != "" {
+			logger.Warnf("tracker warning: %s", res.Warning)
+		}
+
+		// minimum interval to wait before reannouncing
+		switch {
+		case res.MinInterval > 0:
+			interval = res.MinInterval
+		case res.Interval > 0 && res.Interval < interval:
+			interval = res.Interval
+		}
+	}
+
+	d.nextAnnounce = time.Now().Add(interval)
+	d.config.Events.trackerAnnounce(peers, err)
+	return peers, err
+}
+
+// announceRequest returns a request to announce the download's current
+// state to the tracker.
+func (d *Download) announceRequest() *tracker.AnnounceRequest {
+	req := d.torrent.AnnounceRequest(d.config.PeerAmt)
+	req.TrackerID = d.trackerID
+
+	stats := d.stats.snapshot()
+	req.Downloaded = stats.Downloaded
+	req.Uploaded = stats.Uploaded
+	req.Left = stats.Left
+
+	return req
+}
+
+// checkWorkers manages the lifetime of the workers. It starts workers with
+// the initial peers and the peers added to the pool by the peer sources,
+// requests more peers when too few workers are alive, and reports when all
+// the workers are dead and all the peer sources have returned.
+func (d *Download) checkWorkers() {
+	defer close(d.checked)
+
+	minPeers := d.config.MinPeers
+	if minPeers <= 0 {
+		minPeers = 1
+	}
+
+	d.startDials()
+	d.startWorkers(d.pool.filter(d.peers, peer.SourceTracker))
+	sources := d.startSources() // number of running peer sources
+
+	for {
+		if d.peerNum == 0 && sources == 0 {
+			select {
+			case d.result <- resultAllWorkersDead:
+			case <-d.quit:
+			}
+			return
+		}
+
+		// replenish peers if too few are alive
+		d.pool.setLive(d.peerNum)
+		if d.peerNum < minPeers {
+			d.pool.requestPeers()
+		}
+
+		select {
+		case <-d.death:
+			d.peerNum--
+		case peers := <-d.pool.fresh:
+			d.startWorkers(peers)
+		case <-d.pool.finished:
+			sources--
+		case conn := <-d.inbound:
+			d.peerNum++
+			d.workers.Add(1)
+			go d.runWorker(conn.Peer, conn, d.inboundHaveQueue(conn))
+		case <-d.quit:
 			return
 		}
 	}
 }
 
-// managePieces manages the downloaded pieces from the piece channel.
-func (d *download) managePieces() {
+// writePieces writes the verified pieces from the disk queue, and sends
+// them to the piece channel once they are stored. The download fails with a
+// *StorageError if a piece can't be stored, and the pieces which weren't
+// stored are never marked as verified.
+func (d *Download) writePieces() {
+	defer close(d.flushed)
+
+	// stop the disk queue with the download
+	go func() {
+		<-d.quit
+		d.disk.close()
+	}()
+
+	failed := false
+	d.disk.run(func(piece *pieceResult, err error) {
+		if failed {
+			return // the download is stopping
+		}
+
+		if err != nil {
+			failed = true
+			d.log.Errorf("storing piece %d: %v", piece.index, err)
+
+			d.storeErr = &StorageError{Index: piece.index, Err: err}
+			select {
+			case d.result <- resultStorageFailed:
+			case <-d.quit:
+			}
+			return
+		}
+
+		d.pieces <- piece
+	})
+}
+
+// managePieces manages the stored pieces from the piece channel.
+func (d *Download) managePieces() {
 	length := cap(d.work)
-	for done := 0; done < length; done++ {
+	for done := d.stored; done < length; done++ {
 		piece := <-d.pieces
-		fmt.Printf("mtor: downloaded piece %v, %v peers\n", piece.index, d.peerNum)
-		d.manager.Put(piece.index, piece.value)
+
+		d.stats.verify(len(piece.value))
+		d.setHave(piece.index)
+		d.broadcastHave(piece.index)
+		d.log.Debugf("downloaded piece %d", piece.index)
+		d.config.Events.pieceVerified(piece.index, done+1, length)
 	}
 
 	close(d.work)   // no work left to schedule
 	close(d.pieces) // no pieces left to download
 
 	// all pieces downloaded
-	d.result <- resultDownloadComplete
+	select {
+	case d.result <- resultDownloadComplete:
+	case <-d.quit:
+	}
 }
 
 // scheduleWork starts putting the torrent pieces in the work channel.
-func (d *download) scheduleWork() {
+func (d *Download) scheduleWork() {
 	for index, hash := range d.torrent.PieceHashes {
+		// skip stored pieces
+		if d.has(index) {
+			continue
+		}
+
 		d.work <- &piece{
 			index:  index,
 			hash:   hash,
 			length: d.torrent.pieceLen(index),
 		}
 	}
+
+	d.setScheduled()
 }
 
-// startWorkers starts connections with the peers in the state.
-func (d *download) startWorkers() error {
-	d.peerNum = len(d.peers)
+// startDials starts connecting to the peers queued by startWorkers, until
+// the download stops.
+func (d *Download) startDials() {
+	d.dials = peer.NewDialQueue(peer.DialQueueConfig{
+		MaxHalfOpen: d.config.MaxHalfOpen,
+		Score:       d.reputation.Score,
+		Dial:        d.dial,
+		OnConnect: func(p peer.Peer, conn *peer.Conn) {
+			go d.runWorker(p, conn, d.connHaveQueue(conn))
+		},
+		OnFailure: func(p peer.Peer, err error) {
+			d.peerDied(p, err)
+			d.workers.Done()
+		},
+	})
+
+	ctx, _ := d.quitContext()
+	go d.dials.Run(ctx)
+}
 
-	// start peer connections
-	for _, peer := range d.peers {
-		go d.connectToPeer(peer)
-	}
+// quitContext returns a context which is cancelled when the download stops,
+// or when the returned function is called.
+func (d *Download) quitContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-d.quit:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
 
-	return nil
+	return ctx, cancel
 }
 
-// connectToPeer tries to connect to the peer p, and if successful, downloads
-// the torrent pieces from that peer.
-func (d *download) connectToPeer(p peer.Peer) {
-	defer func() {
-		d.death <- &p // report death
-	}()
+// dial connects to the provided peer, and registers the have queue of the
+// connection, which is used by its worker.
+func (d *Download) dial(ctx context.Context, p peer.Peer) (*peer.Conn, error) {
+	// the peer is sent our bitfield in the handshake, and the pieces
+	// verified later using the have queue
+	haves := newHaveQueue()
+	config := d.peerConfig(d.addHaveQueue(haves))
 
-	// try to connect to peer
-	conn, err := peer.NewConn(p, d.torrent.InfoHash, d.torrent.Name, d.config.ConnTimeout)
+	conn, err := peer.NewConnContext(ctx, p, d.torrent.InfoHash, d.torrent.Name, config)
 	if err != nil {
-		fmt.Println(err)
-		return
+		d.removeHaveQueue(haves)
+		return nil, err
 	}
-	defer conn.Conn.Close()
-
-	conn.UnChoke() // un-choke peer
-	conn.Interested()
 
-	fmt.Printf("mtor: connected to peer %s\n", p)
+	d.setConnHaveQueue(conn, haves)
+	return conn, nil
+}
 
-	// get pieces from work channel
-	for piece := range d.work {
-		// check if peer has piece
-		if !conn.Bitfield.Has(piece.index) {
-			d.work <- piece
-			continue
-		}
+// startWorkers queues connections with the provided peers.
+func (d *Download) startWorkers(peers []peer.Peer) {
+	// queue peer connections
+	d.workers.Add(len(peers))
+	d.dials.Push(peers...)
 
-		// download piece from peer
-		block, err := d.downloadPiece(conn, piece)
-		if err != nil {
-			d.work <- piece
-			fmt.Println(err)
-			return
-		}
+	d.peerNum += len(peers)
+	d.stats.setKnown(d.pool.known.Len())
+}
 
-		// check the integrity of downloaded piece
-		if !checkIntegrity(piece, block) {
-			d.work <- piece
-			continue
-		}
+// peerDied reports the death of the peer p, which failed with the provided
+// error.
+func (d *Download) peerDied(p peer.Peer, err error) {
+	d.peerDisconnected(p, err)
 
-		// send downloaded piece to pieces channel
-		d.pieces <- &pieceResult{
-			index: piece.index,
-			value: block,
-		}
+	// report death
+	select {
+	case d.death <- &p:
+	case <-d.quit:
 	}
 }
 
-// downloadBlock downloads a piece from a peer connection.
-func (d *download) downloadPiece(conn *peer.Conn, p *piece) ([]byte, error) {
-	progress := pieceProgress{
-		index: p.index,
-		buf:   make([]byte, p.length),
-		conn:  conn,
-	}
-
-	// set download deadline
-	conn.Conn.SetDeadline(time.Now().Add(d.config.DownTimeout))
-	defer conn.Conn.SetDeadline(time.Time{}) // disable deadline
-
-	// repeat till number of bytes downloaded is less than total
-	for progress.downloaded < p.length {
-		if !conn.Choked {
-			for progress.backlog < d.config.Backlog && progress.requested < p.length {
-				// calculate block size
-				size := MaxBlockSize
-				// last block is of irregular size
-				if p.length-progress.requested < size {
-					size = p.length - progress.requested
-				}
-
-				// request block
-				err := conn.Request(p.index, progress.requested, size)
-				if err != nil {
-					return nil, err
-				}
-				progress.backlog++
-				progress.requested += size
-			}
-		}
+// peerDisconnected records that the connection with the peer p was lost,
+// or couldn't be established, with the provided error.
+func (d *Download) peerDisconnected(p peer.Peer, err error) {
+	// connections are closed when the download stops
+	if d.quitting() {
+		err = nil
+	}
 
-		err := progress.readMessage()
-		if err != nil {
-			return nil, err
-		}
+	if err != nil {
+		d.log.Debugf("peer %s died: %v", p, err)
+		d.recordPeerError(p, err)
+		d.reputation.Disconnected(p)
 	}
 
-	return progress.buf, nil
+	d.config.Events.peerDisconnected(p, err)
 }
 
-// checkIntegrity checks if the dowloaded piece's hash matches the expected
-// hash.
-func checkIntegrity(p *piece, block []byte) bool {
-	return p.hash == sha1.Sum(block)
+// blockTimeout returns the amount of time after which a block request
+// times out.
+func (d *Download) blockTimeout() time.Duration {
+	if d.config.BlockTimeout > 0 {
+		return d.config.BlockTimeout
+	}
+
+	return DefaultBlockTimeout
+}
+
+// snubTimeout returns the amount of time after which a peer is considered
+// to be snubbing us.
+func (d *Download) snubTimeout() time.Duration {
+	if d.config.SnubTimeout > 0 {
+		return d.config.SnubTimeout
+	}
+
+	return DefaultSnubTimeout
 }
 
 // pieceLen calculates the length of the piece with the provided index.
@@ -289,24 +733,145 @@ func (t *Torrent) pieceLen(index int) int {
 // DownloadPieces downloads the pieces of the provided torrent and stores
 // them into the provided PieceManager.
 func (t *Torrent) DownloadPieces(p PieceManager, c *DownloadConfig) error {
-	start := time.Now()
+	return t.NewDownload(p, c).Run()
+}
 
-	err := t.newDownload(p, c).start()
-	if err != nil {
-		return err
+// NewDownload creates a new Download of the torrent, which will store the
+// pieces into the provided PieceManager. Call Run to start it.
+func (t *Torrent) NewDownload(p PieceManager, c *DownloadConfig) *Download {
+	d := &Download{
+		torrent: t,
+		manager: p,
+		config:  c,
+		stats:   newStats(t),
+		haves:   make(map[*haveQueue]struct{}),
+
+		connHaves: make(map[*peer.Conn]*haveQueue),
+		inbound:   make(chan *peer.Conn),
+
+		partials: make(map[int]*partialPiece),
+		inflight: make(map[int]*inflightPiece),
+		claimed:  make(map[int]bool),
+		outcome:  &DownloadResult{PeerErrors: make(map[string]error)},
+
+		bitfield: bitfield.Empty(len(t.PieceHashes)),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		log:      log.OrDiscard(c.Logger).Scope("download"),
 	}
 
-	duration := time.Since(start)
-	fmt.Println("mtor: download complete")
-	fmt.Printf("mtor: %s taken", duration)
+	d.tracker = d.trackerTransport()
+	return d
+}
 
-	return nil
+// trackerTransport returns the Transport used to announce to trackers,
+// which retries failed announces.
+func (d *Download) trackerTransport() *tracker.Retry {
+	t := d.config.Tracker
+	if retry, ok := t.(*tracker.Retry); ok {
+		return retry
+	}
+
+	logger := d.log.Scope("tracker")
+	if t == nil {
+		t = tracker.Default(&tracker.HTTP{
+			Client: d.trackerClient(),
+			TLS:    d.config.TrackerTLS,
+			Logger: logger,
+		})
+	}
+
+	retry := tracker.NewRetry(t)
+	retry.Logger = logger
+	return retry
 }
 
-func (t *Torrent) newDownload(p PieceManager, c *DownloadConfig) *download {
-	return &download{
-		torrent: t,
-		manager: p,
-		config:  c,
+// trackerClient returns the http.Client used to announce to http trackers.
+func (d *Download) trackerClient() *http.Client {
+	if d.config.HTTPClient != nil {
+		return d.config.HTTPClient
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy := d.config.Proxy; proxy != nil && proxy.Trackers {
+		t = proxy.Transport(tracker.DefaultTimeout)
 	}
+	t.TLSClientConfig = d.config.TrackerTLS
+
+	return &http.Client{Timeout: tracker.DefaultTimeout, Transport: t}
+}
+
+// peerConfig returns the configuration used to connect to a peer, which
+// is sent the provided bitfield.
+func (d *Download) peerConfig(b bitfield.Bitfield) *peer.Config {
+	c := &peer.Config{
+		Timeout:    d.config.ConnTimeout,
+		Logger:     d.log.Scope("peer"),
+		Bitfield:   b,
+		Encryption: d.config.Encryption,
+		Pieces:     len(d.torrent.PieceHashes),
+
+		DownloadLimiter: d.config.DownloadLimiter,
+		UploadLimiter:   d.config.UploadLimiter,
+
+		LocalAddr: d.config.LocalAddr,
+		ReusePort: d.config.ReusePort,
+
+		Tracer: d.config.Tracer,
+	}
+
+	if proxy := d.config.Proxy; proxy != nil && proxy.Peers {
+		c.Dialer = proxy.Dialer(d.config.ConnTimeout)
+	}
+
+	return c
+}
+
+// accept hands an inbound connection over to the download, which runs a
+// worker with it. It reports false if the download isn't running, in which
+// case the connection isn't used.
+func (d *Download) accept(conn *peer.Conn) bool {
+	select {
+	case d.inbound <- conn:
+		return true
+	case <-d.quit:
+	case <-d.done:
+	}
+
+	return false
+}
+
+// has checks if the provided piece is marked as verified in our bitfield.
+func (d *Download) has(index int) bool {
+	d.bitfieldMu.Lock()
+	defer d.bitfieldMu.Unlock()
+
+	return d.bitfield.Has(index)
+}
+
+// setHave marks the provided piece as verified in our bitfield.
+func (d *Download) setHave(index int) {
+	d.bitfieldMu.Lock()
+	defer d.bitfieldMu.Unlock()
+
+	d.bitfield.Set(index)
+}
+
+// ourBitfield returns a copy of our current bitfield.
+func (d *Download) ourBitfield() bitfield.Bitfield {
+	d.bitfieldMu.Lock()
+	defer d.bitfieldMu.Unlock()
+
+	return d.bitfield.Clone()
+}
+
+// Torrent returns the torrent being downloaded.
+func (d *Download) Torrent() *Torrent {
+	return d.torrent
+}
+
+// Stats returns a snapshot of the download's statistics. It is safe to
+// call Stats concurrently with Run.
+func (d *Download) Stats() Stats {
+	return d.stats.snapshot()
 }
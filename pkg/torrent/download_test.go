@@ -0,0 +1,533 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+// pieceMap is a PieceManager which stores whole pieces in memory.
+type pieceMap struct {
+	mu     sync.Mutex
+	pieces map[int][]byte
+}
+
+func (m *pieceMap) Init() error  { return nil }
+func (m *pieceMap) Close() error { return nil }
+
+func (m *pieceMap) Get(i int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.pieces[i], nil
+}
+
+func (m *pieceMap) Put(i int, buf []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pieces[i] = buf
+	return nil
+}
+
+// staticTracker is a tracker.Transport which always returns the same peers.
+type staticTracker []peer.Peer
+
+func (t staticTracker) Announce(context.Context, *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error) {
+	return &tracker.AnnounceResponse{Interval: time.Hour, Peers: t}, nil
+}
+
+// seed serves the provided pieces to the peers connecting to the returned
+// listener.
+func seed(t *testing.T, tor *Torrent, pieces [][]byte) *peer.Listener {
+	return seedWith(t, tor, pieces, nil)
+}
+
+// seedWith is like seed, but calls onUpload with the number of the
+// connection after each block sent over it, if it isn't nil.
+func seedWith(t *testing.T, tor *Torrent, pieces [][]byte, onUpload func(n int, conn *peer.Conn)) *peer.Listener {
+	seeder := &pieceMap{pieces: make(map[int][]byte)}
+	for i, piece := range pieces {
+		seeder.pieces[i] = piece
+	}
+
+	ln, err := peer.Listen("127.0.0.1:0", &peer.ListenConfig{
+		Name: [20]byte{'s'},
+		Lookup: func(hash [20]byte) (*peer.Config, bool) {
+			return &peer.Config{
+				Bitfield: bitfield.Full(len(pieces)),
+				Pieces:   len(pieces),
+			}, hash == tor.InfoHash
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			config := &peer.ServeConfig{Reader: peer.FromPieces(seeder)}
+			if onUpload != nil {
+				n := n
+				config.OnUpload = func(int, int, int) { onUpload(n, conn) }
+			}
+
+			go func() {
+				conn.UnChoke()
+				conn.Serve(config)
+				conn.Close(context.Background())
+			}()
+		}
+	}()
+
+	return ln
+}
+
+// splitPieces returns a torrent with the provided data, split into pieces
+// of the provided length.
+func splitPieces(data []byte, pieceLength int) (*Torrent, [][]byte) {
+	tor := &Torrent{
+		InfoHash:    [20]byte{'h'},
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        [20]byte{'l'},
+	}
+
+	var pieces [][]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+
+		pieces = append(pieces, data[begin:end])
+		tor.PieceHashes = append(tor.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+
+	return tor, pieces
+}
+
+func TestDownload(t *testing.T) {
+	// pieces span multiple blocks, and the last one is irregular
+	data := make([]byte, 5*MaxBlockSize+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	tor, pieces := splitPieces(data, 2*MaxBlockSize)
+	ln := seed(t, tor, pieces)
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	leecher := &pieceMap{pieces: make(map[int][]byte)}
+
+	d := tor.NewDownload(leecher, &DownloadConfig{
+		ConnTimeout: time.Second,
+		DownTimeout: 5 * time.Second,
+		Tracker:     staticTracker{{IP: addr.IP, Port: uint16(addr.Port)}},
+	})
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, piece := range pieces {
+		if got, _ := leecher.Get(i); string(got) != string(piece) {
+			t.Errorf("piece %d not downloaded correctly", i)
+		}
+	}
+
+	if stats := d.Stats(); stats.Downloaded != int64(len(data)) || stats.PiecesDone != len(pieces) {
+		t.Errorf("downloaded %d bytes and %d pieces", stats.Downloaded, stats.PiecesDone)
+	}
+}
+
+func TestWorkerRequestRetries(t *testing.T) {
+	data := make([]byte, MaxBlockSize)
+	tor := &Torrent{
+		PieceLength: len(data),
+		Length:      len(data),
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+	}
+
+	d := tor.NewDownload(&pieceMap{}, &DownloadConfig{BlockTimeout: 20 * time.Millisecond})
+	d.init()
+	defer d.stop()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := &peer.Conn{Conn: local, Fast: true, Bitfield: bitfield.Full(1)}
+	w := newWorker(d, peer.Peer{}, conn, newHaveQueue())
+	d.work <- &piece{index: 0, hash: tor.PieceHashes[0], length: len(data)}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- w.run() }()
+
+	read := func(expected message.Message) {
+		msg, err := message.Read(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Identifier != expected.Identifier || !bytes.Equal(msg.Payload, expected.Payload) {
+			t.Fatalf("received %v %v, expected %v %v", msg.Identifier, msg.Payload, expected.Identifier, expected.Payload)
+		}
+	}
+
+	// the unanswered request times out, and is sent again
+	request := *message.NewRequest(0, 0, len(data))
+	read(request)
+	read(*message.NewCancel(0, 0, len(data)))
+	read(request)
+
+	// the rejected request is sent again
+	remote.Write(message.NewRejectRequest(0, 0, len(data)).Serialize())
+	read(request)
+
+	remote.Write((&message.Message{Identifier: message.Piece, Payload: make([]byte, 8+len(data))}).Serialize())
+	if job := <-d.verify; job.piece.index != 0 || !bytes.Equal(job.value, data) {
+		t.Errorf("piece %d with %d bytes sent for verification", job.piece.index, len(job.value))
+	}
+
+	remote.Close()
+	if err := <-stopped; err == nil {
+		t.Error("worker stopped without an error after the peer left")
+	}
+}
+
+func TestWorkerFast(t *testing.T) {
+	data := make([]byte, MaxBlockSize)
+	tor := &Torrent{
+		PieceLength: len(data),
+		Length:      2 * len(data),
+		PieceHashes: [][20]byte{sha1.Sum(data), sha1.Sum(data)},
+	}
+
+	d := tor.NewDownload(&pieceMap{}, &DownloadConfig{})
+	d.init()
+	defer d.stop()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	// piece 0 can be requested while choked
+	allowed := bitfield.Empty(2)
+	allowed.Set(0)
+
+	conn := &peer.Conn{Conn: local, Fast: true, Choked: true, Bitfield: bitfield.Full(2), AllowedFast: allowed}
+	w := newWorker(d, peer.Peer{}, conn, newHaveQueue())
+	d.work <- &piece{index: 0, hash: tor.PieceHashes[0], length: len(data)}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- w.run() }()
+
+	read := func(expected *message.Message) {
+		msg, err := message.Read(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Identifier != expected.Identifier || !bytes.Equal(msg.Payload, expected.Payload) {
+			t.Fatalf("received %v %v, expected %v %v", msg.Identifier, msg.Payload, expected.Identifier, expected.Payload)
+		}
+	}
+
+	read(message.NewRequest(0, 0, len(data)))
+
+	// pieces which aren't allowed fast are requested once unchoked
+	d.work <- &piece{index: 1, hash: tor.PieceHashes[1], length: len(data)}
+	remote.Write((&message.Message{Identifier: message.UnChoke}).Serialize())
+	read(message.NewRequest(1, 0, len(data)))
+
+	// requests stay pending when a fast peer chokes us, until they are
+	// rejected, after which they are requested again once unchoked
+	remote.Write((&message.Message{Identifier: message.Choke}).Serialize())
+	remote.Write(message.NewRejectRequest(1, 0, len(data)).Serialize())
+	remote.Write((&message.Message{Identifier: message.UnChoke}).Serialize())
+	read(message.NewRequest(1, 0, len(data)))
+
+	remote.Close()
+	if err := <-stopped; err == nil {
+		t.Error("worker stopped without an error after the peer left")
+	}
+}
+
+// scriptedTracker is a tracker.Transport which returns its peer lists in
+// order, repeating the last one, and records the times of the announces.
+type scriptedTracker struct {
+	mu          sync.Mutex
+	peers       [][]peer.Peer
+	minInterval time.Duration
+	announces   []time.Time
+}
+
+func (t *scriptedTracker) Announce(context.Context, *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peers := t.peers[len(t.peers)-1]
+	if n := len(t.announces); n < len(t.peers) {
+		peers = t.peers[n]
+	}
+
+	t.announces = append(t.announces, time.Now())
+	return &tracker.AnnounceResponse{Interval: time.Hour, MinInterval: t.minInterval, Peers: peers}, nil
+}
+
+// deadPeer returns a peer which refuses connections.
+func deadPeer(t *testing.T) peer.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestReplenishPeers(t *testing.T) {
+	tor, pieces := splitPieces(make([]byte, MaxBlockSize), MaxBlockSize)
+	ln := seed(t, tor, pieces)
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	seeder := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	// the initial peer is dead, so the tracker is reannounced to after
+	// its min interval
+	tr := &scriptedTracker{
+		peers:       [][]peer.Peer{{deadPeer(t)}, {seeder}},
+		minInterval: 50 * time.Millisecond,
+	}
+
+	d := tor.NewDownload(&pieceMap{pieces: make(map[int][]byte)}, &DownloadConfig{
+		ConnTimeout: time.Second,
+		DownTimeout: 5 * time.Second,
+		Tracker:     tr,
+	})
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if len(tr.announces) < 2 {
+		t.Fatalf("announced %d times", len(tr.announces))
+	}
+
+	if gap := tr.announces[1].Sub(tr.announces[0]); gap < tr.minInterval {
+		t.Errorf("reannounced after %v, min interval %v", gap, tr.minInterval)
+	}
+
+	// the download fails once reannouncing yields no new peers
+	tr = &scriptedTracker{peers: [][]peer.Peer{{deadPeer(t)}}, minInterval: time.Millisecond}
+	d = tor.NewDownload(&pieceMap{pieces: make(map[int][]byte)}, &DownloadConfig{
+		ConnTimeout: time.Second,
+		Tracker:     tr,
+	})
+
+	if err := d.Run(); !errors.Is(err, ErrWorkersDead) {
+		t.Errorf("download without live peers returned %v", err)
+	}
+}
+
+// listingMap is a pieceMap which reports the pieces it has stored.
+type listingMap struct {
+	pieceMap
+}
+
+func (m *listingMap) Has(i int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.pieces[i]
+	return ok
+}
+
+func (m *listingMap) Indices() ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var indices []int
+	for i := range m.pieces {
+		indices = append(indices, i)
+	}
+
+	return indices, nil
+}
+
+func TestResume(t *testing.T) {
+	tor, pieces := splitPieces([]byte("abcdef"), 2)
+	ln := seed(t, tor, pieces)
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+
+	// the stored piece is kept, and unknown indices are ignored
+	leecher := &listingMap{pieceMap{pieces: map[int][]byte{1: []byte("cd"), 7: nil}}}
+	d := tor.NewDownload(leecher, &DownloadConfig{
+		ConnTimeout: time.Second,
+		DownTimeout: 5 * time.Second,
+		Tracker:     staticTracker{{IP: addr.IP, Port: uint16(addr.Port)}},
+		Events: &Events{
+			OnPieceVerified: func(index, done, total int) {
+				if index == 1 || done < 2 {
+					t.Errorf("piece %d verified as %d of %d", index, done, total)
+				}
+			},
+		},
+	})
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, piece := range pieces {
+		if got, _ := leecher.Get(i); string(got) != string(piece) {
+			t.Errorf("piece %d is %q, expected %q", i, got, piece)
+		}
+	}
+
+	if stats := d.Stats(); stats.Downloaded != 4 || stats.Left != 0 {
+		t.Errorf("downloaded %d bytes, %d left", stats.Downloaded, stats.Left)
+	}
+
+	// a download whose pieces are all stored completes without peers
+	d = tor.NewDownload(leecher, &DownloadConfig{Tracker: staticTracker{}})
+	if err := d.Run(); err != nil {
+		t.Errorf("resumed complete download returned %v", err)
+	}
+}
+
+func TestWorkerSnubbed(t *testing.T) {
+	data := make([]byte, 2*MaxBlockSize)
+	tor := &Torrent{
+		PieceLength: len(data),
+		Length:      len(data),
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+	}
+
+	snub := 30 * time.Millisecond
+	d := tor.NewDownload(&pieceMap{}, &DownloadConfig{BlockTimeout: time.Hour, SnubTimeout: snub})
+	d.init()
+	defer d.stop()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	p := peer.Peer{Port: 1}
+	conn := &peer.Conn{Conn: local, Choked: true, Bitfield: bitfield.Full(1)}
+	w := newWorker(d, p, conn, newHaveQueue())
+	d.work <- &piece{index: 0, hash: tor.PieceHashes[0], length: len(data)}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- w.run() }()
+
+	// peers aren't snubbing while they choke us
+	select {
+	case err := <-stopped:
+		t.Fatalf("choked worker stopped with %v", err)
+	case <-time.After(3 * snub):
+	}
+
+	remote.Write((&message.Message{Identifier: message.UnChoke}).Serialize())
+	for begin := 0; begin < len(data); begin += MaxBlockSize {
+		msg, err := message.Read(remote)
+		if err != nil || msg.Identifier != message.Request {
+			t.Fatalf("received %v, %v instead of a request", msg, err)
+		}
+	}
+
+	// the first block arrives, and the peer goes quiet
+	remote.Write((&message.Message{Identifier: message.Piece, Payload: make([]byte, 8+MaxBlockSize)}).Serialize())
+
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, ErrSnubbed) {
+			t.Errorf("snubbed worker stopped with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("snubbing peer not disconnected")
+	}
+
+	// the piece is requeued with its progress, and the peer penalized
+	select {
+	case piece := <-d.work:
+		if piece.index != 0 {
+			t.Errorf("piece %d requeued", piece.index)
+		}
+	default:
+		t.Error("piece not requeued")
+	}
+
+	progress := &pieceProgress{index: 0, buf: make([]byte, len(data)), pending: make(map[int]request)}
+	if d.resumePartial(progress); progress.downloaded != MaxBlockSize {
+		t.Errorf("resumed with %d bytes downloaded", progress.downloaded)
+	}
+
+	if snubs := d.reputation.Get(p).Snubs; snubs != 1 {
+		t.Errorf("peer snubbed %d times", snubs)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	tor, pieces := splitPieces(make([]byte, 2*MaxBlockSize), MaxBlockSize)
+
+	// the download fails without reconnecting
+	for _, attempts := range []int{0, -1} {
+		// the first connection drops after sending a block
+		ln := seedWith(t, tor, pieces, func(n int, conn *peer.Conn) {
+			if n == 0 {
+				conn.Conn.Close()
+			}
+		})
+		defer ln.Close()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		d := tor.NewDownload(&pieceMap{pieces: make(map[int][]byte)}, &DownloadConfig{
+			ConnTimeout:       time.Second,
+			DownTimeout:       5 * time.Second,
+			ReconnectAttempts: attempts,
+			ReconnectDelay:    10 * time.Millisecond,
+			Tracker: &scriptedTracker{
+				peers:       [][]peer.Peer{{{IP: addr.IP, Port: uint16(addr.Port)}}},
+				minInterval: time.Millisecond,
+			},
+		})
+
+		err := d.Run()
+		if attempts < 0 {
+			if !errors.Is(err, ErrWorkersDead) {
+				t.Errorf("download without reconnecting returned %v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res := d.Result(); res.Connected != 2 {
+			t.Errorf("connected to the peer %d times", res.Connected)
+		}
+	}
+}
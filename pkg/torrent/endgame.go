@@ -0,0 +1,128 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+)
+
+// EndgamePoll is how often idle workers check if the download has entered
+// endgame mode, where every remaining piece is already being downloaded.
+const EndgamePoll = time.Second
+
+// inflightPiece represents a piece which is being downloaded by one or more
+// workers.
+type inflightPiece struct {
+	piece   *piece // the piece being downloaded
+	workers int    // number of workers downloading the piece
+}
+
+// startPiece marks the provided piece as being downloaded by a worker.
+func (d *Download) startPiece(p *piece) {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+
+	if f, ok := d.inflight[p.index]; ok {
+		f.workers++
+		return
+	}
+
+	d.inflight[p.index] = &inflightPiece{piece: p, workers: 1}
+}
+
+// endPiece marks that a worker has stopped downloading the provided piece.
+func (d *Download) endPiece(index int) {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+
+	f, ok := d.inflight[index]
+	if !ok {
+		return
+	}
+
+	if f.workers--; f.workers == 0 {
+		delete(d.inflight, index)
+	}
+}
+
+// claimPiece claims the provided downloaded piece for verification, and
+// reports false if another worker has already claimed it.
+func (d *Download) claimPiece(index int) bool {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+
+	if d.claimed[index] {
+		return false
+	}
+
+	d.claimed[index] = true
+	return true
+}
+
+// unclaimPiece releases the claim on a piece which failed verification,
+// so that it can be downloaded again.
+func (d *Download) unclaimPiece(index int) {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+
+	delete(d.claimed, index)
+}
+
+// isClaimed checks if the provided piece has been downloaded by a worker.
+func (d *Download) isClaimed(index int) bool {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+
+	return d.claimed[index]
+}
+
+// endgamePiece returns an unclaimed piece which is being downloaded by
+// other workers, and is available in the provided bitfield, if the download
+// is in endgame mode. The piece with the fewest workers is preferred.
+func (d *Download) endgamePiece(has bitfield.Bitfield) *piece {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+
+	// pieces are still waiting to be downloaded
+	if !d.scheduled || len(d.work) > 0 {
+		return nil
+	}
+
+	var best *inflightPiece
+	for index, f := range d.inflight {
+		if d.claimed[index] || !has.Has(index) {
+			continue
+		}
+
+		if best == nil || f.workers < best.workers {
+			best = f
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	return best.piece
+}
+
+// setScheduled marks that all the pieces have been put in the work channel.
+func (d *Download) setScheduled() {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+
+	d.scheduled = true
+}
@@ -0,0 +1,56 @@
+package torrent
+
+import (
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+)
+
+func TestEndgame(t *testing.T) {
+	tor := &Torrent{PieceLength: 1, Length: 2, PieceHashes: make([][20]byte, 2)}
+	d := tor.NewDownload(nil, &DownloadConfig{})
+	d.init()
+
+	a := &piece{index: 0, length: 1}
+	b := &piece{index: 1, length: 1}
+
+	d.startPiece(a)
+	d.startPiece(b)
+	d.startPiece(b)
+
+	// no duplicates before every piece is scheduled
+	if p := d.endgamePiece(bitfield.Full(2)); p != nil {
+		t.Fatalf("endgame piece %d before scheduling", p.index)
+	}
+
+	d.setScheduled()
+
+	if p := d.endgamePiece(bitfield.Full(2)); p != a {
+		t.Fatalf("endgame piece is %v, expected piece 0", p)
+	}
+
+	// only the first finished download is verified
+	if !d.claimPiece(0) {
+		t.Fatal("first download of piece 0 not claimed")
+	}
+	if d.claimPiece(0) {
+		t.Fatal("duplicate download of piece 0 claimed")
+	}
+
+	if p := d.endgamePiece(bitfield.Full(2)); p != b {
+		t.Fatalf("endgame piece is %v, expected piece 1", p)
+	}
+
+	// a piece which failed verification can be downloaded again
+	d.unclaimPiece(0)
+	if d.isClaimed(0) {
+		t.Error("piece 0 claimed after failing verification")
+	}
+
+	d.endPiece(0)
+	d.endPiece(1)
+	d.endPiece(1)
+	if p := d.endgamePiece(bitfield.Full(2)); p != nil {
+		t.Errorf("endgame piece %d with no downloads in flight", p.index)
+	}
+}
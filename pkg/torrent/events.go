@@ -0,0 +1,104 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// Events contains hooks which are called when the corresponding event
+// occurs during a download. Any of the hooks may be nil, in which case the
+// event is ignored. Hooks may be called from multiple goroutines, and
+// should not block for long.
+type Events struct {
+	// OnPieceVerified is called after a piece has passed its integrity
+	// check and has been stored. done is the number of pieces which have
+	// been verified so far, and total is the number of pieces.
+	OnPieceVerified func(index, done, total int)
+
+	// OnPieceDownloaded is called after a piece has been downloaded from a
+	// peer, before its integrity check, with the time taken to download it.
+	OnPieceDownloaded func(index int, p peer.Peer, taken time.Duration)
+
+	// OnHashFailure is called when a piece downloaded from a peer fails its
+	// integrity check, and needs to be downloaded again.
+	OnHashFailure func(index int, p peer.Peer)
+
+	// OnPeerConnected is called after a connection with a peer has been
+	// successfully established.
+	OnPeerConnected func(p peer.Peer)
+
+	// OnPeerDisconnected is called when a peer connection is closed or a
+	// connection attempt fails. err is the reason, if any.
+	OnPeerDisconnected func(p peer.Peer, err error)
+
+	// OnTrackerAnnounce is called after the tracker has been announced to,
+	// with the received peers or the error.
+	OnTrackerAnnounce func(peers []peer.Peer, err error)
+
+	// OnComplete is called after all the pieces have been downloaded, with
+	// the time taken by the download.
+	OnComplete func(taken time.Duration)
+}
+
+// pieceVerified calls the OnPieceVerified hook if it is set.
+func (e *Events) pieceVerified(index, done, total int) {
+	if e != nil && e.OnPieceVerified != nil {
+		e.OnPieceVerified(index, done, total)
+	}
+}
+
+// pieceDownloaded calls the OnPieceDownloaded hook if it is set.
+func (e *Events) pieceDownloaded(index int, p peer.Peer, taken time.Duration) {
+	if e != nil && e.OnPieceDownloaded != nil {
+		e.OnPieceDownloaded(index, p, taken)
+	}
+}
+
+// hashFailure calls the OnHashFailure hook if it is set.
+func (e *Events) hashFailure(index int, p peer.Peer) {
+	if e != nil && e.OnHashFailure != nil {
+		e.OnHashFailure(index, p)
+	}
+}
+
+// peerConnected calls the OnPeerConnected hook if it is set.
+func (e *Events) peerConnected(p peer.Peer) {
+	if e != nil && e.OnPeerConnected != nil {
+		e.OnPeerConnected(p)
+	}
+}
+
+// peerDisconnected calls the OnPeerDisconnected hook if it is set.
+func (e *Events) peerDisconnected(p peer.Peer, err error) {
+	if e != nil && e.OnPeerDisconnected != nil {
+		e.OnPeerDisconnected(p, err)
+	}
+}
+
+// trackerAnnounce calls the OnTrackerAnnounce hook if it is set.
+func (e *Events) trackerAnnounce(peers []peer.Peer, err error) {
+	if e != nil && e.OnTrackerAnnounce != nil {
+		e.OnTrackerAnnounce(peers, err)
+	}
+}
+
+// complete calls the OnComplete hook if it is set.
+func (e *Events) complete(taken time.Duration) {
+	if e != nil && e.OnComplete != nil {
+		e.OnComplete(taken)
+	}
+}
@@ -0,0 +1,98 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestEvents(t *testing.T) {
+	// the hooks are optional
+	var events *Events
+	events.complete(time.Second)
+	(&Events{}).peerConnected(peer.Peer{})
+
+	tor, pieces := splitPieces(make([]byte, 3*MaxBlockSize), MaxBlockSize)
+	ln := seed(t, tor, pieces)
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	seeder := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	var mu sync.Mutex
+	var log []string
+	var verified []int
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		log = append(log, event)
+	}
+
+	d := tor.NewDownload(&pieceMap{pieces: make(map[int][]byte)}, &DownloadConfig{
+		ConnTimeout: time.Second,
+		DownTimeout: 5 * time.Second,
+		Tracker:     staticTracker{seeder},
+		Events: &Events{
+			OnTrackerAnnounce: func(peers []peer.Peer, err error) {
+				if err != nil || len(peers) != 1 {
+					t.Errorf("announce returned %v, %v", peers, err)
+				}
+				record("announce")
+			},
+			OnPeerConnected: func(p peer.Peer) {
+				if !p.IP.Equal(seeder.IP) || p.Port != seeder.Port {
+					t.Errorf("connected to %v", p)
+				}
+				record("connect")
+			},
+			OnPieceDownloaded: func(index int, p peer.Peer, taken time.Duration) {
+				record("download")
+			},
+			OnPieceVerified: func(index, done, total int) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if done != len(verified)+1 || total != len(pieces) {
+					t.Errorf("piece %d verified as %d of %d", index, done, total)
+				}
+				verified = append(verified, index)
+			},
+			OnPeerDisconnected: func(p peer.Peer, err error) {
+				if errors.Is(err, ErrSnubbed) {
+					t.Errorf("peer disconnected with %v", err)
+				}
+				record("disconnect")
+			},
+			OnComplete: func(taken time.Duration) {
+				record("complete")
+			},
+		},
+	})
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(verified) != len(pieces) {
+		t.Errorf("verified pieces %v", verified)
+	}
+
+	expected := []string{"announce", "connect", "download", "download", "download", "disconnect", "complete"}
+	if len(log) != len(expected) {
+		t.Fatalf("events %v, expected %v", log, expected)
+	}
+
+	for i := range expected {
+		if log[i] != expected[i] {
+			t.Errorf("events %v, expected %v", log, expected)
+			break
+		}
+	}
+}
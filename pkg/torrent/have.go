@@ -0,0 +1,132 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"sync"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// haveQueue is a queue of verified pieces which need to be announced to a
+// peer using Have messages. Pieces are pushed by the goroutine managing the
+// pieces, and flushed by the peer's worker, so that only the worker writes
+// to its connection.
+type haveQueue struct {
+	mu      sync.Mutex    // guards pending
+	pending []int         // pieces to announce
+	notify  chan struct{} // signalled when pending is non-empty
+}
+
+// newHaveQueue creates a new empty haveQueue.
+func newHaveQueue() *haveQueue {
+	return &haveQueue{notify: make(chan struct{}, 1)}
+}
+
+// push adds the provided piece index to the queue.
+func (q *haveQueue) push(index int) {
+	q.mu.Lock()
+	q.pending = append(q.pending, index)
+	q.mu.Unlock()
+
+	// signal the worker without blocking
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// flush sends a Have message for every pending piece on the provided
+// connection at once, and clears the queue.
+func (q *haveQueue) flush(conn *peer.Conn) error {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	msgs := make([]*message.Message, len(pending))
+	for i, index := range pending {
+		msgs[i] = message.NewHave(index)
+	}
+
+	return conn.WriteMessages(msgs...)
+}
+
+// addHaveQueue registers the provided queue to receive broadcasts, and
+// returns a snapshot of our bitfield taken under the same lock, so that
+// every piece verified after the snapshot is pushed to the queue.
+func (d *Download) addHaveQueue(q *haveQueue) bitfield.Bitfield {
+	d.havesMu.Lock()
+	defer d.havesMu.Unlock()
+
+	d.haves[q] = struct{}{}
+	return d.ourBitfield()
+}
+
+// connHaveQueue returns the have queue registered for the provided
+// connection before its handshake, and forgets the association.
+func (d *Download) connHaveQueue(conn *peer.Conn) *haveQueue {
+	d.havesMu.Lock()
+	defer d.havesMu.Unlock()
+
+	q := d.connHaves[conn]
+	delete(d.connHaves, conn)
+	return q
+}
+
+// inboundHaveQueue registers a have queue for an inbound connection, whose
+// bitfield was taken when the handshake was accepted, and pushes the pieces
+// verified since then to it.
+func (d *Download) inboundHaveQueue(conn *peer.Conn) *haveQueue {
+	q := newHaveQueue()
+	b := d.addHaveQueue(q)
+
+	for index := range d.torrent.PieceHashes {
+		if b.Has(index) && !conn.OurBitfield.Has(index) {
+			q.push(index)
+		}
+	}
+
+	return q
+}
+
+// setConnHaveQueue associates the provided have queue with a connection
+// until its worker starts.
+func (d *Download) setConnHaveQueue(conn *peer.Conn, q *haveQueue) {
+	d.havesMu.Lock()
+	defer d.havesMu.Unlock()
+
+	d.connHaves[conn] = q
+}
+
+// removeHaveQueue unregisters the provided queue from receiving broadcasts.
+func (d *Download) removeHaveQueue(q *haveQueue) {
+	d.havesMu.Lock()
+	defer d.havesMu.Unlock()
+
+	delete(d.haves, q)
+}
+
+// broadcastHave queues a Have message for the provided piece on all of the
+// open connections.
+func (d *Download) broadcastHave(index int) {
+	d.havesMu.Lock()
+	defer d.havesMu.Unlock()
+
+	for q := range d.haves {
+		q.push(index)
+	}
+}
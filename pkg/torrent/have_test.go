@@ -0,0 +1,29 @@
+package torrent
+
+import "testing"
+
+func TestAddHaveQueue(t *testing.T) {
+	tor := &Torrent{PieceLength: 1, Length: 3, PieceHashes: make([][20]byte, 3)}
+	d := tor.NewDownload(&pieceMap{}, &DownloadConfig{})
+	d.setHave(0)
+
+	// pieces verified before registering are in the snapshot
+	q := newHaveQueue()
+	b := d.addHaveQueue(q)
+	if !b.Has(0) || b.Has(1) {
+		t.Errorf("snapshot %08b, expected piece 0", b.Bytes())
+	}
+
+	// and pieces verified later are queued
+	d.setHave(1)
+	d.broadcastHave(1)
+	if len(q.pending) != 1 || q.pending[0] != 1 {
+		t.Errorf("queued haves %v, expected piece 1", q.pending)
+	}
+
+	d.removeHaveQueue(q)
+	d.broadcastHave(2)
+	if len(q.pending) != 1 {
+		t.Errorf("removed queue received haves %v", q.pending)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+
+	"laptudirm.com/x/mtor/pkg/bencode"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// DefaultPort is the port announced for torrents created from metainfo.
+const DefaultPort = 6881
+
+// ErrNoInfo is returned when metainfo doesn't contain an info dictionary.
+var ErrNoInfo = errors.New("torrent: metainfo has no info dictionary")
+
+// metainfo represents the fields of a .torrent metainfo file which are
+// needed to create a Torrent.
+type metainfo struct {
+	Info         *rawInfo   `bencode:"info"`
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list"`
+	URLList      any        `bencode:"url-list"` // a url, or a list of urls
+	Comment      string     `bencode:"comment"`
+}
+
+// rawInfo stores the raw bencode of an info dictionary, since the infohash
+// must be calculated from the exact bytes of the metainfo.
+type rawInfo []byte
+
+// UnmarshalBencode stores a copy of the info dictionary.
+func (r *rawInfo) UnmarshalBencode(b []byte) error {
+	*r = append(rawInfo{}, b...)
+	return nil
+}
+
+// info represents the fields of an info dictionary which are needed to
+// create a Torrent.
+type info struct {
+	PieceLen int    `bencode:"piece length"`
+	Pieces   string `bencode:"pieces"`
+	Length   int    `bencode:"length"`
+	Private  int    `bencode:"private"`
+	Source   string `bencode:"source"`
+	Files    []struct {
+		Length int `bencode:"length"`
+	} `bencode:"files"`
+}
+
+// NewFromMetainfo creates a Torrent from the contents of a .torrent
+// metainfo file. The tracker is taken from the announce key, or the first
+// tracker of the announce-list if it is missing.
+func NewFromMetainfo(data []byte) (*Torrent, error) {
+	var m metainfo
+	if err := bencode.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	if m.Info == nil || len(*m.Info) == 0 {
+		return nil, ErrNoInfo
+	}
+
+	announce := []string{m.Announce}
+	for _, tier := range m.AnnounceList {
+		announce = append(announce, tier...)
+	}
+
+	t, err := NewFromInfo(*m.Info, announce)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Trackers = m.AnnounceList
+	t.WebSeeds = urlList(m.URLList)
+	t.Comment = m.Comment
+	return t, nil
+}
+
+// urlList converts the value of a url-list key, which is either a single
+// url or a list of urls, into a list of urls.
+func urlList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []any:
+		var urls []string
+		for _, url := range v {
+			if url, ok := url.(string); ok && url != "" {
+				urls = append(urls, url)
+			}
+		}
+		return urls
+	}
+
+	return nil
+}
+
+// NewFromInfo creates a Torrent from a bencoded info dictionary, like one
+// fetched from peers using a magnet link, and a list of trackers. The first
+// non-empty tracker is announced to.
+func NewFromInfo(data []byte, announce []string) (*Torrent, error) {
+	var i info
+	if err := bencode.Unmarshal(data, &i); err != nil {
+		return nil, err
+	}
+
+	if len(i.Pieces)%20 != 0 {
+		return nil, fmt.Errorf("torrent: malformed piece hash string of length %v", len(i.Pieces))
+	}
+
+	hashes := make([][20]byte, len(i.Pieces)/20)
+	for n := range hashes {
+		copy(hashes[n][:], i.Pieces[n*20:])
+	}
+
+	length := i.Length
+	for _, file := range i.Files {
+		length += file.Length
+	}
+
+	t := &Torrent{
+		InfoHash:    sha1.Sum(data),
+		PieceHashes: hashes,
+		PieceLength: i.PieceLen,
+		Length:      length,
+		Private:     i.Private == 1,
+		Source:      i.Source,
+		Name:        peer.SessionID(),
+		Port:        DefaultPort,
+	}
+
+	for _, url := range announce {
+		if url != "" {
+			t.Announce = url
+			break
+		}
+	}
+
+	return t, nil
+}
@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"testing"
+)
+
+func TestNewFromMetainfo(t *testing.T) {
+	pieces := bytes.Repeat([]byte{1}, 20) // hash of a single piece
+	info := "d5:filesld6:lengthi3e4:pathl1:aeed6:lengthi4e4:pathl1:beee" +
+		"4:name3:dir12:piece lengthi16384e6:pieces20:" + string(pieces) + "e"
+	data := "d13:announce-listll0:el23:http://tracker/announceee4:info" + info + "e"
+
+	tor, err := NewFromMetainfo([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tor.InfoHash != sha1.Sum([]byte(info)) {
+		t.Error("infohash isn't calculated from the raw info dictionary")
+	}
+
+	if tor.Announce != "http://tracker/announce" {
+		t.Errorf("announce is %q", tor.Announce)
+	}
+
+	if tor.Length != 7 || tor.PieceLength != 16384 || len(tor.PieceHashes) != 1 {
+		t.Errorf("torrent has length %d, piece length %d, and %d pieces", tor.Length, tor.PieceLength, len(tor.PieceHashes))
+	}
+
+	if err := tor.Validate().Err(); err != nil {
+		t.Errorf("created torrent is invalid: %v", err)
+	}
+
+	if len(tor.Trackers) != 2 || tor.Trackers[1][0] != "http://tracker/announce" {
+		t.Errorf("trackers are %v", tor.Trackers)
+	}
+
+	data = "d4:info" + info[:len(info)-1] + "7:privatei1e6:source3:abce8:url-list14:http://seed/a/e"
+	if tor, err = NewFromMetainfo([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !tor.Private || tor.Source != "abc" || len(tor.WebSeeds) != 1 || tor.WebSeeds[0] != "http://seed/a/" {
+		t.Errorf("private %v, source %q, web seeds %v", tor.Private, tor.Source, tor.WebSeeds)
+	}
+
+	if _, err := NewFromMetainfo([]byte("d8:announce0:e")); !errors.Is(err, ErrNoInfo) {
+		t.Errorf("metainfo without info returned %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+// partialPiece represents a piece whose download from a peer failed midway.
+// It is kept so that the next peer downloading the piece only requests the
+// missing blocks, instead of starting over.
+type partialPiece struct {
+	buf        []byte  // buffer with the received blocks
+	downloaded int     // number of bytes received
+	missing    []block // blocks which have not been received
+}
+
+// savePartial saves the progress made on a piece whose download failed.
+func (d *Download) savePartial(p *pieceProgress) {
+	if p.downloaded == 0 {
+		return // nothing to save
+	}
+
+	d.partialsMu.Lock()
+	defer d.partialsMu.Unlock()
+
+	d.partials[p.index] = &partialPiece{
+		buf:        p.buf,
+		downloaded: p.downloaded,
+		missing:    p.missing(),
+	}
+}
+
+// resumePartial continues the provided piece progress from the saved
+// partial piece with the same index, if any, and removes it.
+func (d *Download) resumePartial(p *pieceProgress) {
+	d.partialsMu.Lock()
+	partial, ok := d.partials[p.index]
+	delete(d.partials, p.index)
+	d.partialsMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	p.buf = partial.buf
+	p.downloaded = partial.downloaded
+	p.requested = len(partial.buf) // only the missing blocks are requested
+	p.rejected = partial.missing
+}
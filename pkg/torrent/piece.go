@@ -13,10 +13,7 @@
 
 package torrent
 
-import (
-	"laptudirm.com/x/mtor/pkg/message"
-	"laptudirm.com/x/mtor/pkg/peer"
-)
+import "time"
 
 // piece represents a piece of a torrent that needs to be downloaded.
 type piece struct {
@@ -31,57 +28,143 @@ type pieceResult struct {
 	value []byte // the value of the piece
 }
 
+// block represents a block of a piece which is requested from a peer.
+type block struct {
+	begin  int // offset of the block in the piece
+	length int // length of the block
+}
+
+// request represents an outstanding block request.
+type request struct {
+	length int       // length of the block
+	sent   time.Time // time the request was sent
+}
+
 // PieceProgress represents the progress made on a piece that is currently
 // being downloaded.
 type pieceProgress struct {
-	index      int        // index of the piece
-	buf        []byte     // buffer to store value of the piece
-	conn       *peer.Conn // connection to download the piece from
-	downloaded int        // number of bytes dowloaded
-	requested  int        // number of bytes requested
-	backlog    int        // backlog of block requests
+	index      int    // index of the piece
+	buf        []byte // buffer to store value of the piece
+	downloaded int    // number of bytes dowloaded
+	requested  int    // number of bytes requested
+	backlog    int    // backlog of block requests
+
+	pending  map[int]request // outstanding block requests, by begin
+	rejected []block         // rejected blocks which need to be requested again
+	timeouts int             // number of block requests which timed out
+}
+
+// next returns the next block which should be requested, given the maximum
+// block size. Rejected blocks are requested again before new ones.
+func (p *pieceProgress) next(size int) (block, bool) {
+	if n := len(p.rejected); n > 0 {
+		b := p.rejected[n-1]
+		p.rejected = p.rejected[:n-1]
+		return b, true
+	}
+
+	if p.requested >= len(p.buf) {
+		return block{}, false
+	}
+
+	// last block is of irregular size
+	if len(p.buf)-p.requested < size {
+		size = len(p.buf) - p.requested
+	}
+
+	b := block{begin: p.requested, length: size}
+	p.requested += size
+	return b, true
+}
+
+// request marks the provided block as requested.
+func (p *pieceProgress) request(b block) {
+	p.pending[b.begin] = request{length: b.length, sent: time.Now()}
+	p.backlog++
+}
+
+// reject marks the outstanding request for the block at the provided
+// offset as rejected, so that it is requested again.
+func (p *pieceProgress) reject(begin int) {
+	req, ok := p.pending[begin]
+	if !ok {
+		return
+	}
+
+	delete(p.pending, begin)
+	p.backlog--
+	p.rejected = append(p.rejected, block{begin: begin, length: req.length})
 }
 
-// readMessage reads a message from p's peer connection, and works according
-// to the message.
-func (p *pieceProgress) readMessage() error {
-	// read message from connection
-	msg, err := p.conn.Read()
-	if err != nil {
-		return err
+// expire marks the outstanding requests which were sent more than timeout
+// ago as rejected, and returns the expired blocks.
+func (p *pieceProgress) expire(timeout time.Duration) []block {
+	var expired []block
+	for begin, req := range p.pending {
+		if time.Since(req.sent) >= timeout {
+			expired = append(expired, block{begin: begin, length: req.length})
+		}
 	}
 
-	if msg == nil {
-		return nil
+	for _, b := range expired {
+		p.reject(b.begin)
 	}
 
-	switch msg.Identifier {
-	case message.Choke:
-		// peer un-choked us
-		p.conn.Choked = true
-	case message.UnChoke:
-		// peer choked us
-		p.conn.Choked = false
-	case message.Have:
-		// peer has a new piece
-		piece, err := message.ParseHave(msg)
-		if err != nil {
-			return err
+	p.timeouts += len(expired)
+	return expired
+}
+
+// expiry returns the time at which the oldest outstanding request expires,
+// and whether there are any outstanding requests.
+func (p *pieceProgress) expiry(timeout time.Duration) (time.Time, bool) {
+	var oldest time.Time
+	for _, req := range p.pending {
+		if oldest.IsZero() || req.sent.Before(oldest) {
+			oldest = req.sent
 		}
+	}
+
+	return oldest.Add(timeout), !oldest.IsZero()
+}
+
+// missing returns the blocks of the piece which have not been received.
+func (p *pieceProgress) missing() []block {
+	missing := append([]block{}, p.rejected...)
+	for begin, req := range p.pending {
+		missing = append(missing, block{begin: begin, length: req.length})
+	}
 
-		p.conn.Bitfield.Set(piece)
-	case message.Piece:
-		// peer sent a block of data
-		n, err := message.ParsePiece(p.index, p.buf, msg)
-		if err != nil {
-			return err
+	// blocks which were never requested
+	for begin := p.requested; begin < len(p.buf); begin += MaxBlockSize {
+		length := MaxBlockSize
+		if len(p.buf)-begin < length {
+			length = len(p.buf) - begin
 		}
 
-		p.downloaded += n
+		missing = append(missing, block{begin: begin, length: length})
+	}
+
+	return missing
+}
+
+// receive marks the block at the provided offset as received, and reports
+// whether it was expected.
+func (p *pieceProgress) receive(begin int) bool {
+	if _, ok := p.pending[begin]; ok {
+		delete(p.pending, begin)
 		p.backlog--
+		return true
+	}
+
+	// a block may arrive after its request was discarded by a choke
+	for i, b := range p.rejected {
+		if b.begin == begin {
+			p.rejected = append(p.rejected[:i], p.rejected[i+1:]...)
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
 // PieceManager represents an interface which can handle the storage of the
@@ -96,3 +179,20 @@ type PieceManager interface {
 	// Close destroy's the manager's data. Call this when done.
 	Close() error
 }
+
+// PieceLister is an optional interface implemented by a PieceManager which
+// can report the pieces it has already stored, so that they are not
+// downloaded again.
+type PieceLister interface {
+	// Has checks if the piece with the provided index is stored.
+	Has(int) bool
+	// Indices returns the indices of all the stored pieces.
+	Indices() ([]int, error)
+}
+
+// PieceSyncer is an optional interface implemented by a PieceManager which
+// buffers its writes, so that the stored pieces can be flushed to stable
+// storage when a download is closed.
+type PieceSyncer interface {
+	Sync() error
+}
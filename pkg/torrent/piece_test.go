@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPieceProgressBlocks(t *testing.T) {
+	p := &pieceProgress{
+		buf:     make([]byte, 3*MaxBlockSize+1),
+		pending: make(map[int]request),
+	}
+
+	// request the first two blocks
+	for i := 0; i < 2; i++ {
+		b, ok := p.next(MaxBlockSize)
+		if !ok || b.begin != i*MaxBlockSize || b.length != MaxBlockSize {
+			t.Fatalf("next block is %+v, expected block %d", b, i)
+		}
+		p.request(b)
+	}
+
+	if expired := p.expire(time.Hour); len(expired) != 0 {
+		t.Errorf("blocks %v expired early", expired)
+	}
+
+	// the first block arrives, the second times out
+	if !p.receive(0) {
+		t.Error("requested block not received")
+	}
+
+	if expired := p.expire(0); len(expired) != 1 || expired[0].begin != MaxBlockSize {
+		t.Errorf("expired blocks %v, expected the second block", expired)
+	}
+
+	if p.backlog != 0 || p.timeouts != 1 {
+		t.Errorf("backlog %d and timeouts %d, expected 0 and 1", p.backlog, p.timeouts)
+	}
+
+	if _, pending := p.expiry(time.Second); pending {
+		t.Error("expiry reported without outstanding requests")
+	}
+
+	// the expired block is requested again before new ones
+	b, _ := p.next(MaxBlockSize)
+	if b.begin != MaxBlockSize {
+		t.Errorf("next block begins at %d, expected %d", b.begin, MaxBlockSize)
+	}
+
+	sent := time.Now()
+	p.request(b)
+	if expiry, pending := p.expiry(time.Second); !pending || expiry.Before(sent.Add(time.Second)) {
+		t.Errorf("request expires at %v, sent at %v", expiry, sent)
+	}
+
+	// the peer rejects it this time, so that it is missing again
+	p.reject(b.begin)
+
+	missing := p.missing()
+	sort.Slice(missing, func(i, j int) bool { return missing[i].begin < missing[j].begin })
+
+	expected := []block{
+		{begin: MaxBlockSize, length: MaxBlockSize},
+		{begin: 2 * MaxBlockSize, length: MaxBlockSize},
+		{begin: 3 * MaxBlockSize, length: 1},
+	}
+
+	if len(missing) != len(expected) {
+		t.Fatalf("missing blocks %v, expected %v", missing, expected)
+	}
+
+	for i := range expected {
+		if missing[i] != expected[i] {
+			t.Errorf("missing blocks %v, expected %v", missing, expected)
+			break
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import "time"
+
+const (
+	// MinBacklog is the minimum number of outstanding block requests kept
+	// with a peer, regardless of its speed.
+	MinBacklog = 2
+
+	// DefaultMaxBacklog is the maximum number of outstanding block requests
+	// kept with a peer if DownloadConfig.MaxBacklog is not set.
+	DefaultMaxBacklog = 250
+
+	// DefaultQueueTime is the amount of transfer time worth of requests that
+	// are kept outstanding with a peer if DownloadConfig.QueueTime is not
+	// set.
+	DefaultQueueTime = 3 * time.Second
+)
+
+// pipeline manages the adaptive request backlog of a peer connection. The
+// backlog is sized so that the outstanding requests will take QueueTime to
+// arrive at the peer's measured transfer rate, which lets fast or high
+// latency peers keep their link saturated while not hoarding blocks with
+// slow peers. The backlog never exceeds the number of requests the peer
+// is willing to queue, if it has advertised one.
+type pipeline struct {
+	size  int           // current backlog size
+	limit int           // maximum backlog size
+	queue time.Duration // target queue time
+
+	// blocks received in the recent past, and the time spent waiting for
+	// them, which measure the peer's transfer rate
+	received int
+	waited   time.Duration
+}
+
+// newPipeline creates a new pipeline using the provided config.
+func newPipeline(c *DownloadConfig) *pipeline {
+	limit := c.MaxBacklog
+	if limit <= 0 {
+		limit = DefaultMaxBacklog
+	}
+
+	queue := c.QueueTime
+	if queue <= 0 {
+		queue = DefaultQueueTime
+	}
+
+	return &pipeline{
+		size:  MinBacklog,
+		limit: limit,
+		queue: queue,
+	}
+}
+
+// backlog returns the number of requests which should be kept outstanding
+// with the peer.
+func (p *pipeline) backlog() int {
+	return p.size
+}
+
+// limitTo lowers the maximum backlog size to the number of outstanding
+// requests the peer is willing to queue, if it is positive.
+func (p *pipeline) limitTo(n int) {
+	if n > 0 && n < p.limit {
+		p.limit = n
+		p.resize()
+	}
+}
+
+// update updates the backlog size after a block of n bytes was received
+// from the peer, taken after the previous block, or after the requests
+// were sent if nothing was outstanding.
+func (p *pipeline) update(n int, taken time.Duration) {
+	if taken < 0 {
+		return
+	}
+
+	p.received += n
+	p.waited += taken
+
+	// forget old measurements, so that the rate follows the peer's speed
+	if p.waited > 2*p.queue {
+		p.received /= 2
+		p.waited /= 2
+	}
+
+	p.resize()
+}
+
+// resize sizes the backlog using the measured transfer rate.
+func (p *pipeline) resize() {
+	if p.waited <= 0 {
+		p.size = clamp(p.size, MinBacklog, p.limit)
+		return
+	}
+
+	// number of blocks which will arrive in the queue time
+	rate := float64(p.received) / p.waited.Seconds()
+	p.size = clamp(int(rate*p.queue.Seconds()/MaxBlockSize), MinBacklog, p.limit)
+}
+
+// clamp returns n limited to the range [min, max]. max takes precedence.
+func clamp(n, min, max int) int {
+	if n < min {
+		n = min
+	}
+
+	if n > max {
+		n = max
+	}
+
+	return n
+}
@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipelineUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int             // peer's request queue length
+		blocks []time.Duration // time taken by each full block
+		size   int             // expected backlog size
+	}{
+		{name: "initial", size: MinBacklog},
+		{
+			name:   "slow peer",
+			blocks: []time.Duration{time.Second, time.Second, time.Second},
+			size:   3,
+		},
+		{
+			name:   "very slow peer",
+			blocks: []time.Duration{10 * time.Second},
+			size:   MinBacklog,
+		},
+		{
+			name:   "fast peer",
+			blocks: []time.Duration{time.Millisecond, time.Millisecond},
+			size:   DefaultMaxBacklog,
+		},
+		{
+			// blocks arriving together are measured with the wait before
+			name:   "burst",
+			blocks: []time.Duration{time.Second, 0, 0, 0},
+			size:   12,
+		},
+		{
+			// the backlog isn't capped by the number of blocks in a piece
+			name:   "many blocks",
+			blocks: []time.Duration{100 * time.Millisecond, 100 * time.Millisecond},
+			size:   30,
+		},
+		{
+			name:   "peer queue length",
+			limit:  20,
+			blocks: []time.Duration{time.Millisecond},
+			size:   20,
+		},
+		{
+			// old measurements are forgotten
+			name:   "slowing down",
+			blocks: []time.Duration{time.Millisecond, 4 * time.Second, 4 * time.Second},
+			size:   MinBacklog,
+		},
+	}
+
+	for _, test := range tests {
+		p := newPipeline(&DownloadConfig{})
+		p.limitTo(test.limit)
+
+		for _, taken := range test.blocks {
+			p.update(MaxBlockSize, taken)
+		}
+
+		if size := p.backlog(); size != test.size {
+			t.Errorf("%s: backlog %d, expected %d", test.name, size, test.size)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"fmt"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// DownloadResult describes the outcome of a finished download, so that
+// callers can find out why a download failed and retry accordingly.
+type DownloadResult struct {
+	Err      error             // result of the download, nil if complete
+	Bitfield bitfield.Bitfield // pieces which were verified
+
+	// Connected is the number of peers which were connected to, and Useful
+	// is the number of those peers which had pieces that were needed.
+	Connected int
+	Useful    int
+
+	PeerErrors    map[string]error // reasons of peer disconnects, by address
+	TrackerErrors []error          // errors of failed announces
+	HashFailures  int              // number of pieces which failed verification
+}
+
+// Unreachable reports whether none of the peers could be connected to.
+func (r *DownloadResult) Unreachable() bool {
+	return r.Connected == 0
+}
+
+// Unavailable reports whether peers were connected to, but none of them
+// had any of the needed pieces.
+func (r *DownloadResult) Unavailable() bool {
+	return r.Connected > 0 && r.Useful == 0
+}
+
+// WorkersDeadError is returned when all the workers of a download are dead,
+// and no new peers can be found. It matches ErrWorkersDead.
+type WorkersDeadError struct {
+	Result *DownloadResult
+}
+
+// Error returns a description of why the workers died.
+func (e *WorkersDeadError) Error() string {
+	r := e.Result
+	switch {
+	case r.Unreachable():
+		return fmt.Sprintf("%v: none of %d peers were connectable", ErrWorkersDead, len(r.PeerErrors))
+	case r.Unavailable():
+		return fmt.Sprintf("%v: none of %d connected peers had the needed pieces", ErrWorkersDead, r.Connected)
+	default:
+		return fmt.Sprintf("%v: %d connected peers disconnected", ErrWorkersDead, r.Connected)
+	}
+}
+
+// Is makes a WorkersDeadError match ErrWorkersDead.
+func (e *WorkersDeadError) Is(target error) bool {
+	return target == ErrWorkersDead
+}
+
+// StorageError is returned when a verified piece can't be stored by the
+// PieceManager.
+type StorageError struct {
+	Index int   // index of the piece
+	Err   error // error returned by the PieceManager
+}
+
+// Error returns a description of the failed write.
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("download: storing piece %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the error returned by the PieceManager.
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Result returns the outcome of the download, or nil if it hasn't finished.
+func (d *Download) Result() *DownloadResult {
+	select {
+	case <-d.done:
+	default:
+		return nil
+	}
+
+	d.outcomeMu.Lock()
+	defer d.outcomeMu.Unlock()
+
+	return d.outcome
+}
+
+// finish records the final state of the download in its outcome.
+func (d *Download) finish(err error) {
+	d.outcomeMu.Lock()
+	defer d.outcomeMu.Unlock()
+
+	d.outcome.Err = err
+	d.outcome.Bitfield = d.ourBitfield()
+}
+
+// recordConnect records a successful connection with a peer, which is
+// useful if it has any piece that is needed.
+func (d *Download) recordConnect(conn *peer.Conn) {
+	useful := false
+	for index := range d.torrent.PieceHashes {
+		if conn.Bitfield.Has(index) && !d.has(index) {
+			useful = true
+			break
+		}
+	}
+
+	d.outcomeMu.Lock()
+	defer d.outcomeMu.Unlock()
+
+	d.outcome.Connected++
+	if useful {
+		d.outcome.Useful++
+	}
+}
+
+// recordPeerError records the reason a peer was disconnected.
+func (d *Download) recordPeerError(p peer.Peer, err error) {
+	d.outcomeMu.Lock()
+	defer d.outcomeMu.Unlock()
+
+	d.outcome.PeerErrors[p.String()] = err
+}
+
+// recordTrackerError records a failed announce.
+func (d *Download) recordTrackerError(err error) {
+	d.outcomeMu.Lock()
+	defer d.outcomeMu.Unlock()
+
+	d.outcome.TrackerErrors = append(d.outcome.TrackerErrors, err)
+}
+
+// recordHashFailure records a piece which failed verification.
+func (d *Download) recordHashFailure() {
+	d.outcomeMu.Lock()
+	defer d.outcomeMu.Unlock()
+
+	d.outcome.HashFailures++
+}
@@ -0,0 +1,30 @@
+package torrent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWorkersDeadError(t *testing.T) {
+	tests := []struct {
+		result *DownloadResult
+		reason string
+	}{
+		{&DownloadResult{PeerErrors: map[string]error{"a": errors.New("refused")}}, "connectable"},
+		{&DownloadResult{Connected: 2}, "needed pieces"},
+		{&DownloadResult{Connected: 2, Useful: 1}, "disconnected"},
+	}
+
+	for _, test := range tests {
+		var err error = &WorkersDeadError{Result: test.result}
+
+		if !errors.Is(err, ErrWorkersDead) {
+			t.Errorf("%v doesn't match ErrWorkersDead", err)
+		}
+
+		if !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("%q doesn't mention %q", err, test.reason)
+		}
+	}
+}
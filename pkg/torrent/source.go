@@ -0,0 +1,238 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// PeerSource represents a mechanism to discover the peers of a torrent,
+// like a tracker, the DHT, PEX, or local service discovery.
+type PeerSource interface {
+	// Run discovers peers and adds them to the pool, until ctx is done or
+	// the source can't find any more peers. Sources which discover peers
+	// on demand should do so when the pool's Need channel is signalled.
+	// A download whose peers are all dead fails once all of its sources
+	// have returned.
+	Run(ctx context.Context, pool *PeerPool)
+}
+
+// ManualSource is a PeerSource which adds a fixed list of peers.
+type ManualSource []peer.Peer
+
+// Run adds the peers to the pool.
+func (m ManualSource) Run(ctx context.Context, pool *PeerPool) {
+	pool.Add(m)
+}
+
+// PeerPool is a deduplicating pool of peers, which is owned by a download
+// and filled by its PeerSources. Every new peer added to the pool is
+// connected to once. Each source is given its own PeerPool, which shares
+// the peers of the download, so that all the sources are signalled when
+// more peers are needed.
+type PeerPool struct {
+	*peerPool
+
+	need   chan struct{} // signalled when more peers are needed
+	source peer.Source   // mechanism the peers are discovered from
+}
+
+// peerPool is the state shared by the PeerPools of a download's sources.
+type peerPool struct {
+	known    *peer.Set        // peers which have been added
+	fresh    chan []peer.Peer // new peers to connect to
+	finished chan struct{}    // receives when a source returns
+	quit     <-chan struct{}  // closed when the download stops
+
+	mu    sync.Mutex      // guards needs and live
+	needs []chan struct{} // need channels of the sources
+	live  int             // number of live peers of the download
+}
+
+// newPeerPool creates a new empty pool, which stops accepting peers when
+// quit is closed.
+func newPeerPool(quit <-chan struct{}) *peerPool {
+	return &peerPool{
+		known:    peer.NewSet(),
+		fresh:    make(chan []peer.Peer),
+		finished: make(chan struct{}),
+		quit:     quit,
+	}
+}
+
+// Add adds the provided peers to the pool, and returns the number of peers
+// which were not already known. It blocks until the new peers have been
+// accepted by the download, or it has stopped.
+func (p *PeerPool) Add(peers []peer.Peer) int {
+	fresh := p.filter(peers, p.source)
+	if len(fresh) == 0 {
+		return 0
+	}
+
+	select {
+	case p.fresh <- fresh:
+	case <-p.quit:
+	}
+
+	return len(fresh)
+}
+
+// Need returns a channel which is signalled when the download needs more
+// peers, because too few of its connections are alive.
+func (p *PeerPool) Need() <-chan struct{} {
+	return p.need
+}
+
+// Known returns the number of peers known to the pool.
+func (p *PeerPool) Known() int {
+	return p.known.Len()
+}
+
+// source returns a PeerPool for a source which discovers peers from the
+// provided mechanism, with its own need channel.
+func (p *peerPool) source(source peer.Source) *PeerPool {
+	need := make(chan struct{}, 1)
+
+	p.mu.Lock()
+	p.needs = append(p.needs, need)
+	p.mu.Unlock()
+
+	return &PeerPool{peerPool: p, need: need, source: source}
+}
+
+// filter marks the provided peers as known, discovered from the provided
+// source, and returns the ones which were not known before.
+func (p *peerPool) filter(peers []peer.Peer, source peer.Source) []peer.Peer {
+	var fresh []peer.Peer
+	for _, pr := range peers {
+		if p.known.Add(pr, source) {
+			fresh = append(fresh, pr)
+		}
+	}
+
+	return fresh
+}
+
+// requestPeers signals every source that more peers are needed, without
+// blocking if a request is already pending.
+func (p *peerPool) requestPeers() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, need := range p.needs {
+		select {
+		case need <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// setLive records the number of live peers of the download.
+func (p *peerPool) setLive(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.live = n
+}
+
+// livePeers returns the number of live peers of the download.
+func (p *peerPool) livePeers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.live
+}
+
+// trackerSource is a PeerSource which reannounces to the download's
+// tracker when more peers are needed, respecting the tracker's interval.
+type trackerSource struct {
+	d *Download
+}
+
+// Run reannounces to the tracker whenever the pool needs more peers. It
+// returns once a reannounce yields no new peers while none are alive, as
+// the tracker has no more peers to offer.
+func (t trackerSource) Run(ctx context.Context, pool *PeerPool) {
+	for {
+		select {
+		case <-pool.Need():
+		case <-ctx.Done():
+			return
+		}
+
+		// respect the tracker's minimum interval
+		if delay := time.Until(t.d.nextAnnounce); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		peers, _ := t.d.announce(ctx)
+		if pool.Add(peers) == 0 && pool.livePeers() == 0 {
+			return
+		}
+	}
+}
+
+// sourceOf returns the mechanism which the provided source discovers peers
+// from, if it is known.
+func sourceOf(source PeerSource) peer.Source {
+	switch source.(type) {
+	case trackerSource:
+		return peer.SourceTracker
+	case ManualSource:
+		return peer.SourceManual
+	default:
+		return 0
+	}
+}
+
+// peerSources returns the sources of peers used in addition to the
+// tracker. Private torrents only use trackers.
+func (d *Download) peerSources() []PeerSource {
+	if d.torrent.Private {
+		return nil
+	}
+
+	return d.config.PeerSources
+}
+
+// startSources runs the download's peer sources until it stops, and
+// returns the number of sources started. Each source reports to the pool
+// when it returns.
+func (d *Download) startSources() int {
+	ctx, _ := d.quitContext()
+
+	sources := append([]PeerSource{trackerSource{d}}, d.peerSources()...)
+	d.sources.Add(len(sources))
+	for _, source := range sources {
+		go func(source PeerSource, pool *PeerPool) {
+			defer d.sources.Done()
+			source.Run(ctx, pool)
+
+			select {
+			case d.pool.finished <- struct{}{}:
+			case <-d.quit:
+			}
+		}(source, d.pool.source(sourceOf(source)))
+	}
+
+	return len(sources)
+}
@@ -0,0 +1,146 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+func TestPeerPool(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+
+	pool := newPeerPool(quit)
+	source := pool.source(peer.SourceManual)
+
+	a := peer.Peer{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}
+	mapped := peer.Peer{IP: net.IPv4(10, 0, 0, 1).To16(), Port: 6881}
+	b := peer.Peer{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 6881}
+
+	added := make(chan int, 1)
+	go func() { added <- source.Add([]peer.Peer{a, mapped, b}) }()
+
+	// ipv4-mapped addresses are the same peers
+	if fresh := <-pool.fresh; len(fresh) != 2 {
+		t.Errorf("pool handed over %v, expected 2 peers", fresh)
+	}
+
+	if n := <-added; n != 2 || source.Known() != 2 {
+		t.Errorf("added %d peers, %d known, expected 2", n, source.Known())
+	}
+
+	// known peers aren't handed over again, without blocking
+	if n := source.Add([]peer.Peer{b}); n != 0 {
+		t.Errorf("added %d known peers", n)
+	}
+
+	if e, ok := pool.known.Get(a); !ok || !e.Source.Has(peer.SourceManual) {
+		t.Errorf("peer recorded as %+v", e)
+	}
+}
+
+func TestPeerPoolNeed(t *testing.T) {
+	pool := newPeerPool(make(chan struct{}))
+	sources := []*PeerPool{pool.source(peer.SourceTracker), pool.source(0)}
+
+	// every source is signalled, and pending signals aren't lost
+	pool.requestPeers()
+	pool.requestPeers()
+
+	for i, source := range sources {
+		select {
+		case <-source.Need():
+		default:
+			t.Errorf("source %d wasn't signalled", i)
+		}
+
+		select {
+		case <-source.Need():
+			t.Errorf("source %d was signalled twice", i)
+		default:
+		}
+	}
+}
+
+// delayedSource is a PeerSource which adds its peers after a delay.
+type delayedSource struct {
+	delay time.Duration
+	peers []peer.Peer
+}
+
+func (s delayedSource) Run(ctx context.Context, pool *PeerPool) {
+	select {
+	case <-time.After(s.delay):
+		pool.Add(s.peers)
+	case <-ctx.Done():
+	}
+}
+
+func TestPeerSources(t *testing.T) {
+	tor, pieces := splitPieces(make([]byte, MaxBlockSize), MaxBlockSize)
+	ln := seed(t, tor, pieces)
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	seeder := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	// the tracker has no peers, and reannouncing to it yields none, but
+	// the download waits for the other source
+	tr := &scriptedTracker{peers: [][]peer.Peer{nil}, minInterval: time.Millisecond}
+	d := tor.NewDownload(&pieceMap{pieces: make(map[int][]byte)}, &DownloadConfig{
+		ConnTimeout: time.Second,
+		DownTimeout: 5 * time.Second,
+		Tracker:     tr,
+		PeerSources: []PeerSource{delayedSource{100 * time.Millisecond, []peer.Peer{seeder}}},
+	})
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	announces := len(tr.announces)
+	tr.mu.Unlock()
+
+	if announces < 2 {
+		t.Errorf("announced %d times, expected a reannounce", announces)
+	}
+
+	// the same goes for a failing tracker
+	d = tor.NewDownload(&pieceMap{pieces: make(map[int][]byte)}, &DownloadConfig{
+		ConnTimeout: time.Second,
+		DownTimeout: 5 * time.Second,
+		Tracker:     &tracker.Retry{Transport: failingTracker{}},
+		PeerSources: []PeerSource{delayedSource{100 * time.Millisecond, []peer.Peer{seeder}}},
+	})
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// private torrents don't use the other sources
+	private := *tor
+	private.Private = true
+
+	d = private.NewDownload(&pieceMap{pieces: make(map[int][]byte)}, &DownloadConfig{
+		ConnTimeout: time.Second,
+		Tracker:     &scriptedTracker{peers: [][]peer.Peer{{deadPeer(t)}}, minInterval: time.Millisecond},
+		PeerSources: []PeerSource{ManualSource{seeder}},
+	})
+
+	if err := d.Run(); !errors.Is(err, ErrWorkersDead) {
+		t.Errorf("private download with a dead tracker peer returned %v", err)
+	}
+}
+
+// failingTracker is a tracker.Transport whose announces always fail.
+type failingTracker struct{}
+
+func (failingTracker) Announce(context.Context, *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error) {
+	return nil, errors.New("tracker unreachable")
+}
@@ -0,0 +1,247 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// Stats is a snapshot of the statistics of a download.
+type Stats struct {
+	Downloaded int64 // number of bytes downloaded
+	Uploaded   int64 // number of bytes uploaded
+	Left       int64 // number of bytes left to verify
+
+	DownloadRate float64 // download rate in bytes per second
+	UploadRate   float64 // upload rate in bytes per second
+
+	// estimated time left for the download to complete, or -1 if it
+	// can't be estimated because nothing is being downloaded
+	ETA time.Duration
+
+	PiecesDone  int // number of verified pieces
+	PiecesTotal int // total number of pieces
+
+	ConnectedPeers int // number of peers currently connected to
+	KnownPeers     int // number of peers known from all sources
+
+	Elapsed time.Duration // time since the download started
+	Peers   []PeerStats   // statistics of every connected peer
+}
+
+// PeerStats is a snapshot of the statistics of a single peer connection.
+type PeerStats struct {
+	Peer peer.Peer // the peer
+
+	Downloaded int64 // number of bytes downloaded from the peer
+	Uploaded   int64 // number of bytes uploaded to the peer
+
+	DownloadRate float64 // download rate in bytes per second
+	UploadRate   float64 // upload rate in bytes per second
+
+	Connected time.Time // time the connection was established
+}
+
+// rateWindow is the number of seconds the transfer rates are averaged
+// across.
+const rateWindow = 10
+
+// rate is a rolling transfer rate, calculated from the number of bytes
+// transferred in each of the last rateWindow seconds.
+type rate struct {
+	buckets [rateWindow]int64 // bytes transferred in each second
+	last    int64             // unix second of the newest bucket
+}
+
+// add records n bytes as transferred at the provided time.
+func (r *rate) add(now time.Time, n int) {
+	r.advance(now)
+	r.buckets[r.last%rateWindow] += int64(n)
+}
+
+// value returns the transfer rate in bytes per second at the provided time.
+func (r *rate) value(now time.Time) float64 {
+	r.advance(now)
+
+	var total int64
+	for _, n := range r.buckets {
+		total += n
+	}
+
+	return float64(total) / rateWindow
+}
+
+// advance clears the buckets which have expired since r was last used.
+func (r *rate) advance(now time.Time) {
+	sec := now.Unix()
+	if sec <= r.last {
+		return
+	}
+
+	// clear buckets of the seconds which have passed
+	for i := r.last + 1; i <= sec && i <= r.last+rateWindow; i++ {
+		r.buckets[i%rateWindow] = 0
+	}
+
+	r.last = sec
+}
+
+// peerStats stores the statistics of a single peer connection.
+type peerStats struct {
+	peer      peer.Peer
+	connected time.Time
+
+	downloaded, uploaded int64
+	down, up             rate
+}
+
+// stats stores the statistics of a download. It is updated by the worker
+// goroutines and read by Download.Stats.
+type stats struct {
+	mu sync.Mutex // guards everything below
+
+	start    time.Time // start time of the download
+	length   int64     // total length of the torrent
+	verified int64     // number of bytes verified
+	total    int       // total number of pieces
+	done     int       // number of pieces verified
+	known    int       // number of known peers
+
+	downloaded, uploaded int64
+	down, up             rate
+
+	peers map[string]*peerStats // stats of connected peers
+}
+
+// newStats creates a new stats for the provided torrent.
+func newStats(t *Torrent) *stats {
+	return &stats{
+		start:  time.Now(),
+		length: int64(t.Length),
+		total:  len(t.PieceHashes),
+		peers:  make(map[string]*peerStats),
+	}
+}
+
+// connect records a new connection with the provided peer, and returns
+// its statistics.
+func (s *stats) connect(p peer.Peer) *peerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := &peerStats{peer: p, connected: time.Now()}
+	s.peers[p.String()] = ps
+	return ps
+}
+
+// disconnect records the end of a connection with the provided peer.
+func (s *stats) disconnect(p peer.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.peers, p.String())
+}
+
+// download records n bytes as downloaded from the provided peer.
+func (s *stats) download(ps *peerStats, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.downloaded += int64(n)
+	s.down.add(now, n)
+
+	ps.downloaded += int64(n)
+	ps.down.add(now, n)
+}
+
+// upload records n bytes as uploaded to the provided peer.
+func (s *stats) upload(ps *peerStats, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.uploaded += int64(n)
+	s.up.add(now, n)
+
+	ps.uploaded += int64(n)
+	ps.up.add(now, n)
+}
+
+// verify records a piece of the provided length as verified.
+func (s *stats) verify(length int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.done++
+	s.verified += int64(length)
+}
+
+// setKnown sets the number of known peers.
+func (s *stats) setKnown(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.known = n
+}
+
+// snapshot returns a snapshot of the statistics.
+func (s *stats) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	snap := Stats{
+		Downloaded:     s.downloaded,
+		Uploaded:       s.uploaded,
+		Left:           s.length - s.verified,
+		DownloadRate:   s.down.value(now),
+		UploadRate:     s.up.value(now),
+		ETA:            -1,
+		PiecesDone:     s.done,
+		PiecesTotal:    s.total,
+		ConnectedPeers: len(s.peers),
+		KnownPeers:     s.known,
+		Elapsed:        now.Sub(s.start),
+	}
+
+	// estimate time left using the current download rate
+	if snap.Left == 0 {
+		snap.ETA = 0
+	} else if snap.DownloadRate > 0 {
+		snap.ETA = time.Duration(float64(snap.Left) / snap.DownloadRate * float64(time.Second))
+	}
+
+	for _, ps := range s.peers {
+		snap.Peers = append(snap.Peers, PeerStats{
+			Peer:         ps.peer,
+			Downloaded:   ps.downloaded,
+			Uploaded:     ps.uploaded,
+			DownloadRate: ps.down.value(now),
+			UploadRate:   ps.up.value(now),
+			Connected:    ps.connected,
+		})
+	}
+
+	// sort peers by their contribution
+	sort.Slice(snap.Peers, func(i, j int) bool {
+		return snap.Peers[i].Downloaded > snap.Peers[j].Downloaded
+	})
+
+	return snap
+}
@@ -0,0 +1,61 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestRate(t *testing.T) {
+	var r rate
+	start := time.Unix(1000, 0)
+
+	r.add(start, 100)
+	r.add(start.Add(500*time.Millisecond), 100) // same second
+	r.add(start.Add(3*time.Second), 300)
+
+	if v := r.value(start.Add(3 * time.Second)); v != 50 {
+		t.Errorf("rate %v, expected 50", v)
+	}
+
+	// the first bucket falls out of the window
+	if v := r.value(start.Add(rateWindow * time.Second)); v != 30 {
+		t.Errorf("rate %v after the window moved, expected 30", v)
+	}
+
+	// late additions are recorded in the newest bucket
+	r.add(start, 100)
+	if v := r.value(start.Add(rateWindow * time.Second)); v != 40 {
+		t.Errorf("rate %v after a late addition, expected 40", v)
+	}
+
+	// everything expires after a whole window
+	if v := r.value(start.Add(100 * time.Second)); v != 0 {
+		t.Errorf("rate %v after the window passed, expected 0", v)
+	}
+}
+
+func TestStatsTransfers(t *testing.T) {
+	s := newStats(&Torrent{Length: 100, PieceHashes: make([][20]byte, 1)})
+	p := peer.Peer{Port: 1}
+	ps := s.connect(p)
+
+	s.download(ps, 30)
+	s.upload(ps, 20)
+	s.upload(ps, 5)
+
+	snap := s.snapshot()
+	if snap.Downloaded != 30 || snap.Uploaded != 25 || snap.UploadRate == 0 {
+		t.Errorf("downloaded %d, uploaded %d at %v", snap.Downloaded, snap.Uploaded, snap.UploadRate)
+	}
+
+	if len(snap.Peers) != 1 || snap.Peers[0].Uploaded != 25 || snap.Peers[0].Downloaded != 30 {
+		t.Errorf("peer stats %+v", snap.Peers)
+	}
+
+	s.disconnect(p)
+	if snap := s.snapshot(); len(snap.Peers) != 0 || snap.Uploaded != 25 {
+		t.Errorf("stats after disconnecting: %+v", snap)
+	}
+}
@@ -14,15 +14,11 @@
 package torrent
 
 import (
-	"errors"
-	"io"
-	"net/http"
+	"context"
 	"net/url"
-	"strconv"
-	"time"
 
-	"laptudirm.com/x/mtor/pkg/bencode"
 	"laptudirm.com/x/mtor/pkg/peer"
+	"laptudirm.com/x/mtor/pkg/tracker"
 )
 
 // Torrent represents the data required to fetch peers and download a torrent
@@ -35,100 +31,58 @@ type Torrent struct {
 	PieceLength int        // length of each piece in bytes
 	Length      int        // total length of the torrent
 
+	Trackers [][]string // tiers of tracker announce urls
+	WebSeeds []string   // urls of web seeds
+	Private  bool       // whether peers may only be found using trackers
+	Source   string     // source tag, used by private trackers
+	Comment  string     // free-form comment
+
 	Name [20]byte // client identifier
 	Port uint16   // port the client is listening on
 }
 
 // Peers returns a list of peers to fetch pieces from.
 func (t *Torrent) Peers(n int) ([]peer.Peer, error) {
-	// get response from tracker
-	res, err := t.requestTracker(n)
+	res, err := tracker.Default(nil).Announce(context.Background(), t.AnnounceRequest(n))
 	if err != nil {
 		return nil, err
 	}
 
-	// check for failure message
-	if res.Failure != "" {
-		return nil, errors.New(res.Failure)
-	}
-
-	peerBuf := []byte(res.Peers)
-	// unmarshal compact peerlist
-	return peer.Unmarshal(peerBuf)
+	return res.Peers, nil
 }
 
-// Tracker returns the url of t's tracker, along with parameters.
-func (t *Torrent) Tracker(n int, c bool) (string, error) {
-	base, err := url.Parse(t.Announce)
-	if err != nil {
-		return "", err
-	}
-
-	compact := 0 // non-compact peerlist
-	if c {
-		compact = 1 // compact peer list
-	}
-
-	// set url params
-	params := url.Values{
-		"info_hash":  []string{string(t.InfoHash[:])},     // infohash of torrent
-		"peer_id":    []string{string(t.Name[:])},         // client's peer id
-		"port":       []string{strconv.Itoa(int(t.Port))}, // port client is listening on
-		"uploaded":   []string{"0"},                       // number of bytes uploaded
-		"downloaded": []string{"0"},                       // number of bytes downloaded
-		"left":       []string{strconv.Itoa(t.Length)},    // number of bytes left to download
-		"compact":    []string{strconv.Itoa(compact)},     // 1 to get peerlist be in compact format
-		"numwant":    []string{strconv.Itoa(n)},           // number of peers wanted
+// AnnounceRequest returns a request to announce to t's tracker for n peers,
+// as a client which has not downloaded anything yet.
+func (t *Torrent) AnnounceRequest(n int) *tracker.AnnounceRequest {
+	return &tracker.AnnounceRequest{
+		Announce: t.Announce,
+		InfoHash: t.InfoHash,
+		PeerID:   t.Name,
+		Port:     t.Port,
+		Left:     int64(t.Length),
+		NumWant:  n,
 	}
-	base.RawQuery = params.Encode()
-
-	return base.String(), nil
 }
 
-// trackerResponse represents a response from the tracker.
-type trackerResponse struct {
-	Failure string `bencode:"failure reason"`  // failure message
-	Warning string `bencode:"warning message"` // warning message
-
-	Interval   int `bencode:"interval"`     // interval to reconnect after
-	MinIntrval int `bencode:"min interval"` // minimum interval to reconnect after
-
-	TrackerID string `bencode:"tracker id"` // id of the tracker
-
-	CompletePeers   int `bencode:"complete"`   // number of peers with complete pieces
-	IncompletePeers int `bencode:"incomplete"` // number of peers with incomplete pieces
-
-	Peers string `bencode:"peers"` // compact peer ips and ports
-}
-
-// requestTracker requests to t's tracker and returns the parsed response.
-func (t *Torrent) requestTracker(n int) (*trackerResponse, error) {
-	url, err := t.Tracker(n, true)
-	if err != nil {
-		return nil, err
-	}
-
-	// tracker connection client
-	c := &http.Client{Timeout: 5 * time.Second}
-
-	// get peerlist from tracker
-	res, err := c.Get(url)
-	if err != nil {
-		return nil, err
+// Tracker returns the url of t's tracker, along with the parameters of an
+// announce for n peers. A compact peer list is requested if c is true.
+//
+// Deprecated: Use tracker.URL with the request returned by AnnounceRequest.
+func (t *Torrent) Tracker(n int, c bool) (string, error) {
+	u, err := tracker.URL(t.AnnounceRequest(n))
+	if err != nil || c {
+		return u, err
 	}
-	defer res.Body.Close()
 
-	var trackerRes trackerResponse
-	// unmarshal bencode response
-	b, err := io.ReadAll(res.Body)
+	// request a non-compact peer list
+	base, err := url.Parse(u)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	err = bencode.Unmarshal(b, &trackerRes)
-	if err != nil {
-		return nil, err
-	}
+	params := base.Query()
+	params.Set("compact", "0")
+	base.RawQuery = params.Encode()
 
-	return &trackerRes, nil
+	return base.String(), nil
 }
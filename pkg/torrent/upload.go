@@ -0,0 +1,46 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"fmt"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// serveConfig returns the configuration used to serve the requests of the
+// peer with the provided statistics.
+func (d *Download) serveConfig(ps *peerStats) *peer.ServeConfig {
+	return &peer.ServeConfig{
+		Reader: verifiedReader{d},
+		OnUpload: func(_, _, length int) {
+			d.stats.upload(ps, length)
+		},
+	}
+}
+
+// verifiedReader is a peer.BlockReader which reads the blocks of the
+// verified pieces of a download from its piece manager.
+type verifiedReader struct {
+	d *Download
+}
+
+// ReadBlock reads a block of a verified piece.
+func (r verifiedReader) ReadBlock(index, begin int, buf []byte) error {
+	if !r.d.has(index) {
+		return fmt.Errorf("piece %v isn't verified", index)
+	}
+
+	return peer.FromPieces(r.d.manager).ReadBlock(index, begin, buf)
+}
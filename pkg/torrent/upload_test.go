@@ -0,0 +1,29 @@
+package torrent
+
+import (
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestServeConfig(t *testing.T) {
+	tor := &Torrent{PieceLength: 4, Length: 8, PieceHashes: make([][20]byte, 2)}
+	d := tor.NewDownload(&pieceMap{pieces: map[int][]byte{0: []byte("abcd")}}, &DownloadConfig{})
+	config := d.serveConfig(d.stats.connect(peer.Peer{}))
+
+	// only verified pieces are served
+	buf := make([]byte, 2)
+	if err := config.Reader.ReadBlock(0, 2, buf); err == nil {
+		t.Error("unverified piece served")
+	}
+
+	d.setHave(0)
+	if err := config.Reader.ReadBlock(0, 2, buf); err != nil || string(buf) != "cd" {
+		t.Errorf("served %q, %v", buf, err)
+	}
+
+	config.OnUpload(0, 2, 2)
+	if stats := d.Stats(); stats.Uploaded != 2 || stats.Peers[0].Uploaded != 2 {
+		t.Errorf("uploaded %d bytes, %d to the peer", stats.Uploaded, stats.Peers[0].Uploaded)
+	}
+}
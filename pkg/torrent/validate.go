@@ -0,0 +1,162 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// limits of sensible piece lengths
+const (
+	MinPieceLength = 16 << 10  // 16 kb
+	MaxPieceLength = 128 << 20 // 128 mb
+)
+
+// Severity represents the severity of a Problem.
+type Severity int
+
+// various problem severities.
+const (
+	Warning Severity = iota // the torrent is unusual, but can be downloaded
+	Invalid                 // the torrent can't be downloaded
+)
+
+// String converts a Severity into a readable string.
+func (s Severity) String() string {
+	if s == Invalid {
+		return "invalid"
+	}
+
+	return "warning"
+}
+
+// Problem represents a single problem found while validating a torrent.
+type Problem struct {
+	Severity Severity // severity of the problem
+	Field    string   // field of the torrent with the problem
+	Msg      string   // description of the problem
+}
+
+// String converts a Problem into a readable string.
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Severity, p.Field, p.Msg)
+}
+
+// Report contains the problems found while validating a torrent.
+type Report struct {
+	Problems []Problem
+}
+
+// add adds a problem to the report.
+func (r *Report) add(severity Severity, field, format string, a ...any) {
+	r.Problems = append(r.Problems, Problem{
+		Severity: severity,
+		Field:    field,
+		Msg:      fmt.Sprintf(format, a...),
+	})
+}
+
+// Valid reports whether no problems which prevent downloading the torrent
+// were found.
+func (r *Report) Valid() bool {
+	for _, p := range r.Problems {
+		if p.Severity == Invalid {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Err returns a ValidationError containing the report if the torrent is
+// invalid, or nil otherwise.
+func (r *Report) Err() error {
+	if r.Valid() {
+		return nil
+	}
+
+	return &ValidationError{Report: r}
+}
+
+// ValidationError is returned when an invalid torrent is downloaded.
+type ValidationError struct {
+	Report *Report
+}
+
+// Error implements the error interface.
+func (e *ValidationError) Error() string {
+	var problems []string
+	for _, p := range e.Report.Problems {
+		if p.Severity == Invalid {
+			problems = append(problems, p.Field+": "+p.Msg)
+		}
+	}
+
+	return "torrent: invalid torrent: " + strings.Join(problems, "; ")
+}
+
+// Validate checks the torrent for internal consistency, and returns a
+// report of the problems found.
+func (t *Torrent) Validate() *Report {
+	r := &Report{}
+
+	// announce url
+	if t.Announce == "" {
+		r.add(Warning, "announce", "no tracker announce url")
+	} else if u, err := url.Parse(t.Announce); err != nil {
+		r.add(Invalid, "announce", "malformed url: %v", err)
+	} else {
+		switch u.Scheme {
+		case "http", "https", "udp", "ws", "wss":
+			if u.Host == "" {
+				r.add(Invalid, "announce", "url %q has no host", t.Announce)
+			}
+
+			// udp trackers are only reachable with a custom tracker
+			// transport, since package tracker doesn't implement them
+			if u.Scheme == "udp" {
+				r.add(Warning, "announce", "udp trackers are not supported by the default transport")
+			}
+		default:
+			r.add(Invalid, "announce", "unsupported scheme %q", u.Scheme)
+		}
+	}
+
+	// lengths
+	if t.Length <= 0 {
+		r.add(Invalid, "length", "non-positive total length %v", t.Length)
+	}
+
+	switch {
+	case t.PieceLength <= 0:
+		r.add(Invalid, "piece length", "non-positive piece length %v", t.PieceLength)
+		return r // the piece count can't be checked
+	case t.PieceLength < MinPieceLength || t.PieceLength > MaxPieceLength:
+		r.add(Warning, "piece length", "unusual piece length %v", t.PieceLength)
+	case t.PieceLength&(t.PieceLength-1) != 0:
+		r.add(Warning, "piece length", "piece length %v is not a power of two", t.PieceLength)
+	}
+
+	// piece count
+	if t.Length > 0 {
+		expected := (t.Length + t.PieceLength - 1) / t.PieceLength
+		if len(t.PieceHashes) != expected {
+			r.add(Invalid, "pieces", "%v piece hashes for %v pieces", len(t.PieceHashes), expected)
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,62 @@
+package torrent
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	valid := func() *Torrent {
+		return &Torrent{
+			Announce:    "http://tracker.example.com/announce",
+			PieceHashes: make([][20]byte, 3),
+			PieceLength: 1 << 16,
+			Length:      2<<16 + 1,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Torrent)
+		valid  bool
+		field  string
+	}{
+		{"valid", func(*Torrent) {}, true, ""},
+		{"no announce", func(t *Torrent) { t.Announce = "" }, true, "announce"},
+		{"udp", func(t *Torrent) { t.Announce = "udp://tracker.example.com:80" }, true, "announce"},
+		{"bad scheme", func(t *Torrent) { t.Announce = "ftp://example.com" }, false, "announce"},
+		{"no host", func(t *Torrent) { t.Announce = "http:///announce" }, false, "announce"},
+		{"zero length", func(t *Torrent) { t.Length = 0 }, false, "length"},
+		{"zero piece length", func(t *Torrent) { t.PieceLength = 0 }, false, "piece length"},
+		{"odd piece length", func(t *Torrent) { t.PieceLength = 3 << 15; t.Length = 2*3<<15 + 1 }, true, "piece length"},
+		{"too few hashes", func(t *Torrent) { t.PieceHashes = t.PieceHashes[:2] }, false, "pieces"},
+		{"too many hashes", func(t *Torrent) { t.Length = 1 }, false, "pieces"},
+	}
+
+	for _, test := range tests {
+		tor := valid()
+		test.modify(tor)
+		r := tor.Validate()
+
+		if r.Valid() != test.valid {
+			t.Errorf("%s: valid is %v, expected %v: %v", test.name, r.Valid(), test.valid, r.Problems)
+		}
+
+		if (r.Err() == nil) != test.valid {
+			t.Errorf("%s: error is %v", test.name, r.Err())
+		}
+
+		if test.field == "" {
+			if len(r.Problems) != 0 {
+				t.Errorf("%s: unexpected problems %v", test.name, r.Problems)
+			}
+			continue
+		}
+
+		found := false
+		for _, p := range r.Problems {
+			found = found || p.Field == test.field
+		}
+
+		if !found {
+			t.Errorf("%s: no problem with %s in %v", test.name, test.field, r.Problems)
+		}
+	}
+}
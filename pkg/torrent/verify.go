@@ -0,0 +1,90 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"crypto/sha1"
+	"runtime"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// verifyJob represents a downloaded piece whose hash needs to be verified.
+type verifyJob struct {
+	piece *piece    // the downloaded piece
+	value []byte    // the value of the piece
+	peer  peer.Peer // the peer the piece was downloaded from
+}
+
+// verifyChan represents the channel where downloaded pieces are sent to be
+// verified. Its capacity bounds the number of pieces waiting to be
+// verified, so that workers are slowed down if verification falls behind.
+type verifyChan chan *verifyJob
+
+// verifiers returns the number of goroutines verifying pieces.
+func (d *Download) verifiers() int {
+	if d.config.Verifiers > 0 {
+		return d.config.Verifiers
+	}
+
+	return runtime.NumCPU()
+}
+
+// startVerifiers starts the goroutines verifying downloaded pieces.
+func (d *Download) startVerifiers() {
+	for i := 0; i < cap(d.verify); i++ {
+		go d.verifyPieces()
+	}
+}
+
+// verifyPieces verifies the hashes of pieces from the verification channel.
+// Valid pieces are sent to the disk queue, while invalid ones are put back
+// into the work channel to be downloaded again.
+func (d *Download) verifyPieces() {
+	for {
+		var job *verifyJob
+
+		select {
+		case job = <-d.verify:
+		case <-d.quit:
+			return
+		}
+
+		// check the integrity of downloaded piece
+		if !checkIntegrity(job.piece, job.value) {
+			d.log.Warnf("piece %d from peer %s failed verification", job.piece.index, job.peer)
+			d.config.Events.hashFailure(job.piece.index, job.peer)
+			d.unclaimPiece(job.piece.index)
+			d.recordHashFailure()
+			d.reputation.HashFailed(job.peer)
+			d.work <- job.piece
+			continue
+		}
+
+		// send verified piece to be stored, waiting if the disk is behind
+		ok := d.disk.push(&pieceResult{
+			index: job.piece.index,
+			value: job.value,
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+// checkIntegrity checks if the dowloaded piece's hash matches the expected
+// hash.
+func checkIntegrity(p *piece, block []byte) bool {
+	return p.hash == sha1.Sum(block)
+}
@@ -0,0 +1,74 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"runtime"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+func TestVerifyPieces(t *testing.T) {
+	tor := &Torrent{
+		PieceLength: 1,
+		Length:      2,
+		PieceHashes: [][20]byte{sha1.Sum([]byte("a")), sha1.Sum([]byte("b"))},
+	}
+
+	if d := tor.NewDownload(&pieceMap{}, &DownloadConfig{}); d.verifiers() != runtime.NumCPU() {
+		t.Errorf("%d verifiers by default", d.verifiers())
+	}
+
+	failed := make(chan peer.Peer, 1)
+	d := tor.NewDownload(&pieceMap{}, &DownloadConfig{
+		Verifiers: 2,
+		Events: &Events{
+			OnHashFailure: func(index int, p peer.Peer) { failed <- p },
+		},
+	})
+	d.init()
+	defer d.stop()
+
+	if cap(d.verify) != 2 {
+		t.Errorf("verification channel holds %d pieces", cap(d.verify))
+	}
+
+	d.startVerifiers()
+
+	sender := peer.Peer{Port: 1}
+	for i, value := range []string{"a", "x"} {
+		p := &piece{index: i, hash: tor.PieceHashes[i], length: 1}
+		d.claimPiece(i)
+		d.verify <- &verifyJob{piece: p, value: []byte(value), peer: sender}
+	}
+
+	// the corrupt piece is downloaded again
+	select {
+	case p := <-d.work:
+		if p.index != 1 || d.isClaimed(1) {
+			t.Errorf("piece %d requeued, claimed %v", p.index, d.isClaimed(1))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("corrupt piece not requeued")
+	}
+
+	if p := <-failed; p.Port != sender.Port {
+		t.Errorf("hash failure reported for peer %v", p)
+	}
+
+	// the valid piece is sent to be stored
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		d.disk.mu.Lock()
+		pending := d.disk.pending
+		d.disk.mu.Unlock()
+
+		if len(pending) == 1 && pending[0].index == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("pieces %v queued for storage", pending)
+		}
+	}
+}
@@ -0,0 +1,715 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bitfield"
+	"laptudirm.com/x/mtor/pkg/message"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// errPieceTimeout is returned when a peer doesn't send a piece within the
+// download timeout.
+var errPieceTimeout = errors.New("download: piece download timed out")
+
+// runWorker downloads the torrent pieces from the peer p, using the
+// provided connection, and announces the verified pieces using the have
+// queue registered before the handshake. If a peer which we dialed drops
+// after sending us blocks, it is reconnected to, and the worker continues
+// with the new connection.
+func (d *Download) runWorker(p peer.Peer, conn *peer.Conn, haves *haveQueue) {
+	var err error // reason of death
+
+	defer d.workers.Done()
+	defer func() { d.peerDied(p, err) }()
+
+	for {
+		var useful bool
+		useful, err = d.runConn(p, conn, haves)
+		if err == nil || !useful || conn.Inbound || d.config.ReconnectAttempts < 0 || d.quitting() {
+			return
+		}
+
+		d.peerDisconnected(p, err)
+		d.log.Debugf("reconnecting to peer %s", p)
+
+		if conn, err = d.reconnect(p, conn.Bitfield); err != nil {
+			return
+		}
+		haves = d.connHaveQueue(conn)
+	}
+}
+
+// reconnect redials the peer p with backoff, until the download stops. The
+// pieces the peer was known to have are kept.
+func (d *Download) reconnect(p peer.Peer, known bitfield.Bitfield) (*peer.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-d.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return peer.Reconnect(ctx, p, known, peer.ReconnectConfig{
+		MaxAttempts: d.config.ReconnectAttempts,
+		Delay:       d.config.ReconnectDelay,
+		Dial:        d.dial,
+	})
+}
+
+// runConn downloads the torrent pieces from the peer p using the provided
+// connection, until it is closed. It reports whether the peer sent us any
+// blocks, and the error which closed the connection.
+func (d *Download) runConn(p peer.Peer, conn *peer.Conn, haves *haveQueue) (useful bool, err error) {
+	// serving is stopped once the connection is closed, which aborts the
+	// block being sent
+	stopServing := func() {}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), d.config.ConnTimeout)
+		defer cancel()
+		conn.Close(ctx)
+		stopServing()
+	}()
+
+	// interrupt the worker when the download stops
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-d.quit:
+			conn.Conn.Close()
+		case <-exited:
+		}
+	}()
+
+	conn.UnChoke() // un-choke peer
+	conn.Interested()
+
+	d.log.Debugf("connected to peer %s", p)
+	d.recordConnect(conn)
+	d.reputation.Connected(p)
+	d.config.Events.peerConnected(p)
+
+	w := newWorker(d, p, conn, haves)
+	defer d.stats.disconnect(p)
+	defer d.removeHaveQueue(haves)
+
+	// serve the verified pieces to the peer
+	stopServing = conn.HandleRequests(d.serveConfig(w.stats))
+
+	err = w.run()
+	return w.stats.downloaded > 0, err
+}
+
+// worker represents the state of a connection with a peer, from which
+// pieces are being downloaded. The peer's messages are dispatched by the
+// connection's Run, and handed over to the worker's loop, which owns all of
+// the worker's state.
+type worker struct {
+	d     *Download
+	peer  peer.Peer  // the peer
+	conn  *peer.Conn // connection with the peer
+	stats *peerStats // statistics of the peer
+	pipe  *pipeline  // adaptive request backlog
+	haves *haveQueue // pieces to announce to the peer
+	poll  *time.Ticker
+
+	events  chan func() error // message handlers waiting to be run
+	results chan error        // results of the message handlers
+	running chan error        // result of the connection's Run
+	done    chan struct{}     // closed when the loop exits
+
+	choked      bool              // whether the peer is choking us
+	has         bitfield.Bitfield // pieces the peer has
+	allowedFast bitfield.Bitfield // pieces which can be requested while choked
+	starved     bool              // whether the peer lacked the last piece
+	drained     bool              // whether the work channel is closed
+
+	active    []*activePiece // pieces being downloaded, in order
+	lastBlock time.Time      // time the last requested block arrived
+}
+
+// activePiece represents a piece which is being downloaded by a worker.
+type activePiece struct {
+	piece     *piece         // the piece
+	duplicate bool           // whether piece is an endgame duplicate
+	progress  *pieceProgress // progress made on the piece
+	start     time.Time      // time the piece was started
+}
+
+// newWorker creates a new worker for the provided connection, and
+// registers its message handlers.
+func newWorker(d *Download, p peer.Peer, conn *peer.Conn, haves *haveQueue) *worker {
+	w := &worker{
+		d:     d,
+		peer:  p,
+		conn:  conn,
+		stats: d.stats.connect(p),
+		pipe:  newPipeline(d.config),
+		haves: haves,
+
+		events:  make(chan func() error),
+		results: make(chan error),
+		running: make(chan error, 1),
+		done:    make(chan struct{}),
+
+		// the connection's state is updated by Run from now on
+		choked:      conn.Choked,
+		has:         conn.Bitfield.Clone(),
+		allowedFast: conn.AllowedFast.Clone(),
+	}
+
+	// respect the request queue length advertised by the peer
+	w.pipe.limitTo(conn.PeerMaxRequests)
+
+	conn.Handle(&peer.Handlers{
+		Choke: func() error { return w.post(w.choke) },
+		UnChoke: func() error {
+			return w.post(func() error {
+				w.choked = false
+				return nil
+			})
+		},
+		Have: func(index int) error {
+			return w.post(func() error {
+				w.has.Set(index)
+				w.starved = false
+				return nil
+			})
+		},
+		Bitfield: func(b bitfield.Bitfield) error {
+			b = b.Clone()
+			return w.post(func() error {
+				w.has = b
+				w.starved = false
+				return nil
+			})
+		},
+		Reject: func(index, begin, _ int) error {
+			return w.post(func() error {
+				if a := w.find(index); a != nil {
+					a.progress.reject(begin)
+				}
+				return nil
+			})
+		},
+		Piece: func(index, begin int, block []byte) error {
+			return w.post(func() error { return w.receive(index, begin, block) })
+		},
+		Extended: func(id byte, _ []byte) error {
+			if id != 0 {
+				return nil
+			}
+
+			// the extended handshake has been processed by the connection
+			reqq := conn.PeerMaxRequests
+			return w.post(func() error {
+				w.pipe.limitTo(reqq)
+				return nil
+			})
+		},
+		Message: func(msg *message.Message) error {
+			return w.post(func() error { return w.message(msg) })
+		},
+	})
+
+	return w
+}
+
+// post hands a message handler over to the worker's loop, and waits for
+// its result, so that messages are handled in order with the loop's other
+// work, and their payloads stay valid while they are handled.
+func (w *worker) post(fn func() error) error {
+	select {
+	case w.events <- fn:
+		return <-w.results
+	case <-w.done:
+		return nil // Run is being stopped
+	}
+}
+
+// run runs the connection, and downloads pieces from the peer until there
+// is no work left, the download stops, or the peer fails. The pieces being
+// downloaded when the worker stops are left for other peers.
+func (w *worker) run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { w.running <- w.conn.Run(ctx) }()
+
+	w.poll = time.NewTicker(EndgamePoll)
+
+	defer func() {
+		w.poll.Stop()
+		close(w.done)
+
+		// wait for Run, unless it has already returned
+		cancel()
+		if w.running != nil {
+			<-w.running
+		}
+
+		for _, a := range w.pieces() {
+			w.abandon(a)
+		}
+	}()
+
+	for {
+		if err := w.step(); err != nil {
+			return err
+		}
+
+		if stop, err := w.wait(); stop || err != nil {
+			return err
+		}
+	}
+}
+
+// wait waits for something to do, and does it. It reports whether the
+// worker should stop.
+func (w *worker) wait() (stop bool, err error) {
+	if w.drained && len(w.active) == 0 {
+		return true, nil // no work left
+	}
+
+	// get pieces from the work channel while idle
+	var work workChan
+	if len(w.active) == 0 && !w.starved {
+		work = w.d.work
+	}
+
+	var timeout <-chan time.Time
+	if wake, ok := w.wake(); ok {
+		timer := time.NewTimer(time.Until(wake))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case fn := <-w.events:
+		// errors are returned by Run, which stops the worker
+		w.results <- fn()
+	case <-w.haves.notify:
+		// announce verified pieces
+		return false, w.haves.flush(w.conn)
+	case piece, ok := <-work:
+		if !ok {
+			return true, nil // no work left
+		}
+
+		w.begin(piece, false)
+	case <-w.poll.C:
+		w.starved = false
+
+		// help download the remaining pieces in endgame mode
+		if len(w.active) == 0 {
+			if piece := w.d.endgamePiece(w.has); piece != nil {
+				w.begin(piece, true)
+			}
+		}
+	case <-timeout:
+		return false, w.expire()
+	case err := <-w.running:
+		w.running = nil
+		return true, err
+	case <-w.d.quit:
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// begin starts downloading the provided piece, and reports whether the
+// peer has it. Otherwise, the piece is put back, and no more pieces are
+// taken until the peer announces new pieces, or the next poll.
+func (w *worker) begin(p *piece, duplicate bool) bool {
+	if !w.has.Has(p.index) {
+		if !duplicate {
+			w.d.work <- p
+		}
+
+		w.starved = true
+		return false
+	}
+
+	a := &activePiece{
+		piece:     p,
+		duplicate: duplicate,
+		start:     time.Now(),
+		progress: &pieceProgress{
+			index:   p.index,
+			buf:     make([]byte, p.length),
+			pending: make(map[int]request),
+		},
+	}
+
+	// continue from a previous failed download
+	w.d.resumePartial(a.progress)
+	w.d.startPiece(p)
+
+	w.active = append(w.active, a)
+	return true
+}
+
+// take starts downloading another piece from the work channel, if one is
+// available without waiting, and reports whether it did.
+func (w *worker) take() bool {
+	// don't hoard pieces which can't be requested yet
+	if w.choked || w.starved || w.drained {
+		return false
+	}
+
+	select {
+	case p, ok := <-w.d.work:
+		if !ok {
+			w.drained = true
+			return false
+		}
+
+		return w.begin(p, false)
+	default:
+		return false
+	}
+}
+
+// step advances the downloads of the active pieces. Pieces are dropped if
+// another peer has finished them, and are sent for verification once all
+// of their blocks have arrived. Then, the request backlog is filled.
+func (w *worker) step() error {
+	for _, a := range w.pieces() {
+		p := a.piece
+
+		switch {
+		case w.d.isClaimed(p.index):
+			// cancel the outstanding requests if another peer finished
+			// the piece, and discard any blocks which arrive later
+			w.d.log.Debugf("piece %d from peer %s was a duplicate", p.index, w.peer)
+			if err := w.cancelPending(a); err != nil {
+				return err
+			}
+			w.end(a)
+		case a.progress.downloaded >= p.length:
+			w.complete(a)
+		}
+	}
+
+	return w.request()
+}
+
+// request fills the request backlog with the blocks of the active pieces,
+// in order, taking more pieces once all of their blocks are requested. The
+// requests are sent in a single write.
+func (w *worker) request() error {
+	var blocks []peer.Block
+	for w.backlog() < w.pipe.backlog() {
+		a, b, ok := w.next()
+		if !ok {
+			if w.take() {
+				continue
+			}
+
+			break
+		}
+
+		// start waiting for blocks
+		if w.backlog() == 0 {
+			w.lastBlock = time.Now()
+		}
+
+		blocks = append(blocks, peer.Block{Index: a.piece.index, Begin: b.begin, Length: b.length})
+		a.progress.request(b)
+	}
+
+	// request the blocks at once
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	return w.conn.RequestBlocks(blocks...)
+}
+
+// next returns the next block which should be requested, and its piece.
+func (w *worker) next() (*activePiece, block, bool) {
+	for _, a := range w.active {
+		if !w.canRequest(a) {
+			continue
+		}
+
+		if b, ok := a.progress.next(MaxBlockSize); ok {
+			return a, b, true
+		}
+	}
+
+	return nil, block{}, false
+}
+
+// backlog returns the number of outstanding requests.
+func (w *worker) backlog() int {
+	backlog := 0
+	for _, a := range w.active {
+		backlog += a.progress.backlog
+	}
+
+	return backlog
+}
+
+// complete sends a downloaded piece for verification, unless another peer
+// finished it first.
+func (w *worker) complete(a *activePiece) {
+	p, buf := a.piece, a.progress.buf
+	taken := time.Since(a.start)
+	w.end(a)
+
+	if !w.d.claimPiece(p.index) {
+		w.d.log.Debugf("piece %d from peer %s was a duplicate", p.index, w.peer)
+		return
+	}
+
+	w.d.config.Events.pieceDownloaded(p.index, w.peer, taken)
+	w.d.reputation.Downloaded(w.peer, int64(len(buf)), taken)
+
+	// send downloaded piece to be verified
+	select {
+	case w.d.verify <- &verifyJob{piece: p, value: buf, peer: w.peer}:
+	case <-w.d.quit:
+	}
+}
+
+// wake returns the earliest time at which the timeouts of the active
+// pieces need to be checked, and whether there is any.
+func (w *worker) wake() (time.Time, bool) {
+	var wake time.Time
+	ok := false
+
+	earliest := func(t time.Time) {
+		if !ok || t.Before(wake) {
+			wake, ok = t, true
+		}
+	}
+
+	for _, a := range w.active {
+		if expiry, pending := a.progress.expiry(w.d.blockTimeout()); pending {
+			earliest(expiry)
+		}
+
+		if timeout := w.d.config.DownTimeout; timeout > 0 {
+			earliest(a.start.Add(timeout))
+		}
+	}
+
+	if w.snubbing() {
+		earliest(w.lastBlock.Add(w.d.snubTimeout()))
+	}
+
+	return wake, ok
+}
+
+// expire checks the timeouts of the active pieces. Timed out requests are
+// cancelled, so that they are requested again, and a piece is left for
+// other peers if too many of its requests time out. The peer fails if it
+// doesn't send a piece within the download timeout, or if it is snubbing
+// us.
+func (w *worker) expire() error {
+	now := time.Now()
+	if timeout := w.d.config.DownTimeout; timeout > 0 {
+		for _, a := range w.active {
+			if !now.Before(a.start.Add(timeout)) {
+				return errPieceTimeout
+			}
+		}
+	}
+
+	// the peer is snubbing us if it doesn't send requested blocks in
+	// time, even though it isn't choking us
+	if w.snubbing() && !now.Before(w.lastBlock.Add(w.d.snubTimeout())) {
+		w.d.log.Infof("peer %s is snubbing, requeueing %d pieces", w.peer, len(w.active))
+		w.d.reputation.Snubbed(w.peer)
+		return ErrSnubbed
+	}
+
+	for _, a := range w.pieces() {
+		p, progress := a.piece, a.progress
+		for _, b := range progress.expire(w.d.blockTimeout()) {
+			if err := w.conn.Cancel(p.index, b.begin, b.length); err != nil {
+				return err
+			}
+		}
+
+		// give up on the piece if the peer keeps timing out
+		if progress.timeouts > MaxBlockTimeouts {
+			w.d.log.Debugf("peer %s timed out on piece %d, requeueing", w.peer, p.index)
+			if err := w.cancelPending(a); err != nil {
+				return err
+			}
+			w.abandon(a)
+		}
+	}
+
+	return nil
+}
+
+// snubbing reports whether the peer should be sending requested blocks.
+func (w *worker) snubbing() bool {
+	for _, a := range w.active {
+		if w.canRequest(a) && a.progress.backlog > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canRequest reports whether blocks of the provided piece can be
+// requested. Allowed fast pieces can be requested while choked.
+func (w *worker) canRequest(a *activePiece) bool {
+	return !w.choked || w.allowedFast.Has(a.piece.index)
+}
+
+// cancelPending cancels the outstanding requests of the provided piece,
+// which are marked as rejected.
+func (w *worker) cancelPending(a *activePiece) error {
+	p, progress := a.piece, a.progress
+	for begin, req := range progress.pending {
+		if err := w.conn.Cancel(p.index, begin, req.length); err != nil {
+			return err
+		}
+		progress.reject(begin)
+	}
+
+	return nil
+}
+
+// abandon stops downloading the provided piece, and leaves it for other
+// peers, saving the progress made on it.
+func (w *worker) abandon(a *activePiece) {
+	p := a.piece
+	w.end(a)
+
+	// the piece is still owned by the worker which was duplicated, or was
+	// finished by another worker in endgame mode
+	if w.d.isClaimed(p.index) {
+		return
+	}
+
+	if !a.duplicate {
+		w.d.work <- p
+	}
+
+	w.d.savePartial(a.progress)
+}
+
+// end marks that the worker has stopped downloading the provided piece.
+func (w *worker) end(a *activePiece) {
+	w.d.endPiece(a.piece.index)
+
+	for i, active := range w.active {
+		if active == a {
+			w.active = append(w.active[:i], w.active[i+1:]...)
+			break
+		}
+	}
+}
+
+// pieces returns a copy of the active pieces, which can be iterated over
+// while pieces are ended.
+func (w *worker) pieces() []*activePiece {
+	return append([]*activePiece(nil), w.active...)
+}
+
+// find returns the active piece with the provided index, or nil.
+func (w *worker) find(index int) *activePiece {
+	for _, a := range w.active {
+		if a.piece.index == index {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// choke handles the peer choking us.
+func (w *worker) choke() error {
+	w.choked = true
+
+	// peers without the fast extension silently discard outstanding
+	// requests, while fast peers explicitly reject them
+	if !w.conn.Fast {
+		for _, a := range w.active {
+			for begin := range a.progress.pending {
+				a.progress.reject(begin)
+			}
+		}
+	}
+
+	return nil
+}
+
+// receive handles a block sent by the peer.
+func (w *worker) receive(index, begin int, block []byte) error {
+	w.d.stats.download(w.stats, len(block))
+
+	// ignore late blocks of pieces which were given up on
+	a := w.find(index)
+	if a == nil {
+		return nil
+	}
+
+	progress := a.progress
+	if begin >= len(progress.buf) || begin+len(block) > len(progress.buf) {
+		return fmt.Errorf("block of length %v at %v out of range of piece %v", len(block), begin, index)
+	}
+
+	if progress.receive(begin) {
+		copy(progress.buf[begin:], block)
+		progress.downloaded += len(block)
+
+		// adapt backlog to the peer's speed
+		now := time.Now()
+		w.pipe.update(len(block), now.Sub(w.lastBlock))
+		w.lastBlock = now
+	}
+
+	return nil
+}
+
+// message handles the messages without handlers of their own.
+func (w *worker) message(msg *message.Message) error {
+	switch msg.Identifier {
+	case message.AllowedFast:
+		// peer allows requesting the piece while choked
+		index, err := message.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+
+		w.allowedFast.Set(index)
+	case message.SuggestPiece:
+		// suggestions are advisory, and the scheduler doesn't use them
+		index, err := message.ParseSuggestPiece(msg)
+		if err != nil {
+			return err
+		}
+
+		w.d.log.Debugf("peer %s suggested piece %v", w.peer, index)
+	}
+
+	return nil
+}
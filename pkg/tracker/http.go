@@ -0,0 +1,232 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/bencode"
+	"laptudirm.com/x/mtor/pkg/log"
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// DefaultTimeout is the timeout of requests made by a HTTP transport
+// without a Client.
+const DefaultTimeout = 5 * time.Second
+
+// HTTP is a Transport for trackers using the http(s) protocol.
+type HTTP struct {
+	// Client is used to make requests to the tracker. If it is nil, a
+	// client with DefaultTimeout is used.
+	Client *http.Client
+
+	// TLS configures the connections to https trackers made by the
+	// default client. It is ignored if Client is set.
+	TLS *tls.Config
+
+	// UserAgent is sent in the User-Agent header, if it is not empty.
+	UserAgent string
+
+	Logger log.Logger // logger, or nil to discard logs
+
+	defaultOnce   sync.Once    // guards creating defaultClient
+	defaultClient *http.Client // default client, reused by every announce
+}
+
+// httpResponse represents a response from a http tracker.
+type httpResponse struct {
+	Failure string `bencode:"failure reason"`  // failure message
+	Warning string `bencode:"warning message"` // warning message
+
+	Interval    int `bencode:"interval"`     // interval to reconnect after
+	MinInterval int `bencode:"min interval"` // minimum interval to reconnect after
+
+	TrackerID string `bencode:"tracker id"` // id of the tracker
+
+	CompletePeers   int `bencode:"complete"`   // number of peers with complete pieces
+	IncompletePeers int `bencode:"incomplete"` // number of peers with incomplete pieces
+
+	Peers  *rawPeers `bencode:"peers"`  // compact or dictionary peer list
+	Peers6 string    `bencode:"peers6"` // compact ipv6 peer ips and ports
+}
+
+// rawPeers stores the raw bencode of a peer list, which is either a compact
+// string or a list of dictionaries.
+type rawPeers []byte
+
+// UnmarshalBencode stores a copy of the peer list.
+func (r *rawPeers) UnmarshalBencode(b []byte) error {
+	*r = append(rawPeers{}, b...)
+	return nil
+}
+
+// peers parses the peer list.
+func (r *rawPeers) peers() ([]peer.Peer, error) {
+	if r == nil || len(*r) == 0 {
+		return nil, nil
+	}
+
+	// dictionary model
+	if (*r)[0] == 'l' {
+		return peer.UnmarshalDict(*r)
+	}
+
+	// compact model
+	var compact string
+	if err := bencode.Unmarshal(*r, &compact); err != nil {
+		return nil, err
+	}
+
+	return peer.Unmarshal([]byte(compact))
+}
+
+// Announce announces to the http tracker at req.Announce. Errors are
+// returned as a *TrackerError.
+func (h *HTTP) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	logger := log.OrDiscard(h.Logger)
+	logger.Debugf("announcing to %s", req.Announce)
+
+	res, err := h.announce(ctx, req)
+	if err != nil {
+		logger.Debugf("announce to %s failed: %v", req.Announce, err)
+	}
+
+	return res, wrapError(req.Announce, err)
+}
+
+// announce announces to the http tracker at req.Announce.
+func (h *HTTP) announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := URL(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.UserAgent != "" {
+		r.Header.Set("User-Agent", h.UserAgent)
+	}
+
+	// get peerlist from tracker
+	res, err := h.client().Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// unmarshal bencode response
+	var trackerRes httpResponse
+	err = bencode.Unmarshal(b, &trackerRes)
+	if err != nil {
+		if res.StatusCode != http.StatusOK {
+			err = errors.New(res.Status)
+		}
+
+		return nil, &TrackerError{Kind: KindResponse, Announce: req.Announce, Err: err}
+	}
+
+	// check for failure message
+	if trackerRes.Failure != "" {
+		return nil, &TrackerError{Kind: KindFailure, Announce: req.Announce, Reason: trackerRes.Failure}
+	}
+
+	// unmarshal peerlist
+	peers, err := trackerRes.Peers.peers()
+	if err != nil {
+		return nil, &TrackerError{Kind: KindResponse, Announce: req.Announce, Err: err}
+	}
+
+	// unmarshal compact ipv6 peerlist
+	peers6, err := peer.Unmarshal6([]byte(trackerRes.Peers6))
+	if err != nil {
+		return nil, &TrackerError{Kind: KindResponse, Announce: req.Announce, Err: err}
+	}
+	peers = append(peers, peers6...)
+
+	return &AnnounceResponse{
+		Interval:    time.Duration(trackerRes.Interval) * time.Second,
+		MinInterval: time.Duration(trackerRes.MinInterval) * time.Second,
+		TrackerID:   trackerRes.TrackerID,
+		Warning:     trackerRes.Warning,
+		Complete:    trackerRes.CompletePeers,
+		Incomplete:  trackerRes.IncompletePeers,
+		Peers:       peers,
+	}, nil
+}
+
+// client returns the http.Client used by h. The default client is created
+// once, so that its idle connections are reused by later announces.
+func (h *HTTP) client() *http.Client {
+	if h.Client != nil {
+		return h.Client
+	}
+
+	h.defaultOnce.Do(func() {
+		h.defaultClient = &http.Client{Timeout: DefaultTimeout}
+		if h.TLS != nil {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.TLSClientConfig = h.TLS
+			h.defaultClient.Transport = t
+		}
+	})
+
+	return h.defaultClient
+}
+
+// URL returns the url of req's http tracker, along with the announce
+// parameters. A compact peer list is always requested.
+func URL(req *AnnounceRequest) (string, error) {
+	base, err := url.Parse(req.Announce)
+	if err != nil {
+		return "", err
+	}
+
+	// set url params
+	params := base.Query()
+	params.Set("info_hash", string(req.InfoHash[:]))                // infohash of torrent
+	params.Set("peer_id", string(req.PeerID[:]))                    // client's peer id
+	params.Set("port", strconv.Itoa(int(req.Port)))                 // port client is listening on
+	params.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))     // number of bytes uploaded
+	params.Set("downloaded", strconv.FormatInt(req.Downloaded, 10)) // number of bytes downloaded
+	params.Set("left", strconv.FormatInt(req.Left, 10))             // number of bytes left to download
+	params.Set("compact", "1")                                      // get peerlist in compact format
+	params.Set("numwant", strconv.Itoa(req.NumWant))                // number of peers wanted
+
+	if req.Event != None {
+		params.Set("event", string(req.Event)) // event being announced
+	}
+
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID) // id sent by the tracker earlier
+	}
+
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
@@ -0,0 +1,41 @@
+package tracker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+func TestHTTPTrackerID(t *testing.T) {
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.URL.Query().Get("trackerid"))
+		w.Write([]byte("d8:intervali60e5:peers0:10:tracker id3:abce"))
+	}))
+	defer server.Close()
+
+	h := &tracker.HTTP{}
+	req := &tracker.AnnounceRequest{Announce: server.URL}
+
+	res, err := h.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.TrackerID != "abc" {
+		t.Fatalf("received tracker id %q", res.TrackerID)
+	}
+
+	// the tracker id is sent back in later announces
+	req.TrackerID = res.TrackerID
+	if _, err := h.Announce(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2 || ids[0] != "" || ids[1] != "abc" {
+		t.Errorf("tracker received ids %q", ids)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/log"
+)
+
+// default retry policy
+const (
+	DefaultAttempts   = 3
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 30 * time.Minute
+)
+
+// Health represents the recent history of announces to a tracker.
+type Health struct {
+	Failures    int       // number of consecutive failed attempts
+	LastError   error     // error of the last failed attempt
+	LastAttempt time.Time // time of the last attempt
+	LastSuccess time.Time // time of the last successful attempt
+}
+
+// Retry is a Transport which retries failed announces using jittered
+// exponential backoff, and keeps track of the health of each tracker.
+type Retry struct {
+	Transport Transport // transport used for announces
+
+	Attempts   int           // number of attempts per announce
+	MinBackoff time.Duration // backoff after the first failure
+	MaxBackoff time.Duration // maximum backoff
+
+	Logger log.Logger // logger, or nil to discard logs
+
+	mu     sync.Mutex         // guards health
+	health map[string]*Health // health of trackers by announce url
+}
+
+// NewRetry creates a new Retry Transport for t with the default policy.
+func NewRetry(t Transport) *Retry {
+	return &Retry{
+		Transport:  t,
+		Attempts:   DefaultAttempts,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// Announce announces to the tracker at req.Announce, retrying failed
+// attempts after a backoff until the attempts run out or ctx is done. The
+// error of the last attempt is returned. Failure reasons reported by the
+// tracker are returned immediately, since the tracker has answered.
+func (r *Retry) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	attempts := r.Attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err := r.Transport.Announce(ctx, req)
+		r.record(req.Announce, err)
+
+		if err == nil || attempt == attempts || ctx.Err() != nil || isFailure(err) {
+			return res, err
+		}
+
+		backoff := r.backoff(attempt)
+		log.OrDiscard(r.Logger).Warnf("announce to %s failed (attempt %d of %d), retrying in %v: %v",
+			req.Announce, attempt, attempts, backoff.Round(time.Millisecond), err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// isFailure checks if err is a failure reason reported by the tracker.
+func isFailure(err error) bool {
+	var tErr *TrackerError
+	return errors.As(err, &tErr) && tErr.Kind == KindFailure
+}
+
+// Health returns the health of the tracker with the provided announce url.
+func (r *Retry) Health(announce string) Health {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if h, ok := r.health[announce]; ok {
+		return *h
+	}
+
+	return Health{}
+}
+
+// Backoff returns the amount of time to wait before announcing to the
+// tracker with the provided announce url again, which is zero if the last
+// attempt succeeded.
+func (r *Retry) Backoff(announce string) time.Duration {
+	failures := r.Health(announce).Failures
+	if failures == 0 {
+		return 0
+	}
+
+	return r.backoff(failures)
+}
+
+// record records the result of an attempt in the tracker's health.
+func (r *Retry) record(announce string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.health == nil {
+		r.health = make(map[string]*Health)
+	}
+
+	h, ok := r.health[announce]
+	if !ok {
+		h = &Health{}
+		r.health[announce] = h
+	}
+
+	h.LastAttempt = time.Now()
+	if err != nil {
+		h.Failures++
+		h.LastError = err
+		return
+	}
+
+	h.Failures = 0
+	h.LastError = nil
+	h.LastSuccess = h.LastAttempt
+}
+
+// backoff returns a jittered backoff after the provided number of
+// failures, which is between half and the whole of the exponential delay.
+func (r *Retry) backoff(failures int) time.Duration {
+	delay, max := r.MinBackoff, r.MaxBackoff
+	if delay <= 0 {
+		delay = DefaultMinBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,116 @@
+package tracker_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/log"
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+// flaky is a Transport which fails a number of times before succeeding.
+type flaky struct {
+	failures int
+	calls    int
+}
+
+func (f *flaky) Announce(ctx context.Context, req *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, &tracker.TrackerError{Kind: tracker.KindTimeout, Announce: req.Announce}
+	}
+
+	return &tracker.AnnounceResponse{}, nil
+}
+
+func TestRetry(t *testing.T) {
+	req := &tracker.AnnounceRequest{Announce: "http://example.com/announce"}
+
+	var logs bytes.Buffer
+
+	f := &flaky{failures: 2}
+	r := tracker.NewRetry(f)
+	r.MinBackoff = time.Millisecond
+	r.Logger = log.New(&logs, log.LevelWarn)
+
+	if _, err := r.Announce(context.Background(), req); err != nil {
+		t.Fatalf("announce failed: %v", err)
+	}
+
+	if f.calls != 3 {
+		t.Errorf("announced %d times, expected 3", f.calls)
+	}
+
+	// retried attempts are logged
+	if n := strings.Count(logs.String(), "retrying"); n != 2 {
+		t.Errorf("logged %d retries, expected 2:\n%s", n, logs.String())
+	}
+
+	if h := r.Health(req.Announce); h.Failures != 0 || h.LastSuccess.IsZero() {
+		t.Errorf("health %+v, expected healthy tracker", h)
+	}
+
+	f = &flaky{failures: 5}
+	r.Transport = f
+
+	_, err := r.Announce(context.Background(), req)
+
+	var tErr *tracker.TrackerError
+	if !errors.As(err, &tErr) || tErr.Kind != tracker.KindTimeout {
+		t.Errorf("error %v, expected timeout TrackerError", err)
+	}
+
+	if f.calls != tracker.DefaultAttempts {
+		t.Errorf("announced %d times, expected %d", f.calls, tracker.DefaultAttempts)
+	}
+
+	if h := r.Health(req.Announce); h.Failures != tracker.DefaultAttempts {
+		t.Errorf("health %+v, expected %d failures", h, tracker.DefaultAttempts)
+	}
+
+	if r.Backoff(req.Announce) == 0 {
+		t.Error("no backoff for failing tracker")
+	}
+
+	// failure reasons aren't retried
+	calls := 0
+	r.Transport = transportFunc(func(ctx context.Context, req *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error) {
+		calls++
+		return nil, &tracker.TrackerError{Kind: tracker.KindFailure, Announce: req.Announce, Reason: "unregistered torrent"}
+	})
+
+	if _, err := r.Announce(context.Background(), req); err == nil || calls != 1 {
+		t.Errorf("announced %d times with error %v, expected 1 failure", calls, err)
+	}
+}
+
+// transportFunc is a Transport implemented by a function.
+type transportFunc func(ctx context.Context, req *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error)
+
+func (f transportFunc) Announce(ctx context.Context, req *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error) {
+	return f(ctx, req)
+}
+
+func TestHTTPErrors(t *testing.T) {
+	// respond with a tracker failure
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason8:bad hashe"))
+	}))
+	defer server.Close()
+
+	h := &tracker.HTTP{}
+	_, err := h.Announce(context.Background(), &tracker.AnnounceRequest{
+		Announce: server.URL + "/announce",
+	})
+
+	var tErr *tracker.TrackerError
+	if !errors.As(err, &tErr) || tErr.Kind != tracker.KindFailure || tErr.Reason != "bad hash" {
+		t.Errorf("error %v, expected tracker failure", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSOptions describes the TLS settings used to connect to https trackers,
+// like private trackers with self-signed certificates or which require
+// client certificates.
+type TLSOptions struct {
+	// RootCAs is the path of a PEM file with root certificates which are
+	// trusted in addition to the system's.
+	RootCAs string
+
+	// CertFile and KeyFile are the paths of the PEM files with the client
+	// certificate and its private key, which are sent to trackers that
+	// request them.
+	CertFile string
+	KeyFile  string
+
+	// InsecureSkipVerify disables the verification of tracker certificates.
+	// It should only be used with trusted private trackers.
+	InsecureSkipVerify bool
+}
+
+// Config loads the files referenced by the options, and returns the
+// corresponding tls.Config.
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+
+	if o.RootCAs != "" {
+		pem, err := os.ReadFile(o.RootCAs)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tracker: no certificates found in %s", o.RootCAs)
+		}
+
+		c.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,47 @@
+package tracker_test
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"laptudirm.com/x/mtor/pkg/tracker"
+)
+
+func TestTLSOptions(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	req := &tracker.AnnounceRequest{Announce: server.URL + "/announce"}
+
+	// the server's certificate is self-signed
+	if _, err := (&tracker.HTTP{}).Announce(context.Background(), req); err == nil {
+		t.Error("announce to untrusted tracker succeeded")
+	}
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(ca, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []tracker.TLSOptions{
+		{RootCAs: ca},
+		{InsecureSkipVerify: true},
+	} {
+		config, err := opts.Config()
+		if err != nil {
+			t.Fatalf("loading %+v: %v", opts, err)
+		}
+
+		if _, err := (&tracker.HTTP{TLS: config}).Announce(context.Background(), req); err != nil {
+			t.Errorf("announce with %+v failed: %v", opts, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracker implements clients for the protocols used to announce to
+// torrent trackers, behind a common Transport interface.
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/peer"
+)
+
+// Event represents the event which is being announced.
+type Event string
+
+// various announce events.
+const (
+	None      Event = ""          // regular announce
+	Started   Event = "started"   // first announce of a download
+	Completed Event = "completed" // download has been completed
+	Stopped   Event = "stopped"   // download has been stopped
+)
+
+// AnnounceRequest contains the parameters of an announce to a tracker.
+type AnnounceRequest struct {
+	Announce string   // the announce url of the tracker
+	InfoHash [20]byte // hash of the info section of the torrent
+	PeerID   [20]byte // client's peer id
+	Port     uint16   // port the client is listening on
+
+	Uploaded   int64 // number of bytes uploaded
+	Downloaded int64 // number of bytes downloaded
+	Left       int64 // number of bytes left to download
+
+	Event   Event // event being announced
+	NumWant int   // number of peers wanted
+
+	// TrackerID is the id sent by the tracker in a previous response,
+	// which must be sent back in later announces.
+	TrackerID string
+}
+
+// AnnounceResponse contains the parsed response of a tracker.
+type AnnounceResponse struct {
+	Interval    time.Duration // interval to reannounce after
+	MinInterval time.Duration // minimum interval to reannounce after
+
+	TrackerID string // id of the tracker
+	Warning   string // warning message
+
+	Complete   int // number of peers with the complete torrent
+	Incomplete int // number of peers with an incomplete torrent
+
+	Peers []peer.Peer // peers in the swarm
+}
+
+// ErrorKind represents the cause of a TrackerError.
+type ErrorKind int
+
+// various causes of tracker errors.
+const (
+	KindConnection ErrorKind = iota // the tracker couldn't be reached
+	KindDNS                         // the tracker's host couldn't be resolved
+	KindTimeout                     // the announce timed out
+	KindFailure                     // the tracker reported a failure reason
+	KindResponse                    // the tracker's response was invalid
+)
+
+var kinds = [...]string{
+	KindConnection: "connection error",
+	KindDNS:        "dns error",
+	KindTimeout:    "timeout",
+	KindFailure:    "tracker failure",
+	KindResponse:   "invalid response",
+}
+
+// String converts an ErrorKind into a readable string.
+func (k ErrorKind) String() string {
+	if 0 <= k && int(k) < len(kinds) {
+		return kinds[k]
+	}
+
+	return fmt.Sprintf("kind(%d)", k)
+}
+
+// TrackerError represents a failed announce to a tracker.
+type TrackerError struct {
+	Kind     ErrorKind // cause of the error
+	Announce string    // announce url of the tracker
+	Reason   string    // failure reason reported by the tracker
+	Err      error     // underlying error, if any
+}
+
+// Error implements the error interface.
+func (e *TrackerError) Error() string {
+	msg := fmt.Sprintf("tracker: %s: %s", e.Announce, e.Kind)
+
+	switch {
+	case e.Reason != "":
+		msg += ": " + e.Reason
+	case e.Err != nil:
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *TrackerError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError wraps an error returned while announcing to the provided
+// tracker into a TrackerError, classifying its cause.
+func wrapError(announce string, err error) error {
+	var tErr *TrackerError
+	if err == nil || errors.As(err, &tErr) {
+		return err
+	}
+
+	kind := KindConnection
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		kind = KindDNS
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		kind = KindTimeout
+	}
+
+	return &TrackerError{Kind: kind, Announce: announce, Err: err}
+}
+
+// Transport is the interface implemented by the clients of a tracker
+// protocol, like HTTP.
+type Transport interface {
+	// Announce announces to the tracker at req.Announce and returns its
+	// response. Failure reasons reported by the tracker are returned as
+	// errors.
+	Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error)
+}
+
+// Schemes is a Transport which dispatches announces to other Transports
+// depending on the scheme of the announce url.
+type Schemes map[string]Transport
+
+// Announce announces using the Transport registered for the scheme of
+// req.Announce.
+func (s Schemes) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(req.Announce)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := s[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("tracker: unsupported scheme %q", u.Scheme)
+	}
+
+	return t.Announce(ctx, req)
+}
+
+// Default returns a Transport which supports all the tracker protocols
+// implemented by this package, using client for http(s) trackers. If client
+// is nil, a client with the default timeout is used. Websocket trackers use
+// the client's TLS configuration and Logger.
+func Default(client *HTTP) Transport {
+	if client == nil {
+		client = &HTTP{}
+	}
+
+	ws := &WebSocket{TLS: client.TLS, Logger: client.Logger}
+	return Schemes{
+		"http":  client,
+		"https": client,
+		"ws":    ws,
+		"wss":   ws,
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracker
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"time"
+
+	"laptudirm.com/x/mtor/pkg/log"
+)
+
+// WebSocket is a Transport for WebTorrent trackers using the ws(s)
+// protocol. WebTorrent peers connect to each other over WebRTC, so
+// announces report the size of the swarm but never return any peers.
+// A new connection is opened for every announce or scrape.
+type WebSocket struct {
+	// TLS configures the connections to wss trackers.
+	TLS *tls.Config
+
+	Logger log.Logger // logger, or nil to discard logs
+}
+
+// wsRequest represents a message sent to a websocket tracker.
+type wsRequest struct {
+	Action   string `json:"action"`
+	InfoHash any    `json:"info_hash"` // a binary string, or a list of them
+	PeerID   string `json:"peer_id,omitempty"`
+
+	NumWant    int   `json:"numwant"`
+	Uploaded   int64 `json:"uploaded"`
+	Downloaded int64 `json:"downloaded"`
+	Left       int64 `json:"left"`
+
+	Event  string `json:"event,omitempty"`
+	Offers []any  `json:"offers,omitempty"`
+}
+
+// wsResponse represents a message received from a websocket tracker.
+type wsResponse struct {
+	Action   string `json:"action"`
+	InfoHash string `json:"info_hash"`
+
+	Failure string `json:"failure reason"`
+	Warning string `json:"warning message"`
+
+	Interval    int `json:"interval"`
+	MinInterval int `json:"min interval"`
+
+	Complete   int `json:"complete"`
+	Incomplete int `json:"incomplete"`
+
+	Files map[string]ScrapeResult `json:"files"`
+
+	// WebRTC signalling relayed from other peers
+	Offer  json.RawMessage `json:"offer"`
+	Answer json.RawMessage `json:"answer"`
+}
+
+// ScrapeResult contains the statistics of a torrent's swarm.
+type ScrapeResult struct {
+	Complete   int `json:"complete"`   // number of peers with the complete torrent
+	Incomplete int `json:"incomplete"` // number of peers with an incomplete torrent
+	Downloaded int `json:"downloaded"` // number of completed downloads
+}
+
+// Announce announces to the websocket tracker at req.Announce. Errors are
+// returned as a *TrackerError.
+func (w *WebSocket) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	msg := &wsRequest{
+		Action:     "announce",
+		InfoHash:   binaryString(req.InfoHash[:]),
+		PeerID:     binaryString(req.PeerID[:]),
+		Uploaded:   req.Uploaded,
+		Downloaded: req.Downloaded,
+		Left:       req.Left,
+		Event:      string(req.Event),
+	}
+
+	logger := log.OrDiscard(w.Logger)
+	logger.Debugf("announcing to %s", req.Announce)
+
+	res, err := w.roundTrip(ctx, req.Announce, msg, func(res *wsResponse) bool {
+		signalling := res.Offer != nil || res.Answer != nil
+		return res.Action == "announce" && res.InfoHash == msg.InfoHash && !signalling
+	})
+	if err != nil {
+		logger.Debugf("announce to %s failed: %v", req.Announce, err)
+		return nil, wrapError(req.Announce, err)
+	}
+
+	return &AnnounceResponse{
+		Interval:    time.Duration(res.Interval) * time.Second,
+		MinInterval: time.Duration(res.MinInterval) * time.Second,
+		Warning:     res.Warning,
+		Complete:    res.Complete,
+		Incomplete:  res.Incomplete,
+	}, nil
+}
+
+// Scrape requests the statistics of the swarms of the provided torrents
+// from the websocket tracker at the announce url. Errors are returned as a
+// *TrackerError.
+func (w *WebSocket) Scrape(ctx context.Context, announce string, hashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	list := make([]string, len(hashes))
+	for i, hash := range hashes {
+		list[i] = binaryString(hash[:])
+	}
+
+	res, err := w.roundTrip(ctx, announce, &wsRequest{Action: "scrape", InfoHash: list}, func(res *wsResponse) bool {
+		return res.Action == "scrape"
+	})
+	if err != nil {
+		return nil, wrapError(announce, err)
+	}
+
+	results := make(map[[20]byte]ScrapeResult, len(res.Files))
+	for key, stats := range res.Files {
+		var hash [20]byte
+		if b, ok := fromBinaryString(key); ok && len(b) == len(hash) {
+			copy(hash[:], b)
+			results[hash] = stats
+		}
+	}
+
+	return results, nil
+}
+
+// roundTrip sends a message to the websocket tracker at the announce url,
+// and returns the first response for which match reports true, or which
+// contains a failure reason. Other messages, like WebRTC offers, are
+// ignored.
+func (w *WebSocket) roundTrip(ctx context.Context, announce string, msg *wsRequest, match func(*wsResponse) bool) (*wsResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialWebSocket(ctx, announce, w.TLS)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// stop waiting for a response if the context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := conn.writeMessage(b); err != nil {
+		return nil, err
+	}
+
+	for {
+		data, err := conn.readMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			return nil, err
+		}
+
+		var res wsResponse
+		if err := json.Unmarshal(data, &res); err != nil {
+			return nil, &TrackerError{Kind: KindResponse, Announce: announce, Err: err}
+		}
+
+		if res.Failure != "" {
+			return nil, &TrackerError{Kind: KindFailure, Announce: announce, Reason: res.Failure}
+		}
+
+		if match(&res) {
+			return &res, nil
+		}
+	}
+}
+
+// binaryString converts binary data into the string representation used
+// by WebTorrent trackers, where each byte is a single code point.
+func binaryString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+
+	return string(runes)
+}
+
+// fromBinaryString converts a WebTorrent binary string back into binary
+// data, and reports whether it was valid.
+func fromBinaryString(s string) ([]byte, bool) {
+	var b []byte
+	for _, r := range s {
+		if r > 0xff {
+			return nil, false
+		}
+
+		b = append(b, byte(r))
+	}
+
+	return b, true
+}
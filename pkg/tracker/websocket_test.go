@@ -0,0 +1,120 @@
+package tracker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsTracker returns a websocket tracker which answers each message using
+// respond.
+func wsTracker(t *testing.T, respond func(req map[string]any) []any) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + acceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		rw.Flush()
+
+		ws := &wsConn{conn: conn, r: bufio.NewReader(rw)}
+		msg, err := ws.readMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var req map[string]any
+		if err := json.Unmarshal(msg, &req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, res := range respond(req) {
+			b, _ := json.Marshal(res)
+			ws.writeMessage(b)
+		}
+	}))
+}
+
+func TestWebSocketAnnounce(t *testing.T) {
+	hash := [20]byte{0: 0xff, 19: 0x01}
+
+	server := wsTracker(t, func(req map[string]any) []any {
+		if req["action"] != "announce" || req["event"] != "started" {
+			t.Errorf("unexpected request %v", req)
+		}
+
+		return []any{
+			// offers from other peers are ignored
+			map[string]any{"action": "announce", "offer": map[string]any{}, "info_hash": req["info_hash"]},
+			map[string]any{"action": "announce", "info_hash": req["info_hash"], "interval": 120, "complete": 3, "incomplete": 4},
+		}
+	})
+	defer server.Close()
+
+	ws := &WebSocket{}
+	res, err := ws.Announce(context.Background(), &AnnounceRequest{
+		Announce: "ws" + strings.TrimPrefix(server.URL, "http"),
+		InfoHash: hash,
+		Event:    Started,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Complete != 3 || res.Incomplete != 4 || res.Interval.Seconds() != 120 || len(res.Peers) != 0 {
+		t.Errorf("unexpected response %+v", res)
+	}
+}
+
+func TestWebSocketScrape(t *testing.T) {
+	hash := [20]byte{0: 0x80, 19: 0x7f}
+
+	server := wsTracker(t, func(req map[string]any) []any {
+		return []any{map[string]any{
+			"action": "scrape",
+			"files": map[string]any{
+				binaryString(hash[:]): map[string]any{"complete": 1, "incomplete": 2, "downloaded": 5},
+			},
+		}}
+	})
+	defer server.Close()
+
+	announce := "ws" + strings.TrimPrefix(server.URL, "http")
+	res, err := (&WebSocket{}).Scrape(context.Background(), announce, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := res[hash]; stats != (ScrapeResult{Complete: 1, Incomplete: 2, Downloaded: 5}) {
+		t.Errorf("scrape result %+v", res)
+	}
+}
+
+func TestWebSocketFailure(t *testing.T) {
+	server := wsTracker(t, func(req map[string]any) []any {
+		return []any{map[string]any{"failure reason": "unregistered torrent"}}
+	})
+	defer server.Close()
+
+	_, err := (&WebSocket{}).Announce(context.Background(), &AnnounceRequest{
+		Announce: "ws" + strings.TrimPrefix(server.URL, "http"),
+	})
+
+	var tErr *TrackerError
+	if !errors.As(err, &tErr) || tErr.Kind != KindFailure || tErr.Reason != "unregistered torrent" {
+		t.Errorf("error %v, expected tracker failure", err)
+	}
+}
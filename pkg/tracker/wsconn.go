@@ -0,0 +1,287 @@
+// Copyright © 2021 Rak Laptudirm <raklaptudirm@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracker
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// websocket opcodes
+const (
+	opText  byte = 0x1
+	opClose byte = 0x8
+	opPing  byte = 0x9
+	opPong  byte = 0xa
+)
+
+// maxMessageSize is the maximum size of a websocket message.
+const maxMessageSize = 1 << 20 // 1 mb
+
+// wsGUID is appended to the handshake key to calculate the accept key.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// errWSClosed is returned when the websocket is closed by the server.
+var errWSClosed = errors.New("websocket closed by server")
+
+// wsConn is a minimal websocket connection, which exchanges whole messages.
+type wsConn struct {
+	conn net.Conn      // the underlying connection
+	r    *bufio.Reader // buffered reader of conn
+	mask bool          // whether written frames are masked, as by clients
+}
+
+// dialWebSocket opens a websocket connection to the ws(s) url, using config
+// for wss connections. The context's deadline applies to the connection.
+func dialWebSocket(ctx context.Context, rawURL string, config *tls.Config) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	port := u.Port()
+	switch {
+	case u.Scheme != "ws" && u.Scheme != "wss":
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	case port == "" && u.Scheme == "ws":
+		port = "80"
+	case port == "":
+		port = "443"
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if u.Scheme == "wss" {
+		c := &tls.Config{}
+		if config != nil {
+			c = config.Clone()
+		}
+
+		if c.ServerName == "" {
+			c.ServerName = u.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, c)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	ws := &wsConn{conn: conn, r: bufio.NewReader(conn), mask: true}
+	if err := ws.handshake(u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// handshake upgrades the connection to the websocket protocol.
+func (c *wsConn) handshake(u *url.URL) error {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	_, err := fmt.Fprintf(c.conn, "GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, key)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("websocket: handshake failed with status %s", res.Status)
+	}
+
+	if res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return errors.New("websocket: invalid accept key")
+	}
+
+	return nil
+}
+
+// acceptKey returns the accept key corresponding to a handshake key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeMessage writes a text message.
+func (c *wsConn) writeMessage(msg []byte) error {
+	return c.writeFrame(opText, msg)
+}
+
+// readMessage reads the next data message, joining fragmented messages and
+// answering pings.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return nil, errWSClosed
+		}
+
+		msg = append(msg, payload...)
+		if len(msg) > maxMessageSize {
+			return nil, errors.New("websocket: message too large")
+		}
+
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// writeFrame writes a single frame with the provided opcode.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	var maskBit byte
+	if c.mask {
+		maskBit = 0x80
+	}
+
+	frame := []byte{0x80 | op, 0} // always the final fragment
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = maskBit | byte(n)
+	case n <= 0xffff:
+		frame[1] = maskBit | 126
+		frame = append(frame, byte(n>>8), byte(n))
+	default:
+		frame[1] = maskBit | 127
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(n))
+		frame = append(frame, length[:]...)
+	}
+
+	if !c.mask {
+		_, err := c.conn.Write(append(frame, payload...))
+		return err
+	}
+
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+
+	frame = append(frame, key[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readFrame reads a single frame.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return
+	}
+
+	fin, op = header[0]&0x80 != 0, header[0]&0x0f
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+
+	if length > maxMessageSize {
+		err = errors.New("websocket: frame too large")
+		return
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, key[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+
+	return
+}
+
+// Close closes the connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(opClose, nil)
+	return c.conn.Close()
+}